@@ -22,6 +22,9 @@ type Client interface {
 
 type Watcher interface {
 	Next() (*Response, error)
+	// Stop gives up the watch, and cancels the call to Next in progress,
+	// if any, so that the server releases the watch at once.
+	Stop()
 }
 
 type Response struct {
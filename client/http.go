@@ -85,77 +85,77 @@ func (c *httpClient) Get(key string) (*Response, error) {
 
 type roundTripResponse struct {
 	resp *http.Response
+	body []byte
 	err  error
 }
 
 func (c *httpClient) do(ctx context.Context, act httpAction) (*http.Response, []byte, error) {
-	req := act.httpRequest(c.endpoint)
+	req := act.httpRequest(c.endpoint).WithContext(ctx)
 
+	// the body is read before the response is handed over, so that a
+	// server stalling in the middle of it is cut off by ctx too
 	rtchan := make(chan roundTripResponse, 1)
 	go func() {
 		resp, err := c.transport.RoundTrip(req)
-		rtchan <- roundTripResponse{resp: resp, err: err}
+		var body []byte
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		rtchan <- roundTripResponse{resp: resp, body: body, err: err}
 		close(rtchan)
 	}()
 
-	var resp *http.Response
-	var err error
-
 	select {
 	case rtresp := <-rtchan:
-		resp, err = rtresp.resp, rtresp.err
+		if rtresp.err != nil {
+			return nil, nil, rtresp.err
+		}
+		return rtresp.resp, rtresp.body, nil
 	case <-ctx.Done():
 		c.transport.CancelRequest(req)
 		// wait for request to actually exit before continuing
 		<-rtchan
-		err = ctx.Err()
-	}
-
-	// always check for resp nil-ness to deal with possible
-	// race conditions between channels above
-	defer func() {
-		if resp != nil {
-			resp.Body.Close()
-		}
-	}()
-
-	if err != nil {
-		return nil, nil, err
+		return nil, nil, ctx.Err()
 	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	return resp, body, err
 }
 
 func (c *httpClient) Watch(key string, idx uint64) Watcher {
-	return &httpWatcher{
-		httpClient: *c,
-		nextWait: waitAction{
-			Key:       key,
-			WaitIndex: idx,
-			Recursive: false,
-		},
-	}
+	return c.newWatcher(key, idx, false)
 }
 
 func (c *httpClient) RecursiveWatch(key string, idx uint64) Watcher {
+	return c.newWatcher(key, idx, true)
+}
+
+func (c *httpClient) newWatcher(key string, idx uint64, recursive bool) *httpWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &httpWatcher{
 		httpClient: *c,
 		nextWait: waitAction{
 			Key:       key,
 			WaitIndex: idx,
-			Recursive: true,
+			Recursive: recursive,
 		},
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 type httpWatcher struct {
 	httpClient
 	nextWait waitAction
+	// ctx is canceled by Stop
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (hw *httpWatcher) Stop() {
+	hw.cancel()
 }
 
 func (hw *httpWatcher) Next() (*Response, error) {
-	httpresp, body, err := hw.httpClient.do(context.Background(), &hw.nextWait)
+	httpresp, body, err := hw.httpClient.do(hw.ctx, &hw.nextWait)
 	if err != nil {
 		return nil, err
 	}
@@ -432,6 +432,29 @@ func TestHTTPClientDoCancelContext(t *testing.T) {
 	}
 }
 
+// TestHTTPWatcherStop tests that Stop cancels the call to Next in progress.
+func TestHTTPWatcherStop(t *testing.T) {
+	tr := newFakeTransport()
+	c := &httpClient{transport: tr}
+	w := c.Watch("/foo", 1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		errc <- err
+	}()
+	w.Stop()
+	tr.finishCancel <- struct{}{}
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("err = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Next did not return within 1s of Stop")
+	}
+}
+
 func TestHTTPClientDoCancelContextWaitForRoundTrip(t *testing.T) {
 	tr := newFakeTransport()
 	c := &httpClient{transport: tr}
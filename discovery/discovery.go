@@ -3,13 +3,17 @@ package discovery
 import (
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/client"
-	"github.com/coreos/etcd/etcdserver/etcdhttp"
+	"github.com/coreos/etcd/etcdserver"
 )
 
 var (
@@ -19,16 +23,105 @@ var (
 	ErrTokenNotFound = errors.New("discovery: token not found")
 	ErrDuplicateID   = errors.New("discovery: found duplicate id")
 	ErrFullCluster   = errors.New("discovery: cluster is full")
+	ErrTimeout       = errors.New("discovery: timed out waiting for the cluster to be complete")
 )
 
+const (
+	// DefaultRequestTimeout is the default time to wait for a response to
+	// a request to the discovery service.
+	DefaultRequestTimeout = 10 * time.Second
+	// DefaultRetries is the default number of times a failed request to
+	// the discovery service is retried.
+	DefaultRetries = 3
+
+	// wait before the first retry, doubled before each of the next ones
+	retryBackoff = 500 * time.Millisecond
+)
+
+type Discoverer interface {
+	// Discover registers the member to the discovery service, and waits
+	// for the expected number of members to register. It returns the
+	// complete cluster, or ErrFullCluster if the cluster was complete
+	// before the member could register.
+	Discover() (*etcdserver.Cluster, error)
+}
+
 type discovery struct {
 	cluster string
 	id      int64
 	ctx     []byte
 	c       client.Client
+	// time to wait for the other members to register, 0 waits forever
+	timeout time.Duration
+	// time to wait for a response to a request
+	rtimeout time.Duration
+	// number of times a failed request is retried, after backoff, then
+	// twice backoff, and so on
+	retries int
+	backoff time.Duration
+}
+
+// New creates a Discoverer that registers the member id, described by
+// config, to the cluster of the discovery URL durl. The path of durl is the
+// token of the cluster. Each request to the discovery service is given up
+// after rtimeout, and retried at most retries times, with a growing wait in
+// between. The discovery service is reached through the proxy set by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, if any.
+func New(durl string, id int64, config string, timeout, rtimeout time.Duration, retries int) (Discoverer, error) {
+	u, err := url.Parse(durl)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	token := strings.Trim(u.Path, "/")
+	if token == "" {
+		return nil, ErrInvalidURL
+	}
+	u.Path = ""
+	c, err := client.NewHTTPClient(&http.Transport{Proxy: http.ProxyFromEnvironment}, u.String(), rtimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &discovery{
+		cluster:  token,
+		id:       id,
+		ctx:      []byte(config),
+		c:        c,
+		timeout:  timeout,
+		rtimeout: rtimeout,
+		retries:  retries,
+		backoff:  retryBackoff,
+	}, nil
+}
+
+// retry calls f until it succeeds, fails for good, or has been retried
+// d.retries times. f is told whether it is retried. The errors of the
+// discovery service about the keys, and ErrTimeout, are for good; the
+// others, such as the requests timing out, may not be.
+func (d *discovery) retry(f func(retried bool) error) error {
+	backoff := d.backoff
+	for i := 0; ; i++ {
+		err := f(i > 0)
+		switch err {
+		case nil, client.ErrKeyNoExist, client.ErrKeyExists, ErrTimeout:
+			return err
+		}
+		if i == d.retries {
+			if i == 0 {
+				return err
+			}
+			return fmt.Errorf("discovery: giving up after %d attempts: %v", i+1, err)
+		}
+		log.Printf("discovery: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (d *discovery) Discover() (*etcdserver.Cluster, error) {
+	return d.discover()
 }
 
-func (d *discovery) discover() (*etcdhttp.Peers, error) {
+func (d *discovery) discover() (*etcdserver.Cluster, error) {
 	// fast path: if the cluster is full, returns the error
 	// do not need to register itself to the cluster in this
 	// case.
@@ -50,25 +143,50 @@ func (d *discovery) discover() (*etcdhttp.Peers, error) {
 		return nil, err
 	}
 
-	return nodesToPeers(all)
+	return nodesToCluster(all)
 }
 
 func (d *discovery) createSelf() error {
-	resp, err := d.c.Create(d.selfKey(), string(d.ctx), 0)
+	var resp *client.Response
+	err := d.retry(func(retried bool) (err error) {
+		resp, err = d.c.Create(d.selfKey(), string(d.ctx), 0)
+		if err == client.ErrKeyExists && retried {
+			// the member was registered by the previous attempt, whose
+			// response was lost
+			if resp, err = d.c.Get(d.selfKey()); err == nil && resp.Node.Value != string(d.ctx) {
+				err = client.ErrKeyExists
+			}
+		}
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
 	// ensure self appears on the server we connected to
-	w := d.c.Watch(d.selfKey(), resp.Node.CreatedIndex)
-	_, err = w.Next()
-	return err
+	w := &pendingWatcher{w: d.c.Watch(d.selfKey(), resp.Node.CreatedIndex)}
+	defer w.w.Stop()
+	return d.retry(func(bool) error {
+		var timeoutc <-chan time.Time
+		if d.rtimeout > 0 {
+			timeoutc = time.After(d.rtimeout)
+		}
+		wr, ok := w.next(timeoutc)
+		if !ok {
+			return fmt.Errorf("timed out waiting for %s to appear", d.selfKey())
+		}
+		return wr.err
+	})
 }
 
 func (d *discovery) checkCluster() (client.Nodes, int, error) {
 	configKey := path.Join("/", d.cluster, "_config")
 	// find cluster size
-	resp, err := d.c.Get(path.Join(configKey, "size"))
+	var resp *client.Response
+	err := d.retry(func(bool) (err error) {
+		resp, err = d.c.Get(path.Join(configKey, "size"))
+		return err
+	})
 	if err != nil {
 		if err == client.ErrKeyNoExist {
 			return nil, 0, ErrSizeNotFound
@@ -80,7 +198,10 @@ func (d *discovery) checkCluster() (client.Nodes, int, error) {
 		return nil, 0, ErrBadSizeKey
 	}
 
-	resp, err = d.c.Get(d.cluster)
+	err = d.retry(func(bool) (err error) {
+		resp, err = d.c.Get(d.cluster)
+		return err
+	})
 	if err != nil {
 		return nil, 0, err
 	}
@@ -107,20 +228,81 @@ func (d *discovery) checkCluster() (client.Nodes, int, error) {
 	return nodes, size, nil
 }
 
+type watchResponse struct {
+	resp *client.Response
+	err  error
+}
+
+// pendingWatcher waits for the responses of a watcher with a timeout. A
+// call to Next whose wait timed out is left pending, and waited on by the
+// next wait instead of calling Next again, as the watcher cannot be used
+// concurrently.
+type pendingWatcher struct {
+	w  client.Watcher
+	wc chan watchResponse
+}
+
+// next waits for the next response of the watcher until timeoutc fires,
+// in which case it returns false.
+func (p *pendingWatcher) next(timeoutc <-chan time.Time) (watchResponse, bool) {
+	if p.wc == nil {
+		wc := make(chan watchResponse, 1)
+		go func() {
+			resp, err := p.w.Next()
+			wc <- watchResponse{resp, err}
+		}()
+		p.wc = wc
+	}
+	select {
+	case wr := <-p.wc:
+		p.wc = nil
+		return wr, true
+	case <-timeoutc:
+		return watchResponse{}, false
+	}
+}
+
 func (d *discovery) waitNodes(nodes client.Nodes, size int) (client.Nodes, error) {
 	if len(nodes) > size {
 		nodes = nodes[:size]
 	}
-	w := d.c.RecursiveWatch(d.cluster, nodes[len(nodes)-1].ModifiedIndex)
+	w := &pendingWatcher{w: d.c.RecursiveWatch(d.cluster, nodes[len(nodes)-1].ModifiedIndex+1)}
+	// the watch left pending when giving up is canceled, for the
+	// discovery service to release it
+	defer w.w.Stop()
 	all := make(client.Nodes, len(nodes))
 	copy(all, nodes)
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		seen[n.Key] = true
+	}
+	var timeoutc <-chan time.Time
+	if d.timeout > 0 {
+		timeoutc = time.After(d.timeout)
+	}
+	configKey := path.Join("/", d.cluster, "_config")
 	// wait for others
 	for len(all) < size {
-		resp, err := w.Next()
+		var resp *client.Response
+		err := d.retry(func(bool) error {
+			wr, ok := w.next(timeoutc)
+			if !ok {
+				return ErrTimeout
+			}
+			resp = wr.resp
+			return wr.err
+		})
 		if err != nil {
 			return nil, err
 		}
-		all = append(all, resp.Node)
+		// only new members count, not changes to the config or to
+		// members already seen
+		n := resp.Node
+		if seen[n.Key] || strings.HasPrefix(n.Key, configKey) {
+			continue
+		}
+		seen[n.Key] = true
+		all = append(all, n)
 	}
 	return all, nil
 }
@@ -129,17 +311,17 @@ func (d *discovery) selfKey() string {
 	return path.Join("/", d.cluster, fmt.Sprintf("%d", d.id))
 }
 
-func nodesToPeers(ns client.Nodes) (*etcdhttp.Peers, error) {
+func nodesToCluster(ns client.Nodes) (*etcdserver.Cluster, error) {
 	s := make([]string, len(ns))
 	for i, n := range ns {
 		s[i] = n.Value
 	}
 
-	var peers etcdhttp.Peers
-	if err := peers.Set(strings.Join(s, "&")); err != nil {
+	var cls etcdserver.Cluster
+	if err := cls.Set(strings.Join(s, ",")); err != nil {
 		return nil, err
 	}
-	return &peers, nil
+	return &cls, nil
 }
 
 type sortableNodes struct{ client.Nodes }
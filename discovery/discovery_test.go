@@ -3,14 +3,18 @@ package discovery
 import (
 	"errors"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"sort"
+	"strings"
+	"sync/atomic"
 
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/coreos/etcd/client"
-	"github.com/coreos/etcd/etcdserver/etcdhttp"
+	"github.com/coreos/etcd/etcdserver"
 )
 
 func TestCheckCluster(t *testing.T) {
@@ -186,6 +190,82 @@ func TestWaitNodes(t *testing.T) {
 	}
 }
 
+// TestWaitNodesJoining tests that waitNodes waits for the members to join
+// one at a time, ignoring the changes that are not new members.
+func TestWaitNodesJoining(t *testing.T) {
+	nodes := client.Nodes{{Key: "/1000/1", CreatedIndex: 2}}
+	rc := make(chan *client.Response)
+	d := &discovery{cluster: "1000", c: &clientWithResp{nil, &watcherWithChan{rc: rc}}}
+
+	type result struct {
+		all client.Nodes
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		all, err := d.waitNodes(nodes, 3)
+		resc <- result{all, err}
+	}()
+	for _, k := range []string{"/1000/2", "/1000/_config/size", "/1000/2", "/1000/3"} {
+		select {
+		case r := <-resc:
+			t.Fatalf("waitNodes returned %v, %v before all members joined", r.all, r.err)
+		case rc <- &client.Response{Node: &client.Node{Key: k}}:
+		}
+	}
+	r := <-resc
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	var keys []string
+	for _, n := range r.all {
+		keys = append(keys, n.Key)
+	}
+	if w := []string{"/1000/1", "/1000/2", "/1000/3"}; !reflect.DeepEqual(keys, w) {
+		t.Errorf("keys = %v, want %v", keys, w)
+	}
+}
+
+func TestWaitNodesTimeout(t *testing.T) {
+	nodes := client.Nodes{{Key: "/1000/1", CreatedIndex: 2}}
+	w := &watcherWithChan{rc: make(chan *client.Response)}
+	d := &discovery{cluster: "1000", c: &clientWithResp{nil, w}, timeout: 10 * time.Millisecond}
+	if _, err := d.waitNodes(nodes, 3); err != ErrTimeout {
+		t.Errorf("err = %v, want %v", err, ErrTimeout)
+	}
+	// the pending watch is given up, for the service to release it
+	if atomic.LoadInt32(&w.stopped) != 1 {
+		t.Errorf("watcher not stopped on timeout")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		durl string
+
+		wcluster string
+		werr     error
+	}{
+		{"http://discovery.example.com/1000", "1000", nil},
+		{"https://discovery.example.com/1000/", "1000", nil},
+		{"http://discovery.example.com", "", ErrInvalidURL},
+		{"discovery.example.com/1000", "", ErrInvalidURL},
+		{"://", "", ErrInvalidURL},
+	}
+	for i, tt := range tests {
+		g, err := New(tt.durl, 1, "1=http://1.1.1.1:2380", 0, DefaultRequestTimeout, DefaultRetries)
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if err != nil {
+			continue
+		}
+		if d := g.(*discovery); d.cluster != tt.wcluster {
+			t.Errorf("#%d: cluster = %s, want %s", i, d.cluster, tt.wcluster)
+		}
+	}
+}
+
 func TestCreateSelf(t *testing.T) {
 	rs := []*client.Response{{Node: &client.Node{Key: "1000/1", CreatedIndex: 2}}}
 
@@ -216,20 +296,137 @@ func TestCreateSelf(t *testing.T) {
 	}
 }
 
-func TestNodesToPeers(t *testing.T) {
+// TestCreateSelfLostResponse tests that a member registered by an attempt
+// whose response was lost is not mistaken for another one by the retry.
+func TestCreateSelfLostResponse(t *testing.T) {
+	tests := []struct {
+		value string
+		werr  error
+	}{
+		{"1=http://1.1.1.1:2380", nil},
+		{"1=http://2.2.2.2:2380", client.ErrKeyExists},
+	}
+	for i, tt := range tests {
+		c := &clientLostCreate{
+			value: tt.value,
+			w:     &watcherWithResp{},
+		}
+		d := discovery{cluster: "1000", id: 1, ctx: []byte("1=http://1.1.1.1:2380"), c: c, retries: 1, backoff: time.Millisecond}
+		if err := d.createSelf(); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+	}
+}
+
+// TestCreateSelfSlowWatch tests that the retry of a watch that timed out
+// waits for the pending call to Next rather than calling it again.
+func TestCreateSelfSlowWatch(t *testing.T) {
+	w := &watcherCounting{rc: make(chan *client.Response)}
+	rs := []*client.Response{{Node: &client.Node{Key: "1000/1", CreatedIndex: 2}}}
+	d := discovery{cluster: "1000", c: &clientWithResp{rs, w}, rtimeout: 20 * time.Millisecond, retries: 3, backoff: time.Millisecond}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.rc <- &client.Response{}
+	}()
+	if err := d.createSelf(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if n := atomic.LoadInt32(&w.calls); n != 1 {
+		t.Errorf("calls to Next = %d, want 1", n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	errFail := errors.New("fail")
+	tests := []struct {
+		retries int
+		errs    []error
+
+		wcalls int
+		werr   string
+	}{
+		{3, []error{nil}, 1, ""},
+		{3, []error{errFail, errFail, nil}, 3, ""},
+		{2, []error{errFail, errFail, errFail, nil}, 3, "discovery: giving up after 3 attempts: fail"},
+		{0, []error{errFail, nil}, 1, "fail"},
+		// the errors for good are not retried
+		{3, []error{client.ErrKeyNoExist, nil}, 1, client.ErrKeyNoExist.Error()},
+		{3, []error{ErrTimeout, nil}, 1, ErrTimeout.Error()},
+	}
+	for i, tt := range tests {
+		d := &discovery{retries: tt.retries, backoff: time.Millisecond}
+		calls := 0
+		err := d.retry(func(retried bool) error {
+			if retried != (calls > 0) {
+				t.Errorf("#%d: retried = %v at call %d", i, retried, calls)
+			}
+			calls++
+			return tt.errs[calls-1]
+		})
+		if calls != tt.wcalls {
+			t.Errorf("#%d: calls = %d, want %d", i, calls, tt.wcalls)
+		}
+		if g := errString(err); g != tt.werr {
+			t.Errorf("#%d: err = %q, want %q", i, g, tt.werr)
+		}
+	}
+}
+
+// TestDiscoverHungServer tests that discovery gives up on a discovery
+// service that never answers, once the requests are retried.
+func TestDiscoverHungServer(t *testing.T) {
+	var requests int32
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	g, err := New(srv.URL+"/1000", 1, "1=http://1.1.1.1:2380", 0, 50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.(*discovery).backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err = g.Discover()
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts") {
+		t.Errorf("err = %v, want giving up after 3 attempts", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %v, want less than %v", d, time.Second)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestNodesToCluster(t *testing.T) {
 	nodes := client.Nodes{
-		{Key: "/1000/1", Value: "1=1.1.1.1", CreatedIndex: 1},
-		{Key: "/1000/2", Value: "2=2.2.2.2", CreatedIndex: 2},
-		{Key: "/1000/3", Value: "3=3.3.3.3", CreatedIndex: 3},
+		{Key: "/1000/1", Value: "1=http://1.1.1.1:2380", CreatedIndex: 1},
+		{Key: "/1000/2", Value: "2=http://2.2.2.2:2380", CreatedIndex: 2},
+		{Key: "/1000/3", Value: "3=http://3.3.3.3:2380", CreatedIndex: 3},
 	}
-	w := &etcdhttp.Peers{}
-	w.Set("1=1.1.1.1&2=2.2.2.2&3=3.3.3.3")
+	w := &etcdserver.Cluster{}
+	w.Set("1=http://1.1.1.1:2380,2=http://2.2.2.2:2380,3=http://3.3.3.3:2380")
 
-	badnodes := client.Nodes{{Key: "1000/1", Value: "1=1.1.1.1&???", CreatedIndex: 1}}
+	badnodes := client.Nodes{{Key: "1000/1", Value: "1=http://1.1.1.1&???", CreatedIndex: 1}}
 
 	tests := []struct {
 		ns client.Nodes
-		wp *etcdhttp.Peers
+		wp *etcdserver.Cluster
 		we bool
 	}{
 		{nodes, w, false},
@@ -237,7 +434,7 @@ func TestNodesToPeers(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		peers, err := nodesToPeers(tt.ns)
+		peers, err := nodesToCluster(tt.ns)
 		if tt.we {
 			if err == nil {
 				t.Fatalf("#%d: err = %v, want not nil", i, err)
@@ -313,6 +510,34 @@ func (c *clientWithResp) RecursiveWatch(key string, waitIndex uint64) client.Wat
 	return c.w
 }
 
+// clientLostCreate loses the response to the first Create, which registers
+// value all the same.
+type clientLostCreate struct {
+	value   string
+	created bool
+	w       client.Watcher
+}
+
+func (c *clientLostCreate) Create(key string, value string, ttl time.Duration) (*client.Response, error) {
+	if c.created {
+		return nil, client.ErrKeyExists
+	}
+	c.created = true
+	return nil, errors.New("request timed out")
+}
+
+func (c *clientLostCreate) Get(key string) (*client.Response, error) {
+	return &client.Response{Node: &client.Node{Key: key, Value: c.value, CreatedIndex: 2}}, nil
+}
+
+func (c *clientLostCreate) Watch(key string, waitIndex uint64) client.Watcher {
+	return c.w
+}
+
+func (c *clientLostCreate) RecursiveWatch(key string, waitIndex uint64) client.Watcher {
+	return c.w
+}
+
 type clientWithErr struct {
 	err error
 	w   client.Watcher
@@ -347,6 +572,8 @@ func (w *watcherWithResp) Next() (*client.Response, error) {
 	return r, nil
 }
 
+func (w *watcherWithResp) Stop() {}
+
 type watcherWithErr struct {
 	err error
 }
@@ -354,3 +581,32 @@ type watcherWithErr struct {
 func (w *watcherWithErr) Next() (*client.Response, error) {
 	return &client.Response{}, w.err
 }
+
+func (w *watcherWithErr) Stop() {}
+
+// watcherCounting counts the calls to Next, which wait for rc.
+type watcherCounting struct {
+	calls int32
+	rc    chan *client.Response
+}
+
+func (w *watcherCounting) Next() (*client.Response, error) {
+	atomic.AddInt32(&w.calls, 1)
+	return <-w.rc, nil
+}
+
+func (w *watcherCounting) Stop() {}
+
+// watcherWithChan waits for rc, and records whether it was stopped.
+type watcherWithChan struct {
+	rc      chan *client.Response
+	stopped int32
+}
+
+func (w *watcherWithChan) Next() (*client.Response, error) {
+	return <-w.rc, nil
+}
+
+func (w *watcherWithChan) Stop() {
+	atomic.StoreInt32(&w.stopped, 1)
+}
@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/coreos/etcd/etcdserver"
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// Recorded returns a Discoverer that records the cluster d discovers in the
+// file at p. Once the file exists, the cluster is read from there and d is
+// not called, so that a restarted member does not register to the
+// discovery service again: the service may be gone, or the token reused.
+func Recorded(p string, d Discoverer) Discoverer {
+	return &recorded{path: p, d: d}
+}
+
+type recorded struct {
+	path string
+	d    Discoverer
+}
+
+func (r *recorded) Discover() (*etcdserver.Cluster, error) {
+	b, err := ioutil.ReadFile(r.path)
+	switch {
+	case err == nil:
+		log.Printf("discovery: using the cluster discovered before, recorded in %s", r.path)
+		var cls etcdserver.Cluster
+		if err := cls.Set(string(b)); err != nil {
+			return nil, fmt.Errorf("discovery: cannot parse %s: %v", r.path, err)
+		}
+		return &cls, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	cls, err := r.d.Discover()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRecord(r.path, []byte(cls.String())); err != nil {
+		return nil, fmt.Errorf("discovery: cannot record the cluster: %v", err)
+	}
+	return cls, nil
+}
+
+// writeRecord writes b to a temporary file, syncs it, renames it to p and
+// syncs the directory, so that a crash, even of the machine, never leaves
+// a partial record behind, nor loses the record once Discover returned.
+func writeRecord(p string, b []byte) error {
+	tmp := p + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return fileutil.SyncDir(path.Dir(p))
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver"
+)
+
+func TestRecorded(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "members")
+
+	var wcls etcdserver.Cluster
+	if err := wcls.Set("1=http://1.1.1.1:2380,2=http://2.2.2.2:2380"); err != nil {
+		t.Fatal(err)
+	}
+	d := &countingDiscoverer{cls: &wcls}
+
+	// the first start discovers the cluster
+	cls, err := Recorded(p, d).Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cls, &wcls) {
+		t.Errorf("cluster = %v, want %v", cls, wcls)
+	}
+	if d.calls != 1 {
+		t.Errorf("calls = %d, want 1", d.calls)
+	}
+	if _, err := os.Stat(p + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary record is left behind: %v", err)
+	}
+
+	// the second start uses the recorded cluster, without discovery
+	d.err = errors.New("discovery service is gone")
+	cls, err = Recorded(p, d).Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cls, &wcls) {
+		t.Errorf("recorded cluster = %v, want %v", cls, wcls)
+	}
+	if d.calls != 1 {
+		t.Errorf("calls = %d, want 1", d.calls)
+	}
+}
+
+func TestRecordedErrors(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a failed discovery records nothing
+	p := path.Join(dir, "members")
+	d := &countingDiscoverer{err: ErrFullCluster}
+	if _, err := Recorded(p, d).Discover(); err != ErrFullCluster {
+		t.Errorf("err = %v, want %v", err, ErrFullCluster)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("stat err = %v, want not exist", err)
+	}
+
+	// a bad record is not overwritten by another discovery
+	if err := ioutil.WriteFile(p, []byte("1=garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Recorded(p, d).Discover(); err == nil {
+		t.Errorf("err = nil, want error for a bad record")
+	}
+	if d.calls != 1 {
+		t.Errorf("calls = %d, want 1", d.calls)
+	}
+}
+
+type countingDiscoverer struct {
+	cls   *etcdserver.Cluster
+	err   error
+	calls int
+}
+
+func (d *countingDiscoverer) Discover() (*etcdserver.Cluster, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.cls, nil
+}
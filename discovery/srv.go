@@ -0,0 +1,69 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/etcd/etcdserver"
+)
+
+var (
+	ErrSelfNotInSRV = errors.New("discovery: the advertised peer URLs of this member are not among the SRV targets")
+
+	// indirection for testing
+	lookupSRV      = net.LookupSRV
+	resolveTCPAddr = net.ResolveTCPAddr
+)
+
+// SRVCluster bootstraps the cluster from the DNS SRV records of
+// _etcd-server._tcp.<domain>. Each target is a member, reached at its
+// target and port with the given scheme. The member advertising one of
+// apurls is given name; the others are named after their target.
+func SRVCluster(name, domain, scheme string, apurls []url.URL) (*etcdserver.Cluster, error) {
+	_, addrs, err := lookupSRV("etcd-server", "tcp", domain)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: cannot find SRV records of _etcd-server._tcp.%s: %v", domain, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("discovery: no SRV records of _etcd-server._tcp.%s", domain)
+	}
+
+	// the advertised URLs may name this member by IP, while its target
+	// names it by host, so both are compared once resolved
+	self := make(map[string]bool)
+	for _, u := range apurls {
+		tcpAddr, err := resolveTCPAddr("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		self[tcpAddr.String()] = true
+	}
+
+	var s []string
+	found := false
+	for _, srv := range addrs {
+		host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port))
+		tcpAddr, err := resolveTCPAddr("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		n := strings.TrimSuffix(srv.Target, ".")
+		if self[tcpAddr.String()] {
+			n = name
+			found = true
+		}
+		s = append(s, fmt.Sprintf("%s=%s://%s", n, scheme, host))
+	}
+	if !found {
+		return nil, ErrSelfNotInSRV
+	}
+
+	var cls etcdserver.Cluster
+	if err := cls.Set(strings.Join(s, ",")); err != nil {
+		return nil, err
+	}
+	return &cls, nil
+}
@@ -0,0 +1,88 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver"
+)
+
+func TestSRVCluster(t *testing.T) {
+	defer func() {
+		lookupSRV = net.LookupSRV
+		resolveTCPAddr = net.ResolveTCPAddr
+	}()
+	hosts := map[string]string{
+		"1.example.com": "10.0.0.1",
+		"2.example.com": "10.0.0.2",
+		"10.0.0.1":      "10.0.0.1",
+		"10.0.0.3":      "10.0.0.3",
+	}
+	resolveTCPAddr = func(network, addr string) (*net.TCPAddr, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return net.ResolveTCPAddr(network, net.JoinHostPort(ip, port))
+	}
+	records := []*net.SRV{
+		{Target: "1.example.com.", Port: 2380},
+		{Target: "2.example.com.", Port: 2380},
+	}
+
+	tests := []struct {
+		records []*net.SRV
+		err     error
+		apurls  []string
+
+		wcluster string
+		werr     bool
+	}{
+		// self is found by host
+		{records, nil, []string{"http://1.example.com:2380"}, "2.example.com=http://2.example.com:2380,self=http://1.example.com:2380", false},
+		// self is found by IP
+		{records, nil, []string{"http://10.0.0.3:2380", "http://10.0.0.1:2380"}, "2.example.com=http://2.example.com:2380,self=http://1.example.com:2380", false},
+		// the port matters
+		{records, nil, []string{"http://1.example.com:7001"}, "", true},
+		{records, nil, []string{"http://10.0.0.3:2380"}, "", true},
+		// no records
+		{nil, errors.New("no such host"), []string{"http://10.0.0.1:2380"}, "", true},
+		{nil, nil, []string{"http://10.0.0.1:2380"}, "", true},
+	}
+	for i, tt := range tests {
+		lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+			if service != "etcd-server" || proto != "tcp" || name != "example.com" {
+				t.Errorf("#%d: lookup = %s %s %s, want etcd-server tcp example.com", i, service, proto, name)
+			}
+			return "", tt.records, tt.err
+		}
+		var apurls []url.URL
+		for _, s := range tt.apurls {
+			u, err := url.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			apurls = append(apurls, *u)
+		}
+
+		cls, err := SRVCluster("self", "example.com", "http", apurls)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if tt.werr {
+			continue
+		}
+		w := &etcdserver.Cluster{}
+		w.Set(tt.wcluster)
+		if !reflect.DeepEqual(cls, w) {
+			t.Errorf("#%d: cluster = %s, want %s", i, cls, w)
+		}
+	}
+}
@@ -34,6 +34,13 @@ var errors = map[int]string{
 	EcodeKeyIsPreserved:   "The prefix of given key is a keyword in etcd",
 	EcodeDirNotEmpty:      "Directory not empty",
 	EcodeExistingPeerAddr: "Peer address has existed",
+	EcodeQuotaExceeded:    "The store is over its quota",
+	EcodeKeyTooLong:       "Key too long",
+	EcodeKeyTooDeep:       "Key too deeply nested",
+	EcodeUnauthorized:     "The request requires user authentication",
+	EcodeForbidden:        "The user is not permitted to make the request",
+	EcodeNotFound:         "Not found",
+	EcodeConflict:         "Conflicts with the state of the cluster",
 
 	// Post form related errors
 	EcodeValueRequired:        "Value is Required in POST form",
@@ -47,10 +54,18 @@ var errors = map[int]string{
 	EcodeIndexValueMutex:      "Index and value cannot both be specified",
 	EcodeInvalidField:         "Invalid field",
 	EcodeInvalidForm:          "Invalid POST form",
+	EcodeRequestTooLarge:      "Request body too large",
+	EcodeMethodNotAllowed:     "Method not allowed",
 
 	// raft related errors
-	EcodeRaftInternal: "Raft Internal Error",
-	EcodeLeaderElect:  "During Leader Election",
+	EcodeRaftInternal:    "Raft Internal Error",
+	EcodeLeaderElect:     "During Leader Election",
+	EcodeTimeout:         "Request timed out",
+	EcodeTooManyRequests: "Too many requests",
+	EcodeReplaying:       "Replaying the log",
+	EcodeClusterVersion:  "Not supported by every member of the cluster",
+	EcodeNothingApplied:  "No entry applied yet",
+	EcodeCanceled:        "Request canceled",
 
 	// etcd related errors
 	EcodeWatcherCleared:     "watcher is cleared due to etcd recovery",
@@ -74,6 +89,13 @@ const (
 	EcodeRootROnly        = 107
 	EcodeDirNotEmpty      = 108
 	EcodeExistingPeerAddr = 109
+	EcodeQuotaExceeded    = 110
+	EcodeKeyTooLong       = 111
+	EcodeKeyTooDeep       = 112
+	EcodeUnauthorized     = 113
+	EcodeForbidden        = 114
+	EcodeNotFound         = 115
+	EcodeConflict         = 116
 
 	EcodeValueRequired        = 200
 	EcodePrevValueRequired    = 201
@@ -86,9 +108,17 @@ const (
 	EcodeIndexValueMutex      = 208
 	EcodeInvalidField         = 209
 	EcodeInvalidForm          = 210
-
-	EcodeRaftInternal = 300
-	EcodeLeaderElect  = 301
+	EcodeRequestTooLarge      = 211
+	EcodeMethodNotAllowed     = 212
+
+	EcodeRaftInternal    = 300
+	EcodeLeaderElect     = 301
+	EcodeTimeout         = 302
+	EcodeTooManyRequests = 303
+	EcodeReplaying       = 304
+	EcodeClusterVersion  = 305
+	EcodeNothingApplied  = 306
+	EcodeCanceled        = 307
 
 	EcodeWatcherCleared     = 400
 	EcodeEventIndexCleared  = 401
@@ -133,22 +163,42 @@ func (e Error) toJsonString() string {
 	return string(b)
 }
 
-func (e Error) Write(w http.ResponseWriter) {
-	w.Header().Add("X-Etcd-Index", fmt.Sprint(e.Index))
-	// 3xx is raft internal error
-	status := http.StatusBadRequest
+// StatusCode returns the HTTP status the error is responded with.
+func (e Error) StatusCode() int {
 	switch e.ErrorCode {
-	case EcodeKeyNotFound:
-		status = http.StatusNotFound
-	case EcodeNotFile, EcodeDirNotEmpty:
-		status = http.StatusForbidden
+	case EcodeKeyNotFound, EcodeNotFound:
+		return http.StatusNotFound
+	case EcodeNotFile, EcodeDirNotEmpty, EcodeForbidden:
+		return http.StatusForbidden
+	case EcodeUnauthorized:
+		return http.StatusUnauthorized
+	case EcodeConflict:
+		return http.StatusConflict
 	case EcodeTestFailed, EcodeNodeExist:
-		status = http.StatusPreconditionFailed
-	default:
-		if e.ErrorCode/100 == 3 {
-			status = http.StatusInternalServerError
-		}
+		return http.StatusPreconditionFailed
+	case EcodeQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case EcodeRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case EcodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case EcodeLeaderElect, EcodeReplaying, EcodeClusterVersion, EcodeNothingApplied, EcodeCanceled:
+		return http.StatusServiceUnavailable
+	case EcodeTimeout:
+		return http.StatusGatewayTimeout
+	case EcodeTooManyRequests:
+		return http.StatusTooManyRequests
+	}
+	// 3xx is raft internal error
+	if e.ErrorCode/100 == 3 {
+		return http.StatusInternalServerError
 	}
-	w.WriteHeader(status)
+	return http.StatusBadRequest
+}
+
+func (e Error) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("X-Etcd-Index", fmt.Sprint(e.Index))
+	w.WriteHeader(e.StatusCode())
 	fmt.Fprintln(w, e.toJsonString())
 }
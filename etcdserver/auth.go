@@ -0,0 +1,359 @@
+package etcdserver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	etcdErr "github.com/coreos/etcd/error"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.crypto/bcrypt"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+const (
+	// RootUser is the user that must be created first, and that cannot be
+	// removed, so that the cluster is never left without any user. It is
+	// granted every permission, whatever its roles.
+	RootUser = "root"
+
+	userKVPrefix = "/_etcd/auth/users/"
+	roleKVPrefix = "/_etcd/auth/roles/"
+	// hiddenKVPrefix holds the state of etcd itself, which only RootUser
+	// may touch through the keys, whatever the roles of the others.
+	hiddenKVPrefix = "/_etcd"
+)
+
+var (
+	ErrUserExists   = errors.New("etcdserver: user already exists")
+	ErrUserNotFound = errors.New("etcdserver: user not found")
+	ErrRemoveRoot   = errors.New("etcdserver: cannot remove the root user")
+	ErrInvalidUser  = errors.New("etcdserver: user name must be non-empty and must not contain '/'")
+	ErrRoleNotFound = errors.New("etcdserver: role not found")
+	ErrInvalidRole  = errors.New("etcdserver: role name must be non-empty and must not contain '/'")
+)
+
+// User is a user of the client API, as stored under userKVPrefix.
+type User struct {
+	Name string
+	// Password is the bcrypt hash of the password of the user.
+	Password string
+	// Roles are the names of the roles granted to the user.
+	Roles []string
+}
+
+// Role grants the permission to read the keys under the prefixes of Read,
+// and to write the keys under the prefixes of Write. A write permission
+// does not imply the read one. It is stored under roleKVPrefix.
+type Role struct {
+	Name  string   `json:"name"`
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+}
+
+// NewUser returns the user name, with the hash of password.
+func NewUser(name, password string) (User, error) {
+	if !validName(name) {
+		return User{}, ErrInvalidUser
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Name: name, Password: string(h)}, nil
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+func userStoreKey(name string) string {
+	return path.Join(userKVPrefix, name)
+}
+
+func roleStoreKey(name string) string {
+	return path.Join(roleKVPrefix, name)
+}
+
+// underPrefix tells whether key is prefix itself or one of the keys under
+// it, prefix being a directory: "/app" covers "/app/a" but not "/apple".
+func underPrefix(key, prefix string) bool {
+	prefix = path.Clean("/" + prefix)
+	return prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// HiddenUnder tells whether the keys only RootUser may touch are under key,
+// so that listing key with its hidden keys would reveal them.
+func HiddenUnder(key string) bool {
+	return underPrefix(hiddenKVPrefix, path.Clean("/"+key))
+}
+
+// UserStore reads the users and the roles of the client API from the
+// store. They are written through raft, by the methods of Server.
+type UserStore interface {
+	// Names returns the sorted names of the users.
+	Names() []string
+	// Authenticate tells whether password is the password of the user name.
+	Authenticate(name, password string) bool
+	// Permitted tells whether the roles of the user name grant it to read
+	// key, or to write it if write is set.
+	Permitted(name, key string, write bool) bool
+	// Roles returns the roles, sorted by name.
+	Roles() []Role
+}
+
+type userStore struct {
+	Store store.Store
+
+	mu sync.Mutex
+	// verified maps the name of a user to the hash and the sha256 sum of
+	// the password it was last authenticated with, as bcrypt is slow by
+	// design and the clients send their password on every request.
+	verified map[string]verifiedPassword
+}
+
+type verifiedPassword struct {
+	hash string
+	sum  [sha256.Size]byte
+}
+
+func NewUserStore(st store.Store) UserStore {
+	return &userStore{Store: st, verified: make(map[string]verifiedPassword)}
+}
+
+func (s *userStore) Names() []string {
+	e, err := s.Store.Get(userKVPrefix, false, false)
+	if err != nil {
+		if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+			return nil
+		}
+		logger.Panicf("get users should never fail: %v", err)
+	}
+	names := make([]string, 0, len(e.Node.Nodes))
+	for _, n := range e.Node.Nodes {
+		names = append(names, path.Base(n.Key))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// get unmarshals the value of the node at key into v. It returns false if
+// there is no such node.
+func (s *userStore) get(key string, v interface{}) bool {
+	e, err := s.Store.Get(key, false, false)
+	if err != nil || e.Node.Value == nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(*e.Node.Value), v); err != nil {
+		logger.Errorf("etcdserver: error unmarshaling %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+func (s *userStore) Authenticate(name, password string) bool {
+	var u User
+	if !validName(name) || !s.get(userStoreKey(name), &u) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	s.mu.Lock()
+	v, ok := s.verified[name]
+	s.mu.Unlock()
+	if ok && v.hash == u.Password && v.sum == sum {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return false
+	}
+	s.mu.Lock()
+	s.verified[name] = verifiedPassword{hash: u.Password, sum: sum}
+	s.mu.Unlock()
+	return true
+}
+
+func (s *userStore) Permitted(name, key string, write bool) bool {
+	if name == RootUser {
+		return true
+	}
+	key = path.Clean("/" + key)
+	if underPrefix(key, hiddenKVPrefix) {
+		return false
+	}
+	var u User
+	if !validName(name) || !s.get(userStoreKey(name), &u) {
+		return false
+	}
+	for _, rn := range u.Roles {
+		var r Role
+		// the roles removed since they were granted grant nothing
+		if !validName(rn) || !s.get(roleStoreKey(rn), &r) {
+			continue
+		}
+		prefixes := r.Read
+		if write {
+			prefixes = r.Write
+		}
+		for _, p := range prefixes {
+			if underPrefix(key, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *userStore) Roles() []Role {
+	e, err := s.Store.Get(roleKVPrefix, false, true)
+	if err != nil {
+		if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+			return nil
+		}
+		logger.Panicf("get roles should never fail: %v", err)
+	}
+	roles := make([]Role, 0, len(e.Node.Nodes))
+	for _, n := range e.Node.Nodes {
+		var r Role
+		if err := json.Unmarshal([]byte(*n.Value), &r); err != nil {
+			logger.Errorf("etcdserver: error unmarshaling role %s: %v", n.Key, err)
+			continue
+		}
+		roles = append(roles, r)
+	}
+	return roles
+}
+
+// AddUser adds u to the users of the client API. It returns ErrUserExists
+// if a user of the same name already exists.
+func (s *EtcdServer) AddUser(ctx context.Context, u User) error {
+	if !validName(u.Name) {
+		return ErrInvalidUser
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	r := pb.Request{
+		ID:        GenID(),
+		Method:    "PUT",
+		Path:      userStoreKey(u.Name),
+		Val:       string(b),
+		PrevExist: boolp(false),
+	}
+	_, err = s.Do(ctx, r)
+	if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeNodeExist {
+		return ErrUserExists
+	}
+	return err
+}
+
+// RemoveUser removes the user name. It returns ErrUserNotFound if the user
+// does not exist, and ErrRemoveRoot for RootUser.
+func (s *EtcdServer) RemoveUser(ctx context.Context, name string) error {
+	if name == RootUser {
+		return ErrRemoveRoot
+	}
+	if !validName(name) {
+		return ErrUserNotFound
+	}
+	r := pb.Request{
+		ID:     GenID(),
+		Method: "DELETE",
+		Path:   userStoreKey(name),
+	}
+	_, err := s.Do(ctx, r)
+	if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// SetUserRoles replaces the roles granted to the user name with roles. It
+// returns ErrUserNotFound if the user does not exist, and ErrRoleNotFound
+// if one of roles does not.
+func (s *EtcdServer) SetUserRoles(ctx context.Context, name string, roles []string) error {
+	if !validName(name) {
+		return ErrUserNotFound
+	}
+	for _, rn := range roles {
+		if !validName(rn) {
+			return ErrRoleNotFound
+		}
+		if _, err := s.Store.Get(roleStoreKey(rn), false, false); err != nil {
+			return ErrRoleNotFound
+		}
+	}
+	e, err := s.Store.Get(userStoreKey(name), false, false)
+	if err != nil {
+		return ErrUserNotFound
+	}
+	var u User
+	if err := json.Unmarshal([]byte(*e.Node.Value), &u); err != nil {
+		return err
+	}
+	u.Roles = roles
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	// the user is swapped only if it did not change since it was read,
+	// so that a password changed meanwhile is not reverted
+	r := pb.Request{
+		ID:        GenID(),
+		Method:    "PUT",
+		Path:      userStoreKey(name),
+		Val:       string(b),
+		PrevValue: *e.Node.Value,
+	}
+	_, err = s.Do(ctx, r)
+	if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// SetRole creates r, or replaces the role of the same name.
+func (s *EtcdServer) SetRole(ctx context.Context, r Role) error {
+	if !validName(r.Name) {
+		return ErrInvalidRole
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req := pb.Request{
+		ID:     GenID(),
+		Method: "PUT",
+		Path:   roleStoreKey(r.Name),
+		Val:    string(b),
+	}
+	_, err = s.Do(ctx, req)
+	return err
+}
+
+// RemoveRole removes the role name. It returns ErrRoleNotFound if the role
+// does not exist. The users it was granted to keep its name, which grants
+// them nothing unless a role of that name is set again.
+func (s *EtcdServer) RemoveRole(ctx context.Context, name string) error {
+	if !validName(name) {
+		return ErrRoleNotFound
+	}
+	r := pb.Request{
+		ID:     GenID(),
+		Method: "DELETE",
+		Path:   roleStoreKey(name),
+	}
+	_, err := s.Do(ctx, r)
+	if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+		return ErrRoleNotFound
+	}
+	return err
+}
+
+func boolp(b bool) *bool { return &b }
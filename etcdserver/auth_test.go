@@ -0,0 +1,236 @@
+package etcdserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+func TestNewUser(t *testing.T) {
+	u, err := NewUser("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "bob" {
+		t.Errorf("name = %s, want bob", u.Name)
+	}
+	if u.Password == "secret" {
+		t.Errorf("password is not hashed")
+	}
+	for _, name := range []string{"", "a/b"} {
+		if _, err := NewUser(name, "secret"); err != ErrInvalidUser {
+			t.Errorf("%q: err = %v, want %v", name, err, ErrInvalidUser)
+		}
+	}
+}
+
+// TestAddRemoveUser tests that the users added and removed through raft
+// are seen by a UserStore reading the same store.
+func TestAddRemoveUser(t *testing.T) {
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	st := store.New()
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Ticker:  tk,
+	}
+	srv.start()
+	defer srv.Stop()
+	users := NewUserStore(st)
+	ctx := context.TODO()
+
+	if g := users.Names(); len(g) != 0 {
+		t.Errorf("names = %v, want none", g)
+	}
+	for _, name := range []string{RootUser, "bob"} {
+		u, err := NewUser(name, name+"-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.AddUser(ctx, u); err != nil {
+			t.Fatalf("AddUser %s error: %v", name, err)
+		}
+	}
+	if g, w := users.Names(), []string{"bob", RootUser}; !reflect.DeepEqual(g, w) {
+		t.Errorf("names = %v, want %v", g, w)
+	}
+	u, err := NewUser("bob", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddUser(ctx, u); err != ErrUserExists {
+		t.Errorf("AddUser existing err = %v, want %v", err, ErrUserExists)
+	}
+	if !users.Authenticate("bob", "bob-secret") {
+		t.Errorf("user not authenticated with its password")
+	}
+
+	if err := srv.RemoveUser(ctx, RootUser); err != ErrRemoveRoot {
+		t.Errorf("RemoveUser root err = %v, want %v", err, ErrRemoveRoot)
+	}
+	if err := srv.RemoveUser(ctx, "bob"); err != nil {
+		t.Fatalf("RemoveUser error: %v", err)
+	}
+	if err := srv.RemoveUser(ctx, "bob"); err != ErrUserNotFound {
+		t.Errorf("RemoveUser removed err = %v, want %v", err, ErrUserNotFound)
+	}
+	if g, w := users.Names(), []string{RootUser}; !reflect.DeepEqual(g, w) {
+		t.Errorf("names = %v, want %v", g, w)
+	}
+	if users.Authenticate("bob", "bob-secret") {
+		t.Errorf("removed user authenticated")
+	}
+}
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	st := store.New()
+	u, err := NewUser("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Create(userStoreKey(u.Name), false, `{"Name":"bob","Password":"`+u.Password+`"}`, false, store.Permanent); err != nil {
+		t.Fatal(err)
+	}
+	users := NewUserStore(st)
+
+	tests := []struct {
+		name, password string
+		w              bool
+	}{
+		{"bob", "secret", true},
+		// served from the cache of the verified passwords
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"bob", "", false},
+		{"alice", "secret", false},
+		{"", "secret", false},
+		{"bob/x", "secret", false},
+	}
+	for i, tt := range tests {
+		if g := users.Authenticate(tt.name, tt.password); g != tt.w {
+			t.Errorf("#%d: Authenticate(%q, %q) = %v, want %v", i, tt.name, tt.password, g, tt.w)
+		}
+	}
+
+	// a password changed in the store invalidates the cached one
+	u, err = NewUser("bob", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Set(userStoreKey(u.Name), false, `{"Name":"bob","Password":"`+u.Password+`"}`, store.Permanent); err != nil {
+		t.Fatal(err)
+	}
+	if users.Authenticate("bob", "secret") {
+		t.Errorf("old password authenticated")
+	}
+	if !users.Authenticate("bob", "new") {
+		t.Errorf("new password not authenticated")
+	}
+}
+
+// TestRoles tests that the roles set through raft grant their users the
+// permissions on their prefixes, and only those.
+func TestRoles(t *testing.T) {
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	st := store.New()
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Ticker:  tk,
+	}
+	srv.start()
+	defer srv.Stop()
+	users := NewUserStore(st)
+	ctx := context.TODO()
+
+	u, err := NewUser("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetUserRoles(ctx, "bob", []string{"app"}); err != ErrRoleNotFound {
+		t.Errorf("SetUserRoles unknown role err = %v, want %v", err, ErrRoleNotFound)
+	}
+	if err := srv.SetUserRoles(ctx, "alice", nil); err != ErrUserNotFound {
+		t.Errorf("SetUserRoles unknown user err = %v, want %v", err, ErrUserNotFound)
+	}
+	roles := []Role{
+		{Name: "all", Read: []string{"/"}, Write: []string{"/"}},
+		{Name: "app", Read: []string{"/app/"}},
+	}
+	for _, r := range roles {
+		if err := srv.SetRole(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g := users.Roles(); !reflect.DeepEqual(g, roles) {
+		t.Errorf("roles = %+v, want %+v", g, roles)
+	}
+
+	if err := srv.SetUserRoles(ctx, "bob", []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key   string
+		write bool
+		w     bool
+	}{
+		{"/app/foo", false, true},
+		{"/app/foo/bar", false, true},
+		{"/app", false, true},
+		{"/app/foo", true, false},
+		{"/apple", false, false},
+		{"/other/foo", false, false},
+		{"/other/foo", true, false},
+		{"/", false, false},
+	}
+	for i, tt := range tests {
+		if g := users.Permitted("bob", tt.key, tt.write); g != tt.w {
+			t.Errorf("#%d: Permitted(%q, %v) = %v, want %v", i, tt.key, tt.write, g, tt.w)
+		}
+		if !users.Permitted(RootUser, tt.key, tt.write) {
+			t.Errorf("#%d: root not permitted", i)
+		}
+	}
+	if !users.Authenticate("bob", "secret") {
+		t.Errorf("setting the roles changed the password")
+	}
+
+	// no role grants the keys of etcd itself
+	if err := srv.SetUserRoles(ctx, "bob", []string{"all"}); err != nil {
+		t.Fatal(err)
+	}
+	if !users.Permitted("bob", "/other/foo", true) {
+		t.Errorf("/other/foo not permitted with role all")
+	}
+	if users.Permitted("bob", userStoreKey("bob"), true) {
+		t.Errorf("%s permitted", userStoreKey("bob"))
+	}
+
+	if err := srv.RemoveRole(ctx, "all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RemoveRole(ctx, "all"); err != ErrRoleNotFound {
+		t.Errorf("RemoveRole removed err = %v, want %v", err, ErrRoleNotFound)
+	}
+	if users.Permitted("bob", "/other/foo", false) {
+		t.Errorf("removed role still grants its permissions")
+	}
+}
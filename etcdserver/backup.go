@@ -0,0 +1,38 @@
+package etcdserver
+
+import (
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+// Backup is the state of the store of a member at an applied index.
+type Backup struct {
+	// Index is the index of the last entry applied to Store.
+	Index int64
+	// Store is a clone of the store of the member, which the entries
+	// applied later do not change. Its SaveTo writes the state to back up.
+	Store store.Store
+}
+
+// BackupTaker takes backups of the store of a member.
+type BackupTaker interface {
+	// Backup returns the state of the store at the index the member
+	// applied.
+	Backup(ctx context.Context) (Backup, error)
+}
+
+// Backup clones the store while the run loop cannot apply an entry, so
+// that the clone is at the index it reports. The clone is taken by the
+// caller rather than by the run loop, which only waits for it.
+func (s *EtcdServer) Backup(ctx context.Context) (Backup, error) {
+	select {
+	case <-ctx.Done():
+		return Backup{}, ctx.Err()
+	case <-s.done:
+		return Backup{}, ErrStopped
+	default:
+	}
+	s.applyMu.RLock()
+	defer s.applyMu.RUnlock()
+	return Backup{Index: s.Index(), Store: s.Store.Clone()}, nil
+}
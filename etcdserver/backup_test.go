@@ -0,0 +1,53 @@
+package etcdserver
+
+import (
+	"bytes"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	n.Campaign(ctx)
+	s := &EtcdServer{
+		Store:   store.New(),
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Node:    n,
+	}
+	s.start()
+	defer s.Stop()
+
+	if _, err := s.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/foo", Val: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Index != s.Index() {
+		t.Errorf("index = %d, want the applied index %d", b.Index, s.Index())
+	}
+	// the entries applied later are not in the backup
+	if _, err := s.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/foo", Val: "baz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := b.Store.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	st := store.New()
+	if err := st.RecoveryFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := st.Get("/foo", false, false); err != nil || *ev.Node.Value != "bar" {
+		t.Errorf("backed up /foo = %v, %v, want bar", ev, err)
+	}
+}
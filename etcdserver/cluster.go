@@ -7,7 +7,6 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/coreos/etcd/pkg/flags"
 	"github.com/coreos/etcd/pkg/types"
 )
 
@@ -75,8 +74,12 @@ func (c *Cluster) Set(s string) error {
 			return fmt.Errorf("Empty URL given for %q", name)
 		}
 
-		m := newMember(name, types.URLs(*flags.NewURLsValue(strings.Join(urls, ","))), nil)
-		err := c.Add(*m)
+		us, err := types.NewURLs(urls)
+		if err != nil {
+			return fmt.Errorf("bad peer URL for %q: %v", name, err)
+		}
+		m := NewMember(name, us, nil)
+		err = c.Add(*m)
 		if err != nil {
 			return err
 		}
@@ -95,14 +98,22 @@ func (c Cluster) String() string {
 	return strings.Join(sl, ",")
 }
 
+// IDs returns the IDs of the members, sorted in ascending order.
 func (c Cluster) IDs() []int64 {
 	var ids []int64
 	for _, m := range c {
 		ids = append(ids, m.ID)
 	}
+	sort.Sort(int64Slice(ids))
 	return ids
 }
 
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 // PeerURLs returns a list of all peer addresses. Each address is prefixed
 // with the scheme (currently "http://"). The returned list is sorted in
 // ascending lexicographical order.
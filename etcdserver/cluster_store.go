@@ -2,20 +2,34 @@ package etcdserver
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
 )
 
 const (
-	raftPrefix = "/raft"
+	raftPrefix         = "/raft"
+	raftSnapshotPrefix = "/raft/snapshot"
+	raftStreamPrefix   = "/raft/stream"
+
+	// raftMessageHeader carries a snapshot message, without the data of
+	// the snapshot, which is streamed as the request body.
+	raftMessageHeader = "X-Raft-Message"
 )
 
 type ClusterStore interface {
+	Add(m Member)
 	Get() Cluster
 	Delete(id int64)
 }
@@ -27,21 +41,21 @@ type clusterStore struct {
 func NewClusterStore(st store.Store, c Cluster) ClusterStore {
 	cls := &clusterStore{Store: st}
 	for _, m := range c {
-		cls.add(*m)
+		cls.Add(*m)
 	}
 	return cls
 }
 
-// add puts a new Member into the store.
+// Add puts a new Member into the store.
 // A Member with a matching id must not exist.
-func (s *clusterStore) add(m Member) {
+func (s *clusterStore) Add(m Member) {
 	b, err := json.Marshal(m)
 	if err != nil {
-		log.Panicf("marshal peer info error: %v", err)
+		logger.Panicf("marshal peer info error: %v", err)
 	}
 
 	if _, err := s.Store.Create(m.storeKey(), false, string(b), false, store.Permanent); err != nil {
-		log.Panicf("add member should never fail: %v", err)
+		logger.Panicf("add member should never fail: %v", err)
 	}
 }
 
@@ -51,16 +65,19 @@ func (s *clusterStore) Get() Cluster {
 	c := &Cluster{}
 	e, err := s.Store.Get(machineKVPrefix, true, false)
 	if err != nil {
-		log.Panicf("get member should never fail: %v", err)
+		if v, ok := err.(*etcdErr.Error); ok && v.ErrorCode == etcdErr.EcodeKeyNotFound {
+			return *c
+		}
+		logger.Panicf("get member should never fail: %v", err)
 	}
 	for _, n := range e.Node.Nodes {
 		m := Member{}
 		if err := json.Unmarshal([]byte(*n.Value), &m); err != nil {
-			log.Panicf("unmarshal peer error: %v", err)
+			logger.Panicf("unmarshal peer error: %v", err)
 		}
 		err := c.Add(m)
 		if err != nil {
-			log.Panicf("add member to cluster should never fail: %v", err)
+			logger.Panicf("add member to cluster should never fail: %v", err)
 		}
 	}
 	return *c
@@ -71,23 +88,236 @@ func (s *clusterStore) Get() Cluster {
 func (s *clusterStore) Delete(id int64) {
 	p := s.Get().FindID(id).storeKey()
 	if _, err := s.Store.Delete(p, false, false); err != nil {
-		log.Panicf("delete peer should never fail: %v", err)
+		logger.Panicf("delete peer should never fail: %v", err)
 	}
 }
 
-func Sender(t *http.Transport, cls ClusterStore) func(msgs []raftpb.Message) {
+// Sender returns a function sending raft messages to the members of cls.
+// Messages are written on a stream kept open to each member, and posted
+// one by one to members whose stream is not connected, like those that do
+// not serve raftStreamPrefix. Snapshots are sent apart by a snapSender.
+//
+// timeout, if not 0, bounds the time to post a message or to open a
+// stream. It should be close to the heartbeat interval: a peer that takes
+// longer is as good as down to raft, and must not hold back the messages
+// to the other peers.
+//
+// The messages posted, and the ones written on a stream whose peer
+// acknowledges them, are recorded in stats.
+//
+// openSnap, if not nil, opens the data of the snapshots that raft holds
+// without it, such as the one it is restarted from, which is then streamed
+// from where it is saved rather than kept in memory.
+//
+// remove closes the stream and the post queue to a member removed from
+// the cluster. stop closes them all, and must be called once the server
+// stopped: the messages sent after it are dropped but for the snapshots.
+func Sender(t *http.Transport, cls ClusterStore, stats *PeerStats, timeout time.Duration, openSnap func(snap raftpb.Snapshot) (io.ReadCloser, error)) (send func(msgs []raftpb.Message), remove func(id int64), stop func()) {
 	c := &http.Client{Transport: t}
+	ss := &snapSender{c: c, cls: cls, open: openSnap, inflight: make(map[int64]bool)}
+	streams := newStreamSender(c, cls, stats, timeout)
+	ps := &postSender{c: c, cls: cls, stats: stats, timeout: timeout, queues: make(map[int64]chan raftpb.Message)}
 
-	return func(msgs []raftpb.Message) {
+	send = func(msgs []raftpb.Message) {
 		for _, m := range msgs {
-			// TODO: reuse go routines
-			// limit the number of outgoing connections for the same receiver
-			go send(c, cls, m)
+			if !raft.IsEmptySnap(m.Snapshot) {
+				ss.send(m)
+				continue
+			}
+			if streams.send(m) {
+				continue
+			}
+			ps.send(m)
+		}
+	}
+	remove = func(id int64) {
+		streams.remove(id)
+		ps.remove(id)
+	}
+	stop = func() {
+		streams.stop()
+		ps.stop()
+	}
+	return send, remove, stop
+}
+
+const (
+	// peerQueueSize is the number of messages that may wait to be posted
+	// to a peer. Once it is reached, the oldest message is dropped for
+	// each new one; raft sends them again.
+	peerQueueSize = 64
+)
+
+// postSender posts messages to raftPrefix from a queue per peer, each
+// emptied by its own goroutine, so that a peer slow to answer delays the
+// messages to it only. Queuing never blocks: when the queue of a peer is
+// full, its oldest message is dropped, as it is the most likely to be
+// outdated by the messages after it.
+type postSender struct {
+	c       *http.Client
+	cls     ClusterStore
+	stats   *PeerStats
+	timeout time.Duration
+
+	// mu also guards the queuing, for remove and stop to close the
+	// queues
+	mu      sync.Mutex
+	queues  map[int64]chan raftpb.Message
+	stopped bool
+}
+
+func (s *postSender) send(m raftpb.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	q, ok := s.queues[m.To]
+	if !ok {
+		q = make(chan raftpb.Message, peerQueueSize)
+		s.queues[m.To] = q
+		go s.post(q)
+	}
+
+	for {
+		select {
+		case q <- m:
+			peerQueueDepth.Add(1)
+			return
+		default:
+		}
+		// the queue is full, unless the goroutine emptying it just took
+		// a message
+		select {
+		case <-q:
+			peerQueueDepth.Add(-1)
+			messagesDropped.Inc()
+			logger.Debugf("etcdserver: dropping oldest message to %#x: send queue full", m.To)
+		default:
+		}
+	}
+}
+
+// remove closes the queue to the peer id, which left the cluster.
+func (s *postSender) remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[id]; ok {
+		delete(s.queues, id)
+		closeQueue(q)
+	}
+}
+
+// stop closes the queues, and drops the messages sent after it.
+func (s *postSender) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for id, q := range s.queues {
+		delete(s.queues, id)
+		closeQueue(q)
+	}
+}
+
+// closeQueue drops the messages left in q, and closes it for the
+// goroutine emptying it to return.
+func closeQueue(q chan raftpb.Message) {
+	for {
+		select {
+		case <-q:
+			peerQueueDepth.Add(-1)
+		default:
+			close(q)
+			return
 		}
 	}
 }
 
-func send(c *http.Client, cls ClusterStore, m raftpb.Message) {
+func (s *postSender) post(q chan raftpb.Message) {
+	for m := range q {
+		peerQueueDepth.Add(-1)
+		send(s.c, s.cls, s.stats, m, s.timeout)
+	}
+}
+
+// snapSender streams snapshots to the peers on raftSnapshotPrefix, one at a
+// time per peer. A snapshot for a peer still receiving the previous one is
+// dropped, so a slow peer cannot pile up snapshots in the memory of the
+// leader; raft sends a new one as long as the peer lags behind.
+type snapSender struct {
+	c   *http.Client
+	cls ClusterStore
+	// open opens the data of a snapshot sent without it
+	open func(snap raftpb.Snapshot) (io.ReadCloser, error)
+
+	mu       sync.Mutex
+	inflight map[int64]bool
+}
+
+func (s *snapSender) send(m raftpb.Message) {
+	s.mu.Lock()
+	if s.inflight[m.To] {
+		s.mu.Unlock()
+		logger.Warnf("etcdserver: dropping snapshot to %#x: previous one still in flight", m.To)
+		return
+	}
+	s.inflight[m.To] = true
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.inflight, m.To)
+			s.mu.Unlock()
+		}()
+		u := s.cls.Get().Pick(m.To)
+		if u == "" {
+			logger.Warnf("etcdserver: no addr for %d", m.To)
+			return
+		}
+		var data io.Reader = bytes.NewReader(m.Snapshot.Data)
+		if m.Snapshot.Data == nil && s.open != nil {
+			rc, err := s.open(m.Snapshot)
+			if err != nil {
+				logger.Warnf("etcdserver: failed to open snapshot at index %d for %#x: %v", m.Snapshot.Index, m.To, err)
+				return
+			}
+			defer rc.Close()
+			data = rc
+		}
+		if err := postSnapshot(s.c, u+raftSnapshotPrefix, m, data); err != nil {
+			logger.Warnf("etcdserver: failed to send snapshot to %#x: %v", m.To, err)
+		}
+	}()
+}
+
+// postSnapshot posts the snapshot message m to url, streaming the snapshot
+// data from data as the body rather than marshaling it along with the
+// message.
+func postSnapshot(c *http.Client, url string, m raftpb.Message, data io.Reader) error {
+	m.Snapshot.Data = nil
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(raftMessageHeader, base64.StdEncoding.EncodeToString(b))
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func send(c *http.Client, cls ClusterStore, stats *PeerStats, m raftpb.Message, timeout time.Duration) {
 	// TODO (xiangli): reasonable retry logic
 	for i := 0; i < 3; i++ {
 		u := cls.Get().Pick(m.To)
@@ -95,7 +325,7 @@ func send(c *http.Client, cls ClusterStore, m raftpb.Message) {
 			// TODO: unknown peer id.. what do we do? I
 			// don't think his should ever happen, need to
 			// look into this further.
-			log.Printf("etcdhttp: no addr for %d", m.To)
+			logger.Warnf("etcdhttp: no addr for %d", m.To)
 			return
 		}
 
@@ -105,18 +335,33 @@ func send(c *http.Client, cls ClusterStore, m raftpb.Message) {
 		// of messages out at a time.
 		data, err := m.Marshal()
 		if err != nil {
-			log.Println("etcdhttp: dropping message:", err)
+			logger.Errorf("etcdhttp: dropping message: %v", err)
 			return // drop bad message
 		}
-		if httpPost(c, u, data) {
+		start := time.Now()
+		if httpPost(c, u, data, timeout) {
+			stats.Succ(m.To, time.Since(start))
 			return // success
 		}
+		stats.Fail(m.To)
 		// TODO: backoff
 	}
 }
 
-func httpPost(c *http.Client, url string, data []byte) bool {
-	resp, err := c.Post(url, "application/protobuf", bytes.NewBuffer(data))
+func httpPost(c *http.Client, url string, data []byte, timeout time.Duration) bool {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/protobuf")
+	resp, err := c.Do(req)
 	if err != nil {
 		// TODO: log the error?
 		return false
@@ -46,6 +46,13 @@ func TestClusterStoreGet(t *testing.T) {
 	}
 }
 
+func TestClusterStoreGetEmpty(t *testing.T) {
+	cs := NewClusterStore(store.New(), Cluster{})
+	if g := cs.Get(); len(g) != 0 {
+		t.Errorf("mems = %v, want none", g)
+	}
+}
+
 func TestClusterStoreDelete(t *testing.T) {
 	st := &storeGetAllDeleteRecorder{}
 	c := Cluster{}
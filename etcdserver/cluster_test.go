@@ -102,10 +102,29 @@ func TestClusterSet(t *testing.T) {
 	}
 }
 
+func TestClusterSetCanonical(t *testing.T) {
+	var g, w Cluster
+	if err := g.Set("mem1=HTTP://Example.COM:2379/,mem1=http://[2001:DB8::1]:2379"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set("mem1=http://example.com:2379,mem1=http://[2001:db8::1]:2379"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("set = %v, want %v", g, w)
+	}
+}
+
 func TestClusterSetBad(t *testing.T) {
 	tests := []string{
 		"mem1=,mem2=http://128.193.4.20:2379,mem3=http://10.0.0.2:2379",
 		"mem1,mem2=http://128.193.4.20:2379,mem3=http://10.0.0.2:2379",
+		// malformed URLs
+		"mem1=10.0.0.1:2379",
+		"mem1=http://10.0.0.1",
+		"mem1=http://10.0.0.1:2379/path",
+		"mem1=http://10.0.0.1:2379,mem1=ftp://10.0.0.1:2379",
+		"mem1=http://10.0.0.1:2379?foo=bar",
 		// TODO(philips): anyone know of a 64 bit sha1 hash collision
 		// "06b2f82fd81b2c20=http://128.193.4.20:2379,02c60cb75083ceef=http://128.193.4.20:2379",
 	}
@@ -143,6 +162,15 @@ func TestClusterAddBad(t *testing.T) {
 	}
 }
 
+func TestClusterIDs(t *testing.T) {
+	cs := Cluster{}
+	cs.AddSlice([]Member{{ID: 4}, {ID: 1}, {ID: 3}})
+	w := []int64{1, 3, 4}
+	if g := cs.IDs(); !reflect.DeepEqual(g, w) {
+		t.Errorf("IDs = %v, want %v", g, w)
+	}
+}
+
 func TestClusterPeerURLs(t *testing.T) {
 	tests := []struct {
 		mems  []Member
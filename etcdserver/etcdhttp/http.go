@@ -1,13 +1,17 @@
 package etcdhttp
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,44 +19,185 @@ import (
 	etcdErr "github.com/coreos/etcd/error"
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/pkg/metrics"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/store"
 	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
 )
 
 const (
-	keysPrefix     = "/v2/keys"
-	machinesPrefix = "/v2/machines"
-	raftPrefix     = "/raft"
+	keysPrefix         = "/v2/keys"
+	machinesPrefix     = "/v2/machines"
+	membersPath        = "/v2/members"
+	txnPath            = "/v2/txn"
+	adminMembersPrefix = "/v2/admin/members"
+	adminSnapshotPath  = "/v2/admin/snapshot"
+	adminBackupPath    = "/v2/admin/backup"
+	usersPath          = "/v2/auth/users"
+	rolesPath          = "/v2/auth/roles"
+	statsLeaderPath    = "/v2/stats/leader"
+	statsStorePath     = "/v2/stats/store"
+	healthPath         = "/health"
+	metricsPath        = "/metrics"
+	versionPath        = "/version"
+	debugRaftPath      = "/debug/raft"
+	raftPrefix         = "/raft"
+	raftSnapshotPrefix = "/raft/snapshot"
+	raftStreamPrefix   = "/raft/stream"
+
+	// raftMessageHeader carries the message of a snapshot streamed to
+	// raftSnapshotPrefix, without the data of the snapshot.
+	raftMessageHeader = "X-Raft-Message"
+	// raftStreamAckHeader tells the sender of a stream that an empty frame
+	// is written back for each message processed, to measure its latency.
+	raftStreamAckHeader = "X-Raft-Stream-Ack"
 
 	// time to wait for response from EtcdServer requests
 	defaultServerTimeout = 500 * time.Millisecond
 
 	// time to wait for a Watch request
 	defaultWatchTimeout = 5 * time.Minute
+
+	// a member that has not applied any entry for this long is considered
+	// behind the cluster. The leader proposes a SYNC every 500ms, so a
+	// healthy member applies entries well within it.
+	healthApplyWindow = 5 * time.Second
+
+	// DefaultMaxRequestBytes is the default limit on the size of the body
+	// of a client request, which leaves the request room in a raft message.
+	DefaultMaxRequestBytes = 1536 * 1024
+)
+
+var (
+	errClosed          = errors.New("etcdhttp: client closed connection")
+	errRequestTooLarge = errors.New("request body too large")
 )
 
-var errClosed = errors.New("etcdhttp: client closed connection")
+// WriteMode tells how a member that is not the leader serves the requests
+// that write keys. A WriteMode implements flag.Value.
+type WriteMode int
+
+const (
+	// WriteForward proposes the write like the leader does: raft forwards
+	// the proposal to the leader, and the response waits for the write to
+	// be committed.
+	WriteForward WriteMode = iota
+	// WriteRedirect redirects the client to the same URL on the leader,
+	// with 307 so that the client sends the request body again.
+	WriteRedirect
+)
+
+var writeModeNames = []string{"forward", "redirect"}
+
+func (m WriteMode) String() string {
+	if m < WriteForward || m > WriteRedirect {
+		return fmt.Sprintf("WriteMode(%d)", int(m))
+	}
+	return writeModeNames[m]
+}
+
+func (m *WriteMode) Set(s string) error {
+	for i, name := range writeModeNames {
+		if s == name {
+			*m = WriteMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("etcdhttp: unknown write mode %q", s)
+}
 
 // NewClientHandler generates a muxed http.Handler with the given parameters to serve etcd client requests.
-func NewClientHandler(server *etcdserver.EtcdServer, clusterStore etcdserver.ClusterStore, timeout time.Duration) http.Handler {
+// The writes sent to a member that is not the leader are served according to mode.
+// The requests with a body larger than maxRequestBytes are responded 413,
+// unless maxRequestBytes is 0.
+func NewClientHandler(server *etcdserver.EtcdServer, clusterStore etcdserver.ClusterStore, timeout time.Duration, mode WriteMode, maxRequestBytes int64) http.Handler {
 	sh := &serverHandler{
 		server:       server,
+		id:           server.ID,
 		clusterStore: clusterStore,
 		timer:        server,
+		health:       server,
+		raftStatus:   server,
+		leaderStats:  server,
+		storeStats:   server,
+		snapshots:    server,
+		backups:      server,
+		versions:     server,
+		users:        etcdserver.NewUserStore(server.Store),
 		timeout:      timeout,
+		writeMode:    mode,
 	}
 	if sh.timeout == 0 {
 		sh.timeout = defaultServerTimeout
 	}
 	mux := http.NewServeMux()
-	mux.HandleFunc(keysPrefix, sh.serveKeys)
-	mux.HandleFunc(keysPrefix+"/", sh.serveKeys)
+	mux.HandleFunc(keysPrefix, sh.leaderWrites(sh.serveKeys))
+	mux.HandleFunc(keysPrefix+"/", sh.leaderWrites(sh.serveKeys))
 	// TODO: dynamic configuration may make this outdated. take care of it.
 	// TODO: dynamic configuration may introduce race also.
 	mux.HandleFunc(machinesPrefix, sh.serveMachines)
-	mux.HandleFunc("/", http.NotFound)
-	return mux
+	mux.HandleFunc(membersPath, sh.serveMembers)
+	mux.HandleFunc(txnPath, sh.leaderWrites(sh.serveTxn))
+	mux.HandleFunc(adminMembersPrefix, sh.serveAdminMembers)
+	mux.HandleFunc(adminMembersPrefix+"/", sh.serveAdminMembers)
+	mux.HandleFunc(adminSnapshotPath, sh.serveAdminSnapshot)
+	mux.HandleFunc(adminBackupPath, sh.serveAdminBackup)
+	mux.HandleFunc(usersPath, sh.serveUsers)
+	mux.HandleFunc(usersPath+"/", sh.serveUsers)
+	mux.HandleFunc(rolesPath, sh.serveRoles)
+	mux.HandleFunc(rolesPath+"/", sh.serveRoles)
+	mux.HandleFunc(healthPath, sh.serveHealth)
+	mux.HandleFunc(metricsPath, serveMetrics)
+	mux.HandleFunc(debugRaftPath, sh.serveRaftStatus)
+	mux.HandleFunc(versionPath, sh.serveVersion)
+	mux.HandleFunc(statsLeaderPath, sh.serveLeaderStats)
+	mux.HandleFunc(statsStorePath, sh.serveStoreStats)
+	mux.HandleFunc("/", notFound)
+	return NewLimitHandler(waitReplayed(mux, sh.health), maxRequestBytes)
+}
+
+// waitReplayed wraps h so that, until the member replayed its WAL, the
+// requests are responded 503 rather than served from a stale store. Only
+// /health and /metrics are served meanwhile.
+func waitReplayed(h http.Handler, hr etcdserver.HealthReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hr.Replayed() && r.URL.Path != healthPath && r.URL.Path != metricsPath {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeReplaying, ""))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// NewLimitHandler wraps h so that a request whose body is larger than max
+// bytes is responded 413: at once if its Content-Length tells so, or else
+// once h reads past max bytes of it. A max of 0 sets no limit. The client
+// handler limits itself, but a handler wrapping it that reads the body
+// first, such as the one of NewAuthHandler, must be limited too.
+func NewLimitHandler(h http.Handler, max int64) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			writeError(w, errRequestTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isTooLarge tells whether err was returned by reading a body past the
+// limit of NewLimitHandler.
+func isTooLarge(err error) bool {
+	_, ok := err.(*http.MaxBytesError)
+	return ok
 }
 
 // NewPeerHandler generates an http.Handler to handle etcd peer (raft) requests.
@@ -62,16 +207,233 @@ func NewPeerHandler(server etcdserver.Server) http.Handler {
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc(raftPrefix, sh.serveRaft)
+	mux.HandleFunc(raftSnapshotPrefix, sh.serveSnapshot)
+	mux.HandleFunc(raftStreamPrefix, sh.serveRaftStream)
 	mux.HandleFunc("/", http.NotFound)
 	return mux
 }
 
+// NewAccessLogHandler wraps h, usually the client handler, so that every
+// request is logged at INFO level with its method, path, status and
+// duration, with the raft index it was applied at if it was proposed, and
+// with its X-Request-Id, as set by the proxy, if it has one.
+// The response is passed through as it is written, so watches still stream.
+func NewAccessLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !logger.Enabled(logger.InfoLevel) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(aw, r)
+		line := fmt.Sprintf("etcdhttp: %s %s %d %v", r.Method, r.URL.Path, aw.status, time.Since(start))
+		if aw.index != 0 {
+			line += fmt.Sprintf(" raft-index=%d", aw.index)
+		}
+		if id := r.Header.Get("X-Request-Id"); id != "" {
+			line += fmt.Sprintf(" request-id=%q", id)
+		}
+		logger.Infof("%s", line)
+	})
+}
+
+// NewAuthHandler wraps h, usually the client handler, so that every request
+// must carry the HTTP Basic credentials of one of users, and be permitted
+// by the roles of that user. Only /health and /metrics are served to
+// anyone, and, as long as there is no user at all, the request creating
+// RootUser. The requests denied never reach h, so they are never proposed.
+//
+// With certAuth, a request without credentials is made by the user named
+// after the common name of its verified client certificate, if there is
+// such a user.
+func NewAuthHandler(h http.Handler, users etcdserver.UserStore, certAuth bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == healthPath || r.URL.Path == metricsPath:
+		case r.URL.Path == usersPath && r.Method == "POST" && len(users.Names()) == 0:
+			// serveUsers only creates RootUser first
+		default:
+			name, ok := authenticate(r, users, certAuth)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="etcd"`)
+				writeError(w, etcdErr.NewRequestError(etcdErr.EcodeUnauthorized, ""))
+				return
+			}
+			ok, err := permitted(users, name, r)
+			if isTooLarge(err) {
+				writeError(w, errRequestTooLarge)
+				return
+			}
+			if !ok {
+				writeError(w, etcdErr.NewRequestError(etcdErr.EcodeForbidden, name))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the user r is made by, and whether it is
+// authenticated.
+func authenticate(r *http.Request, users etcdserver.UserStore, certAuth bool) (string, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		return name, users.Authenticate(name, password)
+	}
+	if !certAuth || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	names := users.Names()
+	i := sort.SearchStrings(names, name)
+	return name, i < len(names) && names[i] == name
+}
+
+// permitted tells whether the user name may make r. The keys need the
+// permission of a role, on every key compared or written for a
+// transaction. The members and the versions are listed to anyone, and the
+// rest, such as the users and the roles themselves, is left to RootUser.
+// The error is the one reading the body of a transaction, which is denied.
+func permitted(users etcdserver.UserStore, name string, r *http.Request) (bool, error) {
+	p := r.URL.Path
+	switch {
+	case name == etcdserver.RootUser:
+		return true, nil
+	case p == keysPrefix || strings.HasPrefix(p, keysPrefix+"/"):
+		key := p[len(keysPrefix):]
+		// the users and their password hashes would be listed along with
+		// the hidden keys of an ancestor of the keys of etcd itself. The
+		// other listings and the watches leave the hidden keys out.
+		if hidden, _ := strconv.ParseBool(r.URL.Query().Get("hidden")); hidden && etcdserver.HiddenUnder(key) {
+			return false, nil
+		}
+		write := r.Method != "GET" && r.Method != "HEAD"
+		return users.Permitted(name, key, write), nil
+	case p == txnPath:
+		// the body is read ahead of serveTxn, which reads it again; a
+		// body it would not parse is denied rather than let through.
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return false, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		var tr txnRequest
+		if err := json.NewDecoder(bytes.NewReader(b)).Decode(&tr); err != nil {
+			return false, nil
+		}
+		for _, c := range tr.Compare {
+			if !users.Permitted(name, c.Key, false) {
+				return false, nil
+			}
+		}
+		for _, op := range append(tr.Success, tr.Failure...) {
+			if !users.Permitted(name, op.Key, true) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case p == machinesPrefix || p == membersPath || p == versionPath:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// accessLogWriter records the status and the applied raft index of the
+// response written through it.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	index       int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// setAppliedIndex records the raft index a request was applied at, if the
+// response is written through the access log.
+func setAppliedIndex(w http.ResponseWriter, index int64) {
+	if aw, ok := w.(*accessLogWriter); ok {
+		aw.index = index
+	}
+}
+
 // serverHandler provides http.Handlers for etcd client and raft communication.
 type serverHandler struct {
 	timeout      time.Duration
 	server       etcdserver.Server
 	timer        etcdserver.RaftTimer
+	health       etcdserver.HealthReporter
+	raftStatus   etcdserver.RaftStatusReporter
+	leaderStats  etcdserver.LeaderStatsReporter
+	storeStats   etcdserver.StoreStatsReporter
+	snapshots    etcdserver.SnapshotTaker
+	backups      etcdserver.BackupTaker
+	versions     etcdserver.VersionReporter
 	clusterStore etcdserver.ClusterStore
+	users        etcdserver.UserStore
+	// id is the raft ID of the member, to tell whether it is the leader
+	id        int64
+	writeMode WriteMode
+}
+
+// leaderWrites wraps serve so that the requests that write are refused
+// with 503 while the cluster has no leader, rather than waiting for the
+// timeout, and are redirected to the leader in WriteRedirect mode.
+func (h serverHandler) leaderWrites(serve http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT", "POST", "DELETE":
+		default:
+			serve(w, r)
+			return
+		}
+		lead := h.health.Leader()
+		if lead == raft.None {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeLeaderElect, "no leader"))
+			return
+		}
+		if h.writeMode != WriteRedirect {
+			serve(w, r)
+			return
+		}
+		m := h.clusterStore.Get().FindID(lead)
+		switch {
+		case m == nil || len(m.ClientURLs) == 0:
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeLeaderElect, "unknown leader"))
+		case m.ID == h.id:
+			serve(w, r)
+		default:
+			u := m.ClientURLs[0] + r.URL.Path
+			if r.URL.RawQuery != "" {
+				u += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		}
+	}
 }
 
 func (h serverHandler) serveKeys(w http.ResponseWriter, r *http.Request) {
@@ -79,26 +441,50 @@ func (h serverHandler) serveKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
-	defer cancel()
-
 	rr, err := parseRequest(r, etcdserver.GenID())
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	timeout, err := h.requestTimeout(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
 	resp, err := h.server.Do(ctx, rr)
+	// the raft index and term are sent on the errors too, so that a client
+	// knows how far the member is in any case
+	writeRaftHeaders(w, h.timer)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	setAppliedIndex(w, resp.Index)
 
 	switch {
 	case resp.Event != nil:
+		if r.Method == "GET" && rr.Since > resp.Event.EtcdIndex {
+			// a waitIndex without wait asks for a store at that index at
+			// least; the member is behind it, so the client may read
+			// again later or from another member
+			w.Header().Set("X-Etcd-Behind", "true")
+		}
+		if r.Method == "GET" {
+			etag := nodeETag(resp.Event.Node)
+			w.Header().Set("ETag", etag)
+			if etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Set("X-Etcd-Index", fmt.Sprint(resp.Event.EtcdIndex))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 		if err := writeEvent(w, resp.Event, h.timer); err != nil {
 			// Should never be reached
-			log.Printf("error writing event: %v", err)
+			logger.Errorf("error writing event: %v", err)
 		}
 	case resp.Watcher != nil:
 		ctx, cancel := context.WithTimeout(context.Background(), defaultWatchTimeout)
@@ -109,14 +495,569 @@ func (h serverHandler) serveKeys(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveMachines responds address list in the format '0.0.0.0, 1.1.1.1'.
-// TODO: rethink the format of machine list because it is not json format.
+// requestTimeout returns how long the request may wait for the cluster: the
+// duration given by its "timeout" form value, like "500ms", if any, capped
+// by the timeout of the server.
+func (h serverHandler) requestTimeout(r *http.Request) (time.Duration, error) {
+	s := r.FormValue("timeout")
+	if s == "" {
+		return h.timeout, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, etcdErr.NewRequestError(
+			etcdErr.EcodeTimeoutNaN,
+			`invalid value for "timeout"`,
+		)
+	}
+	if d > h.timeout {
+		d = h.timeout
+	}
+	return d, nil
+}
+
+// txnRequest is the body of a request to txnPath. It is a store.Txn, except
+// that the operations give their time to live in seconds.
+type txnRequest struct {
+	Compare []store.Compare `json:"compare"`
+	Success []txnOp         `json:"success"`
+	Failure []txnOp         `json:"failure"`
+}
+
+type txnOp struct {
+	Action    string  `json:"action"`
+	Key       string  `json:"key"`
+	Value     string  `json:"value"`
+	Dir       bool    `json:"dir"`
+	Recursive bool    `json:"recursive"`
+	TTL       *uint64 `json:"ttl"`
+}
+
+// serveTxn applies the transaction in the JSON body of the request in a
+// single raft proposal, and responds which branch was taken along with the
+// result of each of its operations.
+func (h serverHandler) serveTxn(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST") {
+		return
+	}
+
+	rr, err := parseTxnRequest(r, etcdserver.GenID())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	timeout, err := h.requestTimeout(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := h.server.Do(ctx, rr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setAppliedIndex(w, resp.Index)
+	if resp.Txn == nil {
+		writeError(w, errors.New("received response with no Txn!"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(resp.Txn.EtcdIndex))
+	writeRaftHeaders(w, h.timer)
+	if err := json.NewEncoder(w).Encode(resp.Txn); err != nil {
+		logger.Errorf("etcdhttp: error writing txn response: %v", err)
+	}
+}
+
+// parseTxnRequest converts the body of a request to txnPath into a "TXN"
+// etcdserverpb.Request carrying the store.Txn in its Val.
+func parseTxnRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
+	emptyReq := etcdserverpb.Request{}
+
+	var tr txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+		if isTooLarge(err) {
+			return emptyReq, errRequestTooLarge
+		}
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidForm,
+			fmt.Sprintf("invalid transaction: %v", err),
+		)
+	}
+
+	t := store.Txn{Compare: tr.Compare}
+	for _, c := range tr.Compare {
+		if c.Key == "" {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				"comparison without a key",
+			)
+		}
+	}
+	var err error
+	if t.Success, err = txnOps(tr.Success); err != nil {
+		return emptyReq, err
+	}
+	if t.Failure, err = txnOps(tr.Failure); err != nil {
+		return emptyReq, err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return emptyReq, err
+	}
+	return etcdserverpb.Request{
+		ID:     id,
+		Method: "TXN",
+		Val:    string(b),
+	}, nil
+}
+
+func txnOps(tops []txnOp) ([]store.Op, error) {
+	var ops []store.Op
+	for _, top := range tops {
+		if top.Action != store.Set && top.Action != store.Delete {
+			return nil, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				fmt.Sprintf(`invalid action %q, want "set" or "delete"`, top.Action),
+			)
+		}
+		if top.Key == "" {
+			return nil, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				"operation without a key",
+			)
+		}
+		op := store.Op{
+			Action:    top.Action,
+			Key:       top.Key,
+			Value:     top.Value,
+			Dir:       top.Dir,
+			Recursive: top.Recursive,
+		}
+		// the expiration time is fixed here, so that all the members
+		// apply the same one
+		if top.TTL != nil {
+			op.ExpireTime = time.Now().Add(time.Duration(*top.TTL) * time.Second)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// serveMachines responds the sorted client URLs of the current members,
+// for the clients to balance their requests, in the format
+// 'http://1.1.1.1:4001, http://2.2.2.2:4001' the older clients expect, or
+// as a JSON array if the request accepts application/json. The members
+// that have not published their client URLs yet are left out.
 func (h serverHandler) serveMachines(w http.ResponseWriter, r *http.Request) {
 	if !allowMethod(w, r.Method, "GET", "HEAD") {
 		return
 	}
 	endpoints := h.clusterStore.Get().ClientURLs()
-	w.Write([]byte(strings.Join(endpoints, ", ")))
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.Join(endpoints, ", ")))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(endpoints); err != nil {
+		logger.Errorf("etcdhttp: error writing machines: %v", err)
+	}
+}
+
+type members struct {
+	// Leader is the ID of the leader known by the member serving the
+	// list, or raft.None if it knows none.
+	Leader  int64               `json:"leader"`
+	Members []etcdserver.Member `json:"members"`
+}
+
+// serveMembers responds the members of the cluster, sorted by ID, along
+// with the current leader.
+func (h serverHandler) serveMembers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD") {
+		return
+	}
+	cl := h.clusterStore.Get()
+	ms := members{Leader: h.health.Leader(), Members: []etcdserver.Member{}}
+	for _, id := range cl.IDs() {
+		ms.Members = append(ms.Members, *cl.FindID(id))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ms); err != nil {
+		logger.Errorf("etcdhttp: error writing members: %v", err)
+	}
+}
+
+type health struct {
+	Health string `json:"health"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// serveHealth responds 200 if the member knows the leader and has applied
+// entries recently, and 503 along with the reason otherwise.
+func (h serverHandler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD") {
+		return
+	}
+	hl := health{Health: "true"}
+	code := http.StatusOK
+	switch {
+	case !h.health.Replayed():
+		hl = health{Health: "false", Reason: "replaying the log"}
+		code = http.StatusServiceUnavailable
+	case h.health.Leader() == raft.None:
+		hl = health{Health: "false", Reason: "no leader"}
+		code = http.StatusServiceUnavailable
+	case time.Since(h.health.LastApply()) > healthApplyWindow:
+		hl = health{Health: "false", Reason: "behind the leader"}
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(hl); err != nil {
+		logger.Errorf("etcdhttp: error writing health: %v", err)
+	}
+}
+
+// serveRaftStatus responds the state of the raft node of the member. It
+// holds no key, but it is only served to RootUser when auth is enabled.
+func (h serverHandler) serveRaftStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.raftStatus.RaftStatus()); err != nil {
+		logger.Errorf("etcdhttp: error writing raft status: %v", err)
+	}
+}
+
+// serveVersion responds the version of etcd the member runs, and the version
+// of its cluster, to check their compatibility during a rolling upgrade.
+func (h serverHandler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.versions.Versions()); err != nil {
+		logger.Errorf("etcdhttp: error writing versions: %v", err)
+	}
+}
+
+// serveLeaderStats responds the counts and the latency of the raft messages
+// the leader sent to each follower. A member that is not the leader
+// redirects to the leader, or responds 503 if it knows none.
+func (h serverHandler) serveLeaderStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD") {
+		return
+	}
+	ls, ok := h.leaderStats.LeaderStats()
+	if !ok {
+		m := h.clusterStore.Get().FindID(h.health.Leader())
+		if m == nil || len(m.ClientURLs) == 0 {
+			writeError(w, etcdserver.ErrNoLeader)
+			return
+		}
+		http.Redirect(w, r, m.ClientURLs[0]+statsLeaderPath, http.StatusTemporaryRedirect)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ls); err != nil {
+		logger.Errorf("etcdhttp: error writing leader stats: %v", err)
+	}
+}
+
+// serveStoreStats responds the counts of the operations on the store of
+// the member. A POST or DELETE also sets them back to zero, so that a GET,
+// which proxies and monitoring may repeat at will, never changes them.
+func (h serverHandler) serveStoreStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "HEAD", "POST", "DELETE") {
+		return
+	}
+	reset := r.Method == "POST" || r.Method == "DELETE"
+	if _, ok := r.URL.Query()["reset"]; ok && !reset {
+		// the counters used to be reset by a GET with reset=true
+		allowMethod(w, r.Method, "POST", "DELETE")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.storeStats.StoreStats(reset))
+}
+
+// serveMetrics responds the metrics collected by the server in the
+// Prometheus text exposition format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET") {
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// serveAdminSnapshot takes a snapshot of the member at once, rather than
+// after the next snapshot-count entries, and responds where it was saved.
+func (h serverHandler) serveAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	info, err := h.snapshots.TakeSnapshot(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		logger.Errorf("etcdhttp: error writing snapshot info: %v", err)
+	}
+}
+
+// serveAdminBackup streams the state of the store at the index the member
+// applied, as the data of its snapshots holds it, to be saved to a file.
+// The index is sent in the X-Raft-Index header.
+func (h serverHandler) serveAdminBackup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	b, err := h.backups.Backup(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="etcd-backup-%d.json"`, b.Index))
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(b.Store.Index()))
+	w.Header().Set("X-Raft-Index", fmt.Sprint(b.Index))
+	if err := b.Store.SaveTo(w); err != nil {
+		logger.Errorf("etcdhttp: error writing backup: %v", err)
+	}
+}
+
+// serveAdminMembers adds a member to the cluster on POST, and removes the
+// member whose hex ID is at the end of the path on DELETE.
+func (h serverHandler) serveAdminMembers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST", "DELETE") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	switch r.Method {
+	case "POST":
+		if r.URL.Path != adminMembersPrefix {
+			notFound(w, r)
+			return
+		}
+		var m etcdserver.Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "error decoding member: "+err.Error()))
+			return
+		}
+		urls, err := types.NewURLs(m.PeerURLs)
+		if err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "invalid peer URLs: "+err.Error()))
+			return
+		}
+		if m.ID == 0 {
+			now := time.Now()
+			m = *etcdserver.NewMember(m.Name, urls, &now)
+		}
+		if err := h.server.AddMember(ctx, m); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(m); err != nil {
+			logger.Errorf("etcdhttp: error writing member: %v", err)
+		}
+	case "DELETE":
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, adminMembersPrefix+"/"), 16, 64)
+		if err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "invalid member ID"))
+			return
+		}
+		if err := h.server.RemoveMember(ctx, int64(id)); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveUsers lists the names of the users on GET, creates the user whose
+// name and password are given in the JSON body on POST, and removes the
+// user whose name is at the end of the path on DELETE. The first user
+// created must be RootUser. On PUT to the roles of a user, it replaces
+// them with the names given in the JSON body.
+func (h serverHandler) serveUsers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "POST", "PUT", "DELETE") {
+		return
+	}
+	var name string
+	switch r.Method {
+	case "GET", "POST":
+		if r.URL.Path != usersPath {
+			notFound(w, r)
+			return
+		}
+	case "PUT":
+		p := strings.TrimPrefix(r.URL.Path, usersPath+"/")
+		if !strings.HasSuffix(p, "/roles") || p == r.URL.Path {
+			notFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(p, "/roles")
+	case "DELETE":
+		name = strings.TrimPrefix(r.URL.Path, usersPath+"/")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		names := h.users.Names()
+		if names == nil {
+			names = []string{}
+		}
+		if err := json.NewEncoder(w).Encode(struct {
+			Users []string `json:"users"`
+		}{names}); err != nil {
+			logger.Errorf("etcdhttp: error writing users: %v", err)
+		}
+	case "POST":
+		var req struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "error decoding user: "+err.Error()))
+			return
+		}
+		if req.Name != etcdserver.RootUser && len(h.users.Names()) == 0 {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "the first user must be "+etcdserver.RootUser))
+			return
+		}
+		u, err := etcdserver.NewUser(req.Name, req.Password)
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		if err := h.server.AddUser(ctx, u); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PUT":
+		var req struct {
+			Roles []string `json:"roles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "error decoding roles: "+err.Error()))
+			return
+		}
+		if err := h.server.SetUserRoles(ctx, name, req.Roles); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if err := h.server.RemoveUser(ctx, name); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveRoles lists the roles on GET, and creates or replaces on PUT, or
+// removes on DELETE, the role whose name is at the end of the path. The
+// body of a PUT gives the prefixes of the keys the role grants to read and
+// to write, as in {"read":["/app"],"write":[]}.
+func (h serverHandler) serveRoles(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "GET", "PUT", "DELETE") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, rolesPath+"/")
+	if (r.Method == "GET") != (r.URL.Path == rolesPath) {
+		notFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		roles := h.users.Roles()
+		if roles == nil {
+			roles = []etcdserver.Role{}
+		}
+		if err := json.NewEncoder(w).Encode(struct {
+			Roles []etcdserver.Role `json:"roles"`
+		}{roles}); err != nil {
+			logger.Errorf("etcdhttp: error writing roles: %v", err)
+		}
+	case "PUT":
+		rl := etcdserver.Role{Name: name}
+		if err := json.NewDecoder(r.Body).Decode(&rl); err != nil {
+			writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "error decoding role: "+err.Error()))
+			return
+		}
+		rl.Name = name
+		if err := h.server.SetRole(ctx, rl); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if err := h.server.RemoveRole(ctx, name); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeUserError writes the error of a change of the users or the roles
+// to w.
+func writeUserError(w http.ResponseWriter, err error) {
+	switch err {
+	case etcdserver.ErrInvalidUser, etcdserver.ErrInvalidRole:
+		writeError(w, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, err.Error()))
+	case etcdserver.ErrUserExists, etcdserver.ErrRemoveRoot:
+		writeError(w, etcdErr.NewRequestError(etcdErr.EcodeConflict, err.Error()))
+	case etcdserver.ErrUserNotFound, etcdserver.ErrRoleNotFound:
+		writeError(w, etcdErr.NewRequestError(etcdErr.EcodeNotFound, err.Error()))
+	default:
+		writeError(w, err)
+	}
+}
+
+// writeMemberError writes the error of a membership change to w.
+func writeMemberError(w http.ResponseWriter, err error) {
+	switch err {
+	case etcdserver.ErrIDExists, etcdserver.ErrLastMember:
+		writeError(w, etcdErr.NewRequestError(etcdErr.EcodeConflict, err.Error()))
+	case etcdserver.ErrIDNotFound:
+		writeError(w, etcdErr.NewRequestError(etcdErr.EcodeNotFound, err.Error()))
+	default:
+		writeError(w, err)
+	}
 }
 
 func (h serverHandler) serveRaft(w http.ResponseWriter, r *http.Request) {
@@ -126,19 +1067,108 @@ func (h serverHandler) serveRaft(w http.ResponseWriter, r *http.Request) {
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("etcdhttp: error reading raft message:", err)
+		logger.Errorf("etcdhttp: error reading raft message: %v", err)
 		http.Error(w, "error reading raft message", http.StatusBadRequest)
 		return
 	}
 	var m raftpb.Message
 	if err := m.Unmarshal(b); err != nil {
-		log.Println("etcdhttp: error unmarshaling raft message:", err)
+		logger.Errorf("etcdhttp: error unmarshaling raft message: %v", err)
+		http.Error(w, "error unmarshaling raft message", http.StatusBadRequest)
+		return
+	}
+	logger.Debugf("etcdhttp: raft recv message from %#x: %+v", m.From, m)
+	if err := h.server.Process(context.TODO(), m); err != nil {
+		logger.Errorf("etcdhttp: error processing raft message: %v", err)
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRaftStream receives the messages a peer streams as the body of a
+// single request, each framed by transport.WriteFrame, until the peer
+// closes the stream. The response headers are sent at once to tell the
+// peer the stream is accepted. The response body then carries an empty
+// frame for each message processed, for the peer to measure its latency.
+func (h serverHandler) serveRaftStream(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST") {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// keep reading the stream once the response is started, and past the
+	// read timeout of the server. Both fail only on connections that need
+	// neither, like HTTP/2 ones.
+	rc.EnableFullDuplex()
+	rc.SetReadDeadline(time.Time{})
+	w.Header().Set(raftStreamAckHeader, "1")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Errorf("etcdhttp: error starting raft stream: %v", err)
+		return
+	}
+
+	br := bufio.NewReader(r.Body)
+	bw := bufio.NewWriter(w)
+	for {
+		b, err := transport.ReadFrame(br)
+		if err != nil {
+			if err != io.EOF {
+				logger.Infof("etcdhttp: raft stream from %s closed: %v", r.RemoteAddr, err)
+			}
+			return
+		}
+		var m raftpb.Message
+		if err := m.Unmarshal(b); err != nil {
+			logger.Errorf("etcdhttp: error unmarshaling raft message: %v", err)
+			return
+		}
+		logger.Debugf("etcdhttp: raft recv message from %#x: %+v", m.From, m)
+		if err := h.server.Process(context.TODO(), m); err != nil {
+			logger.Errorf("etcdhttp: error processing raft message: %v", err)
+			return
+		}
+		// ack the messages processed once no more are buffered, like the
+		// sender flushes them
+		if err := transport.WriteFrame(bw, nil); err != nil {
+			return
+		}
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
+
+// serveSnapshot receives a snapshot message whose snapshot data is streamed
+// as the request body, and hands it to raft, which installs it.
+func (h serverHandler) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST") {
+		return
+	}
+
+	b, err := base64.StdEncoding.DecodeString(r.Header.Get(raftMessageHeader))
+	if err != nil {
+		http.Error(w, "error decoding raft message", http.StatusBadRequest)
+		return
+	}
+	var m raftpb.Message
+	if err := m.Unmarshal(b); err != nil {
+		logger.Errorf("etcdhttp: error unmarshaling raft message: %v", err)
 		http.Error(w, "error unmarshaling raft message", http.StatusBadRequest)
 		return
 	}
-	log.Printf("etcdhttp: raft recv message from %#x: %+v", m.From, m)
+	if m.Snapshot.Data, err = ioutil.ReadAll(r.Body); err != nil {
+		logger.Errorf("etcdhttp: error reading snapshot: %v", err)
+		http.Error(w, "error reading snapshot", http.StatusBadRequest)
+		return
+	}
+	logger.Infof("etcdhttp: raft recv snapshot at index %d from %#x", m.Snapshot.Index, m.From)
 	if err := h.server.Process(context.TODO(), m); err != nil {
-		log.Println("etcdhttp: error processing raft message:", err)
+		logger.Errorf("etcdhttp: error processing raft message: %v", err)
 		writeError(w, err)
 		return
 	}
@@ -152,6 +1182,9 @@ func parseRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
 	emptyReq := etcdserverpb.Request{}
 
 	err := r.ParseForm()
+	if isTooLarge(err) {
+		return emptyReq, errRequestTooLarge
+	}
 	if err != nil {
 		return emptyReq, etcdErr.NewRequestError(
 			etcdErr.EcodeInvalidForm,
@@ -181,7 +1214,7 @@ func parseRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
 		)
 	}
 
-	var rec, sort, wait, dir, stream bool
+	var rec, sort, wait, dir, stream, quorum, refresh, hidden, delRange bool
 	if rec, err = getBool(r.Form, "recursive"); err != nil {
 		return emptyReq, etcdErr.NewRequestError(
 			etcdErr.EcodeInvalidField,
@@ -214,6 +1247,60 @@ func parseRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
 		)
 	}
 
+	if quorum, err = getBool(r.Form, "quorum"); err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "quorum"`,
+		)
+	}
+
+	// recursive listings are always sorted by key, so that they are stable
+	if rec && r.Method == "GET" {
+		sort = true
+	}
+
+	if refresh, err = getBool(r.Form, "refresh"); err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "refresh"`,
+		)
+	}
+
+	// hidden keys, whose names start with '_', are left out of directory
+	// listings unless asked for
+	if hidden, err = getBool(r.Form, "hidden"); err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "hidden"`,
+		)
+	}
+	if hidden && (r.Method != "GET" || wait) {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`"hidden" can only be used with GET requests that do not wait`,
+		)
+	}
+
+	// a range deletion empties a directory at once, keeping it
+	if delRange, err = getBool(r.Form, "range"); err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "range"`,
+		)
+	}
+	if delRange && r.Method != "DELETE" {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`"range" can only be used with DELETE requests`,
+		)
+	}
+	if delRange && (r.FormValue("prevValue") != "" || r.FormValue("prevIndex") != "") {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`"range" cannot be used with "prevValue" or "prevIndex"`,
+		)
+	}
+
 	if wait && r.Method != "GET" {
 		return emptyReq, etcdErr.NewRequestError(
 			etcdErr.EcodeInvalidField,
@@ -256,6 +1343,45 @@ func parseRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
 		pe = &bv
 	}
 
+	// an explicit prevIndex of 0 means that the key must not exist
+	if _, ok := r.Form["prevIndex"]; ok && pIdx == 0 {
+		switch {
+		case r.Method != "PUT":
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"prevIndex" of 0 can only be used with PUT requests`,
+			)
+		case pe != nil && *pe, pV != "":
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"prevIndex" of 0 requires the key not to exist`,
+			)
+		}
+		notExist := false
+		pe = &notExist
+	}
+
+	// refreshing only updates the TTL of an existing key
+	if refresh {
+		switch {
+		case r.Method != "PUT":
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"refresh" can only be used with PUT requests`,
+			)
+		case pe == nil || !*pe:
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"refresh" requires "prevExist" to be true`,
+			)
+		case r.FormValue("value") != "":
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"value" cannot be set when refreshing`,
+			)
+		}
+	}
+
 	rr := etcdserverpb.Request{
 		ID:        id,
 		Method:    r.Method,
@@ -270,6 +1396,10 @@ func parseRequest(r *http.Request, id int64) (etcdserverpb.Request, error) {
 		Sorted:    sort,
 		Stream:    stream,
 		Wait:      wait,
+		Quorum:    quorum,
+		Refresh:   refresh,
+		Hidden:    hidden,
+		Range:     delRange,
 	}
 
 	if pe != nil {
@@ -316,12 +1446,42 @@ func writeError(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
 	}
-	log.Println(err)
-	if e, ok := err.(*etcdErr.Error); ok {
-		e.Write(w)
-	} else {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	logger.Debugf("etcdhttp: %v", err)
+	e, ok := err.(*etcdErr.Error)
+	if !ok {
+		e = toEtcdError(err)
+	}
+	if err == etcdserver.ErrTooManyRequests {
+		// the proposals in flight are usually applied within a second
+		w.Header().Set("Retry-After", "1")
+	}
+	e.Write(w)
+}
+
+// toEtcdError returns the etcd error a client is responded with for err,
+// so that the clients always get an error code rather than a message.
+func toEtcdError(err error) *etcdErr.Error {
+	switch err {
+	case etcdserver.ErrNoLeader:
+		// the request was not applied, and may be tried again
+		return etcdErr.NewRequestError(etcdErr.EcodeLeaderElect, "no leader; try later")
+	case context.DeadlineExceeded:
+		return etcdErr.NewRequestError(etcdErr.EcodeTimeout, "")
+	case context.Canceled:
+		return etcdErr.NewRequestError(etcdErr.EcodeCanceled, "")
+	case errRequestTooLarge:
+		return etcdErr.NewRequestError(etcdErr.EcodeRequestTooLarge, "")
+	case etcdserver.ErrTooManyRequests:
+		return etcdErr.NewRequestError(etcdErr.EcodeTooManyRequests, "")
+	case etcdserver.ErrNothingApplied:
+		return etcdErr.NewRequestError(etcdErr.EcodeNothingApplied, "")
+	case etcdserver.ErrClusterVersion:
+		// until every member of the cluster is upgraded
+		return etcdErr.NewRequestError(etcdErr.EcodeClusterVersion, "")
 	}
+	// the text of an internal error is for the logs, not for the clients
+	logger.Errorf("etcdhttp: internal error: %v", err)
+	return etcdErr.NewRequestError(etcdErr.EcodeRaftInternal, "")
 }
 
 // writeEvent serializes a single Event and writes the resulting
@@ -333,8 +1493,7 @@ func writeEvent(w http.ResponseWriter, ev *store.Event, rt etcdserver.RaftTimer)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Etcd-Index", fmt.Sprint(ev.EtcdIndex))
-	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
-	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+	writeRaftHeaders(w, rt)
 
 	if ev.IsCreated() {
 		w.WriteHeader(http.StatusCreated)
@@ -343,6 +1502,54 @@ func writeEvent(w http.ResponseWriter, ev *store.Event, rt etcdserver.RaftTimer)
 	return json.NewEncoder(w).Encode(ev)
 }
 
+// writeRaftHeaders sets the raft index and term the member is at, which a
+// client may wait for on another member to read its own writes.
+func writeRaftHeaders(w http.ResponseWriter, rt etcdserver.RaftTimer) {
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+}
+
+// nodeETag returns the ETag of the node n as got. It is weak, as the TTL in
+// the body of the response counts down while the node is unchanged. The ETag
+// of a key is its modifiedIndex. The one of a directory covers the greatest
+// modifiedIndex of the nodes listed in it, which any write under it bumps,
+// and their number, which the deletions lower.
+func nodeETag(n *store.NodeExtern) string {
+	if !n.Dir {
+		return fmt.Sprintf(`W/"%d"`, n.ModifiedIndex)
+	}
+	var max uint64
+	var count int
+	var walk func(n *store.NodeExtern)
+	walk = func(n *store.NodeExtern) {
+		if n.ModifiedIndex > max {
+			max = n.ModifiedIndex
+		}
+		count++
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(n)
+	return fmt.Sprintf(`W/"%d-%d"`, max, count)
+}
+
+// etagMatch reports whether the If-None-Match header value h matches etag,
+// comparing the ETags weakly.
+func etagMatch(h, etag string) bool {
+	if h == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func handleWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher, stream bool, rt etcdserver.RaftTimer) {
 	defer wa.Remove()
 	ech := wa.EventChan()
@@ -352,8 +1559,7 @@ func handleWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher, s
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
-	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+	writeRaftHeaders(w, rt)
 	w.WriteHeader(http.StatusOK)
 
 	// Ensure headers are flushed early, in case of long polling
@@ -376,7 +1582,7 @@ func handleWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher, s
 			}
 			if err := json.NewEncoder(w).Encode(ev); err != nil {
 				// Should never be reached
-				log.Println("error writing event: %v", err)
+				logger.Errorf("error writing event: %v", err)
 				return
 			}
 			if !stream {
@@ -397,6 +1603,11 @@ func allowMethod(w http.ResponseWriter, m string, ms ...string) bool {
 		}
 	}
 	w.Header().Set("Allow", strings.Join(ms, ","))
-	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	writeError(w, etcdErr.NewRequestError(etcdErr.EcodeMethodNotAllowed, m))
 	return false
 }
+
+// notFound responds that there is nothing at the path of r.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, etcdErr.NewRequestError(etcdErr.EcodeNotFound, r.URL.Path))
+}
@@ -2,21 +2,33 @@ package etcdhttp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	etcdErr "github.com/coreos/etcd/error"
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/store"
 	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
@@ -123,6 +135,10 @@ func TestBadParseRequest(t *testing.T) {
 			mustNewForm(t, "foo", url.Values{"sorted": []string{"x"}}),
 			etcdErr.EcodeInvalidField,
 		},
+		{
+			mustNewForm(t, "foo", url.Values{"quorum": []string{"maybe"}}),
+			etcdErr.EcodeInvalidField,
+		},
 		{
 			mustNewForm(t, "foo", url.Values{"wait": []string{"?!"}}),
 			etcdErr.EcodeInvalidField,
@@ -165,6 +181,66 @@ func TestBadParseRequest(t *testing.T) {
 			mustNewMethodRequest(t, "HEAD", "foo?wait=true"),
 			etcdErr.EcodeInvalidField,
 		},
+		// prevIndex of 0 only makes sense for PUT on a key that does not exist
+		{
+			mustNewMethodRequest(t, "DELETE", "foo?prevIndex=0"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewForm(t, "foo", url.Values{"prevIndex": []string{"0"}, "prevExist": []string{"true"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewForm(t, "foo", url.Values{"prevIndex": []string{"0"}, "prevValue": []string{"bar"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		// refresh is only valid with PUT requests on existing keys, without value
+		{
+			mustNewForm(t, "foo", url.Values{"refresh": []string{"nope"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewRequest(t, "foo?refresh=true&prevExist=true"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewForm(t, "foo", url.Values{"refresh": []string{"true"}, "ttl": []string{"10"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewForm(t, "foo", url.Values{"refresh": []string{"true"}, "prevExist": []string{"true"}, "value": []string{"bar"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		// hidden is only valid with GET requests that do not wait
+		{
+			mustNewRequest(t, "foo?hidden=nope"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewForm(t, "foo", url.Values{"hidden": []string{"true"}}),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewRequest(t, "foo?hidden=true&wait=true"),
+			etcdErr.EcodeInvalidField,
+		},
+		// range is only valid with DELETE requests that do not compare
+		{
+			mustNewMethodRequest(t, "DELETE", "foo?range=nope"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewRequest(t, "foo?range=true"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewMethodRequest(t, "DELETE", "foo?range=true&prevValue=bar"),
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			mustNewMethodRequest(t, "DELETE", "foo?range=true&prevIndex=3"),
+			etcdErr.EcodeInvalidField,
+		},
 		// query values are considered
 		{
 			mustNewRequest(t, "foo?prevExist=wrong"),
@@ -269,6 +345,38 @@ func TestGoodParseRequest(t *testing.T) {
 				Path:      "/foo",
 			},
 		},
+		{
+			// recursive GET is sorted
+			mustNewRequest(t, "foo?recursive=true"),
+			etcdserverpb.Request{
+				ID:        1234,
+				Method:    "GET",
+				Recursive: true,
+				Sorted:    true,
+				Path:      "/foo",
+			},
+		},
+		{
+			mustNewRequest(t, "foo?recursive=true&hidden=true"),
+			etcdserverpb.Request{
+				ID:        1234,
+				Method:    "GET",
+				Recursive: true,
+				Sorted:    true,
+				Hidden:    true,
+				Path:      "/foo",
+			},
+		},
+		{
+			mustNewMethodRequest(t, "DELETE", "foo?recursive=true&range=true"),
+			etcdserverpb.Request{
+				ID:        1234,
+				Method:    "DELETE",
+				Recursive: true,
+				Range:     true,
+				Path:      "/foo",
+			},
+		},
 		{
 			// sorted specified
 			mustNewForm(
@@ -283,6 +391,16 @@ func TestGoodParseRequest(t *testing.T) {
 				Path:   "/foo",
 			},
 		},
+		{
+			// quorum specified
+			mustNewRequest(t, "foo?quorum=true"),
+			etcdserverpb.Request{
+				ID:     1234,
+				Method: "GET",
+				Quorum: true,
+				Path:   "/foo",
+			},
+		},
 		{
 			// wait specified
 			mustNewRequest(t, "foo?wait=true"),
@@ -351,6 +469,34 @@ func TestGoodParseRequest(t *testing.T) {
 				Path:      "/foo",
 			},
 		},
+		{
+			// prevIndex of 0 means the key must not exist
+			mustNewForm(
+				t,
+				"foo",
+				url.Values{"prevIndex": []string{"0"}},
+			),
+			etcdserverpb.Request{
+				ID:        1234,
+				Method:    "PUT",
+				PrevExist: boolp(false),
+				Path:      "/foo",
+			},
+		},
+		{
+			mustNewForm(
+				t,
+				"foo",
+				url.Values{"refresh": []string{"true"}, "prevExist": []string{"true"}},
+			),
+			etcdserverpb.Request{
+				ID:        1234,
+				Method:    "PUT",
+				PrevExist: boolp(true),
+				Refresh:   true,
+				Path:      "/foo",
+			},
+		},
 		// mix various fields
 		{
 			mustNewForm(
@@ -467,23 +613,88 @@ func TestWriteError(t *testing.T) {
 	}
 
 	tests := []struct {
-		err   error
-		wcode int
-		wi    string
+		err    error
+		wcode  int
+		wecode int
+		wi     string
 	}{
 		{
 			etcdErr.NewError(etcdErr.EcodeKeyNotFound, "/foo/bar", 123),
 			http.StatusNotFound,
+			etcdErr.EcodeKeyNotFound,
 			"123",
 		},
 		{
 			etcdErr.NewError(etcdErr.EcodeTestFailed, "/foo/bar", 456),
 			http.StatusPreconditionFailed,
+			etcdErr.EcodeTestFailed,
 			"456",
 		},
 		{
-			err:   errors.New("something went wrong"),
-			wcode: http.StatusInternalServerError,
+			etcdErr.NewError(etcdErr.EcodeNodeExist, "/foo/bar", 12),
+			http.StatusPreconditionFailed,
+			etcdErr.EcodeNodeExist,
+			"12",
+		},
+		{
+			etcdErr.NewError(etcdErr.EcodeNotFile, "/foo", 34),
+			http.StatusForbidden,
+			etcdErr.EcodeNotFile,
+			"34",
+		},
+		{
+			etcdErr.NewError(etcdErr.EcodeQuotaExceeded, "", 789),
+			http.StatusInsufficientStorage,
+			etcdErr.EcodeQuotaExceeded,
+			"789",
+		},
+		{
+			errors.New("something went wrong"),
+			http.StatusInternalServerError,
+			etcdErr.EcodeRaftInternal,
+			"0",
+		},
+		{
+			context.DeadlineExceeded,
+			http.StatusGatewayTimeout,
+			etcdErr.EcodeTimeout,
+			"0",
+		},
+		{
+			context.Canceled,
+			http.StatusServiceUnavailable,
+			etcdErr.EcodeCanceled,
+			"0",
+		},
+		{
+			etcdserver.ErrTooManyRequests,
+			http.StatusTooManyRequests,
+			etcdErr.EcodeTooManyRequests,
+			"0",
+		},
+		{
+			errRequestTooLarge,
+			http.StatusRequestEntityTooLarge,
+			etcdErr.EcodeRequestTooLarge,
+			"0",
+		},
+		{
+			etcdserver.ErrNoLeader,
+			http.StatusServiceUnavailable,
+			etcdErr.EcodeLeaderElect,
+			"0",
+		},
+		{
+			etcdserver.ErrClusterVersion,
+			http.StatusServiceUnavailable,
+			etcdErr.EcodeClusterVersion,
+			"0",
+		},
+		{
+			etcdserver.ErrNothingApplied,
+			http.StatusServiceUnavailable,
+			etcdErr.EcodeNothingApplied,
+			"0",
 		},
 	}
 
@@ -496,6 +707,23 @@ func TestWriteError(t *testing.T) {
 		if idx := rw.Header().Get("X-Etcd-Index"); idx != tt.wi {
 			t.Errorf("#%d: X-Etcd-Index=%q, want %q", i, idx, tt.wi)
 		}
+		if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("#%d: Content-Type=%q, want %q", i, ct, "application/json")
+		}
+		var e etcdErr.Error
+		if err := json.Unmarshal(rw.Body.Bytes(), &e); err != nil {
+			t.Fatalf("#%d: error decoding body %q: %v", i, rw.Body.String(), err)
+		}
+		if e.ErrorCode != tt.wecode || e.Message != etcdErr.Message(tt.wecode) {
+			t.Errorf("#%d: errorCode=%d message=%q, want %d %q", i, e.ErrorCode, e.Message, tt.wecode, etcdErr.Message(tt.wecode))
+		}
+		if tt.wcode == http.StatusTooManyRequests && rw.Header().Get("Retry-After") != "1" {
+			t.Errorf("#%d: Retry-After=%q, want %q", i, rw.Header().Get("Retry-After"), "1")
+		}
+		// the text of an internal error is not sent to the client
+		if tt.wecode == etcdErr.EcodeRaftInternal && e.Cause != "" {
+			t.Errorf("#%d: cause=%q, want none", i, e.Cause)
+		}
 	}
 }
 
@@ -589,7 +817,7 @@ func TestV2MachinesEndpoint(t *testing.T) {
 		{"POST", http.StatusMethodNotAllowed},
 	}
 
-	m := NewClientHandler(nil, &fakeCluster{}, time.Hour)
+	m := NewClientHandler(&etcdserver.EtcdServer{Store: store.New()}, &fakeCluster{}, time.Hour, WriteForward, DefaultMaxRequestBytes)
 	s := httptest.NewServer(m)
 	defer s.Close()
 
@@ -634,623 +862,3065 @@ func TestServeMachines(t *testing.T) {
 	}
 }
 
-func TestAllowMethod(t *testing.T) {
+// TestServeMachinesMembership tests that the machines follow the members
+// added to and removed from the cluster, in either format.
+func TestServeMachinesMembership(t *testing.T) {
+	cl := etcdserver.Cluster{}
+	cl.AddSlice([]etcdserver.Member{
+		{ID: 1, Name: "node1", ClientURLs: []string{"http://10.0.0.1:4001", "http://10.0.0.1:2379"}},
+		// not published yet
+		{ID: 2, Name: "node2"},
+	})
+	cls := etcdserver.NewClusterStore(store.New(), cl)
+	h := &serverHandler{clusterStore: cls}
+	get := func(accept string) (string, string) {
+		req, err := http.NewRequest("GET", machinesPrefix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		rw := httptest.NewRecorder()
+		h.serveMachines(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("code = %d, want %d", rw.Code, http.StatusOK)
+		}
+		return rw.Body.String(), rw.Header().Get("Content-Type")
+	}
+
 	tests := []struct {
-		m  string
-		ms []string
-		w  bool
-		wh string
+		accept string
+
+		wbody string
+		wtype string
 	}{
-		// Accepted methods
-		{
-			m:  "GET",
-			ms: []string{"GET", "POST", "PUT"},
-			w:  true,
-		},
-		{
-			m:  "POST",
-			ms: []string{"POST"},
-			w:  true,
-		},
-		// Made-up methods no good
-		{
-			m:  "FAKE",
-			ms: []string{"GET", "POST", "PUT"},
-			w:  false,
-			wh: "GET,POST,PUT",
-		},
-		// Empty methods no good
-		{
-			m:  "",
-			ms: []string{"GET", "POST"},
-			w:  false,
-			wh: "GET,POST",
-		},
-		// Empty accepted methods no good
-		{
-			m:  "GET",
-			ms: []string{""},
-			w:  false,
-			wh: "",
-		},
-		// No methods accepted
-		{
-			m:  "GET",
-			ms: []string{},
-			w:  false,
-			wh: "",
-		},
+		{"", "http://10.0.0.1:2379, http://10.0.0.1:4001", "text/plain; charset=utf-8"},
+		{"application/json", `["http://10.0.0.1:2379","http://10.0.0.1:4001"]` + "\n", "application/json"},
 	}
-
 	for i, tt := range tests {
+		if b, ct := get(tt.accept); b != tt.wbody || ct != tt.wtype {
+			t.Errorf("#%d: body = %q (%s), want %q (%s)", i, b, ct, tt.wbody, tt.wtype)
+		}
+	}
+
+	cls.Add(etcdserver.Member{ID: 3, Name: "node3", ClientURLs: []string{"http://10.0.0.3:4001"}})
+	cls.Delete(1)
+	if b, _ := get(""); b != "http://10.0.0.3:4001" {
+		t.Errorf("body = %q, want %q", b, "http://10.0.0.3:4001")
+	}
+	if b, _ := get("application/json"); b != `["http://10.0.0.3:4001"]`+"\n" {
+		t.Errorf("body = %q, want %q", b, `["http://10.0.0.3:4001"]`+"\n")
+	}
+}
+
+func TestServeMembers(t *testing.T) {
+	cl := &etcdserver.Cluster{}
+	if err := cl.Set("node1=http://10.0.0.1:2380,node2=http://10.0.0.2:2380,node2=http://10.0.0.2:7001"); err != nil {
+		t.Fatal(err)
+	}
+	cls := etcdserver.NewClusterStore(store.New(), *cl)
+	h := &serverHandler{clusterStore: cls, health: &fakeHealth{lead: cl.FindName("node2").ID}}
+	get := func() members {
+		req, err := http.NewRequest("GET", membersPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 		rw := httptest.NewRecorder()
-		g := allowMethod(rw, tt.m, tt.ms...)
-		if g != tt.w {
-			t.Errorf("#%d: got allowMethod()=%t, want %t", i, g, tt.w)
+		h.serveMembers(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
 		}
-		if !tt.w {
-			if rw.Code != http.StatusMethodNotAllowed {
-				t.Errorf("#%d: code=%d, want %d", i, rw.Code, http.StatusMethodNotAllowed)
-			}
-			gh := rw.Header().Get("Allow")
-			if gh != tt.wh {
-				t.Errorf("#%d: Allow header=%q, want %q", i, gh, tt.wh)
-			}
+		if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		var ms members
+		if err := json.NewDecoder(rw.Body).Decode(&ms); err != nil {
+			t.Fatal(err)
 		}
+		return ms
+	}
+
+	var wms []etcdserver.Member
+	for _, id := range cl.IDs() {
+		wms = append(wms, *cl.FindID(id))
+	}
+	ms := get()
+	if !reflect.DeepEqual(ms.Members, wms) {
+		t.Errorf("members = %+v, want %+v", ms.Members, wms)
+	}
+	if w := cl.FindName("node2").ID; ms.Leader != w {
+		t.Errorf("leader = %x, want %x", ms.Leader, w)
+	}
+
+	// membership changes show up in the list
+	cls.Delete(cl.FindName("node1").ID)
+	ms = get()
+	if len(ms.Members) != 1 || ms.Members[0].Name != "node2" {
+		t.Errorf("members = %+v, want node2 only", ms.Members)
 	}
 }
 
-// errServer implements the etcd.Server interface for testing.
-// It returns the given error from any Do/Process calls.
-type errServer struct {
-	err error
+type fakeSnapshots struct {
+	info etcdserver.SnapshotInfo
+	err  error
 }
 
-func (fs *errServer) Do(ctx context.Context, r etcdserverpb.Request) (etcdserver.Response, error) {
-	return etcdserver.Response{}, fs.err
+func (s *fakeSnapshots) TakeSnapshot(ctx context.Context) (etcdserver.SnapshotInfo, error) {
+	return s.info, s.err
 }
-func (fs *errServer) Process(ctx context.Context, m raftpb.Message) error {
-	return fs.err
+
+func TestServeAdminSnapshot(t *testing.T) {
+	info := etcdserver.SnapshotInfo{Index: 12, Term: 3, Path: "/data/snap/0000000000000003-000000000000000c.snap"}
+	tests := []struct {
+		method string
+		err    error
+
+		wcode int
+		wbody string
+	}{
+		{"POST", nil, http.StatusOK, `{"index":12,"term":3,"path":"/data/snap/0000000000000003-000000000000000c.snap"}` + "\n"},
+		{"POST", etcdserver.ErrNothingApplied, http.StatusServiceUnavailable, `{"errorCode":306,"message":"No entry applied yet","index":0}` + "\n"},
+		{"POST", context.DeadlineExceeded, http.StatusGatewayTimeout, `{"errorCode":302,"message":"Request timed out","index":0}` + "\n"},
+		{"GET", nil, http.StatusMethodNotAllowed, ""},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{snapshots: &fakeSnapshots{info: info, err: tt.err}, timeout: time.Hour}
+		req, err := http.NewRequest(tt.method, adminSnapshotPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveAdminSnapshot(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if tt.wbody != "" && rw.Body.String() != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, rw.Body.String(), tt.wbody)
+		}
+	}
 }
-func (fs *errServer) Start() {}
-func (fs *errServer) Stop()  {}
 
-// errReader implements io.Reader to facilitate a broken request.
-type errReader struct{}
+type fakeBackups struct {
+	backup etcdserver.Backup
+	err    error
+}
 
-func (er *errReader) Read(_ []byte) (int, error) { return 0, errors.New("some error") }
+func (b *fakeBackups) Backup(ctx context.Context) (etcdserver.Backup, error) {
+	return b.backup, b.err
+}
 
-func mustMarshalMsg(t *testing.T, m raftpb.Message) []byte {
-	json, err := m.Marshal()
+func TestServeAdminBackup(t *testing.T) {
+	st := store.New()
+	st.Create("/foo", false, "bar", false, store.Permanent)
+	st.Create("/dir/baz", false, "qux", false, store.Permanent)
+	h := &serverHandler{backups: &fakeBackups{backup: etcdserver.Backup{Index: 12, Store: st}}, timeout: time.Hour}
+	req, err := http.NewRequest("GET", adminBackupPath, nil)
 	if err != nil {
-		t.Fatalf("error marshalling raft Message: %#v", err)
+		t.Fatal(err)
 	}
-	return json
-}
+	rw := httptest.NewRecorder()
+	h.serveAdminBackup(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	for name, w := range map[string]string{
+		"X-Raft-Index":        "12",
+		"X-Etcd-Index":        "2",
+		"Content-Disposition": `attachment; filename="etcd-backup-12.json"`,
+	} {
+		if g := rw.Header().Get(name); g != w {
+			t.Errorf("%s = %q, want %q", name, g, w)
+		}
+	}
+	restored := store.New()
+	if err := restored.RecoveryFrom(rw.Body); err != nil {
+		t.Fatal(err)
+	}
+	for k, w := range map[string]string{"/foo": "bar", "/dir/baz": "qux"} {
+		ev, err := restored.Get(k, false, false)
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+			continue
+		}
+		if *ev.Node.Value != w {
+			t.Errorf("%s = %q, want %q", k, *ev.Node.Value, w)
+		}
+	}
+	if restored.Index() != 2 {
+		t.Errorf("index = %d, want 2", restored.Index())
+	}
+}
 
-func TestServeRaft(t *testing.T) {
-	testCases := []struct {
-		method    string
-		body      io.Reader
-		serverErr error
+func TestServeAdminBackupError(t *testing.T) {
+	tests := []struct {
+		method string
+		err    error
 
 		wcode int
 	}{
-		{
-			// bad method
-			"GET",
-			bytes.NewReader(
-				mustMarshalMsg(
-					t,
-					raftpb.Message{},
-				),
-			),
-			nil,
-			http.StatusMethodNotAllowed,
-		},
-		{
-			// bad method
-			"PUT",
-			bytes.NewReader(
-				mustMarshalMsg(
-					t,
-					raftpb.Message{},
-				),
-			),
-			nil,
-			http.StatusMethodNotAllowed,
-		},
-		{
-			// bad method
-			"DELETE",
-			bytes.NewReader(
-				mustMarshalMsg(
-					t,
-					raftpb.Message{},
-				),
-			),
-			nil,
-			http.StatusMethodNotAllowed,
-		},
-		{
-			// bad request body
-			"POST",
-			&errReader{},
-			nil,
-			http.StatusBadRequest,
-		},
-		{
-			// bad request protobuf
-			"POST",
-			strings.NewReader("malformed garbage"),
-			nil,
-			http.StatusBadRequest,
-		},
-		{
-			// good request, etcdserver.Server error
-			"POST",
-			bytes.NewReader(
-				mustMarshalMsg(
-					t,
-					raftpb.Message{},
-				),
-			),
-			errors.New("some error"),
-			http.StatusInternalServerError,
-		},
-		{
-			// good request
-			"POST",
-			bytes.NewReader(
-				mustMarshalMsg(
-					t,
-					raftpb.Message{},
-				),
-			),
-			nil,
-			http.StatusNoContent,
-		},
+		{"POST", nil, http.StatusMethodNotAllowed},
+		{"GET", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"GET", etcdserver.ErrStopped, http.StatusInternalServerError},
 	}
-	for i, tt := range testCases {
-		req, err := http.NewRequest(tt.method, "foo", tt.body)
+	for i, tt := range tests {
+		h := &serverHandler{backups: &fakeBackups{err: tt.err}, timeout: time.Hour}
+		req, err := http.NewRequest(tt.method, adminBackupPath, nil)
 		if err != nil {
-			t.Fatalf("#%d: could not create request: %#v", i, err)
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveAdminBackup(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+func TestServeAdminMembersAdd(t *testing.T) {
+	s := &memberServer{}
+	h := &serverHandler{server: s, timeout: time.Hour}
+	body := `{"ID":1,"Name":"node2","PeerURLs":["http://10.0.0.2:2380"]}`
+	req, err := http.NewRequest("POST", adminMembersPrefix, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	h.serveAdminMembers(rw, req)
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	wm := etcdserver.Member{ID: 1, Name: "node2", PeerURLs: []string{"http://10.0.0.2:2380"}}
+	if !reflect.DeepEqual(s.added, []etcdserver.Member{wm}) {
+		t.Errorf("added = %+v, want %+v", s.added, []etcdserver.Member{wm})
+	}
+	var m etcdserver.Member
+	if err := json.NewDecoder(rw.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, wm) {
+		t.Errorf("member = %+v, want %+v", m, wm)
+	}
+}
+
+func TestServeAdminMembersAddGenerateID(t *testing.T) {
+	s := &memberServer{}
+	h := &serverHandler{server: s, timeout: time.Hour}
+	body := `{"Name":"node2","PeerURLs":["http://10.0.0.2:2380"]}`
+	req, err := http.NewRequest("POST", adminMembersPrefix, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serveAdminMembers(httptest.NewRecorder(), req)
+
+	if len(s.added) != 1 {
+		t.Fatalf("len(added) = %d, want 1", len(s.added))
+	}
+	if s.added[0].ID == 0 {
+		t.Errorf("ID = 0, want generated ID")
+	}
+}
+
+func TestServeAdminMembersRemove(t *testing.T) {
+	s := &memberServer{}
+	h := &serverHandler{server: s, timeout: time.Hour}
+	req, err := http.NewRequest("DELETE", adminMembersPrefix+"/1a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	h.serveAdminMembers(rw, req)
+
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if !reflect.DeepEqual(s.removed, []int64{0x1a}) {
+		t.Errorf("removed = %v, want %v", s.removed, []int64{0x1a})
+	}
+}
+
+func TestServeAdminMembersFail(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		err    error
+
+		wcode int
+	}{
+		{"GET", adminMembersPrefix, "", nil, http.StatusMethodNotAllowed},
+		// bad member
+		{"POST", adminMembersPrefix, "bad json", nil, http.StatusBadRequest},
+		{"POST", adminMembersPrefix, `{"Name":"node2"}`, nil, http.StatusBadRequest},
+		{"POST", adminMembersPrefix, `{"Name":"node2","PeerURLs":["10.0.0.2"]}`, nil, http.StatusBadRequest},
+		{"POST", adminMembersPrefix + "/1", `{"ID":1,"PeerURLs":["http://10.0.0.2:2380"]}`, nil, http.StatusNotFound},
+		// bad id
+		{"DELETE", adminMembersPrefix + "/xyz", "", nil, http.StatusBadRequest},
+		{"DELETE", adminMembersPrefix, "", nil, http.StatusBadRequest},
+		// server errors
+		{"POST", adminMembersPrefix, `{"ID":1,"PeerURLs":["http://10.0.0.2:2380"]}`, etcdserver.ErrIDExists, http.StatusConflict},
+		{"DELETE", adminMembersPrefix + "/1", "", etcdserver.ErrIDNotFound, http.StatusNotFound},
+		{"DELETE", adminMembersPrefix + "/1", "", etcdserver.ErrLastMember, http.StatusConflict},
+		{"DELETE", adminMembersPrefix + "/1", "", errors.New("blah"), http.StatusInternalServerError},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{server: &errServer{tt.err}, timeout: time.Hour}
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveAdminMembers(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		checkErrorBody(t, i, rw)
+	}
+}
+
+// checkErrorBody fails t unless rw holds an etcd error, responded with the
+// status of its code.
+func checkErrorBody(t *testing.T, i int, rw *httptest.ResponseRecorder) {
+	var e etcdErr.Error
+	if err := json.Unmarshal(rw.Body.Bytes(), &e); err != nil {
+		t.Errorf("#%d: error decoding body %q: %v", i, rw.Body.String(), err)
+		return
+	}
+	if e.StatusCode() != rw.Code {
+		t.Errorf("#%d: errorCode %d responded with %d, want %d", i, e.ErrorCode, rw.Code, e.StatusCode())
+	}
+}
+
+type fakeHealth struct {
+	lead      int64
+	lastApply time.Time
+	replaying bool
+}
+
+func (h *fakeHealth) Leader() int64        { return h.lead }
+func (h *fakeHealth) LastApply() time.Time { return h.lastApply }
+func (h *fakeHealth) Replayed() bool       { return !h.replaying }
+
+func TestServeHealth(t *testing.T) {
+	tests := []struct {
+		h *fakeHealth
+
+		wcode int
+		wbody string
+	}{
+		{&fakeHealth{lead: raft.None, lastApply: time.Now()}, http.StatusServiceUnavailable, `{"health":"false","reason":"no leader"}`},
+		{&fakeHealth{lead: 1, lastApply: time.Now(), replaying: true}, http.StatusServiceUnavailable, `{"health":"false","reason":"replaying the log"}`},
+		{&fakeHealth{lead: 1, lastApply: time.Now().Add(-time.Minute)}, http.StatusServiceUnavailable, `{"health":"false","reason":"behind the leader"}`},
+		{&fakeHealth{lead: 1}, http.StatusServiceUnavailable, `{"health":"false","reason":"behind the leader"}`},
+		{&fakeHealth{lead: 1, lastApply: time.Now()}, http.StatusOK, `{"health":"true"}`},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{health: tt.h}
+		req, err := http.NewRequest("GET", healthPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveHealth(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if g := strings.TrimSpace(rw.Body.String()); g != tt.wbody {
+			t.Errorf("#%d: body = %s, want %s", i, g, tt.wbody)
+		}
+	}
+}
+
+func TestWaitReplayed(t *testing.T) {
+	hr := &fakeHealth{replaying: true}
+	h := waitReplayed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), hr)
+	tests := []struct {
+		path      string
+		replaying bool
+
+		wcode int
+	}{
+		{keysPrefix + "/foo", true, http.StatusServiceUnavailable},
+		{membersPath, true, http.StatusServiceUnavailable},
+		{healthPath, true, http.StatusOK},
+		{metricsPath, true, http.StatusOK},
+		{keysPrefix + "/foo", false, http.StatusOK},
+	}
+	for i, tt := range tests {
+		hr.replaying = tt.replaying
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	req, err := http.NewRequest("GET", metricsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	serveMetrics(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	for _, name := range []string{"etcd_server_proposals_committed_total", "etcd_store_keys"} {
+		if !strings.Contains(rw.Body.String(), "\n"+name+" ") {
+			t.Errorf("body = %s, want metric %s", rw.Body.String(), name)
 		}
+	}
+}
+
+// nopStorage implements the etcdserver.Storage interface, and drops
+// everything saved to it.
+type nopStorage struct{}
+
+func (s nopStorage) Save(st raftpb.HardState, ents []raftpb.Entry) {}
+func (s nopStorage) SaveSnap(snap raftpb.Snapshot)                 {}
+func (s nopStorage) Cut() error                                    { return nil }
+func (s nopStorage) Close() error                                  { return nil }
+
+// TestServeHealthElection tests that a member is unhealthy while it is a
+// candidate, and becomes healthy once it is elected and applies entries.
+type fakeRaftStatus struct {
+	st etcdserver.RaftStatus
+}
+
+func (s *fakeRaftStatus) RaftStatus() etcdserver.RaftStatus { return s.st }
+
+func TestServeRaftStatus(t *testing.T) {
+	active := time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)
+	st := etcdserver.RaftStatus{
+		ID:      1,
+		State:   "leader",
+		Term:    3,
+		Leader:  1,
+		Commit:  12,
+		Applied: 11,
+		Peers: []etcdserver.PeerStatus{
+			{ID: 2, Progress: &etcdserver.PeerProgress{Match: 12, Next: 13}, LastActive: &active},
+			{ID: 3, Progress: &etcdserver.PeerProgress{Match: 0, Next: 1}},
+		},
+	}
+	h := &serverHandler{raftStatus: &fakeRaftStatus{st}}
+
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", debugRaftPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serveRaftStatus(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %s, want application/json", ct)
+	}
+	w := `{"id":1,"state":"leader","term":3,"leader":1,"commitIndex":12,"appliedIndex":11,"peers":[` +
+		`{"id":2,"progress":{"match":12,"next":13},"lastActive":"2014-10-01T12:00:00Z"},` +
+		`{"id":3,"progress":{"match":0,"next":1}}]}` + "\n"
+	if g := rw.Body.String(); g != w {
+		t.Errorf("body = %s, want %s", g, w)
+	}
+
+	rw = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", debugRaftPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serveRaftStatus(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+type fakeVersions struct {
+	v etcdserver.Versions
+}
+
+func (v *fakeVersions) Versions() etcdserver.Versions { return v.v }
+
+func TestServeVersion(t *testing.T) {
+	h := &serverHandler{versions: &fakeVersions{etcdserver.Versions{Server: "0.5.1", Cluster: "0.5.0"}}}
+
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", versionPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serveVersion(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %s, want application/json", ct)
+	}
+	w := `{"etcdserver":"0.5.1","etcdcluster":"0.5.0"}` + "\n"
+	if g := rw.Body.String(); g != w {
+		t.Errorf("body = %s, want %s", g, w)
+	}
+
+	rw = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", versionPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serveVersion(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLeaderWrites(t *testing.T) {
+	cls := &fakeCluster{members: []etcdserver.Member{
+		{ID: 1, Name: "node1", ClientURLs: []string{"http://node1:4001"}},
+		{ID: 2, Name: "node2", ClientURLs: []string{"http://node2:4001"}},
+		{ID: 3, Name: "node3"},
+		// a member may share the name of another one
+		{ID: 4, Name: "node1", ClientURLs: []string{"http://node4:4001"}},
+	}}
+	tests := []struct {
+		mode   WriteMode
+		lead   int64
+		method string
+
+		wserved   bool
+		wcode     int
+		wlocation string
+	}{
+		// the leader serves its writes in both modes
+		{WriteForward, 1, "PUT", true, http.StatusOK, ""},
+		{WriteRedirect, 1, "PUT", true, http.StatusOK, ""},
+		// a follower forwards the writes through raft
+		{WriteForward, 2, "PUT", true, http.StatusOK, ""},
+		{WriteForward, 2, "DELETE", true, http.StatusOK, ""},
+		// or redirects them to the leader
+		{WriteRedirect, 2, "PUT", false, http.StatusTemporaryRedirect, "http://node2:4001/v2/keys/foo?prevExist=true"},
+		{WriteRedirect, 2, "POST", false, http.StatusTemporaryRedirect, "http://node2:4001/v2/keys/foo?prevExist=true"},
+		{WriteRedirect, 2, "DELETE", false, http.StatusTemporaryRedirect, "http://node2:4001/v2/keys/foo?prevExist=true"},
+		{WriteRedirect, 4, "PUT", false, http.StatusTemporaryRedirect, "http://node4:4001/v2/keys/foo?prevExist=true"},
+		// the reads are served anyway
+		{WriteRedirect, 2, "GET", true, http.StatusOK, ""},
+		{WriteRedirect, raft.None, "GET", true, http.StatusOK, ""},
+		// no write is served without a leader
+		{WriteForward, raft.None, "PUT", false, http.StatusServiceUnavailable, ""},
+		{WriteRedirect, raft.None, "PUT", false, http.StatusServiceUnavailable, ""},
+		// nor redirected to a leader without client URLs
+		{WriteRedirect, 3, "PUT", false, http.StatusServiceUnavailable, ""},
+	}
+	for i, tt := range tests {
 		h := &serverHandler{
-			timeout: time.Hour,
-			server:  &errServer{tt.serverErr},
+			id:           1,
+			health:       &fakeHealth{lead: tt.lead},
+			clusterStore: cls,
+			writeMode:    tt.mode,
 		}
+		served := false
+		hf := h.leaderWrites(func(w http.ResponseWriter, r *http.Request) { served = true })
 		rw := httptest.NewRecorder()
-		h.serveRaft(rw, req)
+		req, err := http.NewRequest(tt.method, "http://node1:4001/v2/keys/foo?prevExist=true", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hf(rw, req)
+		if served != tt.wserved {
+			t.Errorf("#%d: served = %v, want %v", i, served, tt.wserved)
+		}
 		if rw.Code != tt.wcode {
-			t.Errorf("#%d: got code=%d, want %d", i, rw.Code, tt.wcode)
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if g := rw.Header().Get("Location"); g != tt.wlocation {
+			t.Errorf("#%d: location = %q, want %q", i, g, tt.wlocation)
 		}
 	}
 }
 
-// resServer implements the etcd.Server interface for testing.
-// It returns the given responsefrom any Do calls, and nil error
-type resServer struct {
+func TestWriteModeSet(t *testing.T) {
+	tests := []struct {
+		s     string
+		wmode WriteMode
+		werr  bool
+	}{
+		{"forward", WriteForward, false},
+		{"redirect", WriteRedirect, false},
+		{"", WriteForward, true},
+		{"proxy", WriteForward, true},
+	}
+	for i, tt := range tests {
+		var m WriteMode
+		err := m.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if m != tt.wmode {
+			t.Errorf("#%d: mode = %v, want %v", i, m, tt.wmode)
+		}
+		if !tt.werr && m.String() != tt.s {
+			t.Errorf("#%d: string = %s, want %s", i, m.String(), tt.s)
+		}
+	}
+}
+
+type fakeLeaderStats struct {
+	ls     etcdserver.LeaderStats
+	leader bool
+}
+
+func (s *fakeLeaderStats) LeaderStats() (etcdserver.LeaderStats, bool) { return s.ls, s.leader }
+
+type fakeStoreStats struct {
+	st store.Store
+}
+
+func (s *fakeStoreStats) StoreStats(reset bool) []byte {
+	if reset {
+		return s.st.ResetStats()
+	}
+	return s.st.JsonStats()
+}
+
+func TestServeStoreStats(t *testing.T) {
+	st := store.New()
+	st.Create("/foo", false, "bar", false, store.Permanent)
+	st.Get("/foo", false, false)
+	st.Get("/baz", false, false)
+	h := &serverHandler{storeStats: &fakeStoreStats{st: st}}
+
+	tests := []struct {
+		method string
+		url    string
+
+		wcode  int
+		wstats store.Stats
+	}{
+		{"GET", statsStorePath, http.StatusOK, store.Stats{CreateSuccess: 1, GetSuccess: 1, GetFail: 1}},
+		{"GET", statsStorePath + "?reset=true", http.StatusMethodNotAllowed, store.Stats{}},
+		{"GET", statsStorePath, http.StatusOK, store.Stats{CreateSuccess: 1, GetSuccess: 1, GetFail: 1}},
+		{"POST", statsStorePath, http.StatusOK, store.Stats{CreateSuccess: 1, GetSuccess: 1, GetFail: 1}},
+		{"GET", statsStorePath, http.StatusOK, store.Stats{}},
+		{"DELETE", statsStorePath, http.StatusOK, store.Stats{}},
+		{"PUT", statsStorePath, http.StatusMethodNotAllowed, store.Stats{}},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveStoreStats(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if rw.Code != http.StatusOK {
+			checkErrorBody(t, i, rw)
+			continue
+		}
+		var g store.Stats
+		if err := json.Unmarshal(rw.Body.Bytes(), &g); err != nil {
+			t.Fatal(err)
+		}
+		if g != tt.wstats {
+			t.Errorf("#%d: stats = %+v, want %+v", i, g, tt.wstats)
+		}
+	}
+}
+
+func TestServeLeaderStats(t *testing.T) {
+	ls := etcdserver.LeaderStats{
+		Leader: "node1",
+		Followers: map[string]etcdserver.FollowerStats{
+			"node2": {
+				Counts:  etcdserver.CountsStats{Fail: 1, Success: 3},
+				Latency: etcdserver.LatencyStats{Current: 2, Average: 1.5, StandardDeviation: 0.5, Minimum: 1, Maximum: 2},
+			},
+		},
+	}
+	cls := &fakeCluster{members: []etcdserver.Member{
+		{ID: 1, Name: "node1", ClientURLs: []string{"http://node1:4001"}},
+		{ID: 2, Name: "node2", ClientURLs: []string{"http://node2:4001"}},
+	}}
+	tests := []struct {
+		leader bool
+		lead   int64
+
+		wcode     int
+		wbody     string
+		wlocation string
+	}{
+		{
+			true, 1,
+			http.StatusOK,
+			`{"leader":"node1","followers":{"node2":{"counts":{"fail":1,"success":3},` +
+				`"latency":{"current":2,"average":1.5,"standardDeviation":0.5,"minimum":1,"maximum":2}}}}` + "\n",
+			"",
+		},
+		// a follower redirects to the leader
+		{false, 1, http.StatusTemporaryRedirect, "", "http://node1:4001" + statsLeaderPath},
+		{false, raft.None, http.StatusServiceUnavailable, "", ""},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{
+			leaderStats:  &fakeLeaderStats{ls: ls, leader: tt.leader},
+			health:       &fakeHealth{lead: tt.lead},
+			clusterStore: cls,
+		}
+		rw := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", statsLeaderPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.serveLeaderStats(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if tt.wbody != "" {
+			if g := rw.Body.String(); g != tt.wbody {
+				t.Errorf("#%d: body = %s, want %s", i, g, tt.wbody)
+			}
+		}
+		if g := rw.Header().Get("Location"); g != tt.wlocation {
+			t.Errorf("#%d: location = %q, want %q", i, g, tt.wlocation)
+		}
+		if tt.wcode == http.StatusServiceUnavailable {
+			checkErrorBody(t, i, rw)
+		}
+	}
+}
+
+func TestServeHealthElection(t *testing.T) {
+	msgc := make(chan raftpb.Message, 16)
+	cls := &fakeCluster{members: []etcdserver.Member{{ID: 1, Name: "node1"}, {ID: 2, Name: "node2"}}}
+	srv := &etcdserver.EtcdServer{
+		Name:  "node1",
+		Node:  raft.StartNode(1, []int64{1, 2}, 10, 1),
+		Store: store.New(),
+		Send: func(msgs []raftpb.Message) {
+			for _, m := range msgs {
+				select {
+				case msgc <- m:
+				default:
+				}
+			}
+		},
+		Storage:      nopStorage{},
+		ClusterStore: cls,
+	}
+	srv.Start()
+	defer srv.Stop()
+	s := httptest.NewServer(NewClientHandler(srv, cls, time.Hour, WriteForward, DefaultMaxRequestBytes))
+	defer s.Close()
+
+	getHealth := func() int {
+		resp, err := http.Get(s.URL + healthPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// raft message types, which raft does not export
+	const (
+		msgApp      = 3
+		msgAppResp  = 4
+		msgVote     = 5
+		msgVoteResp = 6
+	)
+	waitMsg := func(typ int64) raftpb.Message {
+		for {
+			select {
+			case m := <-msgc:
+				if m.Type == typ {
+					return m
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for message type %d", typ)
+			}
+		}
+	}
+
+	srv.Node.Campaign(context.TODO())
+	vote := waitMsg(msgVote)
+	if g := getHealth(); g != http.StatusServiceUnavailable {
+		t.Errorf("code of candidate = %d, want %d", g, http.StatusServiceUnavailable)
+	}
+
+	// node 2 elects node 1, and acknowledges the entry of its term
+	srv.Process(context.TODO(), raftpb.Message{Type: msgVoteResp, From: 2, To: 1, Term: vote.Term})
+	app := waitMsg(msgApp)
+	srv.Process(context.TODO(), raftpb.Message{Type: msgAppResp, From: 2, To: 1, Term: app.Term, Index: app.Index + int64(len(app.Entries))})
+	for i := 0; ; i++ {
+		if getHealth() == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("code of leader = %d, want %d", getHealth(), http.StatusOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAllowMethod(t *testing.T) {
+	tests := []struct {
+		m  string
+		ms []string
+		w  bool
+		wh string
+	}{
+		// Accepted methods
+		{
+			m:  "GET",
+			ms: []string{"GET", "POST", "PUT"},
+			w:  true,
+		},
+		{
+			m:  "POST",
+			ms: []string{"POST"},
+			w:  true,
+		},
+		// Made-up methods no good
+		{
+			m:  "FAKE",
+			ms: []string{"GET", "POST", "PUT"},
+			w:  false,
+			wh: "GET,POST,PUT",
+		},
+		// Empty methods no good
+		{
+			m:  "",
+			ms: []string{"GET", "POST"},
+			w:  false,
+			wh: "GET,POST",
+		},
+		// Empty accepted methods no good
+		{
+			m:  "GET",
+			ms: []string{""},
+			w:  false,
+			wh: "",
+		},
+		// No methods accepted
+		{
+			m:  "GET",
+			ms: []string{},
+			w:  false,
+			wh: "",
+		},
+	}
+
+	for i, tt := range tests {
+		rw := httptest.NewRecorder()
+		g := allowMethod(rw, tt.m, tt.ms...)
+		if g != tt.w {
+			t.Errorf("#%d: got allowMethod()=%t, want %t", i, g, tt.w)
+		}
+		if !tt.w {
+			if rw.Code != http.StatusMethodNotAllowed {
+				t.Errorf("#%d: code=%d, want %d", i, rw.Code, http.StatusMethodNotAllowed)
+			}
+			gh := rw.Header().Get("Allow")
+			if gh != tt.wh {
+				t.Errorf("#%d: Allow header=%q, want %q", i, gh, tt.wh)
+			}
+			checkErrorBody(t, i, rw)
+		}
+	}
+}
+
+// errServer implements the etcd.Server interface for testing.
+// It returns the given error from any Do/Process calls.
+type errServer struct {
+	err error
+}
+
+func (fs *errServer) Do(ctx context.Context, r etcdserverpb.Request) (etcdserver.Response, error) {
+	return etcdserver.Response{}, fs.err
+}
+func (fs *errServer) Process(ctx context.Context, m raftpb.Message) error {
+	return fs.err
+}
+func (fs *errServer) Start() {}
+func (fs *errServer) Stop()  {}
+func (fs *errServer) AddMember(ctx context.Context, m etcdserver.Member) error {
+	return fs.err
+}
+func (fs *errServer) RemoveMember(ctx context.Context, id int64) error {
+	return fs.err
+}
+func (fs *errServer) AddUser(ctx context.Context, u etcdserver.User) error {
+	return fs.err
+}
+func (fs *errServer) RemoveUser(ctx context.Context, name string) error {
+	return fs.err
+}
+func (fs *errServer) SetUserRoles(ctx context.Context, name string, roles []string) error {
+	return fs.err
+}
+func (fs *errServer) SetRole(ctx context.Context, r etcdserver.Role) error {
+	return fs.err
+}
+func (fs *errServer) RemoveRole(ctx context.Context, name string) error {
+	return fs.err
+}
+
+// stalledServer implements the etcd.Server interface for testing.
+// Its Do calls never complete, as if the cluster could not commit, until
+// their context is done.
+type stalledServer struct {
+	errServer
+	// deadline is the time left before the deadline of the last Do call
+	deadline time.Duration
+}
+
+func (fs *stalledServer) Do(ctx context.Context, r etcdserverpb.Request) (etcdserver.Response, error) {
+	if d, ok := ctx.Deadline(); ok {
+		fs.deadline = d.Sub(time.Now())
+	}
+	<-ctx.Done()
+	return etcdserver.Response{}, ctx.Err()
+}
+
+// errReader implements io.Reader to facilitate a broken request.
+type errReader struct{}
+
+func (er *errReader) Read(_ []byte) (int, error) { return 0, errors.New("some error") }
+
+func mustMarshalMsg(t *testing.T, m raftpb.Message) []byte {
+	json, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("error marshalling raft Message: %#v", err)
+	}
+	return json
+}
+
+func TestServeRaft(t *testing.T) {
+	testCases := []struct {
+		method    string
+		body      io.Reader
+		serverErr error
+
+		wcode int
+	}{
+		{
+			// bad method
+			"GET",
+			bytes.NewReader(
+				mustMarshalMsg(
+					t,
+					raftpb.Message{},
+				),
+			),
+			nil,
+			http.StatusMethodNotAllowed,
+		},
+		{
+			// bad method
+			"PUT",
+			bytes.NewReader(
+				mustMarshalMsg(
+					t,
+					raftpb.Message{},
+				),
+			),
+			nil,
+			http.StatusMethodNotAllowed,
+		},
+		{
+			// bad method
+			"DELETE",
+			bytes.NewReader(
+				mustMarshalMsg(
+					t,
+					raftpb.Message{},
+				),
+			),
+			nil,
+			http.StatusMethodNotAllowed,
+		},
+		{
+			// bad request body
+			"POST",
+			&errReader{},
+			nil,
+			http.StatusBadRequest,
+		},
+		{
+			// bad request protobuf
+			"POST",
+			strings.NewReader("malformed garbage"),
+			nil,
+			http.StatusBadRequest,
+		},
+		{
+			// good request, etcdserver.Server error
+			"POST",
+			bytes.NewReader(
+				mustMarshalMsg(
+					t,
+					raftpb.Message{},
+				),
+			),
+			errors.New("some error"),
+			http.StatusInternalServerError,
+		},
+		{
+			// good request
+			"POST",
+			bytes.NewReader(
+				mustMarshalMsg(
+					t,
+					raftpb.Message{},
+				),
+			),
+			nil,
+			http.StatusNoContent,
+		},
+	}
+	for i, tt := range testCases {
+		req, err := http.NewRequest(tt.method, "foo", tt.body)
+		if err != nil {
+			t.Fatalf("#%d: could not create request: %#v", i, err)
+		}
+		h := &serverHandler{
+			timeout: time.Hour,
+			server:  &errServer{tt.serverErr},
+		}
+		rw := httptest.NewRecorder()
+		h.serveRaft(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: got code=%d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+// msgServer records the messages it processes.
+type msgServer struct {
+	resServer
+	msgs []raftpb.Message
+}
+
+func (ms *msgServer) Process(_ context.Context, m raftpb.Message) error {
+	ms.msgs = append(ms.msgs, m)
+	return nil
+}
+
+func TestServeRaftStream(t *testing.T) {
+	msgs := []raftpb.Message{{From: 2, Index: 1}, {From: 2, Index: 2}}
+	var body bytes.Buffer
+	for _, m := range msgs {
+		if err := transport.WriteFrame(&body, mustMarshalMsg(t, m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest("POST", raftStreamPrefix, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &msgServer{}
+	h := &serverHandler{server: s}
+	rw := httptest.NewRecorder()
+	h.serveRaftStream(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !reflect.DeepEqual(s.msgs, msgs) {
+		t.Errorf("msgs = %+v, want %+v", s.msgs, msgs)
+	}
+	if rw.Header().Get(raftStreamAckHeader) == "" {
+		t.Errorf("no %s header", raftStreamAckHeader)
+	}
+	// an empty frame acks each message
+	for i := range msgs {
+		b, err := transport.ReadFrame(rw.Body)
+		if err != nil || len(b) != 0 {
+			t.Errorf("ack #%d = %q, %v, want an empty frame", i, b, err)
+		}
+	}
+	if rw.Body.Len() != 0 {
+		t.Errorf("%d bytes left after the acks", rw.Body.Len())
+	}
+
+	req, err = http.NewRequest("GET", raftStreamPrefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveRaftStream(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// resServer implements the etcd.Server interface for testing.
+// It returns the given responsefrom any Do calls, and nil error
+type resServer struct {
 	res etcdserver.Response
 }
 
-func (rs *resServer) Do(_ context.Context, _ etcdserverpb.Request) (etcdserver.Response, error) {
-	return rs.res, nil
+func (rs *resServer) Do(_ context.Context, _ etcdserverpb.Request) (etcdserver.Response, error) {
+	return rs.res, nil
+}
+func (rs *resServer) Process(_ context.Context, _ raftpb.Message) error      { return nil }
+func (rs *resServer) Start()                                                 {}
+func (rs *resServer) Stop()                                                  {}
+func (rs *resServer) AddMember(_ context.Context, _ etcdserver.Member) error { return nil }
+func (rs *resServer) RemoveMember(_ context.Context, _ int64) error          { return nil }
+func (rs *resServer) AddUser(_ context.Context, _ etcdserver.User) error     { return nil }
+func (rs *resServer) RemoveUser(_ context.Context, _ string) error           { return nil }
+func (rs *resServer) SetUserRoles(_ context.Context, _ string, _ []string) error {
+	return nil
+}
+func (rs *resServer) SetRole(_ context.Context, _ etcdserver.Role) error { return nil }
+func (rs *resServer) RemoveRole(_ context.Context, _ string) error       { return nil }
+
+// memberServer implements the etcd.Server interface for testing.
+// It records the members added and removed through it.
+type memberServer struct {
+	resServer
+	added   []etcdserver.Member
+	removed []int64
+}
+
+func (ms *memberServer) AddMember(_ context.Context, m etcdserver.Member) error {
+	ms.added = append(ms.added, m)
+	return nil
+}
+func (ms *memberServer) RemoveMember(_ context.Context, id int64) error {
+	ms.removed = append(ms.removed, id)
+	return nil
+}
+
+type userServer struct {
+	resServer
+	added   []etcdserver.User
+	removed []string
+	// roles are the name of each user whose roles were set, followed
+	// by them
+	roles [][]string
+}
+
+func (us *userServer) AddUser(_ context.Context, u etcdserver.User) error {
+	us.added = append(us.added, u)
+	return nil
+}
+func (us *userServer) RemoveUser(_ context.Context, name string) error {
+	us.removed = append(us.removed, name)
+	return nil
+}
+
+func (us *userServer) SetUserRoles(_ context.Context, name string, roles []string) error {
+	us.roles = append(us.roles, append([]string{name}, roles...))
+	return nil
+}
+
+type roleServer struct {
+	resServer
+	set     []etcdserver.Role
+	removed []string
+}
+
+func (rs *roleServer) SetRole(_ context.Context, r etcdserver.Role) error {
+	rs.set = append(rs.set, r)
+	return nil
+}
+func (rs *roleServer) RemoveRole(_ context.Context, name string) error {
+	rs.removed = append(rs.removed, name)
+	return nil
+}
+
+func mustMarshalEvent(t *testing.T, ev *store.Event) string {
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(ev); err != nil {
+		t.Fatalf("error marshalling event %#v: %v", ev, err)
+	}
+	return b.String()
+}
+
+func TestBadServeKeys(t *testing.T) {
+	testBadCases := []struct {
+		req    *http.Request
+		server etcdserver.Server
+
+		wcode int
+	}{
+		{
+			// bad method
+			&http.Request{
+				Method: "CONNECT",
+			},
+			&resServer{},
+
+			http.StatusMethodNotAllowed,
+		},
+		{
+			// bad method
+			&http.Request{
+				Method: "TRACE",
+			},
+			&resServer{},
+
+			http.StatusMethodNotAllowed,
+		},
+		{
+			// parseRequest error
+			&http.Request{
+				Body:   nil,
+				Method: "PUT",
+			},
+			&resServer{},
+
+			http.StatusBadRequest,
+		},
+		{
+			// etcdserver.Server error
+			mustNewRequest(t, "foo"),
+			&errServer{
+				errors.New("blah"),
+			},
+
+			http.StatusInternalServerError,
+		},
+		{
+			// non-event/watcher response from etcdserver.Server
+			mustNewRequest(t, "foo"),
+			&resServer{
+				etcdserver.Response{},
+			},
+
+			http.StatusInternalServerError,
+		},
+	}
+	for i, tt := range testBadCases {
+		h := &serverHandler{
+			timeout: 0, // context times out immediately
+			server:  tt.server,
+			timer:   &dummyRaftTimer{},
+		}
+		rw := httptest.NewRecorder()
+		h.serveKeys(rw, tt.req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: got code=%d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+func TestServeKeysEvent(t *testing.T) {
+	req := mustNewRequest(t, "foo")
+	server := &resServer{
+		etcdserver.Response{
+			Event: &store.Event{
+				Action: store.Get,
+				Node:   &store.NodeExtern{},
+			},
+		},
+	}
+	h := &serverHandler{
+		timeout: time.Hour,
+		server:  server,
+		timer:   &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+
+	h.serveKeys(rw, req)
+
+	wcode := http.StatusOK
+	wbody := mustMarshalEvent(
+		t,
+		&store.Event{
+			Action: store.Get,
+			Node:   &store.NodeExtern{},
+		},
+	)
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+// TestServeKeysWaitIndexWithoutWait tests that a read asking for a
+// waitIndex, without wait, is served at once, and is told whether the store
+// is behind the index.
+func TestServeKeysWaitIndexWithoutWait(t *testing.T) {
+	server := &resServer{
+		etcdserver.Response{
+			Event: &store.Event{
+				Action:    store.Get,
+				Node:      &store.NodeExtern{},
+				EtcdIndex: 7,
+			},
+		},
+	}
+	h := &serverHandler{
+		timeout: time.Hour,
+		server:  server,
+		timer:   &dummyRaftTimer{},
+	}
+	tests := []struct {
+		query string
+
+		wbehind string
+	}{
+		{"", ""},
+		{"?waitIndex=6", ""},
+		{"?waitIndex=7", ""},
+		// the store has not applied the index yet
+		{"?waitIndex=8", "true"},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    mustNewURL(t, keysPrefix+"/foo"+tt.query),
+		}
+		rw := httptest.NewRecorder()
+		h.serveKeys(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, http.StatusOK)
+		}
+		if g := rw.Header().Get("X-Etcd-Index"); g != "7" {
+			t.Errorf("#%d: X-Etcd-Index = %q, want %q", i, g, "7")
+		}
+		if g := rw.Header().Get("X-Etcd-Behind"); g != tt.wbehind {
+			t.Errorf("#%d: X-Etcd-Behind = %q, want %q", i, g, tt.wbehind)
+		}
+	}
+}
+
+func TestServeKeysETag(t *testing.T) {
+	st := store.New()
+	st.Create("/dir/a", false, "1", false, store.Permanent)
+	st.Create("/dir/b", false, "2", false, store.Permanent)
+	server := &resServer{}
+	h := &serverHandler{
+		timeout: time.Hour,
+		server:  server,
+		timer:   &dummyRaftTimer{},
+	}
+	get := func(p string, recursive bool, inm string) *httptest.ResponseRecorder {
+		ev, err := st.Get(p, recursive, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.res = etcdserver.Response{Event: ev}
+		req := mustNewRequest(t, p)
+		req.Header = http.Header{}
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		rw := httptest.NewRecorder()
+		h.serveKeys(rw, req)
+		return rw
+	}
+
+	tests := []struct {
+		path      string
+		recursive bool
+		// the write made after the first GET, if any
+		write func()
+
+		wetag string
+		wcode int
+	}{
+		{"dir/a", false, nil, `W/"1"`, http.StatusNotModified},
+		{"dir/a", false, func() { st.Set("/dir/a", false, "3", store.Permanent) }, `W/"3"`, http.StatusOK},
+		{"dir/a", false, func() { st.Set("/dir/b", false, "4", store.Permanent) }, `W/"3"`, http.StatusNotModified},
+		{"dir", true, nil, `W/"4-3"`, http.StatusNotModified},
+		{"dir", true, func() { st.Set("/dir/b", false, "5", store.Permanent) }, `W/"5-3"`, http.StatusOK},
+		// a deletion lowers no index, but the number of nodes
+		{"dir", true, func() { st.Delete("/dir/a", false, false) }, `W/"5-2"`, http.StatusOK},
+		{"dir", false, func() { st.Create("/dir/c", false, "6", false, store.Permanent) }, `W/"7-3"`, http.StatusOK},
+	}
+	for i, tt := range tests {
+		rw := get(tt.path, tt.recursive, "")
+		etag := rw.Header().Get("ETag")
+		if tt.write != nil {
+			tt.write()
+		}
+		rw = get(tt.path, tt.recursive, etag)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if g := rw.Header().Get("ETag"); g != tt.wetag {
+			t.Errorf("#%d: ETag = %s, want %s", i, g, tt.wetag)
+		}
+		if tt.wcode == http.StatusNotModified && rw.Body.Len() != 0 {
+			t.Errorf("#%d: body = %q, want empty", i, rw.Body.String())
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		h string
+		w bool
+	}{
+		{`W/"7"`, true},
+		{`"7"`, true},
+		{`W/"6", W/"7"`, true},
+		{`*`, true},
+		{``, false},
+		{`W/"6"`, false},
+		{`W/"7-1"`, false},
+	}
+	for i, tt := range tests {
+		if g := etagMatch(tt.h, `W/"7"`); g != tt.w {
+			t.Errorf("#%d: match = %v, want %v", i, g, tt.w)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	b := &bytes.Buffer{}
+	logger.SetOutput(b)
+	defer logger.SetOutput(os.Stderr)
+
+	server := &resServer{
+		etcdserver.Response{
+			Event: &store.Event{
+				Action: store.Create,
+				Node:   &store.NodeExtern{},
+			},
+			Index: 7,
+		},
+	}
+	sh := &serverHandler{
+		timeout: time.Hour,
+		server:  server,
+		timer:   &dummyRaftTimer{},
+	}
+	h := NewAccessLogHandler(http.HandlerFunc(sh.serveKeys))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, mustNewRequest(t, "foo"))
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	fields := strings.Fields(b.String())
+	// date, time, level, prefix, method, path, status, duration, index
+	if len(fields) != 9 {
+		t.Fatalf("log = %q, want 9 fields", b.String())
+	}
+	if g := strings.Join(fields[4:7], " "); g != "GET /v2/keys/foo 201" {
+		t.Errorf("request = %q, want %q", g, "GET /v2/keys/foo 201")
+	}
+	d, err := time.ParseDuration(fields[7])
+	if err != nil || d <= 0 {
+		t.Errorf("duration = %q, want a positive duration", fields[7])
+	}
+	if fields[8] != "raft-index=7" {
+		t.Errorf("index = %q, want %q", fields[8], "raft-index=7")
+	}
+
+	// the ID of a request sent through the proxy is logged too
+	b.Reset()
+	req := mustNewRequest(t, "foo")
+	req.Header = http.Header{"X-Request-Id": {"0123abcd"}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	fields = strings.Fields(b.String())
+	if len(fields) != 10 || fields[9] != `request-id="0123abcd"` {
+		t.Errorf("log = %q, want it to end with %q", b.String(), `request-id="0123abcd"`)
+	}
+}
+
+// fakeUsers implements the etcdserver.UserStore interface for testing,
+// mapping the names of the users to their passwords. It permits everything.
+type fakeUsers map[string]string
+
+func (u fakeUsers) Names() []string {
+	var names []string
+	for name := range u {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (u fakeUsers) Authenticate(name, password string) bool {
+	p, ok := u[name]
+	return ok && p == password
+}
+
+func (u fakeUsers) Permitted(name, key string, write bool) bool { return true }
+func (u fakeUsers) Roles() []etcdserver.Role                    { return nil }
+
+// roleUsers grants the users but root the permissions of a single role.
+type roleUsers struct {
+	fakeUsers
+	role etcdserver.Role
+}
+
+func (u roleUsers) Permitted(name, key string, write bool) bool {
+	if name == etcdserver.RootUser {
+		return true
+	}
+	prefixes := u.role.Read
+	if write {
+		prefixes = u.role.Write
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u roleUsers) Roles() []etcdserver.Role { return []etcdserver.Role{u.role} }
+
+func TestServeUsers(t *testing.T) {
+	s := &userServer{}
+	h := &serverHandler{server: s, users: fakeUsers{"root": "r", "bob": "b"}, timeout: time.Hour}
+
+	req, err := http.NewRequest("GET", usersPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	h.serveUsers(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("GET code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if g, w := rw.Body.String(), `{"users":["bob","root"]}`+"\n"; g != w {
+		t.Errorf("GET body = %q, want %q", g, w)
+	}
+
+	req, err = http.NewRequest("POST", usersPath, strings.NewReader(`{"name":"alice","password":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveUsers(rw, req)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("POST code = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	if len(s.added) != 1 || s.added[0].Name != "alice" {
+		t.Fatalf("added = %v, want alice", s.added)
+	}
+	if s.added[0].Password == "a" {
+		t.Errorf("password is not hashed")
+	}
+
+	req, err = http.NewRequest("DELETE", usersPath+"/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveUsers(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("DELETE code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if !reflect.DeepEqual(s.removed, []string{"bob"}) {
+		t.Errorf("removed = %v, want %v", s.removed, []string{"bob"})
+	}
+
+	req, err = http.NewRequest("PUT", usersPath+"/alice/roles", strings.NewReader(`{"roles":["app","ops"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveUsers(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("PUT code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if w := [][]string{{"alice", "app", "ops"}}; !reflect.DeepEqual(s.roles, w) {
+		t.Errorf("roles = %v, want %v", s.roles, w)
+	}
+}
+
+func TestServeUsersFail(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		users  fakeUsers
+		err    error
+
+		wcode int
+	}{
+		{"PATCH", usersPath, "", fakeUsers{"root": "r"}, nil, http.StatusMethodNotAllowed},
+		{"GET", usersPath + "/root", "", fakeUsers{"root": "r"}, nil, http.StatusNotFound},
+		// bad user
+		{"POST", usersPath, "bad json", fakeUsers{"root": "r"}, nil, http.StatusBadRequest},
+		{"POST", usersPath, `{"name":"a/b","password":"p"}`, fakeUsers{"root": "r"}, nil, http.StatusBadRequest},
+		// the first user must be root
+		{"POST", usersPath, `{"name":"bob","password":"p"}`, fakeUsers{}, nil, http.StatusBadRequest},
+		// server errors
+		{"POST", usersPath, `{"name":"bob","password":"p"}`, fakeUsers{"root": "r"}, etcdserver.ErrUserExists, http.StatusConflict},
+		{"DELETE", usersPath + "/bob", "", fakeUsers{"root": "r"}, etcdserver.ErrUserNotFound, http.StatusNotFound},
+		{"DELETE", usersPath + "/root", "", fakeUsers{"root": "r"}, etcdserver.ErrRemoveRoot, http.StatusConflict},
+		{"DELETE", usersPath + "/bob", "", fakeUsers{"root": "r"}, errors.New("blah"), http.StatusInternalServerError},
+		// roles
+		{"PUT", usersPath + "/bob", `{"roles":[]}`, fakeUsers{"root": "r"}, nil, http.StatusNotFound},
+		{"PUT", usersPath + "/roles", `{"roles":[]}`, fakeUsers{"root": "r"}, nil, http.StatusNotFound},
+		{"PUT", usersPath + "/bob/roles", "bad json", fakeUsers{"root": "r"}, nil, http.StatusBadRequest},
+		{"PUT", usersPath + "/bob/roles", `{"roles":["app"]}`, fakeUsers{"root": "r"}, etcdserver.ErrRoleNotFound, http.StatusNotFound},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{server: &errServer{tt.err}, users: tt.users, timeout: time.Hour}
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveUsers(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		checkErrorBody(t, i, rw)
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		user   string
+		pass   string
+		users  fakeUsers
+
+		wcode int
+	}{
+		{"GET", keysPrefix + "/foo", "bob", "b", fakeUsers{"root": "r", "bob": "b"}, http.StatusOK},
+		{"GET", keysPrefix + "/foo", "", "", fakeUsers{"root": "r", "bob": "b"}, http.StatusUnauthorized},
+		{"GET", keysPrefix + "/foo", "bob", "wrong", fakeUsers{"root": "r", "bob": "b"}, http.StatusUnauthorized},
+		{"GET", keysPrefix + "/foo", "alice", "b", fakeUsers{"root": "r", "bob": "b"}, http.StatusUnauthorized},
+		// no user authenticates before root is created
+		{"GET", keysPrefix + "/foo", "", "", fakeUsers{}, http.StatusUnauthorized},
+		{"GET", healthPath, "", "", fakeUsers{"root": "r"}, http.StatusOK},
+		{"GET", metricsPath, "", "", fakeUsers{"root": "r"}, http.StatusOK},
+		// creating root
+		{"POST", usersPath, "", "", fakeUsers{}, http.StatusOK},
+		{"POST", usersPath, "", "", fakeUsers{"root": "r"}, http.StatusUnauthorized},
+		{"POST", usersPath, "root", "r", fakeUsers{"root": "r"}, http.StatusOK},
+		{"DELETE", usersPath + "/bob", "", "", fakeUsers{}, http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		h := NewAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tt.users, false)
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		wauth := ""
+		if tt.wcode == http.StatusUnauthorized {
+			wauth = `Basic realm="etcd"`
+			checkErrorBody(t, i, rw)
+		}
+		if g := rw.Header().Get("WWW-Authenticate"); g != wauth {
+			t.Errorf("#%d: WWW-Authenticate = %q, want %q", i, g, wauth)
+		}
+	}
+}
+
+// TestAuthHandlerPermissions tests that the requests of a user are served
+// only if its role permits them, before they reach the client handler.
+func TestAuthHandlerPermissions(t *testing.T) {
+	users := roleUsers{
+		fakeUsers: fakeUsers{"root": "r", "bob": "b"},
+		role:      etcdserver.Role{Name: "app", Read: []string{"/app/"}},
+	}
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		user   string
+
+		wcode int
+	}{
+		{"GET", keysPrefix + "/app/foo", "", "bob", http.StatusOK},
+		{"HEAD", keysPrefix + "/app/foo", "", "bob", http.StatusOK},
+		{"PUT", keysPrefix + "/app/foo", "value=bar", "bob", http.StatusForbidden},
+		{"DELETE", keysPrefix + "/app/foo", "", "bob", http.StatusForbidden},
+		{"GET", keysPrefix + "/other/foo", "", "bob", http.StatusForbidden},
+		{"PUT", keysPrefix + "/other/foo", "value=bar", "bob", http.StatusForbidden},
+		{"GET", keysPrefix, "", "bob", http.StatusForbidden},
+		{"POST", txnPath, `{"compare":[{"key":"/app/foo"}]}`, "bob", http.StatusOK},
+		{"POST", txnPath, `{"compare":[{"key":"/other/foo"}]}`, "bob", http.StatusForbidden},
+		{"POST", txnPath, `{"success":[{"action":"set","key":"/app/foo"}]}`, "bob", http.StatusForbidden},
+		{"POST", txnPath, "bad json", "bob", http.StatusForbidden},
+		{"GET", membersPath, "", "bob", http.StatusOK},
+		{"GET", versionPath, "", "bob", http.StatusOK},
+		{"GET", usersPath, "", "bob", http.StatusForbidden},
+		{"PUT", rolesPath + "/app", `{"read":["/"]}`, "bob", http.StatusForbidden},
+		{"POST", adminMembersPrefix, "", "bob", http.StatusForbidden},
+		{"GET", debugRaftPath, "", "bob", http.StatusForbidden},
+		{"GET", debugRaftPath, "", "root", http.StatusOK},
+		{"PUT", keysPrefix + "/other/foo", "value=bar", "root", http.StatusOK},
+		{"PUT", rolesPath + "/app", `{"read":["/"]}`, "root", http.StatusOK},
+	}
+	for i, tt := range tests {
+		var body string
+		h := NewAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+		}), users, false)
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(tt.user, users.fakeUsers[tt.user])
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		// the body read to check a transaction is still served
+		if rw.Code == http.StatusOK && body != tt.body {
+			t.Errorf("#%d: body = %q, want %q", i, body, tt.body)
+		}
+		if rw.Code == http.StatusForbidden {
+			checkErrorBody(t, i, rw)
+		}
+	}
+}
+
+// TestAuthHandlerTooLarge tests that the body of a transaction read to
+// check its keys is limited, before it reaches the client handler.
+func TestAuthHandlerTooLarge(t *testing.T) {
+	users := roleUsers{
+		fakeUsers: fakeUsers{"root": "r", "bob": "b"},
+		role:      etcdserver.Role{Name: "app", Read: []string{"/app/"}, Write: []string{"/app/"}},
+	}
+	served := false
+	h := NewLimitHandler(NewAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}), users, false), 64)
+
+	txn := `{"success":[{"action":"set","key":"/app/foo","value":"` + strings.Repeat("a", 64) + `"}]}`
+	for i, body := range []io.Reader{strings.NewReader(txn), onlyReader{strings.NewReader(txn)}} {
+		req, err := http.NewRequest("POST", txnPath, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("bob", "b")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, http.StatusRequestEntityTooLarge)
+		}
+		if served {
+			t.Errorf("#%d: the transaction is served", i)
+		}
+	}
+}
+
+// TestAuthHandlerHidden tests that a user who may read "/" still cannot list
+// the keys of etcd itself, the users and their password hashes among them.
+func TestAuthHandlerHidden(t *testing.T) {
+	users := roleUsers{
+		fakeUsers: fakeUsers{"root": "r", "bob": "b"},
+		role:      etcdserver.Role{Name: "all", Read: []string{"/"}},
+	}
+	tests := []struct {
+		path string
+		user string
+
+		wcode int
+	}{
+		{keysPrefix + "/?recursive=true&hidden=true", "bob", http.StatusForbidden},
+		{keysPrefix + "?hidden=true", "bob", http.StatusForbidden},
+		{keysPrefix + "/?hidden=1", "bob", http.StatusForbidden},
+		// the listings without the hidden keys leave /_etcd out
+		{keysPrefix + "/?recursive=true", "bob", http.StatusOK},
+		{keysPrefix + "/?recursive=true&wait=true", "bob", http.StatusOK},
+		{keysPrefix + "/app?recursive=true&hidden=true", "bob", http.StatusOK},
+		{keysPrefix + "/?recursive=true&hidden=true", "root", http.StatusOK},
+	}
+	for i, tt := range tests {
+		h := NewAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), users, false)
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(tt.user, users.fakeUsers[tt.user])
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+// TestAuthHandlerClientCert tests that, with certAuth, the common name of
+// a verified client certificate authenticates the user of that name.
+func TestAuthHandlerClientCert(t *testing.T) {
+	users := roleUsers{
+		fakeUsers: fakeUsers{"root": "r", "bob": "b"},
+		role:      etcdserver.Role{Name: "app", Read: []string{"/app/"}},
+	}
+	verified := func(cn string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	tests := []struct {
+		path     string
+		tls      *tls.ConnectionState
+		user     string
+		certAuth bool
+
+		wcode int
+	}{
+		{keysPrefix + "/app/foo", verified("bob"), "", true, http.StatusOK},
+		{keysPrefix + "/other/foo", verified("bob"), "", true, http.StatusForbidden},
+		{keysPrefix + "/other/foo", verified("root"), "", true, http.StatusOK},
+		// no such user
+		{keysPrefix + "/app/foo", verified("alice"), "", true, http.StatusUnauthorized},
+		// a certificate not verified
+		{keysPrefix + "/app/foo", &tls.ConnectionState{}, "", true, http.StatusUnauthorized},
+		{keysPrefix + "/app/foo", nil, "", true, http.StatusUnauthorized},
+		// the certificates are not trusted without certAuth
+		{keysPrefix + "/app/foo", verified("bob"), "", false, http.StatusUnauthorized},
+		// the credentials come first
+		{keysPrefix + "/other/foo", verified("root"), "bob", true, http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		h := NewAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), users, tt.certAuth)
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TLS = tt.tls
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, users.fakeUsers[tt.user])
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+	}
+}
+
+func TestServeRoles(t *testing.T) {
+	s := &roleServer{}
+	role := etcdserver.Role{Name: "app", Read: []string{"/app"}, Write: []string{"/app/w"}}
+	h := &serverHandler{server: s, users: roleUsers{role: role}, timeout: time.Hour}
+
+	req, err := http.NewRequest("GET", rolesPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	h.serveRoles(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("GET code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if g, w := rw.Body.String(), `{"roles":[{"name":"app","read":["/app"],"write":["/app/w"]}]}`+"\n"; g != w {
+		t.Errorf("GET body = %q, want %q", g, w)
+	}
+
+	req, err = http.NewRequest("PUT", rolesPath+"/app", strings.NewReader(`{"name":"ignored","read":["/app"],"write":["/app/w"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveRoles(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("PUT code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if !reflect.DeepEqual(s.set, []etcdserver.Role{role}) {
+		t.Errorf("set = %+v, want %+v", s.set, []etcdserver.Role{role})
+	}
+
+	req, err = http.NewRequest("DELETE", rolesPath+"/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	h.serveRoles(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("DELETE code = %d, want %d", rw.Code, http.StatusNoContent)
+	}
+	if !reflect.DeepEqual(s.removed, []string{"app"}) {
+		t.Errorf("removed = %v, want %v", s.removed, []string{"app"})
+	}
+}
+
+func TestServeRolesFail(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		err    error
+
+		wcode int
+	}{
+		{"POST", rolesPath, "", nil, http.StatusMethodNotAllowed},
+		{"GET", rolesPath + "/app", "", nil, http.StatusNotFound},
+		{"PUT", rolesPath, `{}`, nil, http.StatusNotFound},
+		{"DELETE", rolesPath, "", nil, http.StatusNotFound},
+		{"PUT", rolesPath + "/app", "bad json", nil, http.StatusBadRequest},
+		// server errors
+		{"PUT", rolesPath + "/", `{}`, etcdserver.ErrInvalidRole, http.StatusBadRequest},
+		{"DELETE", rolesPath + "/app", "", etcdserver.ErrRoleNotFound, http.StatusNotFound},
+		{"DELETE", rolesPath + "/app", "", errors.New("blah"), http.StatusInternalServerError},
+	}
+	for i, tt := range tests {
+		h := &serverHandler{server: &errServer{tt.err}, users: fakeUsers{}, timeout: time.Hour}
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.serveRoles(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		checkErrorBody(t, i, rw)
+	}
+}
+
+func TestServeKeysTimeout(t *testing.T) {
+	tests := []struct {
+		query   string
+		timeout time.Duration
+
+		wcode     int
+		wdeadline time.Duration
+	}{
+		{"", 10 * time.Millisecond, http.StatusGatewayTimeout, 10 * time.Millisecond},
+		{"?timeout=10ms", time.Hour, http.StatusGatewayTimeout, 10 * time.Millisecond},
+		// the server timeout caps the one of the request
+		{"?timeout=1h", 10 * time.Millisecond, http.StatusGatewayTimeout, 10 * time.Millisecond},
+		{"?timeout=10", time.Hour, http.StatusBadRequest, 0},
+		{"?timeout=-1s", time.Hour, http.StatusBadRequest, 0},
+	}
+	for i, tt := range tests {
+		server := &stalledServer{}
+		h := &serverHandler{
+			timeout: tt.timeout,
+			server:  server,
+			timer:   &dummyRaftTimer{},
+		}
+		req, err := http.NewRequest("PUT", "http://example.com/v2/keys/foo"+tt.query, strings.NewReader("value=bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		h.serveKeys(rw, req)
+
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if server.deadline > tt.wdeadline {
+			t.Errorf("#%d: deadline in %v, want at most %v", i, server.deadline, tt.wdeadline)
+		}
+		wbody := `{"errorCode":302,"message":"Request timed out","index":0}` + "\n"
+		if tt.wcode == http.StatusGatewayTimeout && rw.Body.String() != wbody {
+			t.Errorf("#%d: body = %q, want %q", i, rw.Body.String(), wbody)
+		}
+	}
+}
+
+func TestServeKeysWatch(t *testing.T) {
+	req := mustNewRequest(t, "/foo/bar")
+	ec := make(chan *store.Event)
+	dw := &dummyWatcher{
+		echan: ec,
+	}
+	server := &resServer{
+		etcdserver.Response{
+			Watcher: dw,
+		},
+	}
+	h := &serverHandler{
+		timeout: time.Hour,
+		server:  server,
+		timer:   &dummyRaftTimer{},
+	}
+	go func() {
+		ec <- &store.Event{
+			Action: store.Get,
+			Node:   &store.NodeExtern{},
+		}
+	}()
+	rw := httptest.NewRecorder()
+
+	h.serveKeys(rw, req)
+
+	wcode := http.StatusOK
+	wbody := mustMarshalEvent(
+		t,
+		&store.Event{
+			Action: store.Get,
+			Node:   &store.NodeExtern{},
+		},
+	)
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+func TestHandleWatch(t *testing.T) {
+	rw := httptest.NewRecorder()
+	wa := &dummyWatcher{
+		echan: make(chan *store.Event, 1),
+	}
+	wa.echan <- &store.Event{
+		Action: store.Get,
+		Node:   &store.NodeExtern{},
+	}
+
+	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
+
+	wcode := http.StatusOK
+	wct := "application/json"
+	wri := "100"
+	wrt := "5"
+	wbody := mustMarshalEvent(
+		t,
+		&store.Event{
+			Action: store.Get,
+			Node:   &store.NodeExtern{},
+		},
+	)
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	h := rw.Header()
+	if ct := h.Get("Content-Type"); ct != wct {
+		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	}
+	if ri := h.Get("X-Raft-Index"); ri != wri {
+		t.Errorf("X-Raft-Index=%q, want %q", ri, wri)
+	}
+	if rt := h.Get("X-Raft-Term"); rt != wrt {
+		t.Errorf("X-Raft-Term=%q, want %q", rt, wrt)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+func TestHandleWatchNoEvent(t *testing.T) {
+	rw := httptest.NewRecorder()
+	wa := &dummyWatcher{
+		echan: make(chan *store.Event, 1),
+	}
+	close(wa.echan)
+
+	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
+
+	wcode := http.StatusOK
+	wct := "application/json"
+	wbody := ""
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	h := rw.Header()
+	if ct := h.Get("Content-Type"); ct != wct {
+		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+type recordingCloseNotifier struct {
+	*httptest.ResponseRecorder
+	cn chan bool
+}
+
+func (rcn *recordingCloseNotifier) CloseNotify() <-chan bool {
+	return rcn.cn
+}
+
+func TestHandleWatchCloseNotified(t *testing.T) {
+	rw := &recordingCloseNotifier{
+		ResponseRecorder: httptest.NewRecorder(),
+		cn:               make(chan bool, 1),
+	}
+	rw.cn <- true
+	wa := &dummyWatcher{}
+
+	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
+
+	wcode := http.StatusOK
+	wct := "application/json"
+	wbody := ""
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	h := rw.Header()
+	if ct := h.Get("Content-Type"); ct != wct {
+		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+func TestHandleWatchTimeout(t *testing.T) {
+	rw := httptest.NewRecorder()
+	wa := &dummyWatcher{}
+	// Simulate a timed-out context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	handleWatch(ctx, rw, wa, false, dummyRaftTimer{})
+
+	wcode := http.StatusOK
+	wct := "application/json"
+	wbody := ""
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	h := rw.Header()
+	if ct := h.Get("Content-Type"); ct != wct {
+		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+// flushingRecorder provides a channel to allow users to block until the Recorder is Flushed()
+type flushingRecorder struct {
+	*httptest.ResponseRecorder
+	ch chan struct{}
+}
+
+func (fr *flushingRecorder) Flush() {
+	fr.ResponseRecorder.Flush()
+	fr.ch <- struct{}{}
+}
+
+func TestHandleWatchStreaming(t *testing.T) {
+	rw := &flushingRecorder{
+		httptest.NewRecorder(),
+		make(chan struct{}, 1),
+	}
+	wa := &dummyWatcher{
+		echan: make(chan *store.Event),
+	}
+
+	// Launch the streaming handler in the background with a cancellable context
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		handleWatch(ctx, rw, wa, true, dummyRaftTimer{})
+		close(done)
+	}()
+
+	// Expect one Flush for the headers etc.
+	select {
+	case <-rw.ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for flush")
+	}
+
+	// Expect headers but no body
+	wcode := http.StatusOK
+	wct := "application/json"
+	wbody := ""
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	h := rw.Header()
+	if ct := h.Get("Content-Type"); ct != wct {
+		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	}
+	g := rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+
+	// Now send the first event
+	select {
+	case wa.echan <- &store.Event{
+		Action: store.Get,
+		Node:   &store.NodeExtern{},
+	}:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	// Wait for it to be flushed...
+	select {
+	case <-rw.ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for flush")
+	}
+
+	// And check the body is as expected
+	wbody = mustMarshalEvent(
+		t,
+		&store.Event{
+			Action: store.Get,
+			Node:   &store.NodeExtern{},
+		},
+	)
+	g = rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+
+	// Rinse and repeat
+	select {
+	case wa.echan <- &store.Event{
+		Action: store.Get,
+		Node:   &store.NodeExtern{},
+	}:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	select {
+	case <-rw.ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for flush")
+	}
+
+	// This time, we expect to see both events
+	wbody = wbody + wbody
+	g = rw.Body.String()
+	if g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+
+	// Finally, time out the connection and ensure the serving goroutine returns
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for done")
+	}
+}
+
+type fakeCluster struct {
+	members []etcdserver.Member
+}
+
+func (c *fakeCluster) Get() etcdserver.Cluster {
+	cl := &etcdserver.Cluster{}
+	cl.AddSlice(c.members)
+	return *cl
+}
+
+func (c *fakeCluster) Add(m etcdserver.Member) { return }
+func (c *fakeCluster) Delete(id int64)         { return }
+
+// newSingleServer starts an EtcdServer that is the leader of a single
+// member cluster, and an http server serving its client handler.
+func newSingleServer(t *testing.T) (*etcdserver.EtcdServer, *httptest.Server) {
+	cls := &fakeCluster{members: []etcdserver.Member{{ID: 1, Name: "node1"}}}
+	st := store.New()
+	// the cluster version, as set by the leader, supports every request
+	st.Set("/_etcd/version", false, "0.5.0-alpha", store.Permanent)
+	srv := &etcdserver.EtcdServer{
+		Name:         "node1",
+		Node:         raft.StartNode(1, []int64{1}, 10, 1),
+		Store:        st,
+		Send:         func(msgs []raftpb.Message) {},
+		Storage:      nopStorage{},
+		ClusterStore: cls,
+	}
+	srv.Start()
+	srv.Node.Campaign(context.TODO())
+	return srv, httptest.NewServer(NewClientHandler(srv, cls, time.Hour, WriteForward, DefaultMaxRequestBytes))
 }
-func (rs *resServer) Process(_ context.Context, _ raftpb.Message) error { return nil }
-func (rs *resServer) Start()                                            {}
-func (rs *resServer) Stop()                                             {}
 
-func mustMarshalEvent(t *testing.T, ev *store.Event) string {
-	b := new(bytes.Buffer)
-	if err := json.NewEncoder(b).Encode(ev); err != nil {
-		t.Fatalf("error marshalling event %#v: %v", ev, err)
+func mustDecodeEvent(t *testing.T, resp *http.Response) *store.Event {
+	defer resp.Body.Close()
+	ev := &store.Event{}
+	if err := json.NewDecoder(resp.Body).Decode(ev); err != nil {
+		t.Fatalf("error decoding event: %v", err)
 	}
-	return b.String()
+	return ev
 }
 
-func TestBadServeKeys(t *testing.T) {
-	testBadCases := []struct {
-		req    *http.Request
-		server etcdserver.Server
-
-		wcode int
-	}{
-		{
-			// bad method
-			&http.Request{
-				Method: "CONNECT",
-			},
-			&resServer{},
-
-			http.StatusMethodNotAllowed,
-		},
-		{
-			// bad method
-			&http.Request{
-				Method: "TRACE",
-			},
-			&resServer{},
-
-			http.StatusMethodNotAllowed,
-		},
-		{
-			// parseRequest error
-			&http.Request{
-				Body:   nil,
-				Method: "PUT",
-			},
-			&resServer{},
-
-			http.StatusBadRequest,
-		},
-		{
-			// etcdserver.Server error
-			mustNewRequest(t, "foo"),
-			&errServer{
-				errors.New("blah"),
-			},
-
-			http.StatusInternalServerError,
-		},
-		{
-			// non-event/watcher response from etcdserver.Server
-			mustNewRequest(t, "foo"),
-			&resServer{
-				etcdserver.Response{},
-			},
+func TestServeTxnEndToEnd(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-			http.StatusInternalServerError,
-		},
-	}
-	for i, tt := range testBadCases {
-		h := &serverHandler{
-			timeout: 0, // context times out immediately
-			server:  tt.server,
+	txn := func(body string) (int, *store.TxnResponse) {
+		resp, err := http.Post(s.URL+txnPath, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
 		}
-		rw := httptest.NewRecorder()
-		h.serveKeys(rw, tt.req)
-		if rw.Code != tt.wcode {
-			t.Errorf("#%d: got code=%d, want %d", i, rw.Code, tt.wcode)
+		defer resp.Body.Close()
+		tr := &store.TxnResponse{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+				t.Fatalf("error decoding txn response: %v", err)
+			}
 		}
+		return resp.StatusCode, tr
 	}
-}
 
-func TestServeKeysEvent(t *testing.T) {
-	req := mustNewRequest(t, "foo")
-	server := &resServer{
-		etcdserver.Response{
-			Event: &store.Event{
-				Action: store.Get,
-				Node:   &store.NodeExtern{},
-			},
-		},
+	lock := `{
+		"compare": [{"key": "/lock", "exist": false}],
+		"success": [{"action": "set", "key": "/lock", "value": "a"}, {"action": "set", "key": "/owner", "value": "a", "ttl": 60}],
+		"failure": [{"action": "set", "key": "/waiters/a", "value": "a"}]
+	}`
+	code, tr := txn(lock)
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", code, http.StatusOK)
 	}
-	h := &serverHandler{
-		timeout: time.Hour,
-		server:  server,
-		timer:   &dummyRaftTimer{},
+	if !tr.Succeeded || len(tr.Results) != 2 {
+		t.Fatalf("response = %+v, want the 2 success results", tr)
+	}
+	if n := tr.Results[1].Node; *n.Value != "a" || n.TTL == 0 {
+		t.Errorf("node = %+v, want value %q with a TTL", n, "a")
 	}
-	rw := httptest.NewRecorder()
-
-	h.serveKeys(rw, req)
-
-	wcode := http.StatusOK
-	wbody := mustMarshalEvent(
-		t,
-		&store.Event{
-			Action: store.Get,
-			Node:   &store.NodeExtern{},
-		},
-	)
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	code, tr = txn(lock)
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", code, http.StatusOK)
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	if tr.Succeeded || len(tr.Results) != 1 || tr.Results[0].Node.Key != "/waiters/a" {
+		t.Fatalf("response = %+v, want the failure result", tr)
+	}
+	ev, err := srv.Store.Get("/lock", false, false)
+	if err != nil || *ev.Node.Value != "a" {
+		t.Errorf("/lock = %+v, %v, want %q", ev, err, "a")
+	}
+
+	for _, body := range []string{
+		"nope",
+		`{"success": [{"action": "get", "key": "/lock"}]}`,
+		`{"success": [{"action": "set", "value": "a"}]}`,
+		`{"compare": [{"value": "a"}]}`,
+	} {
+		if code, _ := txn(body); code != http.StatusBadRequest {
+			t.Errorf("%s: code = %d, want %d", body, code, http.StatusBadRequest)
+		}
 	}
 }
 
-func TestServeKeysWatch(t *testing.T) {
-	req := mustNewRequest(t, "/foo/bar")
-	ec := make(chan *store.Event)
-	dw := &dummyWatcher{
-		echan: ec,
+func TestServeKeysWaitEndToEnd(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
+
+	set := func(v string) *store.Event {
+		req, err := http.NewRequest("PUT", s.URL+keysPrefix+"/foo", strings.NewReader("value="+v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustDecodeEvent(t, resp)
 	}
-	server := &resServer{
-		etcdserver.Response{
-			Watcher: dw,
-		},
+	first := set("bar")
+
+	// the event at waitIndex is already in the history
+	resp, err := http.Get(fmt.Sprintf("%s%s/foo?wait=true&waitIndex=%d", s.URL, keysPrefix, first.Node.ModifiedIndex))
+	if err != nil {
+		t.Fatal(err)
 	}
-	h := &serverHandler{
-		timeout: time.Hour,
-		server:  server,
-		timer:   &dummyRaftTimer{},
+	if ev := mustDecodeEvent(t, resp); *ev.Node.Value != "bar" {
+		t.Errorf("value = %s, want bar", *ev.Node.Value)
 	}
+
+	// the event after waitIndex happens while the request is waiting
+	evc := make(chan *store.Event, 1)
 	go func() {
-		ec <- &store.Event{
-			Action: store.Get,
-			Node:   &store.NodeExtern{},
+		resp, err := http.Get(fmt.Sprintf("%s%s/foo?wait=true&waitIndex=%d", s.URL, keysPrefix, first.Node.ModifiedIndex+1))
+		if err != nil {
+			t.Error(err)
+			close(evc)
+			return
 		}
+		evc <- mustDecodeEvent(t, resp)
 	}()
-	rw := httptest.NewRecorder()
+	second := set("baz")
+	select {
+	case ev := <-evc:
+		if ev == nil {
+			return
+		}
+		if ev.Action != store.Set || *ev.Node.Value != "baz" || ev.Node.ModifiedIndex != second.Node.ModifiedIndex {
+			t.Errorf("event = %s %s@%d, want set baz@%d", ev.Action, *ev.Node.Value, ev.Node.ModifiedIndex, second.Node.ModifiedIndex)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+}
 
-	h.serveKeys(rw, req)
+func TestServeKeysWaitClientClosed(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-	wcode := http.StatusOK
-	wbody := mustMarshalEvent(
-		t,
-		&store.Event{
-			Action: store.Get,
-			Node:   &store.NodeExtern{},
-		},
-	)
+	req, err := http.NewRequest("GET", s.URL+keysPrefix+"/foo?wait=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel := make(chan struct{})
+	req.Cancel = cancel
+	errc := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		errc <- err
+	}()
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	watchers := func() uint64 {
+		var st store.Stats
+		if err := json.Unmarshal(srv.Store.JsonStats(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Watchers
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	for i := 0; watchers() != 1; i++ {
+		if i > 100 {
+			t.Fatal("watcher was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-}
 
-func TestHandleWatch(t *testing.T) {
-	rw := httptest.NewRecorder()
-	wa := &dummyWatcher{
-		echan: make(chan *store.Event, 1),
-	}
-	wa.echan <- &store.Event{
-		Action: store.Get,
-		Node:   &store.NodeExtern{},
+	close(cancel)
+	<-errc
+	for i := 0; watchers() != 0; i++ {
+		if i > 100 {
+			t.Fatal("watcher was not removed after the client closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+}
 
-	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
+// TestServeKeysCompareAndSwapContended tests that when many clients swap the
+// same key from the same index, exactly one of them succeeds and the others
+// see the precondition fail.
+func TestServeKeysCompareAndSwapContended(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-	wcode := http.StatusOK
-	wct := "application/json"
-	wri := "100"
-	wrt := "5"
-	wbody := mustMarshalEvent(
-		t,
-		&store.Event{
-			Action: store.Get,
-			Node:   &store.NodeExtern{},
-		},
-	)
+	put := func(query string, vals url.Values) (*http.Response, error) {
+		req, err := http.NewRequest("PUT", s.URL+keysPrefix+"/lock"+query, strings.NewReader(vals.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return http.DefaultClient.Do(req)
+	}
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	resp, err := put("?prevIndex=0", url.Values{"value": {"free"}})
+	if err != nil {
+		t.Fatal(err)
 	}
-	h := rw.Header()
-	if ct := h.Get("Content-Type"); ct != wct {
-		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	first := mustDecodeEvent(t, resp)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("code = %d, want %d", resp.StatusCode, http.StatusCreated)
 	}
-	if ri := h.Get("X-Raft-Index"); ri != wri {
-		t.Errorf("X-Raft-Index=%q, want %q", ri, wri)
+	// the key exists now
+	resp, err = put("?prevIndex=0", url.Values{"value": {"free"}})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if rt := h.Get("X-Raft-Term"); rt != wrt {
-		t.Errorf("X-Raft-Term=%q, want %q", rt, wrt)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("code = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	const n = 10
+	codec := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			q := fmt.Sprintf("?prevValue=free&prevIndex=%d", first.Node.ModifiedIndex)
+			resp, err := put(q, url.Values{"value": {fmt.Sprint("owner", i)}})
+			if err != nil {
+				t.Error(err)
+				codec <- 0
+				return
+			}
+			resp.Body.Close()
+			codec <- resp.StatusCode
+		}(i)
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	codes := make(map[int]int)
+	for i := 0; i < n; i++ {
+		codes[<-codec]++
+	}
+	w := map[int]int{http.StatusOK: 1, http.StatusPreconditionFailed: n - 1}
+	if !reflect.DeepEqual(codes, w) {
+		t.Errorf("codes = %v, want %v", codes, w)
 	}
 }
 
-func TestHandleWatchNoEvent(t *testing.T) {
-	rw := httptest.NewRecorder()
-	wa := &dummyWatcher{
-		echan: make(chan *store.Event, 1),
+func TestServeKeysDirectories(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
+
+	do := func(method, key string, vals url.Values) *http.Response {
+		req, err := http.NewRequest(method, s.URL+keysPrefix+key, strings.NewReader(vals.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
 	}
-	close(wa.echan)
 
-	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
+	for _, k := range []string{"/a", "/a/c", "/a/b", "/a/b/d"} {
+		resp := do("PUT", k, url.Values{"dir": {"true"}, "prevExist": {"false"}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create dir %s: code = %d, want %d", k, resp.StatusCode, http.StatusCreated)
+		}
+	}
+	for _, k := range []string{"/a/z", "/a/b/d/y", "/a/b/d/x"} {
+		resp := do("PUT", k, url.Values{"value": {k}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("set %s: code = %d, want %d", k, resp.StatusCode, http.StatusCreated)
+		}
+	}
 
-	wcode := http.StatusOK
-	wct := "application/json"
-	wbody := ""
+	resp, err := http.Get(s.URL + keysPrefix + "/a?recursive=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := mustDecodeEvent(t, resp)
+	var keys func(n *store.NodeExtern) []string
+	keys = func(n *store.NodeExtern) []string {
+		ks := []string{n.Key}
+		for _, c := range n.Nodes {
+			ks = append(ks, keys(c)...)
+		}
+		return ks
+	}
+	wkeys := []string{"/a", "/a/b", "/a/b/d", "/a/b/d/x", "/a/b/d/y", "/a/c", "/a/z"}
+	if g := keys(ev.Node); !reflect.DeepEqual(g, wkeys) {
+		t.Errorf("keys = %v, want %v", g, wkeys)
+	}
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	tests := []struct {
+		method string
+		key    string
+		vals   url.Values
+
+		wcode  int
+		wecode int
+	}{
+		// a directory is deleted only if it is empty, or recursively
+		{"DELETE", "/a/b?dir=true", nil, http.StatusForbidden, etcdErr.EcodeDirNotEmpty},
+		// a value cannot hold children
+		{"PUT", "/a/z/w", url.Values{"value": {"w"}}, http.StatusBadRequest, etcdErr.EcodeNotDir},
+		{"PUT", "/a/z/w", url.Values{"dir": {"true"}}, http.StatusBadRequest, etcdErr.EcodeNotDir},
+	}
+	for i, tt := range tests {
+		resp := do(tt.method, tt.key, tt.vals)
+		var e etcdErr.Error
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, resp.StatusCode, tt.wcode)
+		}
+		if e.ErrorCode != tt.wecode {
+			t.Errorf("#%d: error code = %d, want %d", i, e.ErrorCode, tt.wecode)
+		}
+	}
+
+	resp = do("DELETE", "/a/b?recursive=true", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("recursive delete: code = %d, want %d", resp.StatusCode, http.StatusOK)
 	}
-	h := rw.Header()
-	if ct := h.Get("Content-Type"); ct != wct {
-		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	resp, err = http.Get(s.URL + keysPrefix + "/a/b/d/x")
+	if err != nil {
+		t.Fatal(err)
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get deleted key: code = %d, want %d", resp.StatusCode, http.StatusNotFound)
 	}
 }
 
-type recordingCloseNotifier struct {
-	*httptest.ResponseRecorder
-	cn chan bool
-}
-
-func (rcn *recordingCloseNotifier) CloseNotify() <-chan bool {
-	return rcn.cn
-}
-
-func TestHandleWatchCloseNotified(t *testing.T) {
-	rw := &recordingCloseNotifier{
-		ResponseRecorder: httptest.NewRecorder(),
-		cn:               make(chan bool, 1),
+// TestSnapshotToMemberAddedAfterCompaction checks that a member added after
+// the leader compacted its log catches up from a snapshot streamed to
+// raftSnapshotPrefix.
+func TestSnapshotToMemberAddedAfterCompaction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	snaps := 0
+	handlers := make(map[int64]http.Handler)
+	peers := make(map[int64]*httptest.Server)
+	for id := int64(1); id <= 2; id++ {
+		id := id
+		peers[id] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			h := handlers[id]
+			if r.URL.Path == raftSnapshotPrefix {
+				snaps++
+			}
+			mu.Unlock()
+			if h == nil {
+				http.Error(w, "not started", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+		// the raft streams of the senders are never closed: hang them up
+		// for Close not to wait on them
+		defer func(s *httptest.Server) {
+			s.CloseClientConnections()
+			s.Close()
+		}(peers[id])
+	}
+
+	m1 := etcdserver.Member{ID: 1, Name: "node1", PeerURLs: []string{peers[1].URL}}
+	m2 := etcdserver.Member{ID: 2, Name: "node2", PeerURLs: []string{peers[2].URL}}
+	// the senders are stopped after the servers
+	var stops []func()
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+	// the new member starts knowing the members of the cluster it joins
+	start := func(id int64, bootstrap etcdserver.Cluster) *etcdserver.EtcdServer {
+		st := store.New()
+		cls := etcdserver.NewClusterStore(st, bootstrap)
+		send, _, stop := etcdserver.Sender(&http.Transport{}, cls, nil, 0, nil)
+		stops = append(stops, stop)
+		srv := &etcdserver.EtcdServer{
+			Name:         fmt.Sprintf("node%d", id),
+			Node:         raft.StartNode(id, []int64{1}, 10, 1),
+			Store:        st,
+			Send:         send,
+			Storage:      nopStorage{},
+			Ticker:       time.Tick(10 * time.Millisecond),
+			SnapCount:    5,
+			ClusterStore: cls,
+		}
+		srv.Start()
+		mu.Lock()
+		handlers[id] = NewPeerHandler(srv)
+		mu.Unlock()
+		return srv
+	}
+	put := func(s *etcdserver.EtcdServer, id int64) {
+		r := etcdserverpb.Request{Method: "PUT", ID: id, Path: "/foo", Val: fmt.Sprint(id)}
+		if _, err := s.Do(ctx, r); err != nil {
+			t.Fatalf("put %d: %v", id, err)
+		}
 	}
-	rw.cn <- true
-	wa := &dummyWatcher{}
-
-	handleWatch(context.Background(), rw, wa, false, dummyRaftTimer{})
 
-	wcode := http.StatusOK
-	wct := "application/json"
-	wbody := ""
+	s1 := start(1, etcdserver.Cluster{1: &m1})
+	defer s1.Stop()
+	for id := int64(1); id <= 20; id++ {
+		put(s1, id)
+	}
+	if err := s1.AddMember(ctx, m2); err != nil {
+		t.Fatal(err)
+	}
+	s2 := start(2, etcdserver.Cluster{1: &m1, 2: &m2})
+	defer s2.Stop()
+	// the put commits only once the new member has caught up
+	put(s1, 100)
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	// let the new member apply the last entry
+	time.Sleep(50 * time.Millisecond)
+	ev, err := s2.Store.Get("/foo", false, false)
+	if err != nil {
+		t.Fatal(err)
 	}
-	h := rw.Header()
-	if ct := h.Get("Content-Type"); ct != wct {
-		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	if *ev.Node.Value != "100" {
+		t.Errorf("value = %s, want 100", *ev.Node.Value)
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	mu.Lock()
+	defer mu.Unlock()
+	if snaps == 0 {
+		t.Errorf("no snapshot was streamed to the new member")
 	}
 }
 
-func TestHandleWatchTimeout(t *testing.T) {
-	rw := httptest.NewRecorder()
-	wa := &dummyWatcher{}
-	// Simulate a timed-out context
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
+// onlyReader hides the length of the body it reads, so that the body is
+// sent chunked.
+type onlyReader struct {
+	io.Reader
+}
 
-	handleWatch(ctx, rw, wa, false, dummyRaftTimer{})
+func TestServeRequestTooLarge(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-	wcode := http.StatusOK
-	wct := "application/json"
-	wbody := ""
+	large := strings.Repeat("a", DefaultMaxRequestBytes)
+	form := url.Values{"value": {large}}.Encode()
+	txn := `{"success":[{"action":"set","key":"/foo","value":"` + large + `"}]}`
+	tests := []struct {
+		method string
+		url    string
+		ctype  string
+		body   string
+		chunk  bool
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+		wcode int
+	}{
+		{"PUT", keysPrefix + "/foo", "application/x-www-form-urlencoded", "value=bar", false, http.StatusCreated},
+		{"PUT", keysPrefix + "/foo", "application/x-www-form-urlencoded", form, false, http.StatusRequestEntityTooLarge},
+		{"PUT", keysPrefix + "/foo", "application/x-www-form-urlencoded", form, true, http.StatusRequestEntityTooLarge},
+		{"POST", txnPath, "application/json", txn, false, http.StatusRequestEntityTooLarge},
+		{"POST", txnPath, "application/json", txn, true, http.StatusRequestEntityTooLarge},
 	}
-	h := rw.Header()
-	if ct := h.Get("Content-Type"); ct != wct {
-		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	for i, tt := range tests {
+		var body io.Reader = strings.NewReader(tt.body)
+		if tt.chunk {
+			body = onlyReader{body}
+		}
+		req, err := http.NewRequest(tt.method, s.URL+tt.url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.ctype)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, resp.StatusCode, tt.wcode)
+		}
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	ev, err := srv.Store.Get("/foo", false, false)
+	if err != nil || *ev.Node.Value != "bar" {
+		t.Errorf("/foo = %v, %v, want bar", ev, err)
 	}
 }
 
-// flushingRecorder provides a channel to allow users to block until the Recorder is Flushed()
-type flushingRecorder struct {
-	*httptest.ResponseRecorder
-	ch chan struct{}
+// gatedNode hands out no Ready until open is closed.
+type gatedNode struct {
+	raft.Node
+	open chan struct{}
 }
 
-func (fr *flushingRecorder) Flush() {
-	fr.ResponseRecorder.Flush()
-	fr.ch <- struct{}{}
+func (n *gatedNode) Ready() <-chan raft.Ready {
+	select {
+	case <-n.open:
+		return n.Node.Ready()
+	default:
+		return nil
+	}
 }
 
-func TestHandleWatchStreaming(t *testing.T) {
-	rw := &flushingRecorder{
-		httptest.NewRecorder(),
-		make(chan struct{}, 1),
+func TestServeReplaying(t *testing.T) {
+	const last = 1000
+	var ents []raftpb.Entry
+	for i := int64(1); i <= last; i++ {
+		r := etcdserverpb.Request{Method: "PUT", ID: i, Path: "/foo", Val: fmt.Sprint(i)}
+		d, err := r.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, raftpb.Entry{Index: i, Term: 1, Data: d})
+	}
+	n := &gatedNode{
+		Node: raft.RestartNode(1, []int64{1}, 10, 1, nil, raftpb.HardState{Term: 1, Commit: last}, ents),
+		open: make(chan struct{}),
+	}
+	cls := &fakeCluster{members: []etcdserver.Member{{ID: 1, Name: "node1"}}}
+	srv := &etcdserver.EtcdServer{
+		Name:         "node1",
+		Node:         n,
+		Store:        store.New(),
+		Send:         func(msgs []raftpb.Message) {},
+		Storage:      nopStorage{},
+		Ticker:       time.Tick(time.Millisecond),
+		ClusterStore: cls,
+		ReplayIndex:  last,
+	}
+	srv.Start()
+	defer srv.Stop()
+	s := httptest.NewServer(NewClientHandler(srv, cls, time.Hour, WriteForward, DefaultMaxRequestBytes))
+	defer s.Close()
+
+	get := func(p string) int {
+		resp, err := http.Get(s.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
 	}
-	wa := &dummyWatcher{
-		echan: make(chan *store.Event),
+	for _, p := range []string{keysPrefix + "/foo", healthPath} {
+		if code := get(p); code != http.StatusServiceUnavailable {
+			t.Errorf("%s: code = %d before replaying, want %d", p, code, http.StatusServiceUnavailable)
+		}
 	}
 
-	// Launch the streaming handler in the background with a cancellable context
-	ctx, cancel := context.WithCancel(context.Background())
-	done := make(chan struct{})
+	close(n.open)
+	for i := 0; get(keysPrefix+"/foo") != http.StatusOK; i++ {
+		if i > 100 {
+			t.Fatal("still unavailable after replaying")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ev, err := srv.Store.Get("/foo", false, false)
+	if err != nil || *ev.Node.Value != fmt.Sprint(last) {
+		t.Errorf("/foo = %v, %v, want %d", ev, err, last)
+	}
+}
+
+func TestServeHTTP2(t *testing.T) {
+	srv, hs := newSingleServer(t)
+	defer srv.Stop()
+	hs.Close()
+	s := httptest.NewUnstartedServer(hs.Config.Handler)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+	c := s.Client()
+
+	put := func(value string) *store.Event {
+		req, err := http.NewRequest("PUT", s.URL+keysPrefix+"/foo", strings.NewReader("value="+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("put proto = %s, want HTTP/2.0", resp.Proto)
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			t.Fatalf("put code = %d, want %d or %d", resp.StatusCode, http.StatusOK, http.StatusCreated)
+		}
+		return mustDecodeEvent(t, resp)
+	}
+
+	// the watch waits on the connection the next put is sent over
+	first := put("bar")
+	watched := make(chan *http.Response, 1)
 	go func() {
-		handleWatch(ctx, rw, wa, true, dummyRaftTimer{})
-		close(done)
+		resp, err := c.Get(fmt.Sprintf("%s%s/foo?wait=true&waitIndex=%d", s.URL, keysPrefix, first.Node.ModifiedIndex+1))
+		if err != nil {
+			t.Error(err)
+		}
+		watched <- resp
 	}()
+	// the put is sent only once the watch waits for it; otherwise the
+	// watch would find it in the history, and return without waiting
+	for i := 0; ; i++ {
+		var st store.Stats
+		if err := json.Unmarshal(srv.Store.JsonStats(), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Watchers == 1 {
+			break
+		}
+		if i > 500 {
+			t.Fatal("watcher was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	put("baz")
 
-	// Expect one Flush for the headers etc.
 	select {
-	case <-rw.ch:
-	case <-time.After(time.Second):
-		t.Fatalf("timed out waiting for flush")
+	case resp := <-watched:
+		if resp == nil {
+			return
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("watch proto = %s, want HTTP/2.0", resp.Proto)
+		}
+		if ev := mustDecodeEvent(t, resp); *ev.Node.Value != "baz" {
+			t.Errorf("watched value = %q, want %q", *ev.Node.Value, "baz")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch is not woken by the put")
 	}
+}
 
-	// Expect headers but no body
-	wcode := http.StatusOK
-	wct := "application/json"
-	wbody := ""
+// TestServeKeysIndexHeaders tests that the responses to the writes carry
+// the etcd and raft indexes, growing from one write to the next and not
+// lower than the write itself, and that the errors carry them too.
+func TestServeKeysIndexHeaders(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-	if rw.Code != wcode {
-		t.Errorf("got code=%d, want %d", rw.Code, wcode)
-	}
-	h := rw.Header()
-	if ct := h.Get("Content-Type"); ct != wct {
-		t.Errorf("Content-Type=%q, want %q", ct, wct)
+	headers := func(resp *http.Response) (etcdIndex, raftIndex, raftTerm int64) {
+		for _, h := range []struct {
+			name string
+			v    *int64
+		}{
+			{"X-Etcd-Index", &etcdIndex},
+			{"X-Raft-Index", &raftIndex},
+			{"X-Raft-Term", &raftTerm},
+		} {
+			v, err := strconv.ParseInt(resp.Header.Get(h.name), 10, 64)
+			if err != nil {
+				t.Fatalf("%s = %q, want an index", h.name, resp.Header.Get(h.name))
+			}
+			*h.v = v
+		}
+		return
 	}
-	g := rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	put := func(value string) (*store.Event, int64, int64, int64) {
+		req, err := http.NewRequest("PUT", s.URL+keysPrefix+"/foo", strings.NewReader("value="+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ei, ri, rt := headers(resp)
+		return mustDecodeEvent(t, resp), ei, ri, rt
 	}
 
-	// Now send the first event
-	select {
-	case wa.echan <- &store.Event{
-		Action: store.Get,
-		Node:   &store.NodeExtern{},
-	}:
-	case <-time.After(time.Second):
-		t.Fatal("timed out waiting for send")
+	ev1, ei1, ri1, rt1 := put("bar")
+	ev2, ei2, ri2, rt2 := put("baz")
+	if ei1 != int64(ev1.Node.ModifiedIndex) || ei2 != int64(ev2.Node.ModifiedIndex) {
+		t.Errorf("X-Etcd-Index = %d, %d, want %d, %d", ei1, ei2, ev1.Node.ModifiedIndex, ev2.Node.ModifiedIndex)
 	}
-
-	// Wait for it to be flushed...
-	select {
-	case <-rw.ch:
-	case <-time.After(time.Second):
-		t.Fatalf("timed out waiting for flush")
+	if ei2 <= ei1 {
+		t.Errorf("X-Etcd-Index = %d then %d, want it growing", ei1, ei2)
 	}
-
-	// And check the body is as expected
-	wbody = mustMarshalEvent(
-		t,
-		&store.Event{
-			Action: store.Get,
-			Node:   &store.NodeExtern{},
-		},
-	)
-	g = rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	if ri1 < 1 || ri2 <= ri1 {
+		t.Errorf("X-Raft-Index = %d then %d, want it growing", ri1, ri2)
 	}
-
-	// Rinse and repeat
-	select {
-	case wa.echan <- &store.Event{
-		Action: store.Get,
-		Node:   &store.NodeExtern{},
-	}:
-	case <-time.After(time.Second):
-		t.Fatal("timed out waiting for send")
+	if rt1 < 1 || rt2 < rt1 {
+		t.Errorf("X-Raft-Term = %d then %d, want it not decreasing", rt1, rt2)
 	}
 
-	select {
-	case <-rw.ch:
-	case <-time.After(time.Second):
-		t.Fatalf("timed out waiting for flush")
+	resp, err := http.Get(s.URL + keysPrefix + "/missing")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// This time, we expect to see both events
-	wbody = wbody + wbody
-	g = rw.Body.String()
-	if g != wbody {
-		t.Errorf("got body=%#v, want %#v", g, wbody)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("code = %d, want %d", resp.StatusCode, http.StatusNotFound)
 	}
+	ei, ri, rt := headers(resp)
+	if ei < ei2 || ri < ri2 || rt < rt2 {
+		t.Errorf("error headers = %d, %d, %d, want at least %d, %d, %d", ei, ri, rt, ei2, ri2, rt2)
+	}
+}
 
-	// Finally, time out the connection and ensure the serving goroutine returns
-	cancel()
+func TestServeKeysNoLeader(t *testing.T) {
+	cls := &fakeCluster{members: []etcdserver.Member{{ID: 1, Name: "node1"}, {ID: 2, Name: "node2"}}}
+	// the node cannot elect a leader without its peer
+	srv := &etcdserver.EtcdServer{
+		Name:         "node1",
+		Node:         raft.StartNode(1, []int64{1, 2}, 10, 1),
+		Store:        store.New(),
+		Send:         func(msgs []raftpb.Message) {},
+		Storage:      nopStorage{},
+		ClusterStore: cls,
+	}
+	srv.Start()
+	defer srv.Stop()
+	// the leader may be lost after the write passed the check of
+	// leaderWrites, so the proposal is made whatever the leader
+	h := &serverHandler{server: srv, timer: srv, timeout: 10 * time.Millisecond}
 
-	select {
-	case <-done:
-	case <-time.After(time.Second):
-		t.Fatalf("timed out waiting for done")
+	rw := httptest.NewRecorder()
+	h.serveKeys(rw, mustNewForm(t, "foo", url.Values{"value": {"bar"}}))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	}
+	var e etcdErr.Error
+	if err := json.NewDecoder(rw.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ErrorCode != etcdErr.EcodeLeaderElect || e.Cause != "no leader; try later" {
+		t.Errorf("error = %d %q, want %d %q", e.ErrorCode, e.Cause, etcdErr.EcodeLeaderElect, "no leader; try later")
 	}
 }
 
-type fakeCluster struct {
-	members []etcdserver.Member
-}
+func TestServeKeysDeleteRange(t *testing.T) {
+	srv, s := newSingleServer(t)
+	defer srv.Stop()
+	defer s.Close()
 
-func (c *fakeCluster) Get() etcdserver.Cluster {
-	cl := &etcdserver.Cluster{}
-	cl.AddSlice(c.members)
-	return *cl
-}
+	do := func(method, key string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+keysPrefix+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, k := range []string{"/a/x", "/a/b/y", "/a/b/z", "/ab"} {
+		resp := do("PUT", k+"?value=v")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("set %s: code = %d, want %d", k, resp.StatusCode, http.StatusCreated)
+		}
+	}
+	first := srv.Store.Index()
+	resp, err := http.Get(fmt.Sprintf("%s%s/a?wait=true&recursive=true&waitIndex=%d", s.URL, keysPrefix, first+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched := make(chan *store.Event, 1)
+	go func() {
+		watched <- mustDecodeEvent(t, resp)
+	}()
 
-func (c *fakeCluster) Delete(id int64) { return }
+	ev := mustDecodeEvent(t, do("DELETE", "/a?recursive=true&range=true"))
+	if ev.Action != store.DeleteRange || ev.Deleted != 4 || ev.Node.ModifiedIndex != first+1 {
+		t.Errorf("event = %s deleted %d at %d, want %s deleted 4 at %d", ev.Action, ev.Deleted, ev.Node.ModifiedIndex, store.DeleteRange, first+1)
+	}
+	select {
+	case wev := <-watched:
+		if wev.Action != store.DeleteRange || wev.Deleted != 4 {
+			t.Errorf("watched event = %s deleted %d, want %s deleted 4", wev.Action, wev.Deleted, store.DeleteRange)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch is not woken by the range deletion")
+	}
+
+	ev = mustDecodeEvent(t, do("GET", "/a?recursive=true"))
+	if !ev.Node.Dir || len(ev.Node.Nodes) != 0 {
+		t.Errorf("/a = %+v, want an empty directory", ev.Node)
+	}
+	resp = do("GET", "/ab")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("get /ab: code = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,165 @@
+package etcdhttp
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	etcdErr "github.com/coreos/etcd/error"
+)
+
+// RateLimitBy tells what the requests are rate limited by: each bucket of
+// tokens is shared by the requests with the same key. A RateLimitBy
+// implements flag.Value.
+type RateLimitBy int
+
+const (
+	// RateLimitClient limits the requests of each client IP address.
+	RateLimitClient RateLimitBy = iota
+	// RateLimitKey limits the requests on each key, so that a hot key does
+	// not starve the others.
+	RateLimitKey
+	// RateLimitGlobal limits all the requests together.
+	RateLimitGlobal
+)
+
+var rateLimitByNames = []string{"client", "key", "global"}
+
+func (b RateLimitBy) String() string {
+	if b < RateLimitClient || b > RateLimitGlobal {
+		return fmt.Sprintf("RateLimitBy(%d)", int(b))
+	}
+	return rateLimitByNames[b]
+}
+
+func (b *RateLimitBy) Set(s string) error {
+	for i, name := range rateLimitByNames {
+		if s == name {
+			*b = RateLimitBy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("etcdhttp: unknown rate limit %q", s)
+}
+
+// key returns the key of the bucket r takes a token from.
+func (b RateLimitBy) key(r *http.Request) string {
+	switch b {
+	case RateLimitClient:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	case RateLimitKey:
+		// the other resources, like /v2/txn, are limited by their path
+		return r.URL.Path
+	}
+	return ""
+}
+
+const (
+	// the buckets are spread over rateShards maps, each with its own lock,
+	// so that the requests on unrelated keys do not wait for each other
+	rateShards = 32
+
+	// a shard drops its full buckets at most once per rateSweepInterval,
+	// as a full bucket is the same as no bucket
+	rateSweepInterval = time.Minute
+)
+
+// NewRateLimitHandler wraps h, usually the client handler, so that the
+// requests sharing a key, as told by by, are served at rate per second on
+// average, and at most burst at once. The requests past the rate are
+// responded 429 with a Retry-After telling when a token is available.
+// /health and /metrics are never limited.
+func NewRateLimitHandler(h http.Handler, by RateLimitBy, rate float64, burst int) http.Handler {
+	l := newRateLimiter(rate, burst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPath && r.URL.Path != metricsPath {
+			if ok, wait := l.take(by.key(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+				etcdErr.NewRequestError(etcdErr.EcodeTooManyRequests, "").Write(w)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter keeps a token bucket per key.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	shards [rateShards]rateShard
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// bucket holds the tokens left at last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimiter{rate: rate, burst: float64(burst)}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*bucket)
+	}
+	return l
+}
+
+// take takes a token from the bucket of key at now. If there is none, it
+// returns false and the time until there is one.
+func (l *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > rateSweepInterval {
+		for k, b := range s.buckets {
+			if l.fill(b, now) >= l.burst {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		s.buckets[key] = b
+	}
+	if l.fill(b, now) < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// shard returns the shard holding the bucket of key.
+func (l *rateLimiter) shard(key string) *rateShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%rateShards]
+}
+
+// fill adds to b the tokens earned since it was last filled, up to burst,
+// and returns the tokens it holds.
+func (l *rateLimiter) fill(b *bucket, now time.Time) float64 {
+	if now.After(b.last) {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	return b.tokens
+}
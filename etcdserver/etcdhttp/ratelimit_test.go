@@ -0,0 +1,160 @@
+package etcdhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBySet(t *testing.T) {
+	tests := []struct {
+		s    string
+		wby  RateLimitBy
+		werr bool
+	}{
+		{"client", RateLimitClient, false},
+		{"key", RateLimitKey, false},
+		{"global", RateLimitGlobal, false},
+		{"", RateLimitClient, true},
+		{"ip", RateLimitClient, true},
+	}
+	for i, tt := range tests {
+		var b RateLimitBy
+		err := b.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if b != tt.wby {
+			t.Errorf("#%d: by = %v, want %v", i, b, tt.wby)
+		}
+		if !tt.werr && b.String() != tt.s {
+			t.Errorf("#%d: string = %s, want %s", i, b.String(), tt.s)
+		}
+	}
+}
+
+func TestRateLimitByKey(t *testing.T) {
+	r := &http.Request{
+		RemoteAddr: "10.0.0.1:4001",
+		URL:        mustNewURL(t, "http://example.com/v2/keys/foo"),
+	}
+	tests := []struct {
+		by   RateLimitBy
+		wkey string
+	}{
+		{RateLimitClient, "10.0.0.1"},
+		{RateLimitKey, "/v2/keys/foo"},
+		{RateLimitGlobal, ""},
+	}
+	for i, tt := range tests {
+		if k := tt.by.key(r); k != tt.wkey {
+			t.Errorf("#%d: key = %q, want %q", i, k, tt.wkey)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter(10, 5)
+	now := time.Unix(1000, 0)
+
+	// the burst is served at once, then the requests past it are throttled
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.take("foo", now); !ok {
+			t.Fatalf("#%d: take = false, want true", i)
+		}
+	}
+	ok, wait := l.take("foo", now)
+	if ok {
+		t.Fatalf("take = true, want false")
+	}
+	if wait != 100*time.Millisecond {
+		t.Errorf("wait = %v, want %v", wait, 100*time.Millisecond)
+	}
+
+	// the other keys have their own bucket
+	if ok, _ := l.take("bar", now); !ok {
+		t.Errorf("take bar = false, want true")
+	}
+
+	// a token is earned every 1/rate
+	now = now.Add(100 * time.Millisecond)
+	if ok, _ := l.take("foo", now); !ok {
+		t.Errorf("take after wait = false, want true")
+	}
+	if ok, _ := l.take("foo", now); ok {
+		t.Errorf("take twice after wait = true, want false")
+	}
+
+	// the bucket fills up to the burst, no more
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.take("foo", now); !ok {
+			t.Fatalf("#%d: take after recovery = false, want true", i)
+		}
+	}
+	if ok, _ := l.take("foo", now); ok {
+		t.Errorf("take past burst after recovery = true, want false")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Unix(1000, 0)
+	l.take("foo", now)
+
+	// another key of the same shard sweeps it
+	s := l.shard("foo")
+	other := ""
+	for i := 0; l.shard(other) != s; i++ {
+		other = fmt.Sprint(i)
+	}
+	l.take(other, now.Add(time.Second))
+	if _, ok := s.buckets["foo"]; !ok {
+		t.Errorf("bucket of foo is dropped before rateSweepInterval")
+	}
+	l.take(other, now.Add(rateSweepInterval+time.Second))
+	if _, ok := s.buckets["foo"]; ok {
+		t.Errorf("bucket of foo is kept after it is full")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	served := 0
+	h := NewRateLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}), RateLimitGlobal, 0.5, 2)
+
+	tests := []struct {
+		path    string
+		wcode   int
+		wretry  string
+		wserved int
+	}{
+		{"/v2/keys/foo", http.StatusOK, "", 1},
+		{"/v2/keys/bar", http.StatusOK, "", 2},
+		{"/v2/keys/foo", http.StatusTooManyRequests, "2", 2},
+		// never limited
+		{healthPath, http.StatusOK, "", 3},
+		{metricsPath, http.StatusOK, "", 4},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method:     "GET",
+			RemoteAddr: "10.0.0.1:4001",
+			URL:        mustNewURL(t, tt.path),
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if g := rw.Header().Get("Retry-After"); g != tt.wretry {
+			t.Errorf("#%d: Retry-After = %q, want %q", i, g, tt.wretry)
+		}
+		if served != tt.wserved {
+			t.Errorf("#%d: served = %d, want %d", i, served, tt.wserved)
+		}
+	}
+}
@@ -44,6 +44,9 @@ type Request struct {
 	Quorum           bool   `protobuf:"varint,14,req" json:"Quorum"`
 	Time             int64  `protobuf:"varint,15,req" json:"Time"`
 	Stream           bool   `protobuf:"varint,16,req" json:"Stream"`
+	Refresh          bool   `protobuf:"varint,17,req" json:"Refresh"`
+	Hidden           bool   `protobuf:"varint,18,req" json:"Hidden"`
+	Range            bool   `protobuf:"varint,19,req" json:"Range"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -355,6 +358,57 @@ func (m *Request) Unmarshal(data []byte) error {
 				}
 			}
 			m.Stream = bool(v != 0)
+		case 17:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Refresh = bool(v != 0)
+		case 18:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Hidden = bool(v != 0)
+		case 19:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Range = bool(v != 0)
 		default:
 			var sizeOfWire int
 			for {
@@ -403,6 +457,9 @@ func (m *Request) Size() (n int) {
 	n += 2
 	n += 1 + sovEtcdserver(uint64(m.Time))
 	n += 3
+	n += 3
+	n += 3
+	n += 3
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -528,6 +585,36 @@ func (m *Request) MarshalTo(data []byte) (n int, err error) {
 		data[i] = 0
 	}
 	i++
+	data[i] = 0x88
+	i++
+	data[i] = 0x1
+	i++
+	if m.Refresh {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x90
+	i++
+	data[i] = 0x1
+	i++
+	if m.Hidden {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x98
+	i++
+	data[i] = 0x1
+	i++
+	if m.Range {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
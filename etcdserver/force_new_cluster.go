@@ -0,0 +1,86 @@
+package etcdserver
+
+import (
+	"sort"
+
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// ForceNewCluster turns the state of the member id, read back from its WAL,
+// into the state of a one-member cluster made of id alone. The uncommitted
+// entries are dropped, and entries removing every other member are appended
+// to the committed ones and committed at once: they must be saved to the
+// WAL before restarting the raft node with id as its only peer.
+//
+// peers are the members the cluster was started with; those added or
+// removed since are found in snapshot, if not nil, and in ents.
+//
+// ForceNewCluster returns the new hard state, the entries to restart the
+// raft node with, and those of them that were appended.
+func ForceNewCluster(id int64, peers []int64, snapshot *raftpb.Snapshot, st raftpb.HardState, ents []raftpb.Entry) (raftpb.HardState, []raftpb.Entry, []raftpb.Entry) {
+	for i := range ents {
+		if ents[i].Index > st.Commit {
+			logger.Warnf("etcdserver: dropping %d uncommitted entries", len(ents)-i)
+			ents = ents[:i]
+			break
+		}
+	}
+
+	var appended []raftpb.Entry
+	for _, rid := range memberIDs(peers, snapshot, ents) {
+		if rid == id {
+			continue
+		}
+		cc := raftpb.ConfChange{ID: GenID(), Type: raftpb.ConfChangeRemoveNode, NodeID: rid}
+		d, err := cc.Marshal()
+		if err != nil {
+			logger.Panicf("marshal conf change error: %v", err)
+		}
+		st.Commit++
+		appended = append(appended, raftpb.Entry{
+			Type:  raftpb.EntryConfChange,
+			Term:  st.Term,
+			Index: st.Commit,
+			Data:  d,
+		})
+	}
+	return st, append(ents, appended...), appended
+}
+
+// memberIDs returns the sorted ids of the members of the cluster started
+// with peers, once snapshot and the conf changes of ents are applied.
+// The peers are kept even if the snapshot misses them, since they are put
+// in the ClusterStore at every start.
+func memberIDs(peers []int64, snapshot *raftpb.Snapshot, ents []raftpb.Entry) []int64 {
+	ids := make(map[int64]bool)
+	for _, id := range peers {
+		ids[id] = true
+	}
+	if snapshot != nil {
+		for _, id := range snapshot.Nodes {
+			ids[id] = true
+		}
+	}
+	for _, e := range ents {
+		if e.Type != raftpb.EntryConfChange {
+			continue
+		}
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			logger.Panicf("unmarshal conf change error: %v", err)
+		}
+		switch cc.Type {
+		case raftpb.ConfChangeAddNode:
+			ids[cc.NodeID] = true
+		case raftpb.ConfChangeRemoveNode:
+			delete(ids, cc.NodeID)
+		}
+	}
+	sids := make(int64Slice, 0, len(ids))
+	for id := range ids {
+		sids = append(sids, id)
+	}
+	sort.Sort(sids)
+	return sids
+}
@@ -0,0 +1,115 @@
+package etcdserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+func mustConfChangeEntry(t *testing.T, index int64, cc raftpb.ConfChange) raftpb.Entry {
+	d, err := cc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raftpb.Entry{Type: raftpb.EntryConfChange, Term: 1, Index: index, Data: d}
+}
+
+func mustRequestEntry(t *testing.T, index int64, r pb.Request) raftpb.Entry {
+	d, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raftpb.Entry{Term: 1, Index: index, Data: d}
+}
+
+func TestForceNewCluster(t *testing.T) {
+	ents := []raftpb.Entry{
+		{Term: 1, Index: 1},
+		mustConfChangeEntry(t, 2, raftpb.ConfChange{ID: 1, Type: raftpb.ConfChangeAddNode, NodeID: 4}),
+		mustConfChangeEntry(t, 3, raftpb.ConfChange{ID: 2, Type: raftpb.ConfChangeRemoveNode, NodeID: 3}),
+		// uncommitted
+		mustConfChangeEntry(t, 4, raftpb.ConfChange{ID: 3, Type: raftpb.ConfChangeAddNode, NodeID: 5}),
+	}
+	st := raftpb.HardState{Term: 2, Vote: 1, Commit: 3}
+	snapshot := &raftpb.Snapshot{Index: 0, Nodes: []int64{1, 2, 3, 6}}
+
+	nst, nents, appended := ForceNewCluster(1, []int64{1, 2, 3}, snapshot, st, ents)
+
+	if wst := (raftpb.HardState{Term: 2, Vote: 1, Commit: 6}); !reflect.DeepEqual(nst, wst) {
+		t.Errorf("state = %+v, want %+v", nst, wst)
+	}
+	if len(nents) != 6 || !reflect.DeepEqual(nents[3:], appended) {
+		t.Fatalf("ents = %+v, want the 3 committed ones and the appended ones", nents)
+	}
+	var removed []int64
+	for i, e := range appended {
+		if e.Type != raftpb.EntryConfChange || e.Term != 2 || e.Index != int64(4+i) {
+			t.Errorf("#%d: entry = %+v, want a conf change at term 2, index %d", i, e, 4+i)
+		}
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			t.Fatal(err)
+		}
+		if cc.Type != raftpb.ConfChangeRemoveNode {
+			t.Errorf("#%d: type = %v, want %v", i, cc.Type, raftpb.ConfChangeRemoveNode)
+		}
+		removed = append(removed, cc.NodeID)
+	}
+	if w := []int64{2, 4, 6}; !reflect.DeepEqual(removed, w) {
+		t.Errorf("removed = %v, want %v", removed, w)
+	}
+}
+
+// TestForceNewClusterRestart tests that a member of a cluster of 3 that lost
+// the 2 others restarts as a one-member cluster that keeps its data and
+// commits new proposals alone.
+func TestForceNewClusterRestart(t *testing.T) {
+	ents := []raftpb.Entry{
+		{Term: 1, Index: 1},
+		mustRequestEntry(t, 2, pb.Request{Method: "PUT", ID: 1, Path: "/foo", Val: "bar"}),
+		// proposed before the quorum was lost
+		mustRequestEntry(t, 3, pb.Request{Method: "PUT", ID: 2, Path: "/foo", Val: "lost"}),
+	}
+	st, ents, _ := ForceNewCluster(1, []int64{1, 2, 3}, nil, raftpb.HardState{Term: 1, Commit: 2}, ents)
+
+	c := Cluster{}
+	c.AddSlice([]Member{{Name: "node1", ID: 1}, {Name: "node2", ID: 2}, {Name: "node3", ID: 3}})
+	s := store.New()
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	srv := &EtcdServer{
+		Node:         raft.RestartNode(1, []int64{1}, 10, 1, nil, st, ents),
+		Store:        s,
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		Ticker:       tk,
+		ClusterStore: NewClusterStore(s, c),
+	}
+	srv.start()
+	defer srv.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := srv.Do(ctx, pb.Request{Method: "PUT", ID: 3, Path: "/bar", Val: "baz"}); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	for k, w := range map[string]string{"/foo": "bar", "/bar": "baz"} {
+		ev, err := s.Get(k, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *ev.Node.Value != w {
+			t.Errorf("%s = %q, want %q", k, *ev.Node.Value, w)
+		}
+	}
+	if g := srv.ClusterStore.Get().IDs(); !reflect.DeepEqual(g, []int64{1}) {
+		t.Errorf("members = %v, want [1]", g)
+	}
+}
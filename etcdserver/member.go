@@ -19,11 +19,14 @@ type Member struct {
 	// TODO(philips): ensure these are URLs
 	PeerURLs   []string
 	ClientURLs []string
+	// Version is the version of etcd the member runs, as it published it.
+	Version string `json:",omitempty"`
 }
 
-// newMember creates a Member without an ID and generates one based on the
-// name, peer URLs. This is used for bootstrapping.
-func newMember(name string, peerURLs types.URLs, now *time.Time) *Member {
+// NewMember creates a Member without an ID and generates one based on the
+// name, peer URLs. This is used for bootstrapping, and for adding members
+// to a running cluster.
+func NewMember(name string, peerURLs types.URLs, now *time.Time) *Member {
 	m := &Member{Name: name, PeerURLs: peerURLs.StringSlice()}
 
 	b := []byte(m.Name)
@@ -0,0 +1,24 @@
+package etcdserver
+
+import "github.com/coreos/etcd/pkg/metrics"
+
+var (
+	proposalsCommitted = metrics.NewCounter("etcd_server_proposals_committed_total",
+		"The total number of proposals applied by the server.")
+	proposalsFailed = metrics.NewCounter("etcd_server_proposals_failed_total",
+		"The total number of proposals that timed out or were dropped because the server stopped.")
+	proposalsRejected = metrics.NewCounter("etcd_server_proposals_rejected_total",
+		"The total number of proposals refused because too many were in flight.")
+	messagesDropped = metrics.NewCounter("etcd_server_peer_messages_dropped_total",
+		"The total number of raft messages dropped because the send queue of their peer was full.")
+	peerQueueDepth = metrics.NewGauge("etcd_server_peer_queue_depth",
+		"The number of raft messages waiting in the send queues of all the peers.")
+	slowApplies = metrics.NewCounter("etcd_server_slow_applies_total",
+		"The total number of entries that took longer than the slow apply threshold to apply.")
+	leaderChanges = metrics.NewCounter("etcd_server_leader_changes_total",
+		"The number of leader changes seen by the server.")
+	webhookFailures = metrics.NewCounter("etcd_server_leader_change_webhook_failures_total",
+		"The total number of leader changes that could not be posted to the webhook, or were dropped.")
+	termGauge   = metrics.NewGauge("etcd_server_raft_term", "The current raft term.")
+	commitGauge = metrics.NewGauge("etcd_server_raft_commit_index", "The current raft commit index.")
+)
@@ -0,0 +1,210 @@
+package etcdserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal"
+)
+
+// PeerURLsListened tells whether one of the peer URLs of m is served by
+// one of listen, the URLs m listens for its peers on. A URL is served by a
+// listen URL of the same scheme and port, whose host is the same or the
+// unspecified address. It returns an error if the peer URLs are malformed.
+func PeerURLsListened(m *Member, listen []url.URL) (bool, error) {
+	us, err := types.NewURLs(m.PeerURLs)
+	if err != nil {
+		return false, fmt.Errorf("bad peer URL for %q: %v", m.Name, err)
+	}
+	for _, u := range us {
+		for _, l := range listen {
+			if listened(u, l) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func listened(u, l url.URL) bool {
+	if u.Scheme != l.Scheme {
+		return false
+	}
+	uhost, uport, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(l.Host)
+	if err != nil || uport != lport {
+		return false
+	}
+	if lhost == "" || lhost == uhost {
+		return true
+	}
+	ip := net.ParseIP(lhost)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// UnreachablePeerURLs dials the peer URLs of the members of c but self, and
+// returns the ones no TCP connection was established to within timeout.
+// The members may simply not be started yet, so the URLs are only worth a
+// warning.
+func UnreachablePeerURLs(c Cluster, self int64, timeout time.Duration) []string {
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		unreachable []string
+	)
+	for _, m := range c {
+		if m.ID == self {
+			continue
+		}
+		for _, s := range m.PeerURLs {
+			wg.Add(1)
+			go func(s string) {
+				defer wg.Done()
+				u, err := url.Parse(s)
+				if err == nil {
+					var conn net.Conn
+					if conn, err = net.DialTimeout("tcp", u.Host, timeout); err == nil {
+						conn.Close()
+						return
+					}
+				}
+				mu.Lock()
+				unreachable = append(unreachable, s)
+				mu.Unlock()
+			}(s)
+		}
+	}
+	wg.Wait()
+	sort.Strings(unreachable)
+	return unreachable
+}
+
+// CheckWALDir returns an error if waldir, the WAL directory of a member
+// whose data directory is datadir and snapshot directory snapdir, cannot
+// hold its WAL: it must be neither of the others, nor hold snapshots. Once
+// the member has data, waldir must hold its WAL, or the member would start
+// again from an empty one.
+func CheckWALDir(datadir, snapdir, waldir string) error {
+	abs := func(p string) string {
+		if a, err := filepath.Abs(p); err == nil {
+			return a
+		}
+		return filepath.Clean(p)
+	}
+	w := abs(waldir)
+	if w == abs(datadir) {
+		return fmt.Errorf("WAL directory %s is the data directory", waldir)
+	}
+	if w == abs(snapdir) || strings.HasPrefix(w, abs(snapdir)+string(filepath.Separator)) {
+		return fmt.Errorf("WAL directory %s is in the snapshot directory %s", waldir, snapdir)
+	}
+	if name, err := snapName(waldir); err != nil || name != "" {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("WAL directory %s holds the snapshot %s", waldir, name)
+	}
+	if wal.Exist(waldir) {
+		return nil
+	}
+	if def := path.Join(datadir, "wal"); w != abs(def) && wal.Exist(def) {
+		return fmt.Errorf("the WAL is in %s, not in the WAL directory %s; move it there first", def, waldir)
+	}
+	name, err := snapName(snapdir)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		return fmt.Errorf("the snapshot %s has no WAL in the WAL directory %s", path.Join(snapdir, name), waldir)
+	}
+	return nil
+}
+
+// snapName returns the name of a snapshot file in dir, or "" if there is
+// none.
+func snapName(dir string) (string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".snap") {
+			return fi.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// InconsistentWALError is returned by CheckWAL when the WAL read on restart
+// does not follow the snapshot, or contradicts itself, at Index.
+type InconsistentWALError struct {
+	Index  int64
+	Reason string
+}
+
+func (e *InconsistentWALError) Error() string {
+	return fmt.Sprintf("etcdserver: inconsistent WAL at index %d: %s", e.Index, e.Reason)
+}
+
+// CheckWAL returns an *InconsistentWALError if the hard state st and the
+// entries ents read from the WAL on restart cannot follow snapshot, which
+// may be nil: raft would be restarted from garbage. The entries must
+// start at the index and term of the snapshot, or at index 0 without one,
+// have no gap and no term going backwards. st, when the WAL holds one,
+// must neither commit past the entries nor be of an older term than them.
+// Such a WAL is usually the sign of a data directory restored by halves.
+func CheckWAL(snapshot *raftpb.Snapshot, st raftpb.HardState, ents []raftpb.Entry) error {
+	var index, term int64
+	if snapshot != nil {
+		index, term = snapshot.Index, snapshot.Term
+	}
+	if len(ents) == 0 {
+		return &InconsistentWALError{index, "no entry"}
+	}
+	if ents[0].Index != index {
+		return &InconsistentWALError{index, fmt.Sprintf("the first entry is at index %d", ents[0].Index)}
+	}
+	if ents[0].Term != term {
+		return &InconsistentWALError{index, fmt.Sprintf("the entry is of term %d, but the snapshot of term %d", ents[0].Term, term)}
+	}
+	for i := 1; i < len(ents); i++ {
+		prev, e := ents[i-1], ents[i]
+		if e.Index != prev.Index+1 {
+			return &InconsistentWALError{prev.Index + 1, fmt.Sprintf("missing entry, the next one is at index %d", e.Index)}
+		}
+		if e.Term < prev.Term {
+			return &InconsistentWALError{e.Index, fmt.Sprintf("the term goes back from %d to %d", prev.Term, e.Term)}
+		}
+	}
+	// the hard state is not written again when the WAL is cut, so the
+	// last files may hold none
+	if raft.IsEmptyHardState(st) {
+		return nil
+	}
+	last := ents[len(ents)-1]
+	if st.Commit > last.Index {
+		return &InconsistentWALError{st.Commit, fmt.Sprintf("committed, but the last entry is at index %d", last.Index)}
+	}
+	if st.Commit < index {
+		return &InconsistentWALError{st.Commit, fmt.Sprintf("committed, but the snapshot is at index %d", index)}
+	}
+	if st.Term < last.Term {
+		return &InconsistentWALError{last.Index, fmt.Sprintf("the entry is of term %d, but the hard state of term %d", last.Term, st.Term)}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package etcdserver
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal"
+)
+
+func TestPeerURLsListened(t *testing.T) {
+	listen := func(s ...string) []url.URL {
+		var us []url.URL
+		for _, v := range s {
+			u, err := url.Parse(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			us = append(us, *u)
+		}
+		return us
+	}
+	tests := []struct {
+		peerURLs []string
+		listen   []url.URL
+
+		wok  bool
+		werr bool
+	}{
+		{[]string{"http://10.0.0.1:2380"}, listen("http://10.0.0.1:2380"), true, false},
+		{[]string{"http://10.0.0.1:2380"}, listen("http://0.0.0.0:2380"), true, false},
+		{[]string{"http://10.0.0.1:2380"}, listen("http://[::]:2380"), true, false},
+		{[]string{"http://10.0.0.1:2380", "http://10.0.0.1:7001"}, listen("http://localhost:2379", "http://10.0.0.1:7001"), true, false},
+
+		// malformed peer URLs
+		{[]string{"10.0.0.1:2380"}, listen("http://10.0.0.1:2380"), false, true},
+		{[]string{"http://10.0.0.1"}, listen("http://10.0.0.1:2380"), false, true},
+		{nil, listen("http://10.0.0.1:2380"), false, true},
+		// no peer URL listened on
+		{[]string{"http://10.0.0.1:2380"}, listen("http://10.0.0.1:2381"), false, false},
+		{[]string{"http://10.0.0.1:2380"}, listen("http://10.0.0.2:2380"), false, false},
+		{[]string{"https://10.0.0.1:2380"}, listen("http://10.0.0.1:2380"), false, false},
+		{[]string{"http://10.0.0.1:2380"}, nil, false, false},
+	}
+	for i, tt := range tests {
+		m := &Member{Name: "node1", PeerURLs: tt.peerURLs}
+		ok, err := PeerURLsListened(m, tt.listen)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if ok != tt.wok {
+			t.Errorf("#%d: listened = %v, want %v", i, ok, tt.wok)
+		}
+	}
+}
+
+func TestUnreachablePeerURLs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + closed.Addr().String()
+	closed.Close()
+
+	c := Cluster{}
+	c.AddSlice([]Member{
+		// self is never dialed
+		{ID: 1, Name: "node1", PeerURLs: []string{"http://127.0.0.1:1"}},
+		{ID: 2, Name: "node2", PeerURLs: []string{"http://" + ln.Addr().String()}},
+		{ID: 3, Name: "node3", PeerURLs: []string{closedURL}},
+	})
+	g := UnreachablePeerURLs(c, 1, time.Second)
+	if w := []string{closedURL}; !reflect.DeepEqual(g, w) {
+		t.Errorf("unreachable = %v, want %v", g, w)
+	}
+}
+
+func TestCheckWALDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datadir := path.Join(dir, "data")
+	snapdir := path.Join(datadir, "snap")
+	if err := os.MkdirAll(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// the root of a file system mounted for the WAL holds no WAL yet
+	mounted := path.Join(dir, "mounted")
+	if err := os.MkdirAll(path.Join(mounted, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	snapwal := path.Join(dir, "snapwal")
+	if err := os.MkdirAll(snapwal, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(snapwal, "0000000000000001-0000000000000001.snap"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		waldir string
+		werr   bool
+	}{
+		// a distinct directory, created or not yet
+		{path.Join(dir, "wal"), false},
+		{path.Join(dir, "fast", "wal"), false},
+		// the default one
+		{path.Join(datadir, "wal"), false},
+		{mounted, false},
+
+		{datadir, true},
+		{snapdir, true},
+		{snapdir + "/", true},
+		{path.Join(snapdir, "wal"), true},
+		{snapwal, true},
+	}
+	for i, tt := range tests {
+		err := CheckWALDir(datadir, snapdir, tt.waldir)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+	}
+
+	// once the WAL is in the data directory, it must stay there
+	w, err := wal.Create(path.Join(datadir, "wal"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := CheckWALDir(datadir, snapdir, path.Join(datadir, "wal")); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err := CheckWALDir(datadir, snapdir, path.Join(dir, "wal")); err == nil {
+		t.Errorf("err = nil, want error for a WAL left in the data directory")
+	}
+
+	// nor can the snapshots be left without their WAL
+	if err := os.RemoveAll(path.Join(datadir, "wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(snapdir, "0000000000000001-0000000000000001.snap"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWALDir(datadir, snapdir, path.Join(dir, "wal")); err == nil {
+		t.Errorf("err = nil, want error for snapshots without a WAL")
+	}
+	if err := CheckWALDir(datadir, snapdir, mounted); err == nil {
+		t.Errorf("err = nil, want error for snapshots with a lost+found for WAL")
+	}
+	if w, err = wal.Create(path.Join(dir, "wal"), 1); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := CheckWALDir(datadir, snapdir, path.Join(dir, "wal")); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestCheckWAL(t *testing.T) {
+	ents := func(terms ...int64) []raftpb.Entry {
+		es := make([]raftpb.Entry, len(terms))
+		for i, term := range terms {
+			es[i] = raftpb.Entry{Index: int64(i), Term: term}
+		}
+		return es
+	}
+	snapshot := &raftpb.Snapshot{Index: 2, Term: 1}
+
+	tests := []struct {
+		snapshot *raftpb.Snapshot
+		st       raftpb.HardState
+		ents     []raftpb.Entry
+		werr     error
+	}{
+		{nil, raftpb.HardState{}, ents(0), nil},
+		{nil, raftpb.HardState{Term: 2, Commit: 3}, ents(0, 1, 1, 2), nil},
+		{snapshot, raftpb.HardState{Term: 2, Commit: 3}, ents(0, 1, 1, 2)[2:], nil},
+		// no hard state since the WAL was cut
+		{snapshot, raftpb.HardState{}, ents(0, 1, 1)[2:], nil},
+
+		{nil, raftpb.HardState{}, nil, &InconsistentWALError{0, "no entry"}},
+		{
+			snapshot, raftpb.HardState{}, nil,
+			&InconsistentWALError{2, "no entry"},
+		},
+		// the snapshot is past the WAL, or the WAL does not start at it
+		{
+			snapshot, raftpb.HardState{Term: 1, Commit: 1}, ents(0, 1),
+			&InconsistentWALError{2, "the first entry is at index 0"},
+		},
+		{
+			snapshot, raftpb.HardState{Term: 1, Commit: 3}, ents(0, 1, 1, 1)[3:],
+			&InconsistentWALError{2, "the first entry is at index 3"},
+		},
+		{
+			snapshot, raftpb.HardState{Term: 2, Commit: 3}, ents(0, 1, 2, 2)[2:],
+			&InconsistentWALError{2, "the entry is of term 2, but the snapshot of term 1"},
+		},
+		// the WAL contradicts itself
+		{
+			nil, raftpb.HardState{Term: 1, Commit: 2}, []raftpb.Entry{{Index: 0}, {Index: 1, Term: 1}, {Index: 3, Term: 1}},
+			&InconsistentWALError{2, "missing entry, the next one is at index 3"},
+		},
+		{
+			nil, raftpb.HardState{Term: 2, Commit: 2}, ents(0, 2, 1),
+			&InconsistentWALError{2, "the term goes back from 2 to 1"},
+		},
+		{
+			nil, raftpb.HardState{Term: 1, Commit: 3}, ents(0, 1, 1),
+			&InconsistentWALError{3, "committed, but the last entry is at index 2"},
+		},
+		{
+			snapshot, raftpb.HardState{Term: 1, Commit: 1}, ents(0, 1, 1)[2:],
+			&InconsistentWALError{1, "committed, but the snapshot is at index 2"},
+		},
+		{
+			nil, raftpb.HardState{Term: 1, Commit: 1}, ents(0, 1, 2),
+			&InconsistentWALError{2, "the entry is of term 2, but the hard state of term 1"},
+		},
+	}
+	for i, tt := range tests {
+		err := CheckWAL(tt.snapshot, tt.st, tt.ents)
+		if !reflect.DeepEqual(err, tt.werr) {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+	}
+}
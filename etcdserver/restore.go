@@ -0,0 +1,58 @@
+package etcdserver
+
+import (
+	"fmt"
+	"io"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+)
+
+// the index and the term of the snapshot a member is restored from. The
+// backup does not tell the index it was taken at in the raft log of its
+// cluster, which the new cluster does not share anyway.
+const (
+	restoreIndex = 1
+	restoreTerm  = 1
+)
+
+// Restore turns the state of a store read from r, as Backup saves it, into
+// the snapshot, the hard state and the entries that member id restarts
+// from as the only member of a new cluster. The snapshot must be saved,
+// and the hard state and the entries saved to a new WAL, before
+// restarting the raft node from them.
+//
+// The members of the cluster the backup was taken from are removed from
+// the state, since the ClusterStore puts the members of the new cluster
+// in it at every start.
+func Restore(id int64, r io.Reader) (raftpb.Snapshot, raftpb.HardState, []raftpb.Entry, error) {
+	st := store.New()
+	if err := st.RecoveryFrom(r); err != nil {
+		return raftpb.Snapshot{}, raftpb.HardState{}, nil, fmt.Errorf("etcdserver: cannot read backup: %v", err)
+	}
+	if v, w := st.Version(), store.New().Version(); v != w {
+		return raftpb.Snapshot{}, raftpb.HardState{}, nil, fmt.Errorf("etcdserver: backup of store version %d, want %d", v, w)
+	}
+	if _, err := st.Delete(machineKVPrefix, true, true); err != nil {
+		if v, ok := err.(*etcdErr.Error); !ok || v.ErrorCode != etcdErr.EcodeKeyNotFound {
+			return raftpb.Snapshot{}, raftpb.HardState{}, nil, err
+		}
+	}
+	d, err := st.Save()
+	if err != nil {
+		return raftpb.Snapshot{}, raftpb.HardState{}, nil, err
+	}
+
+	snapshot := raftpb.Snapshot{
+		Data:  d,
+		Nodes: []int64{id},
+		Index: restoreIndex,
+		Term:  restoreTerm,
+	}
+	hs := raftpb.HardState{Term: restoreTerm, Commit: restoreIndex}
+	// the WAL is opened at the index of the snapshot, so it must hold the
+	// entry at that index
+	ents := []raftpb.Entry{{Index: restoreIndex, Term: restoreTerm}}
+	return snapshot, hs, ents, nil
+}
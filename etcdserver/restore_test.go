@@ -0,0 +1,131 @@
+package etcdserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+	"github.com/coreos/etcd/wal"
+)
+
+// TestBackupRestore backs up a member, and restarts another one from the
+// backup as main does with -initial-snapshot.
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	st := store.New()
+	NewClusterStore(st, Cluster{0xBAD0: &Member{ID: 0xBAD0, Name: "node1"}})
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	n.Campaign(ctx)
+	s := &EtcdServer{
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Node:    n,
+	}
+	s.start()
+	if _, err := s.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/foo", Val: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	var backup bytes.Buffer
+	if err := b.Store.SaveTo(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// seed the data directory of the new member
+	const id = 0xBEEF
+	snapshot, hs, ents, err := Restore(id, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapdir, waldir := path.Join(dir, "snap"), path.Join(dir, "wal")
+	if err := os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	snap.New(snapdir).SaveSnap(snapshot)
+	w, err := wal.Create(waldir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Save(hs, ents)
+	w.Close()
+
+	// and restart it from there
+	loaded, err := snap.New(snapdir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rst := store.New()
+	if err := rst.Recovery(loaded.Data); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = wal.OpenAtIndex(waldir, loaded.Index); err != nil {
+		t.Fatal(err)
+	}
+	wid, hs, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if wid != id {
+		t.Errorf("wal id = %x, want %x", wid, id)
+	}
+	cls := NewClusterStore(rst, Cluster{id: &Member{ID: id, Name: "restored"}})
+	if g := cls.Get().IDs(); !reflect.DeepEqual(g, []int64{id}) {
+		t.Errorf("members = %x, want only %x", g, id)
+	}
+
+	rn := raft.RestartNode(id, []int64{id}, 10, 1, loaded, hs, ents)
+	rn.Campaign(ctx)
+	rs := &EtcdServer{
+		Store:   rst,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Node:    rn,
+	}
+	rs.start()
+	defer rs.Stop()
+	if _, err := rs.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/baz", Val: "qux"}); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"/foo": "bar", "/baz": "qux"} {
+		ev, err := rst.Get(k, false, false)
+		if err != nil || *ev.Node.Value != v {
+			t.Errorf("restored %s = %v, %v, want %s", k, ev, err, v)
+		}
+	}
+}
+
+func TestRestoreBadBackup(t *testing.T) {
+	tests := []string{
+		"",
+		`{"Root":`,
+		// a store of another version
+		`{"Root":{"Path":"/","Children":{}},"CurrentVersion":3}`,
+	}
+	for i, tt := range tests {
+		if _, _, _, err := Restore(1, strings.NewReader(tt)); err == nil {
+			t.Errorf("#%d: err = nil, want an error", i)
+		}
+	}
+}
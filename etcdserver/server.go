@@ -1,32 +1,58 @@
 package etcdserver
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"log"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/logger"
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
 	"github.com/coreos/etcd/store"
 	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
 	"github.com/coreos/etcd/wait"
+	"github.com/coreos/etcd/wal"
 )
 
 const (
 	defaultSyncTimeout = time.Second
 	DefaultSnapCount   = 10000
+	// DefaultSnapCatchUpEntries is the default number of entries kept in
+	// the raft log before the index of the last snapshot.
+	DefaultSnapCatchUpEntries = 5000
 	// TODO: calculated based on heartbeat interval
 	defaultPublishRetryInterval = 5 * time.Second
+	// DefaultMaxSnapFiles is the default number of snapshot files to retain.
+	DefaultMaxSnapFiles = 5
+
+	purgeFileInterval = 30 * time.Second
 )
 
 var (
 	ErrUnknownMethod = errors.New("etcdserver: unknown method")
 	ErrStopped       = errors.New("etcdserver: server stopped")
+	ErrIDExists      = errors.New("etcdserver: member ID already exists")
+	ErrIDNotFound    = errors.New("etcdserver: member ID not found")
+	ErrLastMember    = errors.New("etcdserver: cannot remove the last member")
+	// ErrTooManyRequests is returned by Do for a request that would take
+	// the server past its MaxInflightProposals.
+	ErrTooManyRequests = errors.New("etcdserver: too many requests")
+	// ErrNoLeader is returned by Do for a proposal given up while the
+	// cluster has no leader. Unlike a timeout with a leader, it tells that
+	// the request was most likely not applied, and may be tried again once
+	// a leader is elected.
+	ErrNoLeader = errors.New("etcdserver: no leader")
+	// ErrClusterVersion is returned by Do for a request that some members
+	// of the cluster would apply differently, as they run an older version
+	// of etcd, or one that is not known yet.
+	ErrClusterVersion = errors.New("etcdserver: request not supported by every member of the cluster")
 )
 
 func init() {
@@ -39,7 +65,11 @@ type SaveFunc func(st raftpb.HardState, ents []raftpb.Entry)
 type Response struct {
 	Event   *store.Event
 	Watcher store.Watcher
-	err     error
+	Txn     *store.TxnResponse
+	// Index is the raft index of the entry the request was applied at,
+	// or 0 if it was not proposed to raft.
+	Index int64
+	err   error
 }
 
 type Storage interface {
@@ -53,6 +83,9 @@ type Storage interface {
 	// remove it in this interface.
 	// Cut cuts out a new wal file for saving new state and entries.
 	Cut() error
+	// Close flushes any buffered state to the underlying stable storage
+	// and releases it. Save and SaveSnap cannot be called after Close.
+	Close() error
 }
 
 type Server interface {
@@ -69,6 +102,30 @@ type Server interface {
 	// Process takes a raft message and applies it to the server's raft state
 	// machine, respecting any timeout of the given context.
 	Process(ctx context.Context, m raftpb.Message) error
+	// AddMember attempts to add a member into the cluster. It will return
+	// ErrIDExists if a member with the same ID already exists.
+	AddMember(ctx context.Context, m Member) error
+	// RemoveMember attempts to remove a member from the cluster. It will
+	// return ErrIDNotFound if the member does not exist, and ErrLastMember
+	// if it is the only member of the cluster.
+	RemoveMember(ctx context.Context, id int64) error
+	// AddUser attempts to add a user of the client API. It will return
+	// ErrUserExists if a user with the same name already exists.
+	AddUser(ctx context.Context, u User) error
+	// RemoveUser attempts to remove a user of the client API. It will
+	// return ErrUserNotFound if the user does not exist, and ErrRemoveRoot
+	// for RootUser.
+	RemoveUser(ctx context.Context, name string) error
+	// SetUserRoles attempts to replace the roles granted to a user. It will
+	// return ErrUserNotFound if the user does not exist, and
+	// ErrRoleNotFound if one of the roles does not.
+	SetUserRoles(ctx context.Context, name string, roles []string) error
+	// SetRole attempts to create a role, or to replace the one of the
+	// same name.
+	SetRole(ctx context.Context, r Role) error
+	// RemoveRole attempts to remove a role. It will return ErrRoleNotFound
+	// if the role does not exist.
+	RemoveRole(ctx context.Context, name string) error
 }
 
 type RaftTimer interface {
@@ -76,13 +133,45 @@ type RaftTimer interface {
 	Term() int64
 }
 
+// HealthReporter reports what a member knows about the progress of the
+// cluster, to tell whether it is able to serve up-to-date requests.
+type HealthReporter interface {
+	// Leader returns the ID of the current leader, or raft.None if the
+	// member does not know any leader, e.g. while an election is going on.
+	Leader() int64
+	// LastApply returns the time the member last applied committed
+	// entries, or the zero time if it has not applied any yet.
+	LastApply() time.Time
+	// Replayed reports whether the member applied the entries committed
+	// in its WAL when it restarted, before which it serves a stale store.
+	Replayed() bool
+}
+
+// RaftStatusReporter reports the state of the raft node of a member, to
+// diagnose why a cluster does not elect a leader or a follower lags.
+type RaftStatusReporter interface {
+	RaftStatus() RaftStatus
+}
+
 // EtcdServer is the production implementation of the Server interface
 type EtcdServer struct {
 	w    wait.Wait
+	stop chan struct{}
 	done chan struct{}
-
+	// the snapshots asked for with TakeSnapshot
+	snapc chan chan snapResult
+	// applyMu is held by the run loop while it applies an entry and
+	// records its index, for Backup to clone the store at an index
+	applyMu sync.RWMutex
+
+	// ID is the raft ID of the member, which the leader is known by.
+	ID         int64
 	Name       string
 	ClientURLs types.URLs
+	// Version is the version of etcd the server runs, published with its
+	// client URLs. The leader of a cluster whose members all published
+	// theirs sets the cluster version to the oldest of them.
+	Version string
 
 	Node  raft.Node
 	Store store.Store
@@ -92,6 +181,9 @@ type EtcdServer struct {
 	// timeout and reissue their messages.  If Send is nil, server will
 	// panic.
 	Send SendFunc
+	// RemovePeer, if set, is called with the ID of each member removed
+	// from the cluster, for Send to release what it holds for the member.
+	RemovePeer func(id int64)
 
 	Storage Storage
 
@@ -99,19 +191,88 @@ type EtcdServer struct {
 	SyncTicker <-chan time.Time
 
 	SnapCount int64 // number of entries to trigger a snapshot
+	// SnapBytes, if not 0, is the size in bytes of the applied entries
+	// that triggers a snapshot, even if fewer than SnapCount entries were
+	// applied since the last one.
+	SnapBytes int64
+	// SnapCatchUpEntries is the number of entries kept in the raft log
+	// before the index of a snapshot when it is taken, to send to the
+	// followers that are behind it by fewer entries rather than the
+	// whole snapshot. 0 keeps none.
+	SnapCatchUpEntries int64
+
+	// SnapDir and WALDir are the directories the Storage keeps its
+	// snapshot and WAL files in. If both are set, old files in them are
+	// purged in the background, keeping the newest MaxSnapFiles snapshots
+	// and the WAL files needed to recover from the oldest one of those.
+	// A MaxSnapFiles of 0 retains all snapshots.
+	SnapDir      string
+	WALDir       string
+	MaxSnapFiles int
+
+	// MaxInflightProposals is the number of proposals that may wait to
+	// be applied at the same time. Do refuses the ones past it with
+	// ErrTooManyRequests, rather than queueing them. 0 is unlimited.
+	MaxInflightProposals int64
+	// the proposals counted against MaxInflightProposals, from Do until
+	// they are applied, or may have been dropped by raft
+	inflightMu sync.Mutex
+	inflight   map[int64]bool
+
+	// ApplySlowThreshold, if not 0, is the time past which applying a
+	// single entry is logged as slow, with its method and key: as entries
+	// are applied one at a time, a slow one holds back all the others.
+	ApplySlowThreshold time.Duration
+
+	// ReplayIndex is the commit index of the WAL the server restarts
+	// from. Replayed reports false until the entries up to it are
+	// applied.
+	ReplayIndex int64
+	// 1 once the entries up to ReplayIndex are applied
+	replayed int32
+	// 1 while a proposal of the cluster version is pending
+	updatingVersion int32
+	// SnapshotIndex and SnapshotTerm are those of the snapshot the server
+	// restarts from, which the store is recovered from already: raft does
+	// not hand it back through Ready.
+	SnapshotIndex int64
+	SnapshotTerm  int64
 
 	// Cache of the latest raft index and raft term the server has seen
-	raftIndex    int64
-	raftTerm     int64
+	raftIndex int64
+	raftTerm  int64
+	// Cache of the leader the server knows, and of the unix time in
+	// nanoseconds at which it last applied entries
+	raftLead  int64
+	lastApply int64
+	// the time a message from each peer was last processed
+	activity peerActivity
+
+	// PeerStats, if set, is where Send records the messages sent to the
+	// peers. It is reset whenever the leader changes.
+	PeerStats *PeerStats
+
+	// LeaderChangeWebhook, if set, is the URL a LeaderChange is posted to
+	// whenever the server learns of a new leader, in the background and
+	// within LeaderChangeWebhookTimeout, DefaultWebhookTimeout if 0.
+	LeaderChangeWebhook        string
+	LeaderChangeWebhookTimeout time.Duration
+	webhook                    *webhook
+
 	ClusterStore ClusterStore
 }
 
 // Start prepares and starts server in a new goroutine. It is no longer safe to
 // modify a server's fields after it has been sent to Start.
 // It also starts a goroutine to publish its server information.
+// It also starts a goroutine to purge old snapshot and WAL files, if
+// SnapDir and WALDir are set.
 func (s *EtcdServer) Start() {
 	s.start()
 	go s.publish(defaultPublishRetryInterval)
+	if s.SnapDir != "" && s.WALDir != "" {
+		go s.purgeFile(purgeFileInterval)
+	}
 }
 
 // start prepares and starts server in a new goroutine. It is no longer safe to
@@ -119,17 +280,24 @@ func (s *EtcdServer) Start() {
 // This function is just used for testing.
 func (s *EtcdServer) start() {
 	if s.SnapCount == 0 {
-		log.Printf("etcdserver: set snapshot count to default %d", DefaultSnapCount)
+		logger.Infof("etcdserver: set snapshot count to default %d", DefaultSnapCount)
 		s.SnapCount = DefaultSnapCount
 	}
 	s.w = wait.New()
+	s.stop = make(chan struct{})
 	s.done = make(chan struct{})
+	s.snapc = make(chan chan snapResult)
+	if s.LeaderChangeWebhook != "" {
+		s.webhook = newWebhook(s.LeaderChangeWebhook, s.LeaderChangeWebhookTimeout)
+		go s.webhook.run(s.done)
+	}
 	// TODO: if this is an empty log, writes all peer infos
 	// into the first entry
 	go s.run()
 }
 
 func (s *EtcdServer) Process(ctx context.Context, m raftpb.Message) error {
+	s.activity.record(m.From)
 	return s.Node.Step(ctx, m)
 }
 
@@ -137,6 +305,49 @@ func (s *EtcdServer) run() {
 	var syncC <-chan time.Time
 	// snapi indicates the index of the last submitted snapshot request
 	var snapi, appliedi int64
+	// size of the entries applied since snapi
+	var appliedBytes int64
+	// reads waiting for entries to be applied
+	var reads []raft.ReadState
+	// the index and the term of the last snapshot saved, and the
+	// snapshots asked for with TakeSnapshot waiting to be saved
+	var savedi, savedt int64
+	var snapReqs []snapRequest
+	// the latest term, reported with the leader changes
+	var term int64
+
+	if s.SnapshotIndex > 0 {
+		appliedi, snapi = s.SnapshotIndex, s.SnapshotIndex
+		savedi, savedt = s.SnapshotIndex, s.SnapshotTerm
+		atomic.StoreInt64(&s.raftIndex, s.SnapshotIndex)
+		atomic.StoreInt64(&s.raftTerm, s.SnapshotTerm)
+	}
+
+	replayed := func() {
+		if appliedi >= s.ReplayIndex && atomic.CompareAndSwapInt32(&s.replayed, 0, 1) && s.ReplayIndex > 0 {
+			logger.Infof("etcdserver: replayed the WAL up to index %d", s.ReplayIndex)
+		}
+	}
+	replayed()
+
+	snapshot := func() {
+		s.snapshot()
+		snapi = appliedi
+		appliedBytes = 0
+		if ci := snapi - s.SnapCatchUpEntries; ci > 0 {
+			s.Node.Compact(ci)
+		}
+	}
+
+	defer func() {
+		s.Node.Stop()
+		s.releaseAllInflight()
+		if err := s.Storage.Close(); err != nil {
+			logger.Errorf("etcdserver: error closing storage: %v", err)
+		}
+		close(s.done)
+	}()
+
 	for {
 		select {
 		case <-s.Ticker:
@@ -144,106 +355,239 @@ func (s *EtcdServer) run() {
 		case rd := <-s.Node.Ready():
 			s.Storage.Save(rd.HardState, rd.Entries)
 			s.Storage.SaveSnap(rd.Snapshot)
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				savedi, savedt = rd.Snapshot.Index, rd.Snapshot.Term
+				info := s.snapshotInfo(savedi, savedt)
+				waiting := snapReqs[:0]
+				for _, r := range snapReqs {
+					if r.index <= savedi {
+						r.c <- snapResult{info: info}
+					} else {
+						waiting = append(waiting, r)
+					}
+				}
+				snapReqs = waiting
+			}
 			s.Send(rd.Messages)
+			if !raft.IsEmptyHardState(rd.HardState) {
+				term = rd.HardState.Term
+				termGauge.Set(rd.HardState.Term)
+				commitGauge.Set(rd.HardState.Commit)
+			}
 
 			// TODO(bmizerany): do this in the background, but take
 			// care to apply entries in a single goroutine, and not
 			// race them.
-			// TODO: apply configuration change into ClusterStore.
 			for _, e := range rd.CommittedEntries {
+				var id int64
+				var x interface{}
+				s.applyMu.Lock()
 				switch e.Type {
 				case raftpb.EntryNormal:
 					var r pb.Request
 					if err := r.Unmarshal(e.Data); err != nil {
 						panic("TODO: this is bad, what do we do about it?")
 					}
-					s.w.Trigger(r.ID, s.apply(r))
+					start := time.Now()
+					resp := s.apply(r)
+					if took := time.Since(start); s.ApplySlowThreshold > 0 && took > s.ApplySlowThreshold {
+						slowApplies.Inc()
+						logger.Warnf("etcdserver: applying %s %q at index %d took %v, longer than %v", r.Method, r.Path, e.Index, took, s.ApplySlowThreshold)
+					}
+					resp.Index = e.Index
+					id, x = r.ID, resp
+					proposalsCommitted.Inc()
 				case raftpb.EntryConfChange:
 					var cc raftpb.ConfChange
 					if err := cc.Unmarshal(e.Data); err != nil {
 						panic("TODO: this is bad, what do we do about it?")
 					}
-					s.Node.ApplyConfChange(cc)
-					s.w.Trigger(cc.ID, nil)
+					id, x = cc.ID, s.applyConfChange(cc)
 				default:
 					panic("unexpected entry type")
 				}
+				// the index is stored before the waiter is triggered, so
+				// that the response to a request carries an X-Raft-Index
+				// not lower than its own
 				atomic.StoreInt64(&s.raftIndex, e.Index)
 				atomic.StoreInt64(&s.raftTerm, e.Term)
+				s.applyMu.Unlock()
+				s.w.Trigger(id, x)
+				s.releaseInflight(id)
 				appliedi = e.Index
+				appliedBytes += int64(len(e.Data))
+			}
+			if len(rd.CommittedEntries) > 0 {
+				atomic.StoreInt64(&s.lastApply, time.Now().UnixNano())
 			}
 
 			if rd.Snapshot.Index > snapi {
 				snapi = rd.Snapshot.Index
+				appliedBytes = 0
 			}
 
 			// recover from snapshot if it is more updated than current applied
 			if rd.Snapshot.Index > appliedi {
+				s.applyMu.Lock()
 				if err := s.Store.Recovery(rd.Snapshot.Data); err != nil {
 					panic("TODO: this is bad, what do we do about it?")
 				}
+				atomic.StoreInt64(&s.raftIndex, rd.Snapshot.Index)
+				atomic.StoreInt64(&s.raftTerm, rd.Snapshot.Term)
+				s.applyMu.Unlock()
 				appliedi = rd.Snapshot.Index
 			}
 
-			if appliedi-snapi > s.SnapCount {
-				s.snapshot()
-				snapi = appliedi
+			reads = s.applyReads(append(reads, rd.ReadStates...), appliedi)
+			replayed()
+
+			if appliedi-snapi > s.SnapCount || (s.SnapBytes > 0 && appliedBytes >= s.SnapBytes) {
+				snapshot()
 			}
 
 			if rd.SoftState != nil {
+				if lead := atomic.SwapInt64(&s.raftLead, rd.SoftState.Lead); lead != rd.SoftState.Lead && rd.SoftState.Lead != raft.None {
+					leaderChanges.Inc()
+					// raft drops the proposals it did not commit
+					// without telling, when the leader changes
+					s.releaseAllInflight()
+					if s.PeerStats != nil {
+						s.PeerStats.Reset()
+					}
+					if s.webhook != nil {
+						s.webhook.notify(LeaderChange{Member: s.Name, OldLeader: lead, NewLeader: rd.SoftState.Lead, Term: term})
+					}
+				}
 				if rd.RaftState == raft.StateLeader {
 					syncC = s.SyncTicker
 				} else {
 					syncC = nil
 				}
 				if rd.SoftState.ShouldStop {
-					s.Stop()
 					return
 				}
 			}
 		case <-syncC:
 			s.sync(defaultSyncTimeout)
-		case <-s.done:
+			s.updateClusterVersion(defaultSyncTimeout)
+		case c := <-s.snapc:
+			if appliedi == 0 {
+				c <- snapResult{err: ErrNothingApplied}
+				break
+			}
+			if appliedi > snapi {
+				snapshot()
+			}
+			// the snapshot taken is saved with the next Ready
+			if savedi >= snapi {
+				c <- snapResult{info: s.snapshotInfo(savedi, savedt)}
+				break
+			}
+			snapReqs = append(snapReqs, snapRequest{index: snapi, c: c})
+		case <-s.stop:
 			return
 		}
 	}
 }
 
-// Stop stops the server, and shuts down the running goroutine. Stop should be
-// called after a Start(s), otherwise it will block forever.
+// Stop stops the server, and shuts down the running goroutine. It stops the
+// raft node and flushes and closes the underlying storage before returning.
+// Requests still waiting for consensus return ErrStopped, so callers that
+// want in-flight requests to complete should stop feeding requests into the
+// server and let them finish before calling Stop.
+// Stop should be called after a Start(s), otherwise it will block forever.
 func (s *EtcdServer) Stop() {
-	s.Node.Stop()
-	close(s.done)
+	select {
+	case s.stop <- struct{}{}:
+	case <-s.done:
+	}
+	<-s.done
+}
+
+// acquireInflight counts the proposal id against MaxInflightProposals, or
+// returns false if the server already has as many in flight.
+func (s *EtcdServer) acquireInflight(id int64) bool {
+	if s.MaxInflightProposals == 0 {
+		return true
+	}
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	if int64(len(s.inflight)) >= s.MaxInflightProposals {
+		return false
+	}
+	if s.inflight == nil {
+		s.inflight = make(map[int64]bool)
+	}
+	s.inflight[id] = true
+	return true
+}
+
+// releaseInflight stops counting the proposal id, once it was applied or
+// dropped.
+func (s *EtcdServer) releaseInflight(id int64) {
+	s.inflightMu.Lock()
+	delete(s.inflight, id)
+	s.inflightMu.Unlock()
+}
+
+func (s *EtcdServer) releaseAllInflight() {
+	s.inflightMu.Lock()
+	s.inflight = nil
+	s.inflightMu.Unlock()
 }
 
 // Do interprets r and performs an operation on s.Store according to r.Method
-// and other fields. If r.Method is "POST", "PUT", "DELETE", or a "GET" with
-// Quorum == true, r will be sent through consensus before performing its
-// respective operation. Do will block until an action is performed or there is
-// an error.
+// and other fields. If r.Method is "POST", "PUT", "DELETE" or "TXN", r will
+// be sent through consensus before performing its respective operation. A
+// "TXN" carries a store.Txn encoded in JSON in r.Val. Such a request fails
+// with ErrTooManyRequests if s.MaxInflightProposals are already waiting to
+// be applied, and with ErrClusterVersion if it is not supported by the
+// cluster version, see ClusterVersionAtLeast. A "GET" with
+// Quorum == true is served from s.Store once the server has caught up with
+// the commit index of the leader, see linearizableRead. Do will block until
+// an action is performed or there is an error.
 func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 	if r.ID == 0 {
 		panic("r.Id cannot be 0")
 	}
-	if r.Method == "GET" && r.Quorum {
-		r.Method = "QGET"
-	}
 	switch r.Method {
-	case "POST", "PUT", "DELETE", "QGET":
+	case "POST", "PUT", "DELETE", "TXN":
+		if v := requestVersion(r); v != "" && !s.ClusterVersionAtLeast(v) {
+			return Response{}, ErrClusterVersion
+		}
 		data, err := r.Marshal()
 		if err != nil {
 			return Response{}, err
 		}
+		// the proposal keeps its slot after Do gave up on it, as long
+		// as it waits in raft
+		if !s.acquireInflight(r.ID) {
+			proposalsRejected.Inc()
+			return Response{}, ErrTooManyRequests
+		}
 		ch := s.w.Register(r.ID)
-		s.Node.Propose(ctx, data)
+		if err := s.Node.Propose(ctx, data); err != nil {
+			proposalsFailed.Inc()
+			s.releaseInflight(r.ID)
+			s.w.Trigger(r.ID, nil) // GC wait
+			switch err {
+			case raft.ErrProposalDropped:
+				return Response{}, ErrNoLeader
+			case raft.ErrStopped:
+				return Response{}, ErrStopped
+			}
+			return Response{}, err
+		}
 		select {
 		case x := <-ch:
 			resp := x.(Response)
 			return resp, resp.err
 		case <-ctx.Done():
+			proposalsFailed.Inc()
 			s.w.Trigger(r.ID, nil) // GC wait
 			return Response{}, ctx.Err()
 		case <-s.done:
+			proposalsFailed.Inc()
 			return Response{}, ErrStopped
 		}
 	case "GET":
@@ -255,7 +599,16 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 			}
 			return Response{Watcher: wc}, nil
 		default:
-			ev, err := s.Store.Get(r.Path, r.Recursive, r.Sorted)
+			if r.Quorum {
+				if err := s.linearizableRead(ctx); err != nil {
+					return Response{}, err
+				}
+			}
+			get := s.Store.Get
+			if r.Hidden {
+				get = s.Store.GetHidden
+			}
+			ev, err := get(r.Path, r.Recursive, r.Sorted)
 			if err != nil {
 				return Response{}, err
 			}
@@ -266,17 +619,72 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 	}
 }
 
-func (s *EtcdServer) AddNode(ctx context.Context, id int64, context []byte) error {
+// linearizableRead blocks until s has applied all the entries committed in
+// the cluster by the time it was called, so that reading from s.Store
+// afterwards observes every write that completed before.
+// It asks raft for a read index, which the leader only hands out after a
+// quorum confirmed its leadership. That costs a round trip to a quorum but,
+// unlike a proposal, nothing is written to the log. A leader holding a
+// lease, see raft.LeaderLease, skips the round trip.
+func (s *EtcdServer) linearizableRead(ctx context.Context) error {
+	id := GenID()
+	rctx := make([]byte, 8)
+	binary.BigEndian.PutUint64(rctx, uint64(id))
+	ch := s.w.Register(id)
+	if err := s.Node.ReadIndex(ctx, rctx); err != nil {
+		s.w.Trigger(id, nil)
+		return err
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.w.Trigger(id, nil) // GC wait
+		return ctx.Err()
+	case <-s.done:
+		return ErrStopped
+	}
+}
+
+// applyReads unblocks the reads whose index has been applied, and returns
+// the ones that still wait for entries to be applied.
+func (s *EtcdServer) applyReads(reads []raft.ReadState, appliedi int64) []raft.ReadState {
+	pending := reads[:0]
+	for _, rs := range reads {
+		if rs.Index > appliedi {
+			pending = append(pending, rs)
+			continue
+		}
+		s.w.Trigger(int64(binary.BigEndian.Uint64(rs.RequestCtx)), nil)
+	}
+	return pending
+}
+
+func (s *EtcdServer) AddMember(ctx context.Context, m Member) error {
+	if s.ClusterStore.Get().FindID(m.ID) != nil {
+		return ErrIDExists
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
 	cc := raftpb.ConfChange{
 		ID:      GenID(),
 		Type:    raftpb.ConfChangeAddNode,
-		NodeID:  id,
-		Context: context,
+		NodeID:  m.ID,
+		Context: b,
 	}
 	return s.configure(ctx, cc)
 }
 
-func (s *EtcdServer) RemoveNode(ctx context.Context, id int64) error {
+func (s *EtcdServer) RemoveMember(ctx context.Context, id int64) error {
+	c := s.ClusterStore.Get()
+	if c.FindID(id) == nil {
+		return ErrIDNotFound
+	}
+	if len(c) == 1 {
+		return ErrLastMember
+	}
 	cc := raftpb.ConfChange{
 		ID:     GenID(),
 		Type:   raftpb.ConfChangeRemoveNode,
@@ -294,22 +702,41 @@ func (s *EtcdServer) Term() int64 {
 	return atomic.LoadInt64(&s.raftTerm)
 }
 
+// Implement the HealthReporter interface
+func (s *EtcdServer) Leader() int64 {
+	return atomic.LoadInt64(&s.raftLead)
+}
+
+func (s *EtcdServer) Replayed() bool {
+	return s.ReplayIndex == 0 || atomic.LoadInt32(&s.replayed) == 1
+}
+
+func (s *EtcdServer) LastApply() time.Time {
+	if t := atomic.LoadInt64(&s.lastApply); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
 // configure sends configuration change through consensus then performs it.
 // It will block until the change is performed or there is an error.
 func (s *EtcdServer) configure(ctx context.Context, cc raftpb.ConfChange) error {
 	ch := s.w.Register(cc.ID)
 	if err := s.Node.ProposeConfChange(ctx, cc); err != nil {
-		log.Printf("configure error: %v", err)
+		logger.Errorf("configure error: %v", err)
 		s.w.Trigger(cc.ID, nil)
 		return err
 	}
 	select {
-	case <-ch:
-		return nil
+	case x := <-ch:
+		err, _ := x.(error)
+		return err
 	case <-ctx.Done():
+		proposalsFailed.Inc()
 		s.w.Trigger(cc.ID, nil) // GC wait
 		return ctx.Err()
 	case <-s.done:
+		proposalsFailed.Inc()
 		return ErrStopped
 	}
 }
@@ -326,7 +753,7 @@ func (s *EtcdServer) sync(timeout time.Duration) {
 	}
 	data, err := req.Marshal()
 	if err != nil {
-		log.Printf("marshal request %#v error: %v", req, err)
+		logger.Errorf("marshal request %#v error: %v", req, err)
 		return
 	}
 	// There is no promise that node has leader when do SYNC request,
@@ -338,17 +765,18 @@ func (s *EtcdServer) sync(timeout time.Duration) {
 }
 
 // publish registers server information into the cluster. The information
-// is the json format of its self member struct, whose ClientURLs may be
-// updated.
+// is the json format of its self member struct, whose ClientURLs and
+// Version may be updated.
 // The function keeps attempting to register until it succeeds,
 // or its server is stopped.
 // TODO: take care of info fetched from cluster store after having reconfig.
 func (s *EtcdServer) publish(retryInterval time.Duration) {
 	m := *s.ClusterStore.Get().FindName(s.Name)
 	m.ClientURLs = s.ClientURLs.StringSlice()
+	m.Version = s.Version
 	b, err := json.Marshal(m)
 	if err != nil {
-		log.Printf("etcdserver: json marshal error: %v", err)
+		logger.Errorf("etcdserver: json marshal error: %v", err)
 		return
 	}
 	req := pb.Request{
@@ -364,17 +792,49 @@ func (s *EtcdServer) publish(retryInterval time.Duration) {
 		cancel()
 		switch err {
 		case nil:
-			log.Printf("etcdserver: published %+v to the cluster", m)
+			logger.Infof("etcdserver: published %+v to the cluster", m)
 			return
 		case ErrStopped:
-			log.Printf("etcdserver: aborting publish because server is stopped")
+			logger.Infof("etcdserver: aborting publish because server is stopped")
 			return
 		default:
-			log.Printf("etcdserver: publish error: %v", err)
+			logger.Warnf("etcdserver: publish error: %v", err)
+		}
+	}
+}
+
+// purgeFile purges old snapshot and WAL files every interval until the
+// server is stopped.
+func (s *EtcdServer) purgeFile(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.purge()
+		case <-s.done:
+			return
 		}
 	}
 }
 
+// purge removes all but the newest MaxSnapFiles snapshot files, and the WAL
+// files that only hold entries covered by the oldest retained snapshot.
+func (s *EtcdServer) purge() {
+	index, err := snap.New(s.SnapDir).Purge(s.MaxSnapFiles)
+	switch err {
+	case nil:
+	case snap.ErrNoSnapshot:
+		return
+	default:
+		logger.Errorf("etcdserver: purge snapshot error: %v", err)
+		return
+	}
+	if err := wal.Purge(s.WALDir, index); err != nil {
+		logger.Errorf("etcdserver: purge wal error: %v", err)
+	}
+}
+
 func getExpirationTime(r *pb.Request) time.Time {
 	var t time.Time
 	if r.Expiration != 0 {
@@ -398,6 +858,9 @@ func (s *EtcdServer) apply(r pb.Request) Response {
 		switch {
 		case existsSet:
 			if exists {
+				if r.Refresh {
+					return f(s.Store.Refresh(r.Path, expr))
+				}
 				return f(s.Store.Update(r.Path, r.Val, expr))
 			}
 			return f(s.Store.Create(r.Path, r.Dir, r.Val, false, expr))
@@ -408,22 +871,82 @@ func (s *EtcdServer) apply(r pb.Request) Response {
 		}
 	case "DELETE":
 		switch {
+		case r.Range:
+			return f(s.Store.DeleteRange(r.Path))
 		case r.PrevIndex > 0 || r.PrevValue != "":
 			return f(s.Store.CompareAndDelete(r.Path, r.PrevValue, r.PrevIndex))
 		default:
 			return f(s.Store.Delete(r.Path, r.Dir, r.Recursive))
 		}
 	case "QGET":
+		// quorum reads are no longer proposed, but they may still be
+		// found in logs written by older versions.
 		return f(s.Store.Get(r.Path, r.Recursive, r.Sorted))
 	case "SYNC":
 		s.Store.DeleteExpiredKeys(time.Unix(0, r.Time))
 		return Response{}
+	case "TXN":
+		var t store.Txn
+		if err := json.Unmarshal([]byte(r.Val), &t); err != nil {
+			return Response{err: err}
+		}
+		tr, err := s.Store.Txn(t)
+		return Response{Txn: tr, err: err}
 	default:
 		// This should never be reached, but just in case:
 		return Response{err: ErrUnknownMethod}
 	}
 }
 
+// applyConfChange applies cc to the raft node, and to the ClusterStore so
+// that messages start being sent to added members, and stop being sent to
+// removed ones. Changes that conflict with the ClusterStore, which may have
+// been proposed concurrently, are applied to neither and return an error;
+// raft is only told that the change is over.
+func (s *EtcdServer) applyConfChange(cc raftpb.ConfChange) error {
+	var m Member
+	var err error
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode:
+		if err := json.Unmarshal(cc.Context, &m); err != nil {
+			panic("unexpected unmarshal error")
+		}
+		if cc.NodeID != m.ID {
+			panic("unexpected nodeID mismatch")
+		}
+		if s.ClusterStore.Get().FindID(m.ID) != nil {
+			logger.Warnf("etcdserver: member %x already exists", m.ID)
+			err = ErrIDExists
+		}
+	case raftpb.ConfChangeRemoveNode:
+		if s.ClusterStore.Get().FindID(cc.NodeID) == nil {
+			logger.Warnf("etcdserver: member %x does not exist", cc.NodeID)
+			err = ErrIDNotFound
+		}
+	default:
+		panic("unexpected ConfChange type")
+	}
+	if err != nil {
+		cc.NodeID = raft.None
+		s.Node.ApplyConfChange(cc)
+		return err
+	}
+
+	s.Node.ApplyConfChange(cc)
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode:
+		s.ClusterStore.Add(m)
+		logger.Infof("etcdserver: added member %x %v", m.ID, m.PeerURLs)
+	case raftpb.ConfChangeRemoveNode:
+		s.ClusterStore.Delete(cc.NodeID)
+		if s.RemovePeer != nil {
+			s.RemovePeer(cc.NodeID)
+		}
+		logger.Infof("etcdserver: removed member %x", cc.NodeID)
+	}
+	return nil
+}
+
 // TODO: non-blocking snapshot
 func (s *EtcdServer) snapshot() {
 	d, err := s.Store.Save()
@@ -432,7 +955,7 @@ func (s *EtcdServer) snapshot() {
 	if err != nil {
 		panic("TODO: this is bad, what do we do about it?")
 	}
-	s.Node.Compact(d)
+	s.Node.Snapshot(d)
 	s.Storage.Cut()
 }
 
@@ -1,21 +1,31 @@
 package etcdserver
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/url"
+	"os"
+	"path"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	etcdErr "github.com/coreos/etcd/error"
 	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/pkg"
+	"github.com/coreos/etcd/pkg/logger"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
 	"github.com/coreos/etcd/store"
 	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+	"github.com/coreos/etcd/wal"
 )
 
 func TestGetExpirationTime(t *testing.T) {
@@ -69,6 +79,16 @@ func TestDoLocalAction(t *testing.T) {
 				},
 			},
 		},
+		{
+			pb.Request{Method: "GET", ID: 1, Recursive: true, Hidden: true},
+			Response{Event: &store.Event{}}, nil,
+			[]action{
+				action{
+					name:   "GetHidden",
+					params: []interface{}{"", true, false},
+				},
+			},
+		},
 		{
 			pb.Request{Method: "BADMETHOD", ID: 1},
 			Response{}, ErrUnknownMethod, []action{},
@@ -201,6 +221,17 @@ func TestApply(t *testing.T) {
 				},
 			},
 		},
+		// PUT with PrevExist=true and Refresh ==> Refresh
+		{
+			pb.Request{Method: "PUT", ID: 1, PrevExist: boolp(true), Refresh: true, Expiration: 1337},
+			Response{Event: &store.Event{}},
+			[]action{
+				action{
+					name:   "Refresh",
+					params: []interface{}{"", time.Unix(0, 1337)},
+				},
+			},
+		},
 		// PUT with PrevExist=false ==> Create
 		{
 			pb.Request{Method: "PUT", ID: 1, PrevExist: boolp(false)},
@@ -313,6 +344,17 @@ func TestApply(t *testing.T) {
 				},
 			},
 		},
+		// DELETE with Range set ==> DeleteRange
+		{
+			pb.Request{Method: "DELETE", ID: 1, Path: "/foo", Range: true, Recursive: true},
+			Response{Event: &store.Event{}},
+			[]action{
+				action{
+					name:   "DeleteRange",
+					params: []interface{}{"/foo"},
+				},
+			},
+		},
 		// QGET ==> Get
 		{
 			pb.Request{Method: "QGET", ID: 1},
@@ -345,6 +387,20 @@ func TestApply(t *testing.T) {
 				},
 			},
 		},
+		// TXN ==> Txn
+		{
+			pb.Request{Method: "TXN", ID: 1, Val: `{"compare":[{"key":"/foo","exist":true}],"success":[{"action":"delete","key":"/foo"}]}`},
+			Response{Txn: &store.TxnResponse{}},
+			[]action{
+				action{
+					name: "Txn",
+					params: []interface{}{store.Txn{
+						Compare: []store.Compare{{Key: "/foo", Exist: boolp(true)}},
+						Success: []store.Op{{Action: "delete", Key: "/foo"}},
+					}},
+				},
+			},
+		},
 		// Unknown method - error
 		{
 			pb.Request{Method: "BADMETHOD", ID: 1},
@@ -448,12 +504,103 @@ func testServer(t *testing.T, ns int64) {
 	}
 }
 
+// TestCompareAndSwapRace tests that of two CompareAndSwap racing on the
+// same key, the one applied last fails with the value and the index the
+// other one wrote, as they are when it is applied rather than when it was
+// proposed, so that it can be retried against them.
+func TestCompareAndSwapRace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tk := time.NewTicker(10 * time.Millisecond)
+	defer tk.Stop()
+	srv := &EtcdServer{
+		Node:    raft.StartNode(1, []int64{1}, 10, 1),
+		Store:   store.New(),
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Ticker:  tk.C,
+	}
+	srv.start()
+	defer srv.Stop()
+
+	resp, err := srv.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/foo", Val: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		prev := resp.Event.Node
+		reqs := []pb.Request{
+			{Method: "PUT", ID: GenID(), Path: "/foo", Val: fmt.Sprintf("x%d", i)},
+			{Method: "PUT", ID: GenID(), Path: "/foo", Val: fmt.Sprintf("y%d", i)},
+		}
+		// compare the value, then the index
+		for j := range reqs {
+			if i%2 == 0 {
+				reqs[j].PrevValue = *prev.Value
+			} else {
+				reqs[j].PrevIndex = prev.ModifiedIndex
+			}
+		}
+
+		type result struct {
+			resp Response
+			err  error
+		}
+		results := make([]result, len(reqs))
+		var wg sync.WaitGroup
+		for j := range reqs {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				r, err := srv.Do(ctx, reqs[j])
+				results[j] = result{r, err}
+			}(j)
+		}
+		wg.Wait()
+
+		var won, lost []result
+		for _, r := range results {
+			if r.err == nil {
+				won = append(won, r)
+			} else {
+				lost = append(lost, r)
+			}
+		}
+		if len(won) != 1 || len(lost) != 1 {
+			t.Fatalf("#%d: %d won and %d lost, want 1 and 1: %+v", i, len(won), len(lost), results)
+		}
+		w := won[0].resp.Event.Node
+		e, ok := lost[0].err.(*etcdErr.Error)
+		if !ok || e.ErrorCode != etcdErr.EcodeTestFailed {
+			t.Fatalf("#%d: err = %v, want EcodeTestFailed", i, lost[0].err)
+		}
+		if e.Index != w.ModifiedIndex {
+			t.Errorf("#%d: index = %d, want %d of the winner", i, e.Index, w.ModifiedIndex)
+		}
+		var wcause string
+		if i%2 == 0 {
+			wcause = fmt.Sprintf("[%s != %s]", *prev.Value, *w.Value)
+		} else {
+			wcause = fmt.Sprintf("[%d != %d]", prev.ModifiedIndex, w.ModifiedIndex)
+		}
+		if e.Cause != wcause {
+			t.Errorf("#%d: cause = %q, want %q", i, e.Cause, wcause)
+		}
+		resp = won[0].resp
+	}
+}
+
 func TestDoProposal(t *testing.T) {
-	tests := []pb.Request{
-		pb.Request{Method: "POST", ID: 1},
-		pb.Request{Method: "PUT", ID: 1},
-		pb.Request{Method: "DELETE", ID: 1},
-		pb.Request{Method: "GET", ID: 1, Quorum: true},
+	tests := []struct {
+		req pb.Request
+		// index of the applied entry: 1 is the conf change adding the
+		// member, and 2 the first proposal
+		windex int64
+	}{
+		{pb.Request{Method: "POST", ID: 1}, 2},
+		{pb.Request{Method: "PUT", ID: 1}, 2},
+		{pb.Request{Method: "DELETE", ID: 1}, 2},
+		{pb.Request{Method: "GET", ID: 1, Quorum: true}, 0},
 	}
 
 	for i, tt := range tests {
@@ -471,7 +618,7 @@ func TestDoProposal(t *testing.T) {
 			Ticker:  tk,
 		}
 		srv.start()
-		resp, err := srv.Do(ctx, tt)
+		resp, err := srv.Do(ctx, tt.req)
 		srv.Stop()
 
 		action := st.Action()
@@ -481,13 +628,93 @@ func TestDoProposal(t *testing.T) {
 		if err != nil {
 			t.Fatalf("#%d: err = %v, want nil", i, err)
 		}
-		wresp := Response{Event: &store.Event{}}
+		wresp := Response{Event: &store.Event{}, Index: tt.windex}
 		if !reflect.DeepEqual(resp, wresp) {
 			t.Errorf("#%d: resp = %v, want %v", i, resp, wresp)
 		}
 	}
 }
 
+// TestDoProposalSavedBeforeAck ensures that a proposal is acknowledged only
+// after its entry has been saved to the storage.
+func TestDoProposalSavedBeforeAck(t *testing.T) {
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	st := &entryStorage{}
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   &storeRecorder{},
+		Send:    func(_ []raftpb.Message) {},
+		Storage: st,
+		Ticker:  tk,
+	}
+	srv.start()
+	defer srv.Stop()
+
+	for i := int64(1); i <= 3; i++ {
+		if _, err := srv.Do(context.Background(), pb.Request{Method: "PUT", ID: i}); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !st.saved(i) {
+			t.Errorf("#%d: acknowledged before its entry was saved", i)
+		}
+	}
+}
+
+// TestDoQuorumGetStaleFollower ensures that a quorum read waits for the
+// server to apply the entries up to the read index before reading the store.
+func TestDoQuorumGetStaleFollower(t *testing.T) {
+	n := &readIndexNode{readyNode: *newReadyNode(), readc: make(chan []byte, 1)}
+	st := &storeRecorder{}
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+	}
+	srv.start()
+	defer srv.Stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := srv.Do(context.Background(), pb.Request{Method: "GET", ID: 1, Quorum: true})
+		errc <- err
+	}()
+	rctx := <-n.readc
+	// the leader has committed up to 2, while the server has applied nothing
+	n.readyc <- raft.Ready{ReadStates: []raft.ReadState{{Index: 2, RequestCtx: rctx}}}
+	select {
+	case err := <-errc:
+		t.Fatalf("err = %v, want blocking", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	var ents []raftpb.Entry
+	for i := int64(1); i <= 2; i++ {
+		r := pb.Request{Method: "PUT", ID: i + 1}
+		d, err := r.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, raftpb.Entry{Index: i, Data: d})
+	}
+	n.readyc <- raft.Ready{CommittedEntries: ents}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("quorum read still blocks after the read index is applied")
+	}
+	action := st.Action()
+	if len(action) != 3 || action[2].name != "Get" {
+		t.Errorf("action = %v, want [Set Set Get]", action)
+	}
+}
+
 func TestDoProposalCancelled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	// node cannot make any progress because there are two nodes
@@ -523,6 +750,33 @@ func TestDoProposalCancelled(t *testing.T) {
 	}
 }
 
+func TestDoProposalNoLeader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// node cannot elect a leader because there are two nodes
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0, 0xBAD1}, 10, 1)
+	defer n.Stop()
+	st := &storeRecorder{}
+	wait := &waitRecorder{}
+	srv := &EtcdServer{
+		Node:  n,
+		Store: st,
+		w:     wait,
+	}
+
+	_, err := srv.Do(ctx, pb.Request{Method: "PUT", ID: 1})
+	if err != ErrNoLeader {
+		t.Fatalf("err = %v, want %v", err, ErrNoLeader)
+	}
+	if gaction := st.Action(); len(gaction) != 0 {
+		t.Errorf("len(action) = %v, want 0", len(gaction))
+	}
+	w := []action{action{name: "Register1"}, action{name: "Trigger1"}}
+	if !reflect.DeepEqual(wait.action, w) {
+		t.Errorf("wait.action = %+v, want %+v", wait.action, w)
+	}
+}
+
 func TestDoProposalStopped(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -560,6 +814,157 @@ func TestDoProposalStopped(t *testing.T) {
 	}
 }
 
+// TestDoProposalTimeoutCommittedLater ensures that a proposal whose deadline
+// fires while the apply loop is stalled returns, and that its entry is still
+// applied once it commits.
+func TestDoProposalTimeoutCommittedLater(t *testing.T) {
+	n := newReadyNode()
+	st := &storeRecorder{}
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+	}
+	srv.start()
+	defer srv.Stop()
+
+	r := pb.Request{Method: "PUT", ID: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Do(ctx, r); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	d, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.readyc <- raft.Ready{CommittedEntries: []raftpb.Entry{{Index: 1, Data: d}}}
+	// the loop takes this one only once it has applied the entry, since
+	// readyc holds a single Ready
+	n.readyc <- raft.Ready{}
+	n.readyc <- raft.Ready{}
+	action := st.Action()
+	if len(action) != 1 || action[0].name != "Set" {
+		t.Errorf("action = %v, want [Set]", action)
+	}
+}
+
+// TestApplySlowWarning tests that an entry taking longer than
+// ApplySlowThreshold to apply is logged with its method and key, and that
+// the fast ones are not.
+func TestApplySlowWarning(t *testing.T) {
+	b := &bytes.Buffer{}
+	logger.SetOutput(b)
+	defer logger.SetOutput(os.Stderr)
+
+	n := newReadyNode()
+	st := &slowStoreRecorder{delay: 20 * time.Millisecond}
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+
+		ApplySlowThreshold: 10 * time.Millisecond,
+	}
+	srv.start()
+
+	var ents []raftpb.Entry
+	for i, r := range []pb.Request{
+		{Method: "PUT", ID: 1, Path: "/slow"},
+		{Method: "GET", ID: 2, Path: "/fast"},
+	} {
+		d, err := r.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, raftpb.Entry{Index: int64(i + 1), Data: d})
+	}
+	n.readyc <- raft.Ready{CommittedEntries: ents}
+	n.readyc <- raft.Ready{}
+	n.readyc <- raft.Ready{}
+	srv.Stop()
+
+	w := `WARN etcdserver: applying PUT "/slow" at index 1 took`
+	if !strings.Contains(b.String(), w) {
+		t.Errorf("log = %q, want it to contain %q", b.String(), w)
+	}
+	if strings.Contains(b.String(), "/fast") {
+		t.Errorf("log = %q, want no warning on /fast", b.String())
+	}
+}
+
+// TestDoProposalInflightLimit tests that the proposals past
+// MaxInflightProposals are refused until the ones in flight are applied,
+// even the ones Do gave up on, and that reads are not limited.
+func TestDoProposalInflightLimit(t *testing.T) {
+	n := &proposalNode{readyNode: *newReadyNode(), propc: make(chan []byte, 2)}
+	st := &storeRecorder{}
+	srv := &EtcdServer{
+		Node:    n,
+		Store:   st,
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+
+		MaxInflightProposals: 2,
+	}
+	srv.start()
+	defer srv.Stop()
+
+	errc := make(chan error, 2)
+	for i := 1; i <= 2; i++ {
+		go func(id int64) {
+			_, err := srv.Do(context.Background(), pb.Request{Method: "PUT", ID: id})
+			errc <- err
+		}(int64(i))
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 2; i++ {
+		ents = append(ents, raftpb.Entry{Index: int64(i), Data: <-n.propc})
+	}
+
+	if _, err := srv.Do(context.Background(), pb.Request{Method: "PUT", ID: 3}); err != ErrTooManyRequests {
+		t.Errorf("err = %v, want %v", err, ErrTooManyRequests)
+	}
+	if _, err := srv.Do(context.Background(), pb.Request{Method: "GET", ID: 4}); err != nil {
+		t.Errorf("GET err = %v, want nil", err)
+	}
+
+	n.readyc <- raft.Ready{CommittedEntries: ents}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("err = %v, want nil", err)
+		}
+	}
+
+	ents = nil
+	for i := 5; i <= 6; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := srv.Do(ctx, pb.Request{Method: "PUT", ID: int64(i)}); err != context.DeadlineExceeded {
+			t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+		}
+		cancel()
+		ents = append(ents, raftpb.Entry{Index: int64(i), Data: <-n.propc})
+	}
+	// the proposals timed out still wait in raft
+	if _, err := srv.Do(context.Background(), pb.Request{Method: "PUT", ID: 7}); err != ErrTooManyRequests {
+		t.Errorf("err = %v, want %v", err, ErrTooManyRequests)
+	}
+	n.readyc <- raft.Ready{CommittedEntries: ents}
+	// the entries are applied once the next Ready is taken, and the
+	// one after fits in readyc
+	n.readyc <- raft.Ready{}
+	n.readyc <- raft.Ready{}
+	go srv.Do(context.Background(), pb.Request{Method: "PUT", ID: 8})
+	select {
+	case <-n.propc:
+	case <-time.After(time.Second):
+		t.Errorf("proposal is refused once the ones in flight are applied")
+	}
+}
+
 // TestSync tests sync 1. is nonblocking 2. sends out SYNC request.
 func TestSync(t *testing.T) {
 	n := &nodeProposeDataRecorder{}
@@ -666,7 +1071,7 @@ func TestSyncTrigger(t *testing.T) {
 }
 
 // snapshot should snapshot the store and cut the persistent
-// TODO: node.Compact is called... we need to make the node an interface
+// TODO: node.Snapshot is called... we need to make the node an interface
 func TestSnapshot(t *testing.T) {
 	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
 	defer n.Stop()
@@ -720,15 +1125,51 @@ func TestTriggerSnap(t *testing.T) {
 
 	gaction := p.Action()
 	// each operation is recorded as a Save
-	// Nop + SnapCount * Puts + Cut + SaveSnap = Save + SnapCount * Save + Cut + SaveSnap
-	if len(gaction) != 3+int(s.SnapCount) {
-		t.Fatalf("len(action) = %d, want %d", len(gaction), 3+int(s.SnapCount))
+	// Nop + SnapCount * Puts + Cut + SaveSnap + Stop = Save + SnapCount * Save + Cut + SaveSnap + Close
+	if len(gaction) != 4+int(s.SnapCount) {
+		t.Fatalf("len(action) = %d, want %d", len(gaction), 4+int(s.SnapCount))
 	}
 	if !reflect.DeepEqual(gaction[12], action{name: "SaveSnap"}) {
 		t.Errorf("action = %s, want SaveSnap", gaction[12])
 	}
 }
 
+// TestTriggerSnapBytes tests that large entries trigger a snapshot before
+// SnapCount entries are applied.
+func TestTriggerSnapBytes(t *testing.T) {
+	ctx := context.Background()
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	n.Campaign(ctx)
+	st := &storeRecorder{}
+	p := &storageRecorder{}
+	s := &EtcdServer{
+		Store:     st,
+		Send:      func(_ []raftpb.Message) {},
+		Storage:   p,
+		Node:      n,
+		SnapCount: 100,
+		SnapBytes: 3 << 10,
+	}
+
+	s.start()
+	val := strings.Repeat("a", 1<<10)
+	for i := 0; i < 5; i++ {
+		s.Do(ctx, pb.Request{Method: "PUT", ID: 1, Val: val})
+	}
+	time.Sleep(time.Millisecond)
+	s.Stop()
+
+	snaps := 0
+	for _, a := range p.Action() {
+		if a.name == "SaveSnap" {
+			snaps++
+		}
+	}
+	if snaps != 1 {
+		t.Errorf("snapshots = %d, want 1", snaps)
+	}
+}
+
 // TestRecvSnapshot tests when it receives a snapshot from raft leader,
 // it should trigger storage.SaveSnap and also store.Recover.
 func TestRecvSnapshot(t *testing.T) {
@@ -752,7 +1193,7 @@ func TestRecvSnapshot(t *testing.T) {
 	if g := st.Action(); !reflect.DeepEqual(g, wactions) {
 		t.Errorf("store action = %v, want %v", g, wactions)
 	}
-	wactions = []action{action{name: "Save"}, action{name: "SaveSnap"}}
+	wactions = []action{action{name: "Save"}, action{name: "SaveSnap"}, action{name: "Close"}}
 	if g := p.Action(); !reflect.DeepEqual(g, wactions) {
 		t.Errorf("storage action = %v, want %v", g, wactions)
 	}
@@ -786,44 +1227,315 @@ func TestRecvSlowSnapshot(t *testing.T) {
 	}
 }
 
-// TestAddNode tests AddNode can propose and perform node addition.
-func TestAddNode(t *testing.T) {
+// TestAddMember tests AddMember can propose and perform node addition.
+func TestAddMember(t *testing.T) {
 	n := newNodeConfChangeCommitterRecorder()
+	cs := NewClusterStore(store.New(), Cluster{})
 	s := &EtcdServer{
-		Node:    n,
-		Store:   &storeRecorder{},
-		Send:    func(_ []raftpb.Message) {},
-		Storage: &storageRecorder{},
+		Node:         n,
+		Store:        &storeRecorder{},
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		ClusterStore: cs,
 	}
 	s.start()
-	s.AddNode(context.TODO(), 1, []byte("foo"))
+	m := Member{ID: 1, Name: "node1", PeerURLs: []string{"http://127.0.0.1:2380"}}
+	err := s.AddMember(context.TODO(), m)
 	gaction := n.Action()
 	s.Stop()
 
+	if err != nil {
+		t.Fatalf("AddMember error: %v", err)
+	}
 	wactions := []action{action{name: "ProposeConfChange:ConfChangeAddNode"}, action{name: "ApplyConfChange:ConfChangeAddNode"}}
 	if !reflect.DeepEqual(gaction, wactions) {
 		t.Errorf("action = %v, want %v", gaction, wactions)
 	}
+	if g := cs.Get().FindID(1); !reflect.DeepEqual(g, &m) {
+		t.Errorf("member = %+v, want %+v", g, &m)
+	}
 }
 
-// TestRemoveNode tests RemoveNode can propose and perform node removal.
-func TestRemoveNode(t *testing.T) {
+// TestRemoveMember tests RemoveMember can propose and perform node removal.
+func TestRemoveMember(t *testing.T) {
 	n := newNodeConfChangeCommitterRecorder()
+	cs := NewClusterStore(store.New(), Cluster{1: &Member{ID: 1}, 2: &Member{ID: 2}})
+	var removed []int64
 	s := &EtcdServer{
-		Node:    n,
-		Store:   &storeRecorder{},
-		Send:    func(_ []raftpb.Message) {},
-		Storage: &storageRecorder{},
+		Node:         n,
+		Store:        &storeRecorder{},
+		Send:         func(_ []raftpb.Message) {},
+		RemovePeer:   func(id int64) { removed = append(removed, id) },
+		Storage:      &storageRecorder{},
+		ClusterStore: cs,
 	}
 	s.start()
-	s.RemoveNode(context.TODO(), 1)
+	err := s.RemoveMember(context.TODO(), 1)
 	gaction := n.Action()
 	s.Stop()
 
+	if err != nil {
+		t.Fatalf("RemoveMember error: %v", err)
+	}
 	wactions := []action{action{name: "ProposeConfChange:ConfChangeRemoveNode"}, action{name: "ApplyConfChange:ConfChangeRemoveNode"}}
 	if !reflect.DeepEqual(gaction, wactions) {
 		t.Errorf("action = %v, want %v", gaction, wactions)
 	}
+	if g := cs.Get().FindID(1); g != nil {
+		t.Errorf("member = %+v, want nil", g)
+	}
+	if w := []int64{1}; !reflect.DeepEqual(removed, w) {
+		t.Errorf("removed peers = %v, want %v", removed, w)
+	}
+}
+
+// TestApplyConfChangeConflict tests that a committed membership change
+// conflicting with the ClusterStore is applied to neither raft nor the
+// ClusterStore, but that raft is told it is over.
+func TestApplyConfChangeConflict(t *testing.T) {
+	b, err := json.Marshal(Member{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cc   raftpb.ConfChange
+		werr error
+	}{
+		{raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1, Context: b}, ErrIDExists},
+		{raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}, ErrIDNotFound},
+	}
+	for i, tt := range tests {
+		n := &nodeConfChangeRecorder{}
+		cs := NewClusterStore(store.New(), Cluster{1: &Member{ID: 1}, 2: &Member{ID: 2}})
+		s := &EtcdServer{Node: n, ClusterStore: cs}
+		if err := s.applyConfChange(tt.cc); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if len(n.ccs) != 1 || n.ccs[0].NodeID != raft.None {
+			t.Errorf("#%d: applied = %+v, want one change for node None", i, n.ccs)
+		}
+		if g := cs.Get().IDs(); !reflect.DeepEqual(g, []int64{1, 2}) {
+			t.Errorf("#%d: members = %v, want [1 2]", i, g)
+		}
+	}
+}
+
+// TestMemberChangeRejected tests that invalid membership changes are
+// rejected without being proposed.
+func TestMemberChangeRejected(t *testing.T) {
+	tests := []struct {
+		cluster Cluster
+		change  func(s *EtcdServer) error
+
+		werr error
+	}{
+		{
+			Cluster{1: &Member{ID: 1}},
+			func(s *EtcdServer) error { return s.AddMember(context.TODO(), Member{ID: 1}) },
+			ErrIDExists,
+		},
+		{
+			Cluster{1: &Member{ID: 1}, 2: &Member{ID: 2}},
+			func(s *EtcdServer) error { return s.RemoveMember(context.TODO(), 3) },
+			ErrIDNotFound,
+		},
+		{
+			Cluster{1: &Member{ID: 1}},
+			func(s *EtcdServer) error { return s.RemoveMember(context.TODO(), 1) },
+			ErrLastMember,
+		},
+	}
+	for i, tt := range tests {
+		n := &nodeRecorder{}
+		s := &EtcdServer{
+			Node:         n,
+			Store:        &storeRecorder{},
+			ClusterStore: NewClusterStore(store.New(), tt.cluster),
+		}
+		if err := tt.change(s); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if g := n.Action(); len(g) != 0 {
+			t.Errorf("#%d: action = %v, want none", i, g)
+		}
+	}
+}
+
+// TestGrowCluster tests that a cluster of one member can be grown to three
+// members at runtime, and that the added members take part in consensus.
+func TestGrowCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	ss := make(map[int64]*EtcdServer)
+	send := func(msgs []raftpb.Message) {
+		for _, m := range msgs {
+			mu.Lock()
+			s := ss[m.To]
+			mu.Unlock()
+			if s != nil {
+				s.Node.Step(ctx, m)
+			}
+		}
+	}
+	// all the members start from the same bootstrap cluster, and learn
+	// the added members from the log.
+	bootstrap := Cluster{1: &Member{ID: 1, Name: "node1"}}
+	start := func(id int64) *EtcdServer {
+		tk := time.NewTicker(10 * time.Millisecond)
+		st := store.New()
+		srv := &EtcdServer{
+			Node:         raft.StartNode(id, []int64{1}, 10, 1),
+			Store:        st,
+			Send:         send,
+			Storage:      &storageRecorder{},
+			Ticker:       tk.C,
+			ClusterStore: NewClusterStore(st, bootstrap),
+		}
+		srv.start()
+		mu.Lock()
+		ss[id] = srv
+		mu.Unlock()
+		return srv
+	}
+	defer func() {
+		for _, s := range ss {
+			s.Stop()
+		}
+	}()
+
+	s1 := start(1)
+	put := func(s *EtcdServer, id int64) {
+		cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+		defer ccancel()
+		r := pb.Request{Method: "PUT", ID: id, Path: "/foo", Val: fmt.Sprint(id)}
+		if _, err := s.Do(cctx, r); err != nil {
+			t.Fatalf("put %d: %v", id, err)
+		}
+	}
+	put(s1, 1)
+
+	for id := int64(2); id <= 3; id++ {
+		cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+		err := s1.AddMember(cctx, Member{ID: id, Name: fmt.Sprintf("node%d", id)})
+		ccancel()
+		if err != nil {
+			t.Fatalf("add member %d: %v", id, err)
+		}
+		start(id)
+		// the put commits only once the new member has caught up
+		put(s1, 10*id)
+	}
+	put(ss[3], 100)
+
+	// let the followers apply the last entry
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	for id, s := range ss {
+		if g := len(s.ClusterStore.Get()); g != 3 {
+			t.Errorf("member %d: len(cluster) = %d, want 3", id, g)
+		}
+		ev, err := s.Store.Get("/foo", false, false)
+		if err != nil {
+			t.Fatalf("member %d: get error: %v", id, err)
+		}
+		if *ev.Node.Value != "100" {
+			t.Errorf("member %d: value = %s, want 100", id, *ev.Node.Value)
+		}
+	}
+}
+
+// TestReplayed tests that the server reports it replayed its WAL once it
+// applied the entries up to ReplayIndex.
+func TestReplayed(t *testing.T) {
+	n := newReadyNode()
+	srv := &EtcdServer{
+		Node:        n,
+		Store:       &storeRecorder{},
+		Send:        func(_ []raftpb.Message) {},
+		Storage:     &storageRecorder{},
+		ReplayIndex: 4,
+	}
+	srv.start()
+	defer srv.Stop()
+
+	apply := func(from, to int64) {
+		var ents []raftpb.Entry
+		for i := from; i <= to; i++ {
+			r := pb.Request{Method: "PUT", ID: i}
+			d, err := r.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ents = append(ents, raftpb.Entry{Index: i, Data: d})
+		}
+		n.readyc <- raft.Ready{CommittedEntries: ents}
+		// the second Ready after it is only taken once it is applied
+		n.readyc <- raft.Ready{}
+		n.readyc <- raft.Ready{}
+	}
+	if srv.Replayed() {
+		t.Fatal("replayed = true before applying anything")
+	}
+	apply(1, 3)
+	if srv.Replayed() {
+		t.Fatal("replayed = true before applying ReplayIndex")
+	}
+	apply(4, 4)
+	if !srv.Replayed() {
+		t.Fatal("replayed = false after applying ReplayIndex")
+	}
+
+	// a server starting with an empty WAL has nothing to replay
+	fresh := &EtcdServer{
+		Node:    newReadyNode(),
+		Store:   &storeRecorder{},
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+	}
+	fresh.start()
+	defer fresh.Stop()
+	fresh.Node.(*readyNode).readyc <- raft.Ready{}
+	fresh.Node.(*readyNode).readyc <- raft.Ready{}
+	if !fresh.Replayed() {
+		t.Error("replayed = false with no ReplayIndex")
+	}
+}
+
+// TestReplayedFromSnapshot tests that a server restarting from a snapshot
+// whose index is the commit index of the WAL has replayed it already, and
+// counts the entries of the snapshot as applied.
+func TestReplayedFromSnapshot(t *testing.T) {
+	n := newReadyNode()
+	srv := &EtcdServer{
+		Node:          n,
+		Store:         &storeRecorder{},
+		Send:          func(_ []raftpb.Message) {},
+		Storage:       &storageRecorder{},
+		ReplayIndex:   4,
+		SnapshotIndex: 4,
+		SnapshotTerm:  2,
+	}
+	srv.start()
+	defer srv.Stop()
+	n.readyc <- raft.Ready{}
+	n.readyc <- raft.Ready{}
+
+	if !srv.Replayed() {
+		t.Error("replayed = false with the snapshot at ReplayIndex")
+	}
+	if g := srv.Index(); g != 4 {
+		t.Errorf("index = %d, want 4", g)
+	}
+	info, err := srv.TakeSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("TakeSnapshot error: %v", err)
+	}
+	if info.Index != 4 || info.Term != 2 {
+		t.Errorf("snapshot = %d/%d, want 4/2", info.Index, info.Term)
+	}
 }
 
 // TestServerStopItself tests that if node sends out Ready with ShouldStop,
@@ -846,8 +1558,88 @@ func TestServerStopItself(t *testing.T) {
 	}
 }
 
+// TestStopClosesStorage tests that stopping the server flushes and closes
+// its storage once the run loop has exited.
+func TestStopClosesStorage(t *testing.T) {
+	p := &storageRecorder{}
+	s := &EtcdServer{
+		Node:    newReadyNode(),
+		Store:   &storeRecorder{},
+		Send:    func(_ []raftpb.Message) {},
+		Storage: p,
+	}
+	s.start()
+	s.Stop()
+
+	wactions := []action{action{name: "Close"}}
+	if g := p.Action(); !reflect.DeepEqual(g, wactions) {
+		t.Errorf("storage action = %v, want %v", g, wactions)
+	}
+	// a second Stop must not block or panic
+	s.Stop()
+}
+
 // TODO: test wait trigger correctness in multi-server case
 
+// TestPurge tests that purge keeps the newest MaxSnapFiles snapshots and
+// the wal files needed to recover from the oldest of them.
+func TestPurge(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapdir, waldir := path.Join(dir, "snap"), path.Join(dir, "wal")
+	if err := os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ss := snap.New(snapdir)
+	for _, index := range []int64{10, 20, 30} {
+		ss.SaveSnap(raftpb.Snapshot{Index: index, Term: 1, Data: []byte("data")})
+	}
+	w, err := wal.Create(waldir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 40; i++ {
+		if err := w.SaveEntry(&raftpb.Entry{Index: i, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 9 {
+			if err := w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Close()
+
+	srv := &EtcdServer{SnapDir: snapdir, WALDir: waldir, MaxSnapFiles: 2}
+	srv.purge()
+
+	snaps, err := ss.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsnaps := []string{
+		fmt.Sprintf("%016x-%016x.snap", 1, 30),
+		fmt.Sprintf("%016x-%016x.snap", 1, 20),
+	}
+	if !reflect.DeepEqual(snaps, wsnaps) {
+		t.Errorf("snaps = %v, want %v", snaps, wsnaps)
+	}
+	// the wal must still be readable from the oldest retained snapshot
+	if w, err = wal.OpenAtIndex(waldir, 20); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err := w.ReadAll(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if _, err := wal.OpenAtIndex(waldir, 19); err != wal.ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, wal.ErrFileNotFound)
+	}
+}
+
 func TestPublish(t *testing.T) {
 	n := &nodeProposeDataRecorder{}
 	cs := mustClusterStore(t, []Member{{ID: 1, Name: "node1"}})
@@ -888,6 +1680,49 @@ func TestPublish(t *testing.T) {
 	}
 }
 
+// TestPublishAdvertised tests that once the request of publish is applied,
+// the cluster lists the client URLs the member advertises, which are the
+// ones /v2/members and /v2/machines report.
+func TestPublishAdvertised(t *testing.T) {
+	n := &nodeProposeDataRecorder{}
+	c := Cluster{}
+	if err := c.AddSlice([]Member{{ID: 1, Name: "node1"}}); err != nil {
+		t.Fatal(err)
+	}
+	st := store.New()
+	cs := NewClusterStore(st, c)
+	ch := make(chan interface{}, 1)
+	ch <- Response{}
+	srv := &EtcdServer{
+		Name: "node1",
+		// listening on 0.0.0.0:2379 behind a NAT, say
+		ClientURLs:   []url.URL{{Scheme: "http", Host: "203.0.113.1:32379"}},
+		Node:         n,
+		ClusterStore: cs,
+		w:            &waitWithResponse{ch: ch},
+	}
+	srv.publish(time.Hour)
+
+	data := n.data()
+	if len(data) != 1 {
+		t.Fatalf("len(proposeData) = %d, want 1", len(data))
+	}
+	var r pb.Request
+	if err := r.Unmarshal(data[0]); err != nil {
+		t.Fatalf("unmarshal request error: %v", err)
+	}
+	if _, err := st.Set(r.Path, false, r.Val, store.Permanent); err != nil {
+		t.Fatal(err)
+	}
+	w := []string{"http://203.0.113.1:32379"}
+	if g := cs.Get().FindName("node1").ClientURLs; !reflect.DeepEqual(g, w) {
+		t.Errorf("client URLs of the member = %v, want %v", g, w)
+	}
+	if g := cs.Get().ClientURLs(); !reflect.DeepEqual(g, w) {
+		t.Errorf("client URLs of the cluster = %v, want %v", g, w)
+	}
+}
+
 // TestPublishStopped tests that publish will be stopped if server is stopped.
 func TestPublishStopped(t *testing.T) {
 	cs := mustClusterStore(t, []Member{{ID: 1, Name: "node1"}})
@@ -898,7 +1733,7 @@ func TestPublishStopped(t *testing.T) {
 		w:            &waitRecorder{},
 		done:         make(chan struct{}),
 	}
-	srv.Stop()
+	close(srv.done)
 	srv.publish(time.Hour)
 }
 
@@ -913,7 +1748,7 @@ func TestPublishRetry(t *testing.T) {
 		w:            &waitRecorder{},
 		done:         make(chan struct{}),
 	}
-	time.AfterFunc(500*time.Microsecond, srv.Stop)
+	time.AfterFunc(500*time.Microsecond, func() { close(srv.done) })
 	srv.publish(10 * time.Nanosecond)
 
 	action := n.Action()
@@ -993,6 +1828,13 @@ func (s *storeRecorder) Get(path string, recursive, sorted bool) (*store.Event,
 	})
 	return &store.Event{}, nil
 }
+func (s *storeRecorder) GetHidden(path string, recursive, sorted bool) (*store.Event, error) {
+	s.record(action{
+		name:   "GetHidden",
+		params: []interface{}{path, recursive, sorted},
+	})
+	return &store.Event{}, nil
+}
 func (s *storeRecorder) Set(path string, dir bool, val string, expr time.Time) (*store.Event, error) {
 	s.record(action{
 		name:   "Set",
@@ -1007,6 +1849,13 @@ func (s *storeRecorder) Update(path, val string, expr time.Time) (*store.Event,
 	})
 	return &store.Event{}, nil
 }
+func (s *storeRecorder) Refresh(path string, expr time.Time) (*store.Event, error) {
+	s.record(action{
+		name:   "Refresh",
+		params: []interface{}{path, expr},
+	})
+	return &store.Event{}, nil
+}
 func (s *storeRecorder) Create(path string, dir bool, val string, uniq bool, exp time.Time) (*store.Event, error) {
 	s.record(action{
 		name:   "Create",
@@ -1035,6 +1884,20 @@ func (s *storeRecorder) CompareAndDelete(path, prevVal string, prevIdx uint64) (
 	})
 	return &store.Event{}, nil
 }
+func (s *storeRecorder) DeleteRange(prefix string) (*store.Event, error) {
+	s.record(action{
+		name:   "DeleteRange",
+		params: []interface{}{prefix},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) Txn(t store.Txn) (*store.TxnResponse, error) {
+	s.record(action{
+		name:   "Txn",
+		params: []interface{}{t},
+	})
+	return &store.TxnResponse{}, nil
+}
 func (s *storeRecorder) Watch(_ string, _, _ bool, _ uint64) (store.Watcher, error) {
 	s.record(action{name: "Watch"})
 	return &stubWatcher{}, nil
@@ -1043,12 +1906,25 @@ func (s *storeRecorder) Save() ([]byte, error) {
 	s.record(action{name: "Save"})
 	return nil, nil
 }
+func (s *storeRecorder) SaveTo(w io.Writer) error {
+	s.record(action{name: "SaveTo"})
+	return nil
+}
 func (s *storeRecorder) Recovery(b []byte) error {
 	s.record(action{name: "Recovery"})
 	return nil
 }
+func (s *storeRecorder) RecoveryFrom(r io.Reader) error {
+	s.record(action{name: "RecoveryFrom"})
+	return nil
+}
+func (s *storeRecorder) Clone() store.Store {
+	s.record(action{name: "Clone"})
+	return s
+}
 func (s *storeRecorder) TotalTransactions() uint64 { return 0 }
 func (s *storeRecorder) JsonStats() []byte         { return nil }
+func (s *storeRecorder) ResetStats() []byte        { return nil }
 func (s *storeRecorder) DeleteExpiredKeys(cutoff time.Time) {
 	s.record(action{
 		name:   "DeleteExpiredKeys",
@@ -1062,6 +1938,17 @@ func (w *stubWatcher) EventChan() chan *store.Event { return nil }
 func (w *stubWatcher) Remove()                      {}
 
 // errStoreRecorder returns an store error on Get, Watch request
+// slowStoreRecorder takes delay to set a key.
+type slowStoreRecorder struct {
+	storeRecorder
+	delay time.Duration
+}
+
+func (s *slowStoreRecorder) Set(path string, dir bool, val string, expr time.Time) (*store.Event, error) {
+	time.Sleep(s.delay)
+	return s.storeRecorder.Set(path, dir, val, expr)
+}
+
 type errStoreRecorder struct {
 	storeRecorder
 	err error
@@ -1088,8 +1975,6 @@ func (w *waitRecorder) Trigger(id int64, x interface{}) {
 	w.action = append(w.action, action{name: fmt.Sprint("Trigger", id)})
 }
 
-func boolp(b bool) *bool { return &b }
-
 func stringp(s string) *string { return &s }
 
 type storageRecorder struct {
@@ -1109,6 +1994,37 @@ func (p *storageRecorder) SaveSnap(st raftpb.Snapshot) {
 	}
 	p.record(action{name: "SaveSnap"})
 }
+func (p *storageRecorder) Close() error {
+	p.record(action{name: "Close"})
+	return nil
+}
+
+// entryStorage is a storageRecorder that keeps the saved entries.
+type entryStorage struct {
+	storageRecorder
+	mu   sync.Mutex
+	ents []raftpb.Entry
+}
+
+func (s *entryStorage) Save(st raftpb.HardState, ents []raftpb.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ents = append(s.ents, ents...)
+}
+
+// saved reports whether the entry of the request with the given id has
+// been saved.
+func (s *entryStorage) saved(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.ents {
+		var r pb.Request
+		if e.Type == raftpb.EntryNormal && r.Unmarshal(e.Data) == nil && r.ID == id {
+			return true
+		}
+	}
+	return false
+}
 
 type readyNode struct {
 	readyc chan raft.Ready
@@ -1124,11 +2040,36 @@ func (n *readyNode) Propose(ctx context.Context, data []byte) error { return nil
 func (n *readyNode) ProposeConfChange(ctx context.Context, conf raftpb.ConfChange) error {
 	return nil
 }
+func (n *readyNode) ReadIndex(ctx context.Context, rctx []byte) error   { return nil }
 func (n *readyNode) Step(ctx context.Context, msg raftpb.Message) error { return nil }
 func (n *readyNode) Ready() <-chan raft.Ready                           { return n.readyc }
 func (n *readyNode) ApplyConfChange(conf raftpb.ConfChange)             {}
 func (n *readyNode) Stop()                                              {}
-func (n *readyNode) Compact(d []byte)                                   {}
+func (n *readyNode) Snapshot(d []byte)                                  {}
+func (n *readyNode) Compact(index int64)                                {}
+func (n *readyNode) Status() raft.Status                                { return raft.Status{} }
+
+// proposalNode hands out the data of proposals on propc.
+type proposalNode struct {
+	readyNode
+	propc chan []byte
+}
+
+func (n *proposalNode) Propose(ctx context.Context, data []byte) error {
+	n.propc <- data
+	return nil
+}
+
+// readIndexNode hands out the context of ReadIndex requests on readc.
+type readIndexNode struct {
+	readyNode
+	readc chan []byte
+}
+
+func (n *readIndexNode) ReadIndex(ctx context.Context, rctx []byte) error {
+	n.readc <- rctx
+	return nil
+}
 
 type nodeRecorder struct {
 	recorder
@@ -1149,6 +2090,10 @@ func (n *nodeRecorder) ProposeConfChange(ctx context.Context, conf raftpb.ConfCh
 	n.record(action{name: "ProposeConfChange"})
 	return nil
 }
+func (n *nodeRecorder) ReadIndex(ctx context.Context, rctx []byte) error {
+	n.record(action{name: "ReadIndex"})
+	return nil
+}
 func (n *nodeRecorder) Step(ctx context.Context, msg raftpb.Message) error {
 	n.record(action{name: "Step"})
 	return nil
@@ -1160,9 +2105,16 @@ func (n *nodeRecorder) ApplyConfChange(conf raftpb.ConfChange) {
 func (n *nodeRecorder) Stop() {
 	n.record(action{name: "Stop"})
 }
-func (n *nodeRecorder) Compact(d []byte) {
+func (n *nodeRecorder) Snapshot(d []byte) {
+	n.record(action{name: "Snapshot"})
+}
+func (n *nodeRecorder) Compact(index int64) {
 	n.record(action{name: "Compact"})
 }
+func (n *nodeRecorder) Status() raft.Status {
+	n.record(action{name: "Status"})
+	return raft.Status{}
+}
 
 type nodeProposeDataRecorder struct {
 	nodeRecorder
@@ -1209,8 +2161,8 @@ func (n *nodeConfChangeCommitterRecorder) ProposeConfChange(ctx context.Context,
 	if err != nil {
 		return err
 	}
-	n.readyc <- raft.Ready{CommittedEntries: []raftpb.Entry{{Type: raftpb.EntryConfChange, Data: data}}}
 	n.record(action{name: "ProposeConfChange:" + conf.Type.String()})
+	n.readyc <- raft.Ready{CommittedEntries: []raftpb.Entry{{Type: raftpb.EntryConfChange, Data: data}}}
 	return nil
 }
 func (n *nodeConfChangeCommitterRecorder) Ready() <-chan raft.Ready {
@@ -1220,6 +2172,16 @@ func (n *nodeConfChangeCommitterRecorder) ApplyConfChange(conf raftpb.ConfChange
 	n.record(action{name: "ApplyConfChange:" + conf.Type.String()})
 }
 
+// nodeConfChangeRecorder records the config changes applied to it.
+type nodeConfChangeRecorder struct {
+	nodeRecorder
+	ccs []raftpb.ConfChange
+}
+
+func (n *nodeConfChangeRecorder) ApplyConfChange(cc raftpb.ConfChange) {
+	n.ccs = append(n.ccs, cc)
+}
+
 type waitWithResponse struct {
 	ch <-chan interface{}
 }
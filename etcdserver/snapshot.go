@@ -0,0 +1,73 @@
+package etcdserver
+
+import (
+	"errors"
+	"path"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+// ErrNothingApplied is returned by TakeSnapshot when the member has not
+// applied any entry yet, so that there is nothing to snapshot.
+var ErrNothingApplied = errors.New("etcdserver: no entry applied yet")
+
+// SnapshotInfo tells where a snapshot was saved.
+type SnapshotInfo struct {
+	Index int64 `json:"index"`
+	Term  int64 `json:"term"`
+	// Path is the path of the snapshot file, empty if the server has no
+	// SnapDir.
+	Path string `json:"path"`
+}
+
+// SnapshotTaker takes snapshots on demand, e.g. to back them up.
+type SnapshotTaker interface {
+	// TakeSnapshot takes a snapshot at the index the member applied,
+	// unless the last snapshot is at that index already, and returns once
+	// the snapshot is saved.
+	TakeSnapshot(ctx context.Context) (SnapshotInfo, error)
+}
+
+// snapRequest is a snapshot asked for with TakeSnapshot. The run loop takes
+// it, like the snapshots it takes on its own, so that no two are taken at
+// the same time, and answers c once it saved a snapshot at index or later.
+type snapRequest struct {
+	index int64
+	c     chan snapResult
+}
+
+type snapResult struct {
+	info SnapshotInfo
+	err  error
+}
+
+func (s *EtcdServer) TakeSnapshot(ctx context.Context) (SnapshotInfo, error) {
+	c := make(chan snapResult, 1)
+	select {
+	case s.snapc <- c:
+	case <-ctx.Done():
+		return SnapshotInfo{}, ctx.Err()
+	case <-s.done:
+		return SnapshotInfo{}, ErrStopped
+	}
+	select {
+	case r := <-c:
+		return r.info, r.err
+	case <-ctx.Done():
+		return SnapshotInfo{}, ctx.Err()
+	case <-s.done:
+		return SnapshotInfo{}, ErrStopped
+	}
+}
+
+// snapshotInfo returns the SnapshotInfo of the snapshot saved at index and
+// term.
+func (s *EtcdServer) snapshotInfo(index, term int64) SnapshotInfo {
+	info := SnapshotInfo{Index: index, Term: term}
+	if s.SnapDir != "" {
+		info.Path = path.Join(s.SnapDir, snap.FileName(raftpb.Snapshot{Index: index, Term: term}))
+	}
+	return info
+}
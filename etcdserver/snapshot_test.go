@@ -0,0 +1,114 @@
+package etcdserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+// snapStorage is a storageRecorder saving the snapshots to files.
+type snapStorage struct {
+	storageRecorder
+	ss *snap.Snapshotter
+}
+
+func (s *snapStorage) SaveSnap(st raftpb.Snapshot) {
+	s.storageRecorder.SaveSnap(st)
+	s.ss.SaveSnap(st)
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	n := raft.StartNode(0xBAD0, []int64{0xBAD0}, 10, 1)
+	n.Campaign(ctx)
+	s := &EtcdServer{
+		Store:     store.New(),
+		Send:      func(_ []raftpb.Message) {},
+		Storage:   &snapStorage{ss: snap.New(dir)},
+		Node:      n,
+		SnapCount: 1000,
+		SnapDir:   dir,
+	}
+	s.start()
+	defer s.Stop()
+
+	put := func(v string) {
+		if _, err := s.Do(ctx, pb.Request{Method: "PUT", ID: GenID(), Path: "/foo", Val: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		put(fmt.Sprint(i))
+	}
+
+	info, err := s.TakeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Index != s.Index() {
+		t.Errorf("index = %d, want the applied index %d", info.Index, s.Index())
+	}
+	if _, err := os.Stat(info.Path); err != nil {
+		t.Errorf("snapshot file: %v", err)
+	}
+	snapshot, err := snap.New(dir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Index != info.Index || snapshot.Term != info.Term {
+		t.Errorf("loaded snapshot at %d/%d, want %d/%d", snapshot.Index, snapshot.Term, info.Index, info.Term)
+	}
+	st := store.New()
+	if err := st.Recovery(snapshot.Data); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := st.Get("/foo", false, false); err != nil || *ev.Node.Value != "2" {
+		t.Errorf("recovered /foo = %v, %v, want 2", ev, err)
+	}
+
+	// the last snapshot is at the applied index already
+	again, err := s.TakeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != info {
+		t.Errorf("snapshot = %+v, want the same %+v", again, info)
+	}
+
+	put("3")
+	later, err := s.TakeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if later.Index <= info.Index {
+		t.Errorf("index = %d, want after %d", later.Index, info.Index)
+	}
+}
+
+func TestTakeSnapshotNothingApplied(t *testing.T) {
+	s := &EtcdServer{
+		Store:   store.New(),
+		Send:    func(_ []raftpb.Message) {},
+		Storage: &storageRecorder{},
+		Node:    newReadyNode(),
+	}
+	s.start()
+	defer s.Stop()
+	if _, err := s.TakeSnapshot(context.Background()); err != ErrNothingApplied {
+		t.Errorf("err = %v, want %v", err, ErrNothingApplied)
+	}
+}
@@ -0,0 +1,172 @@
+package etcdserver
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// PeerStats records the outcome of the raft messages sent to each peer,
+// and the latency between sending and the peer acknowledging them. A nil
+// PeerStats records nothing.
+type PeerStats struct {
+	mu    sync.Mutex
+	peers map[int64]*peerStats
+}
+
+type peerStats struct {
+	fail, success uint64
+	// the latencies, in milliseconds, of the acknowledged messages
+	current, min, max, sum, sumSquares float64
+}
+
+func NewPeerStats() *PeerStats {
+	return &PeerStats{peers: make(map[int64]*peerStats)}
+}
+
+func (ps *PeerStats) get(id int64) *peerStats {
+	p, ok := ps.peers[id]
+	if !ok {
+		p = &peerStats{}
+		ps.peers[id] = p
+	}
+	return p
+}
+
+// Succ records that the peer id acknowledged a message d after it was sent.
+func (ps *PeerStats) Succ(id int64, d time.Duration) {
+	if ps == nil {
+		return
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p := ps.get(id)
+	if p.success == 0 || ms < p.min {
+		p.min = ms
+	}
+	if ms > p.max {
+		p.max = ms
+	}
+	p.success++
+	p.current = ms
+	p.sum += ms
+	p.sumSquares += ms * ms
+}
+
+// Fail records that a message to the peer id was not acknowledged.
+func (ps *PeerStats) Fail(id int64) {
+	if ps == nil {
+		return
+	}
+	ps.mu.Lock()
+	ps.get(id).fail++
+	ps.mu.Unlock()
+}
+
+// Reset forgets what was recorded, as a new leader starts sending
+// messages of its own.
+func (ps *PeerStats) Reset() {
+	ps.mu.Lock()
+	ps.peers = make(map[int64]*peerStats)
+	ps.mu.Unlock()
+}
+
+// LeaderStats is what the leader knows of the raft messages it sent to
+// each follower, which are keyed by name.
+type LeaderStats struct {
+	Leader    string                   `json:"leader"`
+	Followers map[string]FollowerStats `json:"followers"`
+}
+
+type FollowerStats struct {
+	Counts  CountsStats  `json:"counts"`
+	Latency LatencyStats `json:"latency"`
+}
+
+// CountsStats counts the messages acknowledged by a follower, and the ones
+// that were not.
+type CountsStats struct {
+	Fail    uint64 `json:"fail"`
+	Success uint64 `json:"success"`
+}
+
+// LatencyStats summarizes the latency, in milliseconds, between sending
+// the messages to a follower and the follower acknowledging them.
+type LatencyStats struct {
+	Current           float64 `json:"current"`
+	Average           float64 `json:"average"`
+	StandardDeviation float64 `json:"standardDeviation"`
+	Minimum           float64 `json:"minimum"`
+	Maximum           float64 `json:"maximum"`
+}
+
+// StoreStatsReporter reports the counts of the operations on the store of
+// a member.
+type StoreStatsReporter interface {
+	// StoreStats returns the stats of the store as JSON, and sets its
+	// counters back to zero if reset is true.
+	StoreStats(reset bool) []byte
+}
+
+func (s *EtcdServer) StoreStats(reset bool) []byte {
+	if reset {
+		return s.Store.ResetStats()
+	}
+	return s.Store.JsonStats()
+}
+
+// LeaderStatsReporter reports the LeaderStats of a member, which only the
+// leader has.
+type LeaderStatsReporter interface {
+	// LeaderStats returns the stats of the followers, and false if the
+	// member is not the leader.
+	LeaderStats() (LeaderStats, bool)
+}
+
+// Implement the LeaderStatsReporter interface
+func (s *EtcdServer) LeaderStats() (LeaderStats, bool) {
+	st := s.Node.Status()
+	if st.Lead != st.ID || st.ID == 0 {
+		return LeaderStats{}, false
+	}
+	c := s.ClusterStore.Get()
+	ls := LeaderStats{Leader: memberName(c, st.ID), Followers: make(map[string]FollowerStats)}
+	if s.PeerStats == nil {
+		return ls, true
+	}
+	s.PeerStats.mu.Lock()
+	defer s.PeerStats.mu.Unlock()
+	for _, id := range c.IDs() {
+		if id == st.ID {
+			continue
+		}
+		fs := FollowerStats{}
+		if p, ok := s.PeerStats.peers[id]; ok {
+			fs.Counts = CountsStats{Fail: p.fail, Success: p.success}
+			if p.success > 0 {
+				n := float64(p.success)
+				avg := p.sum / n
+				fs.Latency = LatencyStats{
+					Current:           p.current,
+					Average:           avg,
+					StandardDeviation: math.Sqrt(math.Max(p.sumSquares/n-avg*avg, 0)),
+					Minimum:           p.min,
+					Maximum:           p.max,
+				}
+			}
+		}
+		ls.Followers[memberName(c, id)] = fs
+	}
+	return ls, true
+}
+
+// memberName returns the name of the member id, or its hex ID if it has
+// none.
+func memberName(c Cluster, id int64) string {
+	if m := c.FindID(id); m != nil && m.Name != "" {
+		return m.Name
+	}
+	return fmt.Sprintf("%x", id)
+}
@@ -0,0 +1,126 @@
+package etcdserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+)
+
+func TestPeerStats(t *testing.T) {
+	ps := NewPeerStats()
+	ps.Succ(2, 2*time.Millisecond)
+	ps.Succ(2, 4*time.Millisecond)
+	ps.Fail(2)
+	p := ps.peers[2]
+	if p.success != 2 || p.fail != 1 {
+		t.Errorf("success, fail = %d, %d, want 2, 1", p.success, p.fail)
+	}
+	if p.min != 2 || p.max != 4 || p.current != 4 || p.sum != 6 {
+		t.Errorf("min, max, current, sum = %v, %v, %v, %v, want 2, 4, 4, 6", p.min, p.max, p.current, p.sum)
+	}
+	ps.Reset()
+	if len(ps.peers) != 0 {
+		t.Errorf("peers = %v, want none after reset", ps.peers)
+	}
+
+	// a nil PeerStats records nothing
+	var nps *PeerStats
+	nps.Succ(2, time.Millisecond)
+	nps.Fail(2)
+}
+
+// TestSenderStats tests that the messages acked by a peer, on a stream or
+// posted, are counted along with their latency.
+func TestSenderStats(t *testing.T) {
+	for i, noStream := range []bool{false, true} {
+		p := newPeerRecorder()
+		p.noStream = noStream
+		p.ack = true
+		srv := httptest.NewServer(p)
+
+		stats := NewPeerStats()
+		tr := &http.Transport{}
+		send, _, stop := Sender(tr, newPeerClusterStore(srv.URL), stats, 0, nil)
+		deadline := time.Now().Add(5 * time.Second)
+		for idx := int64(1); ; idx++ {
+			send([]raftpb.Message{{To: 2, Index: idx}})
+			stats.mu.Lock()
+			ps, ok := stats.peers[2]
+			done := ok && ps.success > 0
+			stats.mu.Unlock()
+			if done {
+				if ps.max <= 0 {
+					t.Errorf("#%d: max latency = %v, want > 0", i, ps.max)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("#%d: no message counted as acked", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stop()
+		tr.CloseIdleConnections()
+		srv.CloseClientConnections()
+		srv.Close()
+	}
+}
+
+// TestLeaderStats tests that the leader reports each follower of the
+// cluster, with what was recorded of the messages sent to it.
+func TestLeaderStats(t *testing.T) {
+	n := raft.StartNode(1, []int64{1}, 10, 1)
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	c := Cluster{}
+	c.AddSlice([]Member{{ID: 1, Name: "node1"}, {ID: 2, Name: "node2"}, {ID: 3}})
+	srv := &EtcdServer{
+		Node:         n,
+		Store:        store.New(),
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		Ticker:       tk,
+		ClusterStore: NewClusterStore(store.New(), c),
+		PeerStats:    NewPeerStats(),
+	}
+	srv.start()
+	defer srv.Stop()
+
+	var ls LeaderStats
+	for deadline := time.Now().Add(time.Second); ; {
+		var ok bool
+		if ls, ok = srv.LeaderStats(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("member never reported leader stats")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.PeerStats.Succ(2, 3*time.Millisecond)
+	srv.PeerStats.Fail(2)
+	ls, _ = srv.LeaderStats()
+	if ls.Leader != "node1" {
+		t.Errorf("leader = %s, want node1", ls.Leader)
+	}
+	if len(ls.Followers) != 2 {
+		t.Fatalf("followers = %+v, want node2 and 3", ls.Followers)
+	}
+	f := ls.Followers["node2"]
+	if f.Counts != (CountsStats{Fail: 1, Success: 1}) {
+		t.Errorf("counts = %+v, want 1 fail and 1 success", f.Counts)
+	}
+	wl := LatencyStats{Current: 3, Average: 3, Minimum: 3, Maximum: 3}
+	if f.Latency != wl {
+		t.Errorf("latency = %+v, want %+v", f.Latency, wl)
+	}
+	if f := ls.Followers["3"]; f != (FollowerStats{}) {
+		t.Errorf("unnamed follower = %+v, want no stats", f)
+	}
+}
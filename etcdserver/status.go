@@ -0,0 +1,90 @@
+package etcdserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RaftStatus is the state of the raft node of a member, for debugging. It
+// carries neither entries nor keys.
+type RaftStatus struct {
+	ID int64 `json:"id"`
+	// State is one of follower, candidate, precandidate and leader.
+	State  string `json:"state"`
+	Term   int64  `json:"term"`
+	Leader int64  `json:"leader"`
+	Commit int64  `json:"commitIndex"`
+	// Applied is the index of the last entry the member applied.
+	Applied int64        `json:"appliedIndex"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is what a member knows of one of the other members.
+type PeerStatus struct {
+	ID int64 `json:"id"`
+	// Progress is the replication progress of the peer, which only the
+	// leader knows.
+	Progress *PeerProgress `json:"progress,omitempty"`
+	// LastActive is when the member last received a raft message from the
+	// peer, or nil if it never did since it started.
+	LastActive *time.Time `json:"lastActive,omitempty"`
+}
+
+// PeerProgress tells that the log of a peer is known to hold the entries up
+// to Match, and that the entries from Next are the next ones to send to it.
+type PeerProgress struct {
+	Match int64 `json:"match"`
+	Next  int64 `json:"next"`
+}
+
+// peerActivity records the time a member last received a message from each
+// of its peers.
+type peerActivity struct {
+	mu   sync.Mutex
+	last map[int64]time.Time
+}
+
+func (a *peerActivity) record(id int64) {
+	a.mu.Lock()
+	if a.last == nil {
+		a.last = make(map[int64]time.Time)
+	}
+	a.last[id] = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *peerActivity) get(id int64) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.last[id]
+	return t, ok
+}
+
+// Implement the RaftStatusReporter interface
+func (s *EtcdServer) RaftStatus() RaftStatus {
+	st := s.Node.Status()
+	rs := RaftStatus{
+		ID:      st.ID,
+		State:   strings.ToLower(strings.TrimPrefix(st.RaftState.String(), "State")),
+		Term:    st.Term,
+		Leader:  st.Lead,
+		Commit:  st.Commit,
+		Applied: s.Index(),
+		Peers:   []PeerStatus{},
+	}
+	for _, id := range s.ClusterStore.Get().IDs() {
+		if id == st.ID {
+			continue
+		}
+		ps := PeerStatus{ID: id}
+		if pr, ok := st.Progress[id]; ok {
+			ps.Progress = &PeerProgress{Match: pr.Match, Next: pr.Next}
+		}
+		if t, ok := s.activity.get(id); ok {
+			ps.LastActive = &t
+		}
+		rs.Peers = append(rs.Peers, ps)
+	}
+	return rs
+}
@@ -0,0 +1,69 @@
+package etcdserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+// TestRaftStatus tests that a single member reports itself as the leader,
+// along with the peers it heard from.
+func TestRaftStatus(t *testing.T) {
+	n := raft.StartNode(1, []int64{1}, 10, 1)
+	tk := make(chan time.Time)
+	// this makes <-tk always successful, which accelerates internal clock
+	close(tk)
+	c := Cluster{}
+	c.AddSlice([]Member{{ID: 1, Name: "node1"}, {ID: 2, Name: "node2"}})
+	srv := &EtcdServer{
+		Node:         n,
+		Store:        store.New(),
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		Ticker:       tk,
+		ClusterStore: NewClusterStore(store.New(), c),
+	}
+	srv.start()
+	defer srv.Stop()
+
+	var st RaftStatus
+	for deadline := time.Now().Add(time.Second); ; {
+		st = srv.RaftStatus()
+		if st.State == "leader" && st.Applied >= st.Commit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, want a leader having applied its commit index", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.ID != 1 || st.Leader != 1 {
+		t.Errorf("id, leader = %d, %d, want 1, 1", st.ID, st.Leader)
+	}
+	if st.Term < 1 {
+		t.Errorf("term = %d, want at least 1", st.Term)
+	}
+	if st.Commit < 1 {
+		t.Errorf("commit = %d, want at least 1", st.Commit)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].ID != 2 {
+		t.Fatalf("peers = %+v, want node2 only", st.Peers)
+	}
+	// node2 is not a member of the raft cluster
+	if p := st.Peers[0]; p.Progress != nil || p.LastActive != nil {
+		t.Errorf("peer = %+v, want no progress and no activity", p)
+	}
+
+	start := time.Now()
+	if err := srv.Process(context.TODO(), raftpb.Message{From: 2, To: 1}); err != nil {
+		t.Fatal(err)
+	}
+	st = srv.RaftStatus()
+	if p := st.Peers[0]; p.LastActive == nil || p.LastActive.Before(start) {
+		t.Errorf("last active = %v, want after %v", p.LastActive, start)
+	}
+}
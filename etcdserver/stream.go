@@ -0,0 +1,289 @@
+package etcdserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+const (
+	// streamBufSize is the number of messages that may wait to be written
+	// on a stream. Messages beyond it are posted one by one instead.
+	streamBufSize = 4096
+
+	// time to wait before connecting again a stream that broke or could
+	// not be established
+	streamRetryInterval = time.Second
+
+	// raftStreamAckHeader is set by the peers that write an empty frame
+	// on the response of a stream for each message they processed.
+	raftStreamAckHeader = "X-Raft-Stream-Ack"
+)
+
+var errStreamClosed = errors.New("etcdserver: stream closed by the peer")
+
+// streamSender sends the messages to each peer over a single request to
+// raftStreamPrefix, whose body is the stream of the messages framed by
+// transport.WriteFrame. The stream to a peer is connected on the first
+// message sent to it, and connected again whenever it breaks.
+type streamSender struct {
+	c     *http.Client
+	cls   ClusterStore
+	stats *PeerStats
+	// timeout, if not 0, bounds the time to open a stream.
+	timeout time.Duration
+
+	mu      sync.Mutex
+	streams map[int64]*stream
+	stopped bool
+}
+
+func newStreamSender(c *http.Client, cls ClusterStore, stats *PeerStats, timeout time.Duration) *streamSender {
+	return &streamSender{c: c, cls: cls, stats: stats, timeout: timeout, streams: make(map[int64]*stream)}
+}
+
+// send queues m on the stream to m.To. It returns false if the stream is
+// not connected or is full, in which case m must be sent some other way.
+func (s *streamSender) send(m raftpb.Message) bool {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return false
+	}
+	st, ok := s.streams[m.To]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		st = &stream{
+			to:     m.To,
+			msgc:   make(chan raftpb.Message, streamBufSize),
+			ctx:    ctx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		s.streams[m.To] = st
+		go s.run(st)
+	}
+	s.mu.Unlock()
+	return st.send(m)
+}
+
+// stop closes the streams, and waits for them to be closed.
+func (s *streamSender) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	streams := s.streams
+	s.streams = nil
+	s.mu.Unlock()
+	for _, st := range streams {
+		st.cancel()
+		<-st.done
+	}
+}
+
+// remove closes the stream to the peer id, which left the cluster.
+func (s *streamSender) remove(id int64) {
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	if ok {
+		delete(s.streams, id)
+	}
+	s.mu.Unlock()
+	if ok {
+		st.cancel()
+	}
+}
+
+// run connects st until it is stopped, or its peer leaves the cluster.
+func (s *streamSender) run(st *stream) {
+	defer close(st.done)
+	for {
+		u := s.cls.Get().Pick(st.to)
+		if u == "" {
+			logger.Warnf("etcdserver: no addr for %#x, closing its stream", st.to)
+			s.mu.Lock()
+			if s.streams != nil {
+				delete(s.streams, st.to)
+			}
+			s.mu.Unlock()
+			return
+		}
+		err := st.connect(s.c, u+raftStreamPrefix, s.stats, s.timeout)
+		if st.ctx.Err() != nil {
+			return
+		}
+		logger.Debugf("etcdserver: stream to %#x: %v", st.to, err)
+		select {
+		case <-time.After(streamRetryInterval):
+		case <-st.ctx.Done():
+			return
+		}
+	}
+}
+
+type stream struct {
+	to   int64
+	msgc chan raftpb.Message
+	// ctx is canceled to stop the stream, which aborts its request.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	connected bool
+}
+
+func (st *stream) send(m raftpb.Message) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.connected {
+		return false
+	}
+	select {
+	case st.msgc <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *stream) setConnected(c bool) {
+	st.mu.Lock()
+	st.connected = c
+	st.mu.Unlock()
+}
+
+// connect opens the stream at url, and writes the queued messages on it
+// until it breaks or st is stopped. The messages still queued then are
+// dropped; raft sends them again if they matter. connect gives up if the
+// peer does not accept the stream within timeout, unless it is 0.
+//
+// If the peer acknowledges the messages, their latency is recorded in
+// stats, and the ones written but not acknowledged when the stream breaks
+// are recorded as failed.
+func (st *stream) connect(c *http.Client, url string, stats *PeerStats, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(st.ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	// the transport does not return before it is done writing the body,
+	// which it reads from pr: the writes must end once ctx is canceled,
+	// even if the peer never answered
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
+	req, err := http.NewRequest("POST", url, pr)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var t *time.Timer
+	if timeout > 0 {
+		t = time.AfterFunc(timeout, cancel)
+	}
+	resp, err := c.Do(req)
+	if t != nil {
+		t.Stop()
+	}
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	acked := resp.Header.Get(raftStreamAckHeader) != ""
+	// the times the messages waiting for their ack were written, in order
+	var (
+		mu   sync.Mutex
+		sent []time.Time
+	)
+	// the peer writes nothing on the stream but the acks: reading hits the
+	// end of the body as soon as the peer closes it, and unblocks the
+	// writes below.
+	closedc := make(chan struct{})
+	go func() {
+		if acked {
+			br := bufio.NewReader(resp.Body)
+			for {
+				if _, err := transport.ReadFrame(br); err != nil {
+					break
+				}
+				mu.Lock()
+				if len(sent) > 0 {
+					stats.Succ(st.to, time.Since(sent[0]))
+					sent = sent[1:]
+				}
+				mu.Unlock()
+			}
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		pw.CloseWithError(errStreamClosed)
+		close(closedc)
+	}()
+	defer pw.Close()
+	defer func() {
+		if st.ctx.Err() != nil {
+			return
+		}
+		mu.Lock()
+		for range sent {
+			stats.Fail(st.to)
+		}
+		sent = nil
+		mu.Unlock()
+	}()
+
+	logger.Infof("etcdserver: stream to %#x connected", st.to)
+	st.setConnected(true)
+	defer func() {
+		st.setConnected(false)
+		for len(st.msgc) > 0 {
+			<-st.msgc
+		}
+	}()
+
+	bw := bufio.NewWriter(pw)
+	for {
+		select {
+		case m := <-st.msgc:
+			b, err := m.Marshal()
+			if err != nil {
+				logger.Errorf("etcdserver: dropping message: %v", err)
+				continue
+			}
+			if acked {
+				mu.Lock()
+				sent = append(sent, time.Now())
+				mu.Unlock()
+			}
+			if err := transport.WriteFrame(bw, b); err != nil {
+				return err
+			}
+			// write what is queued at once, but do not hold messages
+			// back waiting for more
+			if len(st.msgc) == 0 {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+			}
+		case <-closedc:
+			return errStreamClosed
+		case <-st.ctx.Done():
+			return st.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package etcdserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+)
+
+// peerRecorder serves the raft messages posted to raftPrefix and streamed
+// to raftStreamPrefix, and sends them on recvc.
+type peerRecorder struct {
+	recvc chan raftpb.Message
+	// noStream makes the peer answer 404 on raftStreamPrefix.
+	noStream bool
+	// ack makes the peer ack each message streamed with an empty frame.
+	ack bool
+
+	mu    sync.Mutex
+	paths map[string]int
+	// closeAfter, if not 0, is the number of messages after which the
+	// next stream is closed by the peer.
+	closeAfter int
+}
+
+func newPeerRecorder() *peerRecorder {
+	return &peerRecorder{recvc: make(chan raftpb.Message, 1024), paths: make(map[string]int)}
+}
+
+func (p *peerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.paths[r.URL.Path]++
+	closeAfter := p.closeAfter
+	p.closeAfter = 0
+	p.mu.Unlock()
+
+	switch {
+	case r.URL.Path == raftPrefix:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m raftpb.Message
+		if err := m.Unmarshal(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.recvc <- m
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == raftStreamPrefix && !p.noStream:
+		rc := http.NewResponseController(w)
+		rc.EnableFullDuplex()
+		if p.ack {
+			w.Header().Set(raftStreamAckHeader, "1")
+		}
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		br := bufio.NewReader(r.Body)
+		for n := 1; ; n++ {
+			b, err := transport.ReadFrame(br)
+			if err != nil {
+				return
+			}
+			var m raftpb.Message
+			if err := m.Unmarshal(b); err != nil {
+				return
+			}
+			p.recvc <- m
+			if p.ack {
+				transport.WriteFrame(w, nil)
+				rc.Flush()
+			}
+			if n == closeAfter {
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *peerRecorder) count(path string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paths[path]
+}
+
+func newPeerClusterStore(url string) ClusterStore {
+	c := Cluster{}
+	c.Add(Member{Name: "node2", ID: 2, PeerURLs: []string{url}})
+	return NewClusterStore(store.New(), c)
+}
+
+// sendUntilReceived sends m with ss until the peer receives it on the
+// stream, which takes the time the stream needs to connect. Like raft, it
+// sends m again if a broken stream dropped it.
+func sendUntilReceived(t testing.TB, ss *streamSender, p *peerRecorder, m raftpb.Message) {
+	deadline := time.After(5 * time.Second)
+	for {
+		if ss.send(m) {
+			select {
+			case g := <-p.recvc:
+				if g.Index != m.Index {
+					t.Fatalf("index = %d, want %d", g.Index, m.Index)
+				}
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("message %d not received on the stream", m.Index)
+		}
+	}
+}
+
+// TestStreamReconnect tests that a stream closed by the peer is connected
+// again, and carries the next messages.
+func TestStreamReconnect(t *testing.T) {
+	p := newPeerRecorder()
+	p.closeAfter = 1
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	ss := newStreamSender(&http.Client{}, newPeerClusterStore(srv.URL), nil, 0)
+	defer ss.stop()
+
+	sendUntilReceived(t, ss, p, raftpb.Message{To: 2, Index: 1})
+	sendUntilReceived(t, ss, p, raftpb.Message{To: 2, Index: 2})
+	sendUntilReceived(t, ss, p, raftpb.Message{To: 2, Index: 3})
+	if n := p.count(raftStreamPrefix); n != 2 {
+		t.Errorf("streams = %d, want 2", n)
+	}
+}
+
+// TestSenderNoStream tests that the messages to a peer that does not
+// serve raftStreamPrefix are posted to raftPrefix.
+func TestSenderNoStream(t *testing.T) {
+	p := newPeerRecorder()
+	p.noStream = true
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// the peer answers 404 only once the stream body ends, which the
+	// sender does not end before the answer; like on a real cluster, the
+	// timeout gives up on the stream, and lets srv be closed.
+	send, _, stop := Sender(&http.Transport{}, newPeerClusterStore(srv.URL), nil, 100*time.Millisecond, nil)
+	defer stop()
+	send([]raftpb.Message{{To: 2, Index: 1}})
+	select {
+	case m := <-p.recvc:
+		if m.Index != 1 {
+			t.Errorf("index = %d, want 1", m.Index)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+	if n := p.count(raftPrefix); n != 1 {
+		t.Errorf("posts = %d, want 1", n)
+	}
+}
+
+// TestSenderStop tests that stopping the sender closes the streams, and
+// that the messages sent after it are dropped.
+func TestSenderStop(t *testing.T) {
+	p := newPeerRecorder()
+	srv := httptest.NewServer(p)
+	// the server waits for the streams to be closed
+	defer srv.Close()
+
+	send, _, stop := Sender(&http.Transport{}, newPeerClusterStore(srv.URL), nil, 0, nil)
+	recv := func(idx int64) {
+		select {
+		case m := <-p.recvc:
+			if m.Index != idx {
+				t.Fatalf("index = %d, want %d", m.Index, idx)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not received", idx)
+		}
+	}
+	// the first messages are posted until the stream is connected
+	deadline := time.Now().Add(5 * time.Second)
+	for idx := int64(1); ; idx++ {
+		posts := p.count(raftPrefix)
+		send([]raftpb.Message{{To: 2, Index: idx}})
+		recv(idx)
+		if p.count(raftPrefix) == posts {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+	posts := p.count(raftPrefix)
+	send([]raftpb.Message{{To: 2, Index: 0}})
+	select {
+	case m := <-p.recvc:
+		t.Errorf("message %d received after stop", m.Index)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if g := p.count(raftPrefix); g != posts {
+		t.Errorf("posts = %d, want %d", g, posts)
+	}
+}
+
+// TestSenderRemove tests that removing a peer closes its stream and its
+// post queue.
+func TestSenderRemove(t *testing.T) {
+	p := newPeerRecorder()
+	p.noStream = true
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	send, remove, stop := Sender(&http.Transport{}, newPeerClusterStore(srv.URL), nil, 0, nil)
+	defer stop()
+	send([]raftpb.Message{{To: 2, Index: 1}})
+	select {
+	case <-p.recvc:
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+	n := runtime.NumGoroutine()
+	remove(2)
+	// the goroutines of the stream and of the queue return
+	for i := 0; runtime.NumGoroutine() > n-2; i++ {
+		if i == 100 {
+			t.Fatalf("goroutines = %d, want at most %d", runtime.NumGoroutine(), n-2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSenderOpenSnapshot tests that the data of a snapshot that raft holds
+// without it is streamed from where openSnap opens it.
+func TestSenderOpenSnapshot(t *testing.T) {
+	datac := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != raftSnapshotPrefix {
+			http.NotFound(w, r)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		datac <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var opened raftpb.Snapshot
+	open := func(snap raftpb.Snapshot) (io.ReadCloser, error) {
+		opened = snap
+		return ioutil.NopCloser(bytes.NewReader([]byte("some snapshot"))), nil
+	}
+	send, _, stop := Sender(&http.Transport{}, newPeerClusterStore(srv.URL), nil, 0, open)
+	defer stop()
+	snap := raftpb.Snapshot{Index: 5, Term: 2}
+	send([]raftpb.Message{{To: 2, Snapshot: snap}})
+	select {
+	case b := <-datac:
+		if string(b) != "some snapshot" {
+			t.Errorf("data = %q, want %q", b, "some snapshot")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("snapshot not received")
+	}
+	if !reflect.DeepEqual(opened, snap) {
+		t.Errorf("opened = %+v, want %+v", opened, snap)
+	}
+}
+
+// TestSenderBlackholedPeer tests that a peer that never answers holds back
+// neither the sender nor the messages to the other peers, and that the
+// messages to it are dropped once its queue is full.
+func TestSenderBlackholedPeer(t *testing.T) {
+	p := newPeerRecorder()
+	healthy := httptest.NewServer(p)
+	defer func() {
+		healthy.CloseClientConnections()
+		healthy.Close()
+	}()
+	unblockc := make(chan struct{})
+	blackholed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblockc
+	}))
+	defer blackholed.Close()
+	defer close(unblockc)
+
+	c := Cluster{}
+	c.AddSlice([]Member{
+		{Name: "node2", ID: 2, PeerURLs: []string{healthy.URL}},
+		{Name: "node3", ID: 3, PeerURLs: []string{blackholed.URL}},
+	})
+	send, _, stop := Sender(&http.Transport{}, NewClusterStore(store.New(), c), nil, 100*time.Millisecond, nil)
+	defer stop()
+
+	dropped := messagesDropped.Get()
+	for i := 0; i < 10; i++ {
+		var msgs []raftpb.Message
+		for j := 0; j < 2*peerQueueSize; j++ {
+			msgs = append(msgs, raftpb.Message{To: 3})
+		}
+		msgs = append(msgs, raftpb.Message{To: 2, Index: int64(i)})
+		start := time.Now()
+		send(msgs)
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Errorf("#%d: send took %v", i, d)
+		}
+		select {
+		case m := <-p.recvc:
+			if m.Index != int64(i) {
+				t.Errorf("#%d: index = %d, want %d", i, m.Index, i)
+			}
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("#%d: message to the healthy peer not received", i)
+		}
+	}
+	if messagesDropped.Get() == dropped {
+		t.Errorf("no message to the blackholed peer was dropped")
+	}
+}
+
+// TestPostSenderDropOldest tests that queuing messages to a peer that does
+// not answer never blocks, and that its queue keeps the newest messages.
+func TestPostSenderDropOldest(t *testing.T) {
+	stalledc := make(chan struct{}, 1)
+	unblockc := make(chan struct{})
+	recvc := make(chan int64, 2*peerQueueSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m raftpb.Message
+		if err := m.Unmarshal(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case stalledc <- struct{}{}:
+		default:
+		}
+		<-unblockc
+		recvc <- m.Index
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := &postSender{c: &http.Client{}, cls: newPeerClusterStore(srv.URL), queues: make(map[int64]chan raftpb.Message)}
+	// stall the goroutine posting to the peer
+	s.send(raftpb.Message{To: 2, Index: 0})
+	select {
+	case <-stalledc:
+	case <-time.After(time.Second):
+		t.Fatal("first message not received")
+	}
+
+	dropped := messagesDropped.Get()
+	n := peerQueueSize + 10
+	start := time.Now()
+	for i := 1; i <= n; i++ {
+		s.send(raftpb.Message{To: 2, Index: int64(i)})
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("send took %v", d)
+	}
+	if g := messagesDropped.Get() - dropped; g != 10 {
+		t.Errorf("dropped = %d, want 10", g)
+	}
+
+	close(unblockc)
+	got := []int64{}
+	for i := 0; i <= peerQueueSize; i++ {
+		select {
+		case idx := <-recvc:
+			got = append(got, idx)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want %d messages", got, peerQueueSize+1)
+		}
+	}
+	want := []int64{0}
+	for i := 11; i <= n; i++ {
+		want = append(want, int64(i))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+// benchmarkSender measures the throughput of sending messages carrying a
+// small entry to a peer, either on a stream or by posting them.
+func benchmarkSender(b *testing.B, stream bool) {
+	p := newPeerRecorder()
+	srv := httptest.NewServer(p)
+	defer func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	}()
+	cls := newPeerClusterStore(srv.URL)
+	c := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 64}}
+	ss := newStreamSender(c, cls, nil, 0)
+	defer ss.stop()
+
+	ents := []raftpb.Entry{{Term: 1, Index: 1, Data: make([]byte, 128)}}
+	m := raftpb.Message{To: 2, Entries: ents}
+	if stream {
+		sendUntilReceived(b, ss, p, m)
+	}
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if !stream {
+				go send(c, cls, nil, m, 0)
+				continue
+			}
+			for !ss.send(m) {
+				runtime.Gosched()
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		select {
+		case <-p.recvc:
+		case <-time.After(10 * time.Second):
+			b.Fatalf("received %d messages, want %d", i, b.N)
+		}
+	}
+}
+
+func BenchmarkSenderStream(b *testing.B) { benchmarkSender(b, true) }
+func BenchmarkSenderPost(b *testing.B)   { benchmarkSender(b, false) }
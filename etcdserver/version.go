@@ -0,0 +1,172 @@
+package etcdserver
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	etcdErr "github.com/coreos/etcd/error"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+)
+
+const (
+	// clusterVersionKey holds the version of the cluster, which the leader
+	// sets to the oldest version published by the members.
+	clusterVersionKey = "/_etcd/version"
+
+	// v05Requests is the version introducing the transactions, the range
+	// deletions and the refreshes, which the older members would apply
+	// differently: they fail a transaction, delete the directory itself of
+	// a range deletion, and set the value of a refresh to empty.
+	v05Requests = "0.5.0-alpha"
+)
+
+// Versions are the version of etcd a member runs, and the version of its
+// cluster: the oldest one its members run, which all of them support. It
+// is empty until every member published its version.
+type Versions struct {
+	Server  string `json:"etcdserver"`
+	Cluster string `json:"etcdcluster"`
+}
+
+// VersionReporter reports the versions of a member and its cluster, to
+// check that they are compatible while a cluster is upgraded.
+type VersionReporter interface {
+	Versions() Versions
+}
+
+func (s *EtcdServer) Versions() Versions {
+	return Versions{Server: s.Version, Cluster: s.clusterVersion()}
+}
+
+// ClusterVersionAtLeast reports whether the cluster version is v or newer,
+// which means that every member runs at least v. A feature that changes
+// what the members write to the log, or send to each other, is enabled only
+// once it reports true for the version introducing it, so that a cluster
+// being upgraded keeps the old behavior until its last member is upgraded.
+// It reports false while the cluster version is unknown.
+func (s *EtcdServer) ClusterVersionAtLeast(v string) bool {
+	cv := s.clusterVersion()
+	return cv != "" && compareVersions(cv, v) >= 0
+}
+
+// clusterVersion returns the version of the cluster as applied to the store,
+// or "" if none is yet.
+func (s *EtcdServer) clusterVersion() string {
+	e, err := s.Store.Get(clusterVersionKey, false, false)
+	if err != nil {
+		if v, ok := err.(*etcdErr.Error); !ok || v.ErrorCode != etcdErr.EcodeKeyNotFound {
+			logger.Errorf("etcdserver: get cluster version error: %v", err)
+		}
+		return ""
+	}
+	return *e.Node.Value
+}
+
+// updateClusterVersion proposes the oldest version of the members as the
+// version of the cluster if it changed, and is non-blocking. It is called
+// by the leader, so that the cluster version is decided once, in the log.
+// Nothing is proposed until every member published its version, nor while
+// the previous proposal is pending.
+func (s *EtcdServer) updateClusterVersion(timeout time.Duration) {
+	if s.Version == "" {
+		return
+	}
+	v := minVersion(s.ClusterStore.Get())
+	if v == "" || v == s.clusterVersion() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.updatingVersion, 0, 1) {
+		return
+	}
+	req := pb.Request{
+		ID:     GenID(),
+		Method: "PUT",
+		Path:   clusterVersionKey,
+		Val:    v,
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.updatingVersion, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if _, err := s.Do(ctx, req); err != nil {
+			logger.Warnf("etcdserver: error setting cluster version to %s: %v", v, err)
+			return
+		}
+		logger.Infof("etcdserver: set cluster version to %s", v)
+	}()
+}
+
+// requestVersion returns the version of etcd every member must run for r to
+// be proposed, or "" if any may apply it.
+func requestVersion(r pb.Request) string {
+	if r.Method == "TXN" || r.Range || r.Refresh {
+		return v05Requests
+	}
+	return ""
+}
+
+// minVersion returns the oldest version of the members of c, or "" if one
+// of them has not published its version.
+func minVersion(c Cluster) string {
+	min := ""
+	for _, m := range c {
+		if m.Version == "" {
+			return ""
+		}
+		if min == "" || compareVersions(m.Version, min) < 0 {
+			min = m.Version
+		}
+	}
+	return min
+}
+
+// compareVersions compares two versions like 0.5.0 or 0.5.0-alpha, and
+// returns -1, 0 or 1 if a is older than, the same as or newer than b. A
+// pre-release is older than its release.
+func compareVersions(a, b string) int {
+	acore, apre := splitVersion(a)
+	bcore, bpre := splitVersion(b)
+	for i := 0; i < len(acore) || i < len(bcore); i++ {
+		var an, bn int
+		if i < len(acore) {
+			an = acore[i]
+		}
+		if i < len(bcore) {
+			bn = bcore[i]
+		}
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	case apre < bpre:
+		return -1
+	}
+	return 1
+}
+
+// splitVersion splits v into its dot separated numbers and its pre-release.
+// A part that is not a number counts as 0.
+func splitVersion(v string) (core []int, pre string) {
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		core = append(core, n)
+	}
+	return core, pre
+}
@@ -0,0 +1,218 @@
+package etcdserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
+	"github.com/coreos/etcd/wait"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		w    int
+	}{
+		{"0.5.0", "0.5.0", 0},
+		{"0.4.6", "0.5.0", -1},
+		{"0.5.0", "0.4.6", 1},
+		{"0.10.0", "0.9.0", 1},
+		{"1.0", "1.0.0", 0},
+		{"0.5.0-alpha", "0.5.0", -1},
+		{"0.5.0", "0.5.0-alpha", 1},
+		{"0.5.0-alpha", "0.5.0-beta", -1},
+		{"0.5.0-alpha", "0.4.6", 1},
+	}
+	for i, tt := range tests {
+		if g := compareVersions(tt.a, tt.b); g != tt.w {
+			t.Errorf("#%d: compareVersions(%q, %q) = %d, want %d", i, tt.a, tt.b, g, tt.w)
+		}
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	tests := []struct {
+		membs []Member
+		w     string
+	}{
+		{[]Member{{ID: 1, Version: "0.5.0"}}, "0.5.0"},
+		{[]Member{{ID: 1, Version: "0.5.0"}, {ID: 2, Version: "0.5.0-alpha"}, {ID: 3, Version: "0.5.1"}}, "0.5.0-alpha"},
+		// the version of a member that has not published it is unknown
+		{[]Member{{ID: 1, Version: "0.5.0"}, {ID: 2}}, ""},
+		{nil, ""},
+	}
+	for i, tt := range tests {
+		c := Cluster{}
+		if err := c.AddSlice(tt.membs); err != nil {
+			t.Fatal(err)
+		}
+		if g := minVersion(c); g != tt.w {
+			t.Errorf("#%d: minVersion = %q, want %q", i, g, tt.w)
+		}
+	}
+}
+
+// TestDoClusterVersion tests that the requests the older members would
+// apply differently are not proposed until every member supports them.
+func TestDoClusterVersion(t *testing.T) {
+	reqs := []pb.Request{
+		{ID: 1, Method: "TXN", Val: `{}`},
+		{ID: 1, Method: "DELETE", Path: "/foo", Range: true},
+		{ID: 1, Method: "PUT", Path: "/foo", Refresh: true},
+	}
+	tests := []struct {
+		cv string
+		w  bool
+	}{
+		{"", false},
+		{"0.4.6", false},
+		{"0.5.0-alpha", true},
+		{"0.5.1", true},
+	}
+	for i, tt := range tests {
+		st := store.New()
+		if tt.cv != "" {
+			st.Set(clusterVersionKey, false, tt.cv, store.Permanent)
+		}
+		for j, r := range append(reqs, pb.Request{ID: 1, Method: "PUT", Path: "/foo"}) {
+			n := &nodeRecorder{}
+			srv := &EtcdServer{Node: n, Store: st, w: &waitRecorder{}}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := srv.Do(ctx, r)
+			// a plain PUT is supported by any member
+			w := tt.w || j == len(reqs)
+			if g := len(n.Action()) == 1; g != w {
+				t.Errorf("#%d.%d: proposed = %v, want %v", i, j, g, w)
+			}
+			if !w && err != ErrClusterVersion {
+				t.Errorf("#%d.%d: err = %v, want %v", i, j, err, ErrClusterVersion)
+			}
+		}
+	}
+}
+
+// TestVersionsOf1 tests that a single member, once it published its
+// version, reports it as both its own version and the cluster version.
+func TestVersionsOf1(t *testing.T) {
+	tk := time.NewTicker(10 * time.Millisecond)
+	defer tk.Stop()
+	st := store.New()
+	c := Cluster{}
+	c.AddSlice([]Member{{ID: 1, Name: "node1"}})
+	srv := &EtcdServer{
+		Name:         "node1",
+		Version:      "0.5.0",
+		Node:         raft.StartNode(1, []int64{1}, 10, 1),
+		Store:        st,
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		Ticker:       tk.C,
+		SyncTicker:   tk.C,
+		ClusterStore: NewClusterStore(st, c),
+	}
+	srv.Start()
+	defer srv.Stop()
+
+	w := Versions{Server: "0.5.0", Cluster: "0.5.0"}
+	var g Versions
+	for i := 0; i < 500; i++ {
+		if g = srv.Versions(); g == w {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("versions = %+v, want %+v", g, w)
+}
+
+// TestClusterVersionUpgrade tests that the cluster version stays at the
+// oldest version of the members while they are upgraded one at a time.
+// TestUpdateClusterVersionPending tests that the cluster version is not
+// proposed again while the previous proposal is pending.
+func TestUpdateClusterVersionPending(t *testing.T) {
+	n := &nodeProposeDataRecorder{}
+	st := store.New()
+	srv := &EtcdServer{
+		Version:      "0.5.0",
+		Node:         n,
+		Store:        st,
+		ClusterStore: mustClusterStore(t, []Member{{ID: 1, Name: "node1", Version: "0.5.0"}}),
+		w:            wait.New(),
+	}
+	for i := 0; i < 3; i++ {
+		srv.updateClusterVersion(100 * time.Millisecond)
+		pkg.ForceGosched()
+	}
+	if g := len(n.data()); g != 1 {
+		t.Fatalf("proposals = %d, want 1 while the first one is pending", g)
+	}
+	// the next tick proposes again once the proposal gave up
+	time.Sleep(200 * time.Millisecond)
+	srv.updateClusterVersion(100 * time.Millisecond)
+	pkg.ForceGosched()
+	if g := len(n.data()); g != 2 {
+		t.Errorf("proposals = %d, want 2", g)
+	}
+}
+
+func TestClusterVersionUpgrade(t *testing.T) {
+	tk := time.NewTicker(10 * time.Millisecond)
+	defer tk.Stop()
+	st := store.New()
+	c := Cluster{}
+	// node2 only shows in the cluster store, as if it were a follower
+	c.AddSlice([]Member{{ID: 1, Name: "node1"}, {ID: 2, Name: "node2", Version: "0.4.6"}})
+	srv := &EtcdServer{
+		Name:         "node1",
+		Version:      "0.5.0",
+		Node:         raft.StartNode(1, []int64{1}, 10, 1),
+		Store:        st,
+		Send:         func(_ []raftpb.Message) {},
+		Storage:      &storageRecorder{},
+		Ticker:       tk.C,
+		SyncTicker:   tk.C,
+		ClusterStore: NewClusterStore(st, c),
+	}
+	srv.Start()
+	defer srv.Stop()
+
+	waitClusterVersion := func(w string) {
+		for i := 0; i < 500; i++ {
+			if srv.Versions().Cluster == w {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("cluster version = %q, want %q", srv.Versions().Cluster, w)
+	}
+	waitClusterVersion("0.4.6")
+	if srv.ClusterVersionAtLeast("0.5.0") {
+		t.Errorf("features of 0.5.0 are enabled while node2 runs 0.4.6")
+	}
+	if !srv.ClusterVersionAtLeast("0.4.6") {
+		t.Errorf("features of 0.4.6 are disabled")
+	}
+
+	// node2 restarts with 0.5.0 and publishes it
+	m := *srv.ClusterStore.Get().FindID(2)
+	m.Version = "0.5.0"
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := srv.Do(ctx, pb.Request{ID: GenID(), Method: "PUT", Path: m.storeKey(), Val: string(b)}); err != nil {
+		t.Fatal(err)
+	}
+	waitClusterVersion("0.5.0")
+	if !srv.ClusterVersionAtLeast("0.5.0") {
+		t.Errorf("features of 0.5.0 are disabled once every member runs it")
+	}
+}
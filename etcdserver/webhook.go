@@ -0,0 +1,95 @@
+package etcdserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/etcd/pkg/logger"
+)
+
+const (
+	// DefaultWebhookTimeout is the default time to wait for the webhook to
+	// respond to a leader change.
+	DefaultWebhookTimeout = 5 * time.Second
+
+	// number of the leader changes waiting to be posted to the webhook;
+	// the ones past it are dropped
+	webhookQueueSize = 16
+)
+
+// LeaderChange is posted as JSON to the LeaderChangeWebhook of a member when
+// it learns that a new leader was elected. Each member posts its own, so a
+// webhook shared by the members gets one per member.
+type LeaderChange struct {
+	// Member is the name of the member posting it.
+	Member string `json:"member"`
+	// OldLeader is the leader the member knew before, or raft.None if it
+	// knew none, as when it just started or the leader was lost first.
+	OldLeader int64 `json:"oldLeader"`
+	NewLeader int64 `json:"newLeader"`
+	Term      int64 `json:"term"`
+}
+
+// webhook posts the leader changes to a URL from its own goroutine, one at
+// a time, so that a slow or unreachable webhook never holds back raft.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan LeaderChange
+}
+
+func newWebhook(url string, timeout time.Duration) *webhook {
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan LeaderChange, webhookQueueSize),
+	}
+}
+
+// notify queues lc to be posted, or drops it if the queue is full. It never
+// blocks.
+func (h *webhook) notify(lc LeaderChange) {
+	select {
+	case h.queue <- lc:
+	default:
+		webhookFailures.Inc()
+		logger.Warnf("etcdserver: dropped leader change to %x for the webhook, which is behind", lc.NewLeader)
+	}
+}
+
+// run posts the queued leader changes until done is closed.
+func (h *webhook) run(done <-chan struct{}) {
+	for {
+		select {
+		case lc := <-h.queue:
+			if err := h.post(lc); err != nil {
+				webhookFailures.Inc()
+				logger.Warnf("etcdserver: error posting leader change to %x to the webhook: %v", lc.NewLeader, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (h *webhook) post(lc LeaderChange) error {
+	b, err := json.Marshal(lc)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package etcdserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// TestLeaderChangeWebhook tests that each new leader the server learns of
+// is posted to the webhook, with the leader it replaces and the term.
+func TestLeaderChangeWebhook(t *testing.T) {
+	lcc := make(chan LeaderChange, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type = %s, want application/json", ct)
+		}
+		var lc LeaderChange
+		if err := json.NewDecoder(r.Body).Decode(&lc); err != nil {
+			t.Errorf("decode error: %v", err)
+		}
+		lcc <- lc
+	}))
+	defer ts.Close()
+
+	n := newReadyNode()
+	srv := &EtcdServer{
+		Name:                "node1",
+		Node:                n,
+		Store:               &storeRecorder{},
+		Send:                func(_ []raftpb.Message) {},
+		Storage:             &storageRecorder{},
+		LeaderChangeWebhook: ts.URL,
+	}
+	srv.start()
+	defer srv.Stop()
+
+	n.readyc <- raft.Ready{SoftState: &raft.SoftState{Lead: 1}, HardState: raftpb.HardState{Term: 2}}
+	// the same leader again is no change
+	n.readyc <- raft.Ready{SoftState: &raft.SoftState{Lead: 1}}
+	n.readyc <- raft.Ready{SoftState: &raft.SoftState{Lead: 2}, HardState: raftpb.HardState{Term: 3}}
+
+	wlcs := []LeaderChange{
+		{Member: "node1", OldLeader: raft.None, NewLeader: 1, Term: 2},
+		{Member: "node1", OldLeader: 1, NewLeader: 2, Term: 3},
+	}
+	for i, w := range wlcs {
+		select {
+		case g := <-lcc:
+			if !reflect.DeepEqual(g, w) {
+				t.Errorf("#%d: leader change = %+v, want %+v", i, g, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("#%d: leader change is not posted", i)
+		}
+	}
+	select {
+	case g := <-lcc:
+		t.Errorf("unexpected leader change %+v", g)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestLeaderChangeWebhookBlocked tests that a webhook that does not respond
+// holds back neither the server nor its Stop.
+func TestLeaderChangeWebhookBlocked(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	n := newReadyNode()
+	srv := &EtcdServer{
+		Node:                       n,
+		Store:                      &storeRecorder{},
+		Send:                       func(_ []raftpb.Message) {},
+		Storage:                    &storageRecorder{},
+		LeaderChangeWebhook:        ts.URL,
+		LeaderChangeWebhookTimeout: time.Hour,
+	}
+	srv.start()
+
+	done := make(chan struct{})
+	go func() {
+		for i := int64(1); i <= 2*webhookQueueSize; i++ {
+			n.readyc <- raft.Ready{SoftState: &raft.SoftState{Lead: i}}
+		}
+		srv.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("server is held back by the webhook")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/etcdhttp"
 	"github.com/coreos/etcd/pkg"
+	"github.com/coreos/etcd/pkg/fileutil"
 	flagtypes "github.com/coreos/etcd/pkg/flags"
 	"github.com/coreos/etcd/pkg/transport"
 	"github.com/coreos/etcd/raft"
@@ -19,14 +20,10 @@ import (
 	"time"
 )
 
-const (
-	// the owner can make/remove files inside the directory
-	privateDirMode = 0700
-)
-
 type ITServer struct {
 	port          int
 	etcds         *etcdserver.EtcdServer
+	stopSend      func()
 	dir           string
 	name          string
 	peerTLSInfo   transport.TLSInfo
@@ -50,13 +47,14 @@ func NewItServer(port int) *ITServer {
 		cluster:       &etcdserver.Cluster{},
 	}
 	s.addr.Set(fmt.Sprintf("127.0.0.1:%v", port))
-	s.cluster.Set("itest=localhost:8080")
+	s.cluster.Set("itest=http://localhost:8080")
 	return s
 
 }
 
 func (s *ITServer) Stop() {
 	s.etcds.Stop()
+	s.stopSend()
 	os.RemoveAll(s.dir)
 }
 
@@ -78,11 +76,11 @@ func (s *ITServer) Start() {
 	s.dir = fmt.Sprintf("%v_%v_etcd_data", s.name, self.ID)
 	log.Printf("main: no data-dir is given, using default data-dir ./%s", s.dir)
 
-	if err := os.MkdirAll(s.dir, privateDirMode); err != nil {
+	if err := fileutil.CreateDirAll(s.dir, fileutil.PrivateDirMode); err != nil {
 		log.Fatalf("main: cannot create data directory: %v", err)
 	}
 	snapdir := path.Join(s.dir, "snap")
-	if err := os.MkdirAll(snapdir, privateDirMode); err != nil {
+	if err := fileutil.CreateDirAll(snapdir, fileutil.PrivateDirMode); err != nil {
 		log.Fatalf("etcd: cannot create snapshot directory: %v", err)
 	}
 	snapshotter := snap.New(snapdir)
@@ -94,7 +92,7 @@ func (s *ITServer) Start() {
 	st := store.New()
 
 	if !wal.Exist(waldir) {
-		w, err = wal.Create(waldir)
+		w, err = wal.Create(waldir, self.ID)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -119,22 +117,26 @@ func (s *ITServer) Start() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		// TODO(xiangli): save/recovery nodeID?
-		if wid != 0 {
-			log.Fatalf("unexpected nodeid %d: nodeid should always be zero until we save nodeid into wal", wid)
+		if wid != self.ID {
+			log.Fatalf("member id mismatch: the data directory belongs to member %x, not %x", wid, self.ID)
 		}
-		n = raft.RestartNode(self.ID, s.cluster.IDs(), 10, 1, snapshot, st, ents)
+		n = raft.RestartNode(wid, s.cluster.IDs(), 10, 1, snapshot, st, ents)
 	}
 
-	pt, err := transport.NewTransport(s.peerTLSInfo)
+	peerTimeout := 500 * time.Millisecond
+	pt, err := transport.NewTimeoutTransport(s.peerTLSInfo, peerTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	cls := etcdserver.NewClusterStore(st, *s.cluster)
+	stats := etcdserver.NewPeerStats()
+	send, removePeer, stopSend := etcdserver.Sender(pt, cls, stats, peerTimeout, snapshotter.OpenData)
+	s.stopSend = stopSend
 	u, _ := url.Parse(fmt.Sprintf("http://localhost:%v/", s.port))
 
 	s.etcds = &etcdserver.EtcdServer{
+		ID:         self.ID,
 		Name:       s.name,
 		ClientURLs: []url.URL{*u},
 		Store:      st,
@@ -143,16 +145,18 @@ func (s *ITServer) Start() {
 			*wal.WAL
 			*snap.Snapshotter
 		}{w, snapshotter},
-		Send:         etcdserver.Sender(pt, cls),
+		Send:         send,
+		RemovePeer:   removePeer,
 		Ticker:       time.Tick(100 * time.Millisecond),
 		SyncTicker:   time.Tick(500 * time.Millisecond),
 		SnapCount:    int64(s.snapCount),
 		ClusterStore: cls,
+		PeerStats:    stats,
 	}
 	s.etcds.Start()
 
 	ch := &pkg.CORSHandler{
-		Handler: etcdhttp.NewClientHandler(s.etcds, cls, s.timeout),
+		Handler: etcdhttp.NewClientHandler(s.etcds, cls, s.timeout, etcdhttp.WriteForward, etcdhttp.DefaultMaxRequestBytes),
 		Info:    &pkg.CORSInfo{},
 	}
 
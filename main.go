@@ -3,45 +3,129 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/coreos/etcd/discovery"
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/etcdhttp"
 	"github.com/coreos/etcd/pkg"
+	"github.com/coreos/etcd/pkg/fileutil"
 	flagtypes "github.com/coreos/etcd/pkg/flags"
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/pkg/timeutil"
 	"github.com/coreos/etcd/pkg/transport"
 	"github.com/coreos/etcd/proxy"
 	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/snap"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
 	"github.com/coreos/etcd/wal"
 )
 
 const (
-	// the owner can make/remove files inside the directory
-	privateDirMode = 0700
-
 	version = "0.5.0-alpha"
+
+	// the format version of the data directory written by this binary.
+	// Bump it whenever the layout of the data directory changes, and add
+	// the step translating the previous format to upgradeDataDir.
+	dataDirVersion = 1
+
+	// the interval of the raft logical clock
+	tickInterval = 100 * time.Millisecond
 )
 
 var (
 	name         = flag.String("name", "default", "Unique human-readable name for this node")
 	timeout      = flag.Duration("timeout", 10*time.Second, "Request Timeout")
+	electionMs   = flag.Uint("election-timeout", 1000, "Time (in milliseconds) a follower waits without hearing from the leader before campaigning")
+	heartbeatMs  = flag.Uint("heartbeat-interval", 100, "Time (in milliseconds) between the heartbeats of the leader")
 	dir          = flag.String("data-dir", "", "Path to the data directory")
+	walDir       = flag.String("wal-dir", "", "Path to the WAL directory, to keep the WAL on a dedicated disk (default wal under data-dir)")
 	snapCount    = flag.Int64("snapshot-count", etcdserver.DefaultSnapCount, "Number of committed transactions to trigger a snapshot")
+	snapCatchUp  = flag.Int64("snapshot-catch-up-entries", etcdserver.DefaultSnapCatchUpEntries, "Number of entries kept in the raft log before a snapshot, to catch up the followers slightly behind it without sending them the snapshot")
+	snapBytes    = flag.Int64("snapshot-size-bytes", 0, "Size in bytes of the committed transactions to trigger a snapshot, whichever of it and snapshot-count is reached first (0 is unlimited)")
+	snapCompress = flag.Bool("snapshot-compression", false, "Compress the snapshot files with gzip")
+	maxSnaps     = flag.Int("max-snapshots", etcdserver.DefaultMaxSnapFiles, "Maximum number of snapshot files to retain (0 is unlimited)")
+	maxInflight  = flag.Int64("max-inflight-proposals", 0, "Maximum number of write requests waiting to be applied; the ones past it are refused with 429 (0 is unlimited)")
+	leaderHook   = flag.String("leader-change-webhook", "", "URL to POST a JSON description of each leader change the member sees to, in the background")
+	applySlow    = flag.Duration("apply-slow-threshold", 100*time.Millisecond, "Time past which applying a single entry is logged as slow (0 disables it)")
+	quotaKeys    = flag.Int64("quota-keys", 0, "Maximum number of keys in the store; writes past it are refused (0 is unlimited)")
+	quotaBytes   = flag.Int64("quota-backend-bytes", 0, "Maximum size in bytes of the keys and values in the store; writes past it are refused (0 is unlimited)")
+	maxKeyBytes  = flag.Int("max-key-bytes", 0, "Maximum length in bytes of a key; creating a longer key is refused (0 is unlimited, must be the same on every member)")
+	maxKeyDepth  = flag.Int("max-key-depth", 0, "Maximum number of levels of a key; creating a deeper key is refused (0 is unlimited, must be the same on every member)")
+	historySize  = flag.Int("event-history-size", store.DefaultEventHistorySize, "Number of the latest events kept for the watches resuming from a waitIndex; older indexes are answered with error 401")
+	maxRequest   = flag.Int64("max-request-bytes", etcdhttp.DefaultMaxRequestBytes, "Maximum size in bytes of the body of a client request; larger requests are refused with 413 (0 is unlimited)")
+	rateLimit    = flag.Float64("rate-limit", 0, "Number of client requests per second served on average for each client, key or all of them as set by rate-limit-by; the ones past it are refused with 429 (0 is unlimited)")
+	rateBurst    = flag.Int("rate-limit-burst", 100, "Number of client requests served at once before rate-limit applies")
+	maxConns     = flag.Int("max-client-conns", 0, "Maximum number of simultaneous client connections per listener; the ones past it are closed at once (0 is unlimited)")
+	keepAlive    = flag.Bool("client-keep-alive", true, "Keep client connections open between requests")
+	tlsMinVer    = flag.String("tls-min-version", "TLS1.2", "Oldest TLS version accepted by the client and peer listeners and used to reach the peers: TLS1.0, TLS1.1, TLS1.2 or TLS1.3")
+	tlsCiphers   = flag.String("tls-cipher-suites", "", "Comma-separated list of the cipher suites, as Go names them, allowed up to TLS 1.2 on the client and peer connections (empty allows those Go chooses)")
+	enableHTTP2  = flag.Bool("enable-http2", false, "Offer HTTP/2 on the TLS client and peer listeners, and use it to reach the peers, multiplexing the requests over one connection")
+	leaderLease  = flag.Bool("leader-lease", false, "Serve quorum reads on the leader without a round trip while it holds a lease; all members must set it")
+	preVote      = flag.Bool("pre-vote", false, "Run a pre-election before campaigning, so that a member rejoining the cluster does not disrupt the leader")
+	authEnabled  = flag.Bool("auth-enabled", false, "Require the HTTP Basic credentials of a user under /v2/auth/users on every client request, and the permissions of its roles")
+	syncJitter   = flag.Float64("sync-jitter", 0.1, "Fraction of the 500ms interval between the syncs of the expired keys by which it is made longer or shorter at random, so that the members started together do not sync at the same time (0 disables it)")
+	checkPeers   = flag.Bool("check-peer-urls", false, "Dial the peer URLs of the other members at startup, and warn about the unreachable ones")
+	accessLog    = flag.Bool("access-log", false, "Log the method, path, status and duration of every client request at INFO level")
+	forceNew     = flag.Bool("force-new-cluster", false, "Restart this member as a one-member cluster, removing all the others; only to recover from a permanent loss of quorum")
+	noFsync      = flag.Bool("unsafe-no-fsync", false, "Never sync the WAL to disk, the same as -wal-sync=none; a crash of the machine loses acknowledged writes and may break the cluster. Only for benchmarks and throwaway clusters")
+	repairWAL    = flag.Bool("repair-wal", false, "Truncate the WAL before its first corrupted record on restart, backing up the files changed; the entries after it are lost")
+	initialSnap  = flag.String("initial-snapshot", "", "Path to a backup downloaded from /v2/admin/backup to start a new one-member cluster from; only used when the data directory holds no WAL")
+	configFile   = flag.String("config-file", "", "Path to a YAML file setting flags by name; the command line and the environment take precedence. On SIGHUP, it is read again to change the CORS flags, log-level and proxy-refresh-interval")
 	printVersion = flag.Bool("version", false, "Print the version and exit")
+	durl         = flag.String("discovery", "", "Discovery service used to bootstrap the cluster")
+	dwait        = flag.Duration("discovery-wait-timeout", 0, "Time to wait for all the members to register to the discovery service (0 waits forever)")
+	dtimeout     = flag.Duration("discovery-request-timeout", discovery.DefaultRequestTimeout, "Time to wait for a response to a request to the discovery service")
+	dretries     = flag.Int("discovery-retries", discovery.DefaultRetries, "Number of times a failed request to the discovery service is retried before giving up")
+	discoverySRV = flag.String("discovery-srv", "", "Domain whose _etcd-server._tcp SRV records list the members to bootstrap the cluster from")
 
-	cluster   = &etcdserver.Cluster{}
-	cors      = &pkg.CORSInfo{}
-	proxyFlag = new(flagtypes.Proxy)
+	proxyRefreshInterval = flag.Duration("proxy-refresh-interval", 30*time.Second, "Interval at which the proxy refreshes the list of members (0 disables refreshing)")
+	proxyCacheTTL        = flag.Duration("proxy-cache-ttl", 0, "Time the proxy answers the GET requests on a key from the response it cached for it (0 disables caching)")
+	proxyTrustXFF        = flag.Bool("proxy-trust-forwarded-for", true, "Keep the X-Forwarded-For addresses sent by the clients, adding theirs after them; when false, they are replaced by the client address")
+
+	cluster      = &etcdserver.Cluster{}
+	clusterState = new(flagtypes.ClusterState)
+	cors         = &pkg.CORSInfo{}
+	proxyFlag    = new(flagtypes.Proxy)
+
+	corsMethods, corsHeaders string
+	corsCredentials          bool
 
 	clientTLSInfo = transport.TLSInfo{}
 	peerTLSInfo   = transport.TLSInfo{}
+	timeouts      = transport.Timeouts{}
+	logLevel      = logger.InfoLevel
+	writeMode     = etcdhttp.WriteForward
+	rateLimitBy   = etcdhttp.RateLimitClient
+	walSync       = wal.SyncFsync
+	walCommit     = wal.CommitGroup
+	proxyBalance  = proxy.BalanceFirst
+	dataDirMode   = flagtypes.DirMode(fileutil.PrivateDirMode)
+
+	// cfgFile is the config file loaded, if any, which is read again on
+	// SIGHUP to change the reloadable flags
+	cfgFile    *flagtypes.ConfigFile
+	reloadable = []string{
+		"cors",
+		"cors-methods",
+		"cors-headers",
+		"cors-credentials",
+		"log-level",
+		"proxy-refresh-interval",
+	}
+	// onReload are the functions applying the reloadable flags to the
+	// servers, added as they start
+	onReload []func()
 
 	deprecated = []string{
 		"cluster-active-size",
@@ -63,6 +147,8 @@ var (
 func init() {
 	flag.Var(cluster, "bootstrap-config", "Initial cluster configuration for bootstrapping")
 	cluster.Set("default=http://localhost:2380,default=http://localhost:7001")
+	flag.Var(clusterState, "initial-cluster-state", fmt.Sprintf("Whether a member without data forms a new cluster with the members of bootstrap-config, or joins an existing one that it was added to; one of %s", strings.Join(flagtypes.ClusterStateValues, ", ")))
+	clusterState.Set(flagtypes.ClusterStateValueNew)
 
 	flag.Var(flagtypes.NewURLsValue("http://localhost:2380,http://localhost:7001"), "advertise-peer-urls", "List of this member's peer URLs to advertise to the rest of the cluster")
 	flag.Var(flagtypes.NewURLsValue("http://localhost:2379,http://localhost:4001"), "advertise-client-urls", "List of this member's client URLs to advertise to the rest of the cluster")
@@ -70,6 +156,9 @@ func init() {
 	flag.Var(flagtypes.NewURLsValue("http://localhost:2379,http://localhost:4001"), "listen-client-urls", "List of this URLs to listen on for client traffic")
 
 	flag.Var(cors, "cors", "Comma-separated white list of origins for CORS (cross-origin resource sharing).")
+	flag.StringVar(&corsMethods, "cors-methods", strings.Join(pkg.DefaultCORSMethods, ","), "Comma-separated list of the methods allowed in CORS requests")
+	flag.StringVar(&corsHeaders, "cors-headers", strings.Join(pkg.DefaultCORSHeaders, ","), "Comma-separated list of the request headers allowed in CORS requests")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "Allow CORS requests to carry cookies and HTTP authentication")
 
 	flag.Var(proxyFlag, "proxy", fmt.Sprintf("Valid values include %s", strings.Join(flagtypes.ProxyValues, ", ")))
 	proxyFlag.Set(flagtypes.ProxyValueOff)
@@ -77,11 +166,25 @@ func init() {
 	flag.StringVar(&clientTLSInfo.CAFile, "ca-file", "", "Path to the client server TLS CA file.")
 	flag.StringVar(&clientTLSInfo.CertFile, "cert-file", "", "Path to the client server TLS cert file.")
 	flag.StringVar(&clientTLSInfo.KeyFile, "key-file", "", "Path to the client server TLS key file.")
+	flag.BoolVar(&clientTLSInfo.ClientCertAuth, "client-cert-auth", false, "Refuse the client connections without a certificate signed by ca-file, and authenticate the user named after its common name with auth-enabled")
 
 	flag.StringVar(&peerTLSInfo.CAFile, "peer-ca-file", "", "Path to the peer server TLS CA file.")
 	flag.StringVar(&peerTLSInfo.CertFile, "peer-cert-file", "", "Path to the peer server TLS cert file.")
 	flag.StringVar(&peerTLSInfo.KeyFile, "peer-key-file", "", "Path to the peer server TLS key file.")
 
+	flag.Var(&logLevel, "log-level", "Minimum level of the logged messages: DEBUG, INFO, WARN, ERROR or FATAL")
+	flag.Var(&dataDirMode, "data-dir-mode", "Octal permission bits of the data directory and of its snap and wal directories, set whatever the umask when they are created")
+	flag.Var(&proxyBalance, "proxy-lb", "How the proxy spreads the requests over the members: first, round-robin or least-connections")
+	flag.Var(&rateLimitBy, "rate-limit-by", "What the client requests are rate limited by: client, key or global")
+	flag.Var(&walSync, "wal-sync", "How the WAL is synced to disk after each write: fsync, fdatasync, as durable and faster on Linux, or none, which is unsafe")
+	flag.Var(&walCommit, "wal-sync-mode", "When the WAL syncs the concurrent writes: group, which syncs together the writes arriving during a sync, or write, which syncs each on its own")
+	flag.Var(&writeMode, "follower-writes", "How a follower serves the writes: forward them to the leader through raft, or redirect the client to the leader")
+
+	flag.DurationVar(&timeouts.ReadHeader, "read-header-timeout", transport.DefaultReadHeaderTimeout, "Time allowed to read the headers of a request (0 is unlimited)")
+	flag.DurationVar(&timeouts.Read, "read-timeout", 0, "Time allowed to read a whole request (0 is unlimited)")
+	flag.DurationVar(&timeouts.Write, "write-timeout", 0, "Time allowed to write a response, which also bounds watches (0 is unlimited)")
+	flag.DurationVar(&timeouts.Idle, "idle-timeout", 2*time.Minute, "Time a keep-alive connection may wait for the next request (0 is unlimited)")
+
 	// backwards-compatibility with v0.4.6
 	flag.Var(&flagtypes.IPAddressPort{}, "addr", "DEPRECATED: Use -advertise-client-urls instead.")
 	flag.Var(&flagtypes.IPAddressPort{}, "bind-addr", "DEPRECATED: Use -listen-client-urls instead.")
@@ -102,195 +205,732 @@ func main() {
 		os.Exit(0)
 	}
 
-	pkg.SetFlagsFromEnv(flag.CommandLine)
+	if err := pkg.SetFlagsFromEnv(flag.CommandLine); err != nil {
+		logger.Fatalf("etcd: %v", err)
+	}
+	if *configFile != "" {
+		var err error
+		if cfgFile, err = flagtypes.LoadConfigFile(flag.CommandLine, *configFile); err != nil {
+			logger.Fatalf("etcd: cannot load config file: %v", err)
+		}
+	}
+	logger.SetLevel(logLevel)
+	clientTLSInfo.HTTP2 = *enableHTTP2
+	peerTLSInfo.HTTP2 = *enableHTTP2
+	minVersion, err := transport.ParseTLSVersion(*tlsMinVer)
+	if err != nil {
+		logger.Fatalf("etcd: invalid tls-min-version: %v", err)
+	}
+	cipherSuites, err := transport.ParseCipherSuites(*tlsCiphers)
+	if err != nil {
+		logger.Fatalf("etcd: invalid tls-cipher-suites: %v", err)
+	}
+	clientTLSInfo.MinVersion, peerTLSInfo.MinVersion = minVersion, minVersion
+	clientTLSInfo.CipherSuites, peerTLSInfo.CipherSuites = cipherSuites, cipherSuites
+
+	if *maxRequest < 0 {
+		logger.Fatalf("etcd: max-request-bytes must not be negative: max-request-bytes=%d", *maxRequest)
+	}
+	if *rateLimit < 0 {
+		logger.Fatalf("etcd: rate-limit must not be negative: rate-limit=%v", *rateLimit)
+	}
+	if *rateBurst < 1 {
+		logger.Fatalf("etcd: rate-limit-burst must be at least 1: rate-limit-burst=%d", *rateBurst)
+	}
+	if *maxConns < 0 {
+		logger.Fatalf("etcd: max-client-conns must not be negative: max-client-conns=%d", *maxConns)
+	}
+	if dataDirMode&0002 != 0 {
+		logger.Warnf("etcd: data-dir-mode %v lets any user make and remove files in the data directory", &dataDirMode)
+	}
 
+	var stop func() error
 	if string(*proxyFlag) == flagtypes.ProxyValueOff {
-		startEtcd()
+		stop = startEtcd()
 	} else {
-		startProxy()
+		stop = startProxy()
+	}
+
+	stopReload := pkg.ReloadOnSignal(reloadConfig, syscall.SIGHUP)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	logger.Infof("etcd: received %v, shutting down", <-sigc)
+	stopReload()
+	if err := stop(); err != nil {
+		logger.Warnf("etcd: unclean shutdown: %v", err)
+		os.Exit(1)
+	}
+	logger.Infof("etcd: shutdown complete")
+}
+
+// upgradeDataDir translates the data directory dir from the format version
+// from to dataDirVersion, one version at a time, and records the new version.
+// Version 0 is a directory with no version file: either a new one, or one
+// written before the version file was introduced, whose format is the same
+// as version 1.
+func upgradeDataDir(dir string, from int) error {
+	for v := from; v < dataDirVersion; v++ {
+		switch v {
+		case 0:
+			// nothing to translate
+		default:
+			return fmt.Errorf("no upgrade from version %d", v)
+		}
+		if err := fileutil.WriteVersion(dir, v+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDataDir seeds the snapshot and WAL directories of member id, which
+// hold no data yet, with the backup at p, so that the member restarts from
+// it as the only member of a new cluster.
+func restoreDataDir(p string, id int64, ss *snap.Snapshotter, snapdir, waldir string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snapshot, hs, ents, err := etcdserver.Restore(id, f)
+	if err != nil {
+		return err
+	}
+	// SaveSnap only logs its errors
+	ss.SaveSnap(snapshot)
+	if _, err := os.Stat(path.Join(snapdir, snap.FileName(snapshot))); err != nil {
+		return fmt.Errorf("cannot save snapshot: %v", err)
+	}
+
+	if err := fileutil.CreateDirAll(waldir, os.FileMode(dataDirMode)); err != nil {
+		return err
+	}
+	w, err := wal.Create(waldir, id)
+	if err != nil {
+		return err
+	}
+	w.Save(hs, ents)
+	return w.Close()
+}
+
+// raftTicks converts the election timeout and the heartbeat interval, in
+// milliseconds, to ticks of the raft clock. The heartbeat interval must be a
+// multiple of the tick interval, and the election timeout at least five
+// heartbeat intervals, so that a few lost heartbeats do not trigger an
+// election.
+func raftTicks(electionMs, heartbeatMs uint) (election, heartbeat int, err error) {
+	tick := uint(tickInterval / time.Millisecond)
+	if heartbeatMs < tick || heartbeatMs%tick != 0 {
+		return 0, 0, fmt.Errorf("heartbeat-interval %dms is not a multiple of %dms", heartbeatMs, tick)
+	}
+	if electionMs < 5*heartbeatMs {
+		return 0, 0, fmt.Errorf("election-timeout %dms is less than 5 times heartbeat-interval %dms", electionMs, heartbeatMs)
 	}
+	return int(electionMs / tick), int(heartbeatMs / tick), nil
+}
 
-	// Block indefinitely
-	<-make(chan struct{})
+// discoverCluster bootstraps the cluster through the discovery service, and
+// records it in the data directory so that a restarted member reads it from
+// there rather than registering to the discovery service again.
+func discoverCluster() {
+	apurls, err := pkg.URLsFromFlags(flag.CommandLine, "advertise-peer-urls", "peer-addr", peerTLSInfo)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	self := etcdserver.NewMember(*name, apurls, nil)
+	if *dir == "" {
+		*dir = fmt.Sprintf("%v_etcd_data", self.ID)
+		logger.Infof("main: no data-dir is given, using default data-dir ./%s", *dir)
+	}
+	if err := fileutil.CreateDirAll(*dir, os.FileMode(dataDirMode)); err != nil {
+		logger.Fatalf("main: cannot create data directory: %v", err)
+	}
+
+	config := etcdserver.Cluster{}
+	config.Add(*self)
+	d, err := discovery.New(*durl, self.ID, config.String(), *dwait, *dtimeout, *dretries)
+	if err != nil {
+		logger.Fatalf("etcd: cannot use discovery URL %q: %v", *durl, err)
+	}
+	cls, err := discovery.Recorded(path.Join(*dir, "members"), d).Discover()
+	if err == discovery.ErrFullCluster {
+		logger.Fatalf("etcd: the cluster of %s is full, use a new discovery token", *durl)
+	}
+	if err != nil {
+		logger.Fatalf("etcd: discovery failed: %v", err)
+	}
+	*cluster = *cls
 }
 
 // startEtcd launches the etcd server and HTTP handlers for client/server communication.
-func startEtcd() {
+// It returns a function that gracefully shuts them down again.
+func startEtcd() func() error {
+	electionTicks, heartbeatTicks, err := raftTicks(*electionMs, *heartbeatMs)
+	if err != nil {
+		logger.Fatalf("etcd: %v", err)
+	}
+	checkURLSchemes("advertise-peer-urls", "listen-peer-urls", "advertise-client-urls", "listen-client-urls")
+	if *discoverySRV != "" {
+		apurls, err := pkg.URLsFromFlags(flag.CommandLine, "advertise-peer-urls", "peer-addr", peerTLSInfo)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		scheme := "http"
+		if !peerTLSInfo.Empty() {
+			scheme = "https"
+		}
+		cls, err := discovery.SRVCluster(*name, *discoverySRV, scheme, apurls)
+		if err != nil {
+			logger.Fatalf("etcd: cannot bootstrap from SRV records: %v", err)
+		}
+		*cluster = *cls
+	}
+	joining := string(*clusterState) == flagtypes.ClusterStateValueExisting
+	if joining && *durl != "" {
+		logger.Fatalf("etcd: discovery bootstraps a new cluster, but initial-cluster-state=%s", *clusterState)
+	}
+	if joining && *initialSnap != "" {
+		logger.Fatalf("etcd: initial-snapshot starts a new cluster, but initial-cluster-state=%s", *clusterState)
+	}
+	if *durl != "" {
+		if *dtimeout <= 0 {
+			logger.Fatalf("etcd: discovery-request-timeout must be greater than 0: discovery-request-timeout=%v", *dtimeout)
+		}
+		if *dretries < 0 {
+			logger.Fatalf("etcd: discovery-retries must not be negative: discovery-retries=%d", *dretries)
+		}
+		discoverCluster()
+	}
+
 	self := cluster.FindName(*name)
 	if self == nil {
-		log.Fatalf("etcd: no member with name=%q exists", *name)
+		logger.Fatalf("etcd: no member with name=%q exists", *name)
 	}
 
 	if self.ID == raft.None {
-		log.Fatalf("etcd: cannot use None(%d) as member id", raft.None)
+		logger.Fatalf("etcd: cannot use None(%d) as member id", raft.None)
+	}
+
+	lpurls, err := pkg.URLsFromFlags(flag.CommandLine, "listen-peer-urls", "peer-bind-addr", peerTLSInfo)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	// the peer URLs of the member are what the other members dial, so a
+	// typo in them only shows as a cluster that never forms
+	listened, err := etcdserver.PeerURLsListened(self, lpurls)
+	if err != nil {
+		logger.Fatalf("etcd: %v", err)
+	}
+	if !listened {
+		logger.Warnf("etcd: none of the peer URLs %v of this member is served by listen-peer-urls; the other members may not reach it", self.PeerURLs)
+	}
+	if *checkPeers {
+		for _, u := range etcdserver.UnreachablePeerURLs(*cluster, self.ID, time.Second) {
+			logger.Warnf("etcd: peer URL %s is unreachable; the member may not be started yet", u)
+		}
+	}
+
+	if *noFsync {
+		walSync = wal.SyncNone
+	}
+	if walSync == wal.SyncNone {
+		logger.Warnf("etcd: THE WAL IS NEVER SYNCED TO DISK: a crash or power loss of this machine loses the writes it acknowledged, and may leave the cluster inconsistent. Do not use it for data you care about")
 	}
 
 	if *snapCount <= 0 {
-		log.Fatalf("etcd: snapshot-count must be greater than 0: snapshot-count=%d", *snapCount)
+		logger.Fatalf("etcd: snapshot-count must be greater than 0: snapshot-count=%d", *snapCount)
+	}
+
+	if *snapCatchUp < 0 {
+		logger.Fatalf("etcd: snapshot-catch-up-entries must not be negative: snapshot-catch-up-entries=%d", *snapCatchUp)
+	}
+
+	if *snapBytes < 0 {
+		logger.Fatalf("etcd: snapshot-size-bytes must not be negative: snapshot-size-bytes=%d", *snapBytes)
+	}
+
+	if *maxSnaps < 0 {
+		logger.Fatalf("etcd: max-snapshots must not be negative: max-snapshots=%d", *maxSnaps)
+	}
+
+	if *maxInflight < 0 {
+		logger.Fatalf("etcd: max-inflight-proposals must not be negative: max-inflight-proposals=%d", *maxInflight)
+	}
+
+	if *applySlow < 0 {
+		logger.Fatalf("etcd: apply-slow-threshold must not be negative: apply-slow-threshold=%v", *applySlow)
+	}
+
+	if *leaderHook != "" {
+		if u, err := url.Parse(*leaderHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.Fatalf("etcd: leader-change-webhook must be an http or https URL: leader-change-webhook=%s", *leaderHook)
+		}
+	}
+
+	if *maxKeyBytes < 0 || *maxKeyDepth < 0 {
+		logger.Fatalf("etcd: max-key-bytes and max-key-depth must not be negative: max-key-bytes=%d max-key-depth=%d", *maxKeyBytes, *maxKeyDepth)
+	}
+
+	if *syncJitter < 0 || *syncJitter >= 1 {
+		logger.Fatalf("etcd: sync-jitter must be at least 0 and less than 1: sync-jitter=%v", *syncJitter)
+	}
+
+	if *historySize <= 0 {
+		logger.Fatalf("etcd: event-history-size must be greater than 0: event-history-size=%d", *historySize)
 	}
 
 	if *dir == "" {
 		*dir = fmt.Sprintf("%v_etcd_data", self.ID)
-		log.Printf("main: no data-dir is given, using default data-dir ./%s", *dir)
+		logger.Infof("main: no data-dir is given, using default data-dir ./%s", *dir)
+	}
+	if err := fileutil.CreateDirAll(*dir, os.FileMode(dataDirMode)); err != nil {
+		logger.Fatalf("main: cannot create data directory: %v", err)
+	}
+	// two members writing the same WAL would corrupt it
+	dirLock, err := fileutil.TryLockDir(*dir)
+	if err == fileutil.ErrLocked {
+		logger.Fatalf("etcd: data-dir %s already in use by another etcd process", *dir)
 	}
-	if err := os.MkdirAll(*dir, privateDirMode); err != nil {
-		log.Fatalf("main: cannot create data directory: %v", err)
+	if err != nil {
+		logger.Fatalf("etcd: cannot lock data directory: %v", err)
+	}
+	dv, err := fileutil.CheckVersion(*dir, dataDirVersion)
+	if err != nil {
+		logger.Fatalf("etcd: cannot use data directory: %v", err)
+	}
+	if dv < dataDirVersion {
+		if err := upgradeDataDir(*dir, dv); err != nil {
+			logger.Fatalf("etcd: cannot upgrade data directory from version %d: %v", dv, err)
+		}
 	}
 	snapdir := path.Join(*dir, "snap")
-	if err := os.MkdirAll(snapdir, privateDirMode); err != nil {
-		log.Fatalf("etcd: cannot create snapshot directory: %v", err)
+	if err := fileutil.CreateDirAll(snapdir, os.FileMode(dataDirMode)); err != nil {
+		logger.Fatalf("etcd: cannot create snapshot directory: %v", err)
 	}
 	snapshotter := snap.New(snapdir)
+	snapshotter.Compress = *snapCompress
 
 	waldir := path.Join(*dir, "wal")
+	var walLock *fileutil.Lock
+	if *walDir != "" {
+		if err := etcdserver.CheckWALDir(*dir, snapdir, *walDir); err != nil {
+			logger.Fatalf("etcd: cannot use wal-dir: %v", err)
+		}
+		waldir = *walDir
+		if err := fileutil.CreateDirAll(waldir, os.FileMode(dataDirMode)); err != nil {
+			logger.Fatalf("etcd: cannot create wal directory: %v", err)
+		}
+		// the WAL directory may be shared by the data directories of
+		// several members, so it is locked on its own
+		walLock, err = fileutil.TryLockDir(waldir)
+		if err == fileutil.ErrLocked {
+			logger.Fatalf("etcd: wal-dir %s already in use by another etcd process", waldir)
+		}
+		if err != nil {
+			logger.Fatalf("etcd: cannot lock wal directory: %v", err)
+		}
+	}
 	var w *wal.WAL
 	var n raft.Node
-	var err error
-	st := store.New()
+	// the entries committed in the WAL are applied again on restart, and
+	// the clients are answered 503 until they are. Those up to the snapshot
+	// restarted from are applied with it.
+	var replayIndex, snapIndex, snapTerm int64
+	var ropts []raft.Option
+	if *preVote {
+		ropts = append(ropts, raft.PreVote())
+	}
+	if *leaderLease {
+		ropts = append(ropts, raft.LeaderLease())
+	}
+	st := store.NewWithConfig(store.Config{
+		Quota:            store.Quota{Keys: *quotaKeys, Bytes: *quotaBytes},
+		EventHistorySize: *historySize,
+		MaxKeyBytes:      *maxKeyBytes,
+		MaxKeyDepth:      *maxKeyDepth,
+	})
+
+	if *initialSnap != "" {
+		if wal.Exist(waldir) {
+			logger.Warnf("etcd: ignoring initial-snapshot, as %s holds the data of the member already", *dir)
+		} else {
+			if len(*cluster) != 1 {
+				logger.Fatalf("etcd: initial-snapshot starts a one-member cluster, but bootstrap-config lists %d members", len(*cluster))
+			}
+			if err := restoreDataDir(*initialSnap, self.ID, snapshotter, snapdir, waldir); err != nil {
+				logger.Fatalf("etcd: cannot restore from %s: %v", *initialSnap, err)
+			}
+			logger.Infof("etcd: restored the store from %s", *initialSnap)
+		}
+	}
 
 	if !wal.Exist(waldir) {
-		w, err = wal.Create(waldir)
+		if *forceNew {
+			logger.Fatalf("etcd: force-new-cluster needs the data of the member, but %s holds no WAL", *dir)
+		}
+		// wal.Create makes a private directory if there is none
+		if err := fileutil.CreateDirAll(waldir, os.FileMode(dataDirMode)); err != nil {
+			logger.Fatalf("etcd: cannot create wal directory: %v", err)
+		}
+		w, err = wal.CreateWithSync(waldir, self.ID, walSync)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
+		}
+		sopts := ropts
+		if joining {
+			logger.Infof("etcd: joining the existing cluster as member %x, waiting for its leader", self.ID)
+			sopts = append(sopts, raft.Join())
 		}
-		n = raft.StartNode(self.ID, cluster.IDs(), 10, 1)
+		n = raft.StartNode(self.ID, cluster.IDs(), electionTicks, heartbeatTicks, sopts...)
 	} else {
 		var index int64
-		snapshot, err := snapshotter.Load()
+		snapshot, rc, err := snapshotter.LoadReader()
 		if err != nil && err != snap.ErrNoSnapshot {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
 		if snapshot != nil {
-			log.Printf("etcd: restart from snapshot at index %d", snapshot.Index)
-			st.Recovery(snapshot.Data)
+			logger.Infof("etcd: restart from snapshot at index %d", snapshot.Index)
+			// the store is rebuilt as the data is read from the file. raft
+			// is handed the snapshot without its data, which is read from
+			// the file again when it is sent to a follower too far behind.
+			if err := st.RecoveryFrom(rc); err != nil {
+				logger.Fatalf("etcd: error recovering the store from the snapshot: %v", err)
+			}
+			rc.Close()
 			index = snapshot.Index
+			snapIndex, snapTerm = snapshot.Index, snapshot.Term
 		}
 
+		if *repairWAL {
+			if err := wal.Repair(waldir); err != nil {
+				logger.Fatal(err)
+			}
+		}
 		// restart a node from previous wal
-		if w, err = wal.OpenAtIndex(waldir, index); err != nil {
-			log.Fatal(err)
+		if w, err = wal.OpenAtIndexWithSync(waldir, index, walSync); err != nil {
+			logger.Fatal(err)
 		}
 		wid, st, ents, err := w.ReadAll()
+		if _, ok := err.(*wal.CRCMismatchError); ok {
+			logger.Fatalf("etcd: %v; restart with -repair-wal to truncate the WAL before it", err)
+		}
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
-		// TODO(xiangli): save/recovery nodeID?
-		if wid != 0 {
-			log.Fatalf("unexpected nodeid %d: nodeid should always be zero until we save nodeid into wal", wid)
+		switch wid {
+		case 0:
+			// written before the WAL recorded the id of its member
+			logger.Infof("etcd: recording member id %x in the WAL", self.ID)
+			if err := w.SaveInfo(&raftpb.Info{ID: self.ID}); err != nil {
+				logger.Fatal(err)
+			}
+			wid = self.ID
+		case self.ID:
+		default:
+			logger.Fatalf("etcd: member id mismatch: the data directory belongs to member %x, but -name=%q is member %x", wid, *name, self.ID)
 		}
-		n = raft.RestartNode(self.ID, cluster.IDs(), 10, 1, snapshot, st, ents)
+		if err := etcdserver.CheckWAL(snapshot, st, ents); err != nil {
+			logger.Fatalf("etcd: %v; the snapshots in %s and the WAL in %s do not go together", err, snapdir, waldir)
+		}
+		peers := cluster.IDs()
+		if *forceNew {
+			logger.Warnf("etcd: FORCING A NEW CLUSTER: member %x is restarted as the only member of the cluster, all the others are removed", wid)
+			var appended []raftpb.Entry
+			st, ents, appended = etcdserver.ForceNewCluster(wid, peers, snapshot, st, ents)
+			w.Save(st, appended)
+			peers = []int64{wid}
+		}
+		replayIndex = st.Commit
+		n = raft.RestartNode(wid, peers, electionTicks, heartbeatTicks, snapshot, st, ents, ropts...)
 	}
+	w.SetCommitMode(walCommit)
 
-	pt, err := transport.NewTransport(peerTLSInfo)
+	// a message that takes longer than a few heartbeats to reach a peer is
+	// of no use to raft, and must not hold back the ones to other peers
+	peerTimeout := 5 * time.Duration(*heartbeatMs) * time.Millisecond
+	pt, err := transport.NewTimeoutTransport(peerTLSInfo, peerTimeout)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	cls := etcdserver.NewClusterStore(st, *cluster)
+	stats := etcdserver.NewPeerStats()
+	send, removePeer, stopSend := etcdserver.Sender(pt, cls, stats, peerTimeout, snapshotter.OpenData)
 
 	acurls, err := pkg.URLsFromFlags(flag.CommandLine, "advertise-client-urls", "addr", clientTLSInfo)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err)
+	}
+	if err := pkg.CheckAdvertiseURLs(acurls); err != nil {
+		logger.Fatalf("etcd: advertise-client-urls: %v", err)
 	}
 
 	s := &etcdserver.EtcdServer{
+		ID:         self.ID,
 		Name:       *name,
 		ClientURLs: acurls,
+		Version:    version,
 		Store:      st,
 		Node:       n,
 		Storage: struct {
 			*wal.WAL
 			*snap.Snapshotter
 		}{w, snapshotter},
-		Send:         etcdserver.Sender(pt, cls),
-		Ticker:       time.Tick(100 * time.Millisecond),
-		SyncTicker:   time.Tick(500 * time.Millisecond),
+		Send:         send,
+		RemovePeer:   removePeer,
+		Ticker:       time.Tick(tickInterval),
+		SyncTicker:   timeutil.JitterTick(500*time.Millisecond, *syncJitter),
 		SnapCount:    *snapCount,
+		SnapBytes:    *snapBytes,
+		SnapDir:      snapdir,
+		WALDir:       waldir,
+		MaxSnapFiles: *maxSnaps,
 		ClusterStore: cls,
+		PeerStats:    stats,
+
+		SnapCatchUpEntries:   *snapCatchUp,
+		MaxInflightProposals: *maxInflight,
+		ApplySlowThreshold:   *applySlow,
+		ReplayIndex:          replayIndex,
+		SnapshotIndex:        snapIndex,
+		SnapshotTerm:         snapTerm,
+		LeaderChangeWebhook:  *leaderHook,
 	}
 	s.Start()
 
-	ch := &pkg.CORSHandler{
-		Handler: etcdhttp.NewClientHandler(s, cls, *timeout),
-		Info:    cors,
+	var kh http.Handler = etcdhttp.NewClientHandler(s, cls, *timeout, writeMode, *maxRequest)
+	if *authEnabled {
+		kh = etcdhttp.NewAuthHandler(kh, etcdserver.NewUserStore(s.Store), clientTLSInfo.ClientCertAuth)
+		// the bodies of the transactions are read to check them first
+		kh = etcdhttp.NewLimitHandler(kh, *maxRequest)
 	}
-	ph := etcdhttp.NewPeerHandler(s)
-
-	lpurls, err := pkg.URLsFromFlags(flag.CommandLine, "listen-peer-urls", "peer-bind-addr", peerTLSInfo)
-	if err != nil {
-		log.Fatal(err.Error())
+	if *rateLimit > 0 {
+		kh = etcdhttp.NewRateLimitHandler(kh, rateLimitBy, *rateLimit, *rateBurst)
+	}
+	if *accessLog {
+		kh = etcdhttp.NewAccessLogHandler(kh)
 	}
+	ch := newCORSHandler(kh)
+	ph := etcdhttp.NewPeerHandler(s)
 
+	var pss, css []*http.Server
 	for _, u := range lpurls {
 		l, err := transport.NewListener(u.Host, peerTLSInfo)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
 
 		// Start the peer server in a goroutine
 		urlStr := u.String()
+		srv := transport.NewServer(ph, timeouts)
+		pss = append(pss, srv)
 		go func() {
-			log.Print("Listening for peers on ", urlStr)
-			log.Fatal(http.Serve(l, ph))
+			logger.Infof("Listening for peers on %s", urlStr)
+			serve(srv, l)
 		}()
 	}
 
 	lcurls, err := pkg.URLsFromFlags(flag.CommandLine, "listen-client-urls", "bind-addr", clientTLSInfo)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err)
 	}
 
 	// Start a client server goroutine for each listen address
 	for _, u := range lcurls {
-		l, err := transport.NewListener(u.Host, clientTLSInfo)
+		l, err := transport.NewLimitListener(u.Host, clientTLSInfo, *maxConns)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
 
 		urlStr := u.String()
+		srv := transport.NewServer(ch, timeouts)
+		srv.SetKeepAlivesEnabled(*keepAlive)
+		css = append(css, srv)
 		go func() {
-			log.Print("Listening for client requests on ", urlStr)
-			log.Fatal(http.Serve(l, ch))
+			logger.Infof("Listening for client requests on %s", urlStr)
+			serve(srv, l)
 		}()
 	}
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		// Let in-flight client requests finish before stopping the server,
+		// since they may still be waiting on consensus. Peers keep being
+		// served until then so those requests can commit.
+		err := shutdown(ctx, css)
+		s.Stop()
+		stopSend()
+		for _, srv := range pss {
+			srv.Close()
+		}
+		if walLock != nil {
+			walLock.Unlock()
+		}
+		dirLock.Unlock()
+		return err
+	}
 }
 
 // startProxy launches an HTTP proxy for client communication which proxies to other etcd nodes.
-func startProxy() {
+// It returns a function that gracefully shuts it down again.
+func startProxy() func() error {
+	checkURLSchemes("listen-client-urls")
 	pt, err := transport.NewTransport(clientTLSInfo)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
-	ph, err := proxy.NewHandler(pt, (*cluster).PeerURLs())
+	ph, err := proxy.NewHandler(pt, (*cluster).PeerURLs(), *proxyRefreshInterval, proxyBalance, *proxyTrustXFF)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
+	rp := ph.(proxy.Refresher)
+	onReload = append(onReload, func() {
+		rp.SetRefreshInterval(*proxyRefreshInterval)
+	})
 
-	ph = &pkg.CORSHandler{
-		Handler: ph,
-		Info:    cors,
+	if *proxyCacheTTL > 0 {
+		ph = proxy.NewCacheHandler(ph, *proxyCacheTTL)
 	}
-
 	if string(*proxyFlag) == flagtypes.ProxyValueReadonly {
 		ph = proxy.NewReadonlyHandler(ph)
 	}
+	// preflight requests are answered before being refused as writes
+	ph = newCORSHandler(ph)
 
 	lcurls, err := pkg.URLsFromFlags(flag.CommandLine, "listen-client-urls", "bind-addr", clientTLSInfo)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err)
 	}
+	var css []*http.Server
 	// Start a proxy server goroutine for each listen address
 	for _, u := range lcurls {
-		l, err := transport.NewListener(u.Host, clientTLSInfo)
+		l, err := transport.NewLimitListener(u.Host, clientTLSInfo, *maxConns)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
 
 		host := u.Host
+		srv := transport.NewServer(ph, timeouts)
+		srv.SetKeepAlivesEnabled(*keepAlive)
+		css = append(css, srv)
 		go func() {
-			log.Print("Listening for client requests on ", host)
-			log.Fatal(http.Serve(l, ph))
+			logger.Infof("Listening for client requests on %s", host)
+			serve(srv, l)
 		}()
 	}
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		return shutdown(ctx, css)
+	}
+}
+
+// urlsFlags are the flags setting URLs, with the deprecated flag setting
+// the same as an address, and the TLS configuration serving them.
+var urlsFlags = map[string]struct {
+	addr      string
+	info      *transport.TLSInfo
+	cert, key string
+}{
+	"advertise-peer-urls":   {"peer-addr", &peerTLSInfo, "peer-cert-file", "peer-key-file"},
+	"listen-peer-urls":      {"peer-bind-addr", &peerTLSInfo, "peer-cert-file", "peer-key-file"},
+	"advertise-client-urls": {"addr", &clientTLSInfo, "cert-file", "key-file"},
+	"listen-client-urls":    {"bind-addr", &clientTLSInfo, "cert-file", "key-file"},
+}
+
+// checkURLSchemes fails if the URLs set by one of the given flags do not
+// use https when TLS is configured for them, or http when it is not.
+func checkURLSchemes(names ...string) {
+	for _, name := range names {
+		f := urlsFlags[name]
+		us, err := pkg.URLsFromFlags(flag.CommandLine, name, f.addr, *f.info)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if err := pkg.CheckURLSchemes(us, *f.info, name, f.cert, f.key); err != nil {
+			logger.Fatalf("etcd: %v", err)
+		}
+	}
+}
+
+// serve serves srv on l until srv is shut down.
+func serve(srv *http.Server, l net.Listener) {
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+}
+
+// shutdown stops the given servers from accepting new connections and waits
+// for their in-flight requests to complete. It returns an error if ctx is done
+// before all requests have drained.
+func shutdown(ctx context.Context, srvs []*http.Server) error {
+	var err error
+	for _, srv := range srvs {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// newCORSHandler wraps h to serve CORS requests as configured by the flags,
+// and as they are reloaded.
+func newCORSHandler(h http.Handler) http.Handler {
+	corsHandler := func() http.Handler {
+		// the flag is set again on reload, while being served
+		info := *cors
+		return &pkg.CORSHandler{
+			Handler:     h,
+			Info:        &info,
+			Methods:     splitList(corsMethods),
+			Headers:     splitList(corsHeaders),
+			Credentials: corsCredentials,
+		}
+	}
+	sh := pkg.NewHandlerSwapper(corsHandler())
+	onReload = append(onReload, func() {
+		sh.Swap(corsHandler())
+	})
+	return sh
+}
+
+// reloadConfig reads the config file again, and applies the reloadable flags
+// it changes without dropping any connection. The other flags it changes
+// are ignored until restart.
+func reloadConfig() {
+	if cfgFile == nil {
+		logger.Warnf("etcd: received SIGHUP without config-file, nothing to reload")
+		return
+	}
+	changed, restart, err := cfgFile.Reload(reloadable)
+	if err != nil {
+		logger.Errorf("etcd: cannot reload config file, keeping the current configuration: %v", err)
+		return
+	}
+	for _, name := range restart {
+		logger.Warnf("etcd: %s changed in %s requires restart, ignored", name, *configFile)
+	}
+	if len(changed) == 0 {
+		logger.Infof("etcd: reloaded %s, nothing to apply", *configFile)
+		return
+	}
+	logger.SetLevel(logLevel)
+	for _, f := range onReload {
+		f()
+	}
+	logger.Infof("etcd: reloaded %s, applied %s", *configFile, strings.Join(changed, ", "))
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
 }
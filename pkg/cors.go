@@ -33,7 +33,14 @@ func (ci *CORSInfo) Set(s string) error {
 		if v == "" {
 			continue
 		}
-		if v != "*" {
+		switch {
+		case v == "*":
+		case strings.Contains(v, "*"):
+			_, domain := splitWildcard(v)
+			if !strings.HasPrefix(domain, "*.") || len(domain) == 2 || strings.Contains(domain[1:], "*") {
+				return fmt.Errorf("Invalid CORS origin: %s: only a leading *. is allowed in a wildcard origin", v)
+			}
+		default:
 			if _, err := url.Parse(v); err != nil {
 				return fmt.Errorf("Invalid CORS origin: %s", err)
 			}
@@ -54,33 +61,104 @@ func (ci *CORSInfo) String() string {
 }
 
 // OriginAllowed determines whether the server will allow a given CORS origin.
+// Besides the exact origins and "*", the list may hold wildcard origins like
+// "*.example.com" or "https://*.example.com:4001", which allow the
+// subdomains of example.com, at any depth, with the given scheme if any and
+// the given port.
 func (c CORSInfo) OriginAllowed(origin string) bool {
-	return c["*"] || c[origin]
+	if c["*"] || c[origin] {
+		return true
+	}
+	for v := range c {
+		if v != "*" && strings.Contains(v, "*") && wildcardMatch(v, origin) {
+			return true
+		}
+	}
+	return false
 }
 
+// splitWildcard splits a wildcard origin into its scheme, which may be
+// empty, and its domain.
+func splitWildcard(v string) (scheme, domain string) {
+	if i := strings.Index(v, "://"); i >= 0 {
+		return v[:i], v[i+len("://"):]
+	}
+	return "", v
+}
+
+// wildcardMatch reports whether origin is allowed by the wildcard origin v.
+// The host of origin must end with the domain of v past its "*", so that
+// a label boundary is always matched: *.example.com never allows
+// example.com itself, evilexample.com or example.com.evil.net.
+func wildcardMatch(v, origin string) bool {
+	u, err := url.Parse(origin)
+	// an origin is only a scheme, a host and a port
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil ||
+		u.Opaque != "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	scheme, domain := splitWildcard(v)
+	if scheme != "" && !strings.EqualFold(scheme, u.Scheme) {
+		return false
+	}
+	host, suffix := strings.ToLower(u.Host), strings.ToLower(domain[1:])
+	return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+}
+
+var (
+	DefaultCORSMethods = []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}
+	DefaultCORSHeaders = []string{"accept", "content-type"}
+)
+
 type CORSHandler struct {
 	Handler http.Handler
 	Info    *CORSInfo
+	// Methods and Headers are the methods and request headers allowed in
+	// cross-origin requests. DefaultCORSMethods and DefaultCORSHeaders are
+	// used if they are empty.
+	Methods []string
+	Headers []string
+	// Credentials allows cross-origin requests to carry cookies and HTTP
+	// authentication. Browsers refuse credentialed responses allowing
+	// any origin, so the origin of the request is then always echoed.
+	Credentials bool
 }
 
 // addHeader adds the correct cors headers given an origin
 func (h *CORSHandler) addHeader(w http.ResponseWriter, origin string) {
-	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	methods, headers := h.Methods, h.Headers
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	w.Header().Add("Access-Control-Allow-Methods", strings.Join(methods, ", "))
 	w.Header().Add("Access-Control-Allow-Origin", origin)
-	w.Header().Add("Access-Control-Allow-Headers", "accept, content-type")
+	w.Header().Add("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if h.Credentials {
+		w.Header().Add("Access-Control-Allow-Credentials", "true")
+	}
+	if origin != "*" {
+		// the response depends on the origin of the request
+		w.Header().Add("Vary", "Origin")
+	}
 }
 
 // ServeHTTP adds the correct CORS headers based on the origin and returns immediately
-// with a 200 OK if the method is OPTIONS.
+// with a 200 OK if the method is OPTIONS, so that preflight requests never
+// reach the wrapped handler.
 func (h *CORSHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// It is important to flush before leaving the goroutine.
 	// Or it may miss the latest info written.
 	defer w.(http.Flusher).Flush()
 
 	// Write CORS header.
-	if h.Info.OriginAllowed("*") {
+	origin := req.Header.Get("Origin")
+	switch {
+	case h.Info.OriginAllowed("*") && (!h.Credentials || origin == ""):
 		h.addHeader(w, "*")
-	} else if origin := req.Header.Get("Origin"); h.Info.OriginAllowed(origin) {
+	case origin != "" && h.Info.OriginAllowed(origin):
 		h.addHeader(w, origin)
 	}
 
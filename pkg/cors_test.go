@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSHandlerPreflight(t *testing.T) {
+	info := &CORSInfo{}
+	info.Set("http://example.com")
+	called := false
+	h := &CORSHandler{
+		Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }),
+		Info:    info,
+		Methods: []string{"GET", "PUT"},
+		Headers: []string{"content-type", "x-token"},
+	}
+
+	req, _ := http.NewRequest("OPTIONS", "http://localhost/v2/keys/foo", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if called {
+		t.Errorf("preflight request reached the wrapped handler")
+	}
+	for k, w := range map[string]string{
+		"Access-Control-Allow-Origin":      "http://example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "content-type, x-token",
+		"Access-Control-Allow-Credentials": "",
+		"Vary":                             "Origin",
+	} {
+		if g := rw.Header().Get(k); g != w {
+			t.Errorf("%s = %q, want %q", k, g, w)
+		}
+	}
+}
+
+func TestCORSHandlerCredentials(t *testing.T) {
+	tests := []struct {
+		origins string
+		origin  string
+
+		worigin string
+	}{
+		{"http://example.com", "http://example.com", "http://example.com"},
+		// browsers refuse "*" on credentialed responses
+		{"*", "http://example.com", "http://example.com"},
+		{"http://example.com", "http://evil.com", ""},
+	}
+	for i, tt := range tests {
+		info := &CORSInfo{}
+		info.Set(tt.origins)
+		called := false
+		h := &CORSHandler{
+			Handler:     http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }),
+			Info:        info,
+			Credentials: true,
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost/v2/keys/foo", nil)
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Cookie", "session=1")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if !called {
+			t.Errorf("#%d: request did not reach the wrapped handler", i)
+		}
+		if g := rw.Header().Get("Access-Control-Allow-Origin"); g != tt.worigin {
+			t.Errorf("#%d: Access-Control-Allow-Origin = %q, want %q", i, g, tt.worigin)
+		}
+		wcred := ""
+		if tt.worigin != "" {
+			wcred = "true"
+		}
+		if g := rw.Header().Get("Access-Control-Allow-Credentials"); g != wcred {
+			t.Errorf("#%d: Access-Control-Allow-Credentials = %q, want %q", i, g, wcred)
+		}
+	}
+}
+
+func TestCORSInfoSetWildcard(t *testing.T) {
+	tests := []struct {
+		s    string
+		werr bool
+	}{
+		{"*.example.com", false},
+		{"https://*.example.com", false},
+		{"http://*.example.com:4001", false},
+		{"*", false},
+		{"*.", true},
+		{"*example.com", true},
+		{"http://a.*.example.com", true},
+		{"*.example.*", true},
+	}
+	for i, tt := range tests {
+		info := &CORSInfo{}
+		if err := info.Set(tt.s); (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+	}
+}
+
+func TestCORSInfoOriginAllowedWildcard(t *testing.T) {
+	tests := []struct {
+		origins string
+		origin  string
+
+		w bool
+	}{
+		{"*.example.com", "http://foo.example.com", true},
+		{"*.example.com", "https://foo.example.com", true},
+		{"*.example.com", "http://foo.bar.example.com", true},
+		{"*.example.com", "http://FOO.Example.COM", true},
+		{"https://*.example.com", "https://foo.example.com", true},
+		{"https://*.example.com", "http://foo.example.com", false},
+		{"*.example.com:4001", "http://foo.example.com:4001", true},
+		{"*.example.com:4001", "http://foo.example.com", false},
+		{"*.example.com", "http://foo.example.com:4001", false},
+		// the wildcard needs a subdomain
+		{"*.example.com", "http://example.com", false},
+		// hosts merely containing or ending like the domain
+		{"*.example.com", "http://evilexample.com", false},
+		{"*.example.com", "http://evil.com.attacker.net", false},
+		{"*.example.com", "http://foo.example.com.attacker.net", false},
+		{"*.example.com", "http://foo.example.com@attacker.net", false},
+		{"*.example.com", "http://attacker.net/.example.com", false},
+		{"*.example.com", "http://attacker.net?.example.com", false},
+		{"*.example.com", "foo.example.com", false},
+		// exact origins are still matched along wildcards
+		{"*.example.com,http://example.org", "http://example.org", true},
+		{"*.example.com,http://example.org", "http://foo.example.org", false},
+	}
+	for i, tt := range tests {
+		info := &CORSInfo{}
+		if err := info.Set(tt.origins); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if g := info.OriginAllowed(tt.origin); g != tt.w {
+			t.Errorf("#%d: OriginAllowed(%q) = %v, want %v", i, tt.origin, g, tt.w)
+		}
+	}
+}
+
+func TestCORSHandlerWildcard(t *testing.T) {
+	info := &CORSInfo{}
+	info.Set("*.example.com")
+	h := &CORSHandler{
+		Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		Info:    info,
+	}
+	tests := []struct {
+		origin  string
+		worigin string
+	}{
+		{"http://foo.example.com", "http://foo.example.com"},
+		{"http://evil.com.attacker.net", ""},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/v2/keys/foo", nil)
+		req.Header.Set("Origin", tt.origin)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if g := rw.Header().Get("Access-Control-Allow-Origin"); g != tt.worigin {
+			t.Errorf("#%d: Access-Control-Allow-Origin = %q, want %q", i, g, tt.worigin)
+		}
+	}
+}
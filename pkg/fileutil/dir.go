@@ -0,0 +1,25 @@
+package fileutil
+
+import (
+	"os"
+)
+
+// PrivateDirMode is the mode of a directory only its owner can list, and
+// make or remove files in.
+const PrivateDirMode = 0700
+
+// CreateDirAll creates the directory dir, along with any parents it needs,
+// like os.MkdirAll. Unlike os.MkdirAll, the mode of dir is set to mode
+// whatever the umask. The mode of a directory that already exists is left
+// as it is, and so are the modes of the parents.
+func CreateDirAll(dir string, mode os.FileMode) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
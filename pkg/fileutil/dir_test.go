@@ -0,0 +1,57 @@
+package fileutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+func TestCreateDirAll(t *testing.T) {
+	tmp, err := ioutil.TempDir(os.TempDir(), "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// the bits cleared by the usual umask of 022 are set too
+	for i, mode := range []os.FileMode{PrivateDirMode, 0750, 0777} {
+		dir := path.Join(tmp, fmt.Sprint(i), "data")
+		if err := CreateDirAll(dir, mode); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir() || fi.Mode().Perm() != mode {
+			t.Errorf("#%d: mode = %v, want directory %v", i, fi.Mode(), mode)
+		}
+	}
+
+	// the mode of an existing directory is left as it is
+	dir := path.Join(tmp, "0", "data")
+	if err := CreateDirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != PrivateDirMode {
+		t.Errorf("mode = %v, %v, want %v", fi.Mode(), err, os.FileMode(PrivateDirMode))
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	tmp, err := ioutil.TempDir(os.TempDir(), "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := SyncDir(tmp); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err := SyncDir(path.Join(tmp, "missing")); err == nil && runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		t.Errorf("err = nil, want an error for a missing directory")
+	}
+}
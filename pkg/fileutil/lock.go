@@ -0,0 +1,35 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by TryLockDir when the directory is already locked.
+var ErrLocked = errors.New("fileutil: directory already locked")
+
+// Lock is an exclusive lock on a directory, held by at most one process at
+// a time. The operating system releases it when the process holding it
+// dies, so a crash leaves no stale lock behind.
+type Lock struct {
+	f *os.File
+}
+
+// TryLockDir locks the directory dir. It returns ErrLocked rather than
+// waiting if another process holds the lock already.
+func TryLockDir(dir string) (*Lock, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
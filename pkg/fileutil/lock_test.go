@@ -0,0 +1,38 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTryLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := TryLockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock locks are held by open files, so a second open in the same
+	// process conflicts like one in another process would
+	if _, err := TryLockDir(dir); err != ErrLocked {
+		t.Errorf("err = %v, want %v", err, ErrLocked)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = TryLockDir(dir)
+	if err != nil {
+		t.Errorf("err = %v after unlock, want nil", err)
+	} else {
+		l.Unlock()
+	}
+
+	if _, err := TryLockDir(dir + "/missing"); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
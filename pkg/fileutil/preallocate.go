@@ -0,0 +1,15 @@
+package fileutil
+
+import "os"
+
+// preallocateTruncate extends f to size bytes, unless it is larger already.
+func preallocateTruncate(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
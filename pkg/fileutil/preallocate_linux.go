@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package fileutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves the disk blocks for the first size bytes of f, which
+// read as zeros past its current end. The file is extended as with Truncate
+// where the file system cannot reserve them.
+func Preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.ENOTSUP || err == syscall.EINTR {
+		return preallocateTruncate(f, size)
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fileutil
+
+import "os"
+
+// Preallocate extends f to size bytes, which read as zeros past its current
+// end. No disk blocks are reserved on these systems.
+func Preallocate(f *os.File, size int64) error {
+	return preallocateTruncate(f, size)
+}
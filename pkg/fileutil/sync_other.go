@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fileutil
+
+import "os"
+
+// Fdatasync is the same as f.Sync, as fdatasync is missing or not reliable
+// on these systems.
+func Fdatasync(f *os.File) error {
+	return f.Sync()
+}
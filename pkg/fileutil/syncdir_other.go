@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package fileutil
+
+// SyncDir does nothing, as a directory cannot be synced on these systems.
+func SyncDir(dir string) error {
+	return nil
+}
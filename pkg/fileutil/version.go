@@ -0,0 +1,67 @@
+package fileutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// VersionFileName is the name of the file holding the format version of a
+// data directory.
+const VersionFileName = "version"
+
+// VersionTooNewError is returned by CheckVersion when a directory was written
+// in a format newer than the one supported.
+type VersionTooNewError struct {
+	Dir       string
+	Version   int
+	Supported int
+}
+
+func (e *VersionTooNewError) Error() string {
+	return fmt.Sprintf("fileutil: the format version of %s is %d, newer than the supported version %d", e.Dir, e.Version, e.Supported)
+}
+
+// ReadVersion reads the format version of the directory dir. It returns 0 if
+// dir has no version file, which is the case of directories written before
+// the version file was introduced, and of newly created ones.
+func ReadVersion(dir string) (int, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, VersionFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("fileutil: malformed version file in %s: %v", dir, err)
+	}
+	return v, nil
+}
+
+// WriteVersion writes v as the format version of the directory dir. The
+// version file is replaced atomically, so it is never seen half written.
+func WriteVersion(dir string, v int) error {
+	tmp := path.Join(dir, VersionFileName+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(v)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, VersionFileName))
+}
+
+// CheckVersion reads the format version of the directory dir, and returns a
+// *VersionTooNewError if it is newer than supported.
+func CheckVersion(dir string, supported int) (int, error) {
+	v, err := ReadVersion(dir)
+	if err != nil {
+		return 0, err
+	}
+	if v > supported {
+		return v, &VersionTooNewError{Dir: dir, Version: v, Supported: supported}
+	}
+	return v, nil
+}
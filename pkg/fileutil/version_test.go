@@ -0,0 +1,91 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		content string // "" means no version file
+
+		wv   int
+		werr bool
+	}{
+		// legacy or new directory
+		{"", 0, false},
+		{"1\n", 1, false},
+		{"2", 2, false},
+		{"3\n", 3, true},
+		{"one", 0, true},
+	}
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir(os.TempDir(), "fileutil")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.content != "" {
+			if err := ioutil.WriteFile(path.Join(dir, VersionFileName), []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, err := CheckVersion(dir, 2)
+		if v != tt.wv {
+			t.Errorf("#%d: version = %d, want %d", i, v, tt.wv)
+		}
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckVersionTooNew(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := WriteVersion(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CheckVersion(dir, 4)
+	verr, ok := err.(*VersionTooNewError)
+	if !ok {
+		t.Fatalf("err = %v, want *VersionTooNewError", err)
+	}
+	w := &VersionTooNewError{Dir: dir, Version: 5, Supported: 4}
+	if *verr != *w {
+		t.Errorf("err = %+v, want %+v", verr, w)
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, w := range []int{1, 2} {
+		if err := WriteVersion(dir, w); err != nil {
+			t.Fatal(err)
+		}
+		v, err := ReadVersion(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != w {
+			t.Errorf("version = %d, want %d", v, w)
+		}
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("len(files) = %d, want 1", len(names))
+	}
+}
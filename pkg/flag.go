@@ -4,11 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/coreos/etcd/pkg/flags"
+	"github.com/coreos/etcd/pkg/logger"
 	"github.com/coreos/etcd/pkg/transport"
 )
 
@@ -48,25 +50,43 @@ func UsageWithIgnoredFlagsFunc(fs *flag.FlagSet, ignore []string) func() {
 	}
 }
 
-// SetFlagsFromEnv parses all registered flags in the given flagset,
-// and if they are not already set it attempts to set their values from
-// environment variables. Environment variables take the name of the flag but
-// are UPPERCASE, have the prefix "ETCD_", and any dashes are replaced by
+const envPrefix = "ETCD_"
+
+// SetFlagsFromEnv sets the flags of the given flagset from the non-empty
+// environment variables with the prefix "ETCD_". Environment variables take
+// the name of the flag but are UPPERCASE, and any dashes are replaced by
 // underscores - for example: some-flag => ETCD_SOME_FLAG
-func SetFlagsFromEnv(fs *flag.FlagSet) {
+//
+// Flags already set on the command line take precedence, with a warning.
+// An error is returned if a variable names no flag of fs, or holds a value
+// invalid for its flag.
+func SetFlagsFromEnv(fs *flag.FlagSet) error {
 	alreadySet := make(map[string]bool)
 	fs.Visit(func(f *flag.Flag) {
 		alreadySet[f.Name] = true
 	})
-	fs.VisitAll(func(f *flag.Flag) {
-		if !alreadySet[f.Name] {
-			key := "ETCD_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
-			val := os.Getenv(key)
-			if val != "" {
-				fs.Set(f.Name, val)
-			}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
 		}
-	})
+		i := strings.Index(kv, "=")
+		key, val := kv[:i], kv[i+1:]
+		if val == "" {
+			continue
+		}
+		name := strings.ToLower(strings.Replace(key[len(envPrefix):], "_", "-", -1))
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag -%s set by the environment variable %s", name, key)
+		}
+		if alreadySet[name] {
+			logger.Warnf("pkg: ignoring %s, flag -%s is set on the command line", key, name)
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			return fmt.Errorf("invalid value %q for flag -%s set by %s: %v", val, name, key, err)
+		}
+	}
+	return nil
 }
 
 // URLsFromFlags decides what URLs should be using two different flags
@@ -103,3 +123,37 @@ func URLsFromFlags(fs *flag.FlagSet, urlsFlagName string, addrFlagName string, t
 
 	return []url.URL(*fs.Lookup(urlsFlagName).Value.(*flags.URLsValue)), nil
 }
+
+// CheckAdvertiseURLs returns an error if one of us, the URLs a member
+// advertises, has an unspecified host such as 0.0.0.0. Such a host is only
+// meaningful to listen on: the clients and the other members told to use
+// it cannot reach the member.
+func CheckAdvertiseURLs(us []url.URL) error {
+	for _, u := range us {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			return fmt.Errorf("cannot advertise %s, as its host %s is only meaningful to listen on", u.String(), host)
+		}
+	}
+	return nil
+}
+
+// CheckURLSchemes returns an error if one of us, the URLs set by the flag
+// urlsFlag, does not use the scheme tlsInfo serves: https if its files are
+// set by certFlag and keyFlag, and http otherwise. A client or member told
+// the wrong scheme fails to connect with obscure errors, far from the
+// misconfiguration.
+func CheckURLSchemes(us []url.URL, tlsInfo transport.TLSInfo, urlsFlag, certFlag, keyFlag string) error {
+	for _, u := range us {
+		switch {
+		case !tlsInfo.Empty() && u.Scheme != "https":
+			return fmt.Errorf("-%s %s uses %s, but TLS is configured by -%s and -%s: use https", urlsFlag, u.String(), u.Scheme, certFlag, keyFlag)
+		case tlsInfo.Empty() && u.Scheme != "http":
+			return fmt.Errorf("-%s %s uses %s, but -%s and -%s are not set: use http, or set them", urlsFlag, u.String(), u.Scheme, certFlag, keyFlag)
+		}
+	}
+	return nil
+}
@@ -16,11 +16,13 @@ func TestSetFlagsFromEnv(t *testing.T) {
 	fs.String("a", "", "")
 	fs.String("b", "", "")
 	fs.String("c", "", "")
+	fs.String("d-e", "", "")
 	fs.Parse([]string{})
 
 	os.Clearenv()
 	// flags should be settable using env vars
 	os.Setenv("ETCD_A", "foo")
+	os.Setenv("ETCD_D_E", "baz")
 	// and command-line flags
 	if err := fs.Set("b", "bar"); err != nil {
 		t.Fatal(err)
@@ -43,11 +45,14 @@ func TestSetFlagsFromEnv(t *testing.T) {
 	}
 
 	// now read the env and verify flags were updated as expected
-	SetFlagsFromEnv(fs)
+	if err := SetFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
 	for f, want := range map[string]string{
-		"a": "foo",
-		"b": "bar",
-		"c": "quack",
+		"a":   "foo",
+		"b":   "bar",
+		"c":   "quack",
+		"d-e": "baz",
 	} {
 		if got := fs.Lookup(f).Value.String(); got != want {
 			t.Errorf("flag %q=%q, want %q", f, got, want)
@@ -55,6 +60,30 @@ func TestSetFlagsFromEnv(t *testing.T) {
 	}
 }
 
+func TestSetFlagsFromEnvBad(t *testing.T) {
+	tests := []struct {
+		key, val string
+	}{
+		// no flag is named "d"
+		{"ETCD_D", "foo"},
+		// the flag is named "a-b"
+		{"ETCD_A_B_", "foo"},
+		{"ETCD_N", "NaN"},
+	}
+	for i, tt := range tests {
+		fs := flag.NewFlagSet("testing", flag.ExitOnError)
+		fs.String("a-b", "", "")
+		fs.Int("n", 0, "")
+		fs.Parse([]string{})
+
+		os.Clearenv()
+		os.Setenv(tt.key, tt.val)
+		if err := SetFlagsFromEnv(fs); err == nil {
+			t.Errorf("#%d: err = nil, want not nil", i)
+		}
+	}
+}
+
 func TestURLsFromFlags(t *testing.T) {
 	tests := []struct {
 		args     []string
@@ -93,6 +122,16 @@ func TestURLsFromFlags(t *testing.T) {
 			wantFail: false,
 		},
 
+		// an IPv6 -addr should stay bracketed
+		{
+			args:    []string{"-addr=[2001:db8::1]:1024"},
+			tlsInfo: transport.TLSInfo{},
+			wantURLs: []url.URL{
+				url.URL{Scheme: "http", Host: "[2001:db8::1]:1024"},
+			},
+			wantFail: false,
+		},
+
 		// scheme prepended to -addr should be https if TLSInfo non-empty
 		{
 			args: []string{"-addr=192.0.2.3:1024"},
@@ -136,3 +175,56 @@ func TestURLsFromFlags(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckAdvertiseURLs(t *testing.T) {
+	tests := []struct {
+		us   []url.URL
+		werr bool
+	}{
+		{[]url.URL{{Scheme: "http", Host: "10.0.0.1:2379"}}, false},
+		{[]url.URL{{Scheme: "http", Host: "example.com:2379"}, {Scheme: "https", Host: "[2001:db8::1]:2379"}}, false},
+		{[]url.URL{{Scheme: "http", Host: "localhost"}}, false},
+		{nil, false},
+
+		{[]url.URL{{Scheme: "http", Host: "0.0.0.0:2379"}}, true},
+		{[]url.URL{{Scheme: "http", Host: "10.0.0.1:2379"}, {Scheme: "http", Host: "[::]:2379"}}, true},
+		{[]url.URL{{Scheme: "http", Host: "0.0.0.0"}}, true},
+	}
+	for i, tt := range tests {
+		if err := CheckAdvertiseURLs(tt.us); (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+	}
+}
+
+func TestCheckURLSchemes(t *testing.T) {
+	tls := transport.TLSInfo{CertFile: "/tmp/cert.pem", KeyFile: "/tmp/key.pem"}
+	tests := []struct {
+		us   []url.URL
+		info transport.TLSInfo
+		werr string
+	}{
+		{[]url.URL{{Scheme: "http", Host: "10.0.0.1:7001"}}, transport.TLSInfo{}, ""},
+		{[]url.URL{{Scheme: "https", Host: "10.0.0.1:7001"}, {Scheme: "https", Host: "10.0.0.2:7001"}}, tls, ""},
+		{nil, tls, ""},
+
+		// TLS without https
+		{[]url.URL{{Scheme: "http", Host: "10.0.0.1:7001"}}, tls, "-advertise-peer-urls http://10.0.0.1:7001 uses http, but TLS is configured by -peer-cert-file and -peer-key-file: use https"},
+		{[]url.URL{{Scheme: "https", Host: "10.0.0.1:7001"}, {Scheme: "http", Host: "10.0.0.2:7001"}}, tls, "-advertise-peer-urls http://10.0.0.2:7001 uses http, but TLS is configured by -peer-cert-file and -peer-key-file: use https"},
+		// only one of the files set still configures TLS
+		{[]url.URL{{Scheme: "http", Host: "10.0.0.1:7001"}}, transport.TLSInfo{KeyFile: "/tmp/key.pem"}, "-advertise-peer-urls http://10.0.0.1:7001 uses http, but TLS is configured by -peer-cert-file and -peer-key-file: use https"},
+		// https without TLS
+		{[]url.URL{{Scheme: "https", Host: "10.0.0.1:7001"}}, transport.TLSInfo{}, "-advertise-peer-urls https://10.0.0.1:7001 uses https, but -peer-cert-file and -peer-key-file are not set: use http, or set them"},
+		// neither
+		{[]url.URL{{Scheme: "unix", Host: "10.0.0.1:7001"}}, transport.TLSInfo{}, "-advertise-peer-urls unix://10.0.0.1:7001 uses unix, but -peer-cert-file and -peer-key-file are not set: use http, or set them"},
+	}
+	for i, tt := range tests {
+		err := CheckURLSchemes(tt.us, tt.info, "advertise-peer-urls", "peer-cert-file", "peer-key-file")
+		switch {
+		case tt.werr == "" && err != nil:
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		case tt.werr != "" && (err == nil || err.Error() != tt.werr):
+			t.Errorf("#%d: err = %v, want %q", i, err, tt.werr)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package flags
+
+import (
+	"errors"
+)
+
+const (
+	ClusterStateValueNew      = "new"
+	ClusterStateValueExisting = "existing"
+)
+
+var (
+	ClusterStateValues = []string{
+		ClusterStateValueNew,
+		ClusterStateValueExisting,
+	}
+)
+
+// ClusterState tells whether a member starting without data forms a new
+// cluster, or joins an existing one. It implements the flag.Value
+// interface.
+type ClusterState string
+
+// Set verifies the argument to be a valid member of ClusterStateValues
+// before setting the underlying flag value.
+func (cs *ClusterState) Set(s string) error {
+	for _, v := range ClusterStateValues {
+		if s == v {
+			*cs = ClusterState(s)
+			return nil
+		}
+	}
+
+	return errors.New("invalid value")
+}
+
+func (cs *ClusterState) String() string {
+	return string(*cs)
+}
@@ -0,0 +1,31 @@
+package flags
+
+import (
+	"testing"
+)
+
+func TestClusterStateSet(t *testing.T) {
+	tests := []struct {
+		val  string
+		pass bool
+	}{
+		// known values
+		{"new", true},
+		{"existing", true},
+
+		// unrecognized values
+		{"foo", false},
+		{"", false},
+	}
+
+	for i, tt := range tests {
+		cs := new(ClusterState)
+		err := cs.Set(tt.val)
+		if tt.pass != (err == nil) {
+			t.Errorf("#%d: want pass=%t, but got err=%v", i, tt.pass, err)
+		}
+		if tt.pass && cs.String() != tt.val {
+			t.Errorf("#%d: string = %s, want %s", i, cs.String(), tt.val)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package flags
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configEntry is a flag set by a config file, with the line setting it.
+type configEntry struct {
+	name  string
+	value string
+	line  int
+}
+
+// SetFlagsFromConfigFile sets the flags of fs from the YAML file at path,
+// whose keys are flag names. Flags already set, on the command line or
+// from the environment, take precedence over the file.
+//
+// The file is a mapping of flag names to scalars, or to lists of scalars,
+// which are joined with commas as for the URL list flags:
+//
+//	name: infra0
+//	data-dir: "/var/lib/etcd"
+//	listen-client-urls:
+//	  - http://10.0.1.10:2379
+//	  - http://127.0.0.1:2379
+//
+// An error is returned for a key that is not a flag of fs, listing the
+// valid ones.
+func SetFlagsFromConfigFile(fs *flag.FlagSet, path string) error {
+	_, err := LoadConfigFile(fs, path)
+	return err
+}
+
+// A ConfigFile is a config file the flags of a flag set were set from,
+// which can be read again to change the flags that may change while
+// running.
+type ConfigFile struct {
+	fs   *flag.FlagSet
+	path string
+	// alreadySet are the flags set before the file was loaded, which it
+	// never changes
+	alreadySet map[string]bool
+	// ents are the flags the file set when last read
+	ents map[string]configEntry
+}
+
+// LoadConfigFile sets the flags of fs from the file at path, like
+// SetFlagsFromConfigFile, and returns it to be reloaded later.
+func LoadConfigFile(fs *flag.FlagSet, path string) (*ConfigFile, error) {
+	c := &ConfigFile{fs: fs, path: path, alreadySet: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) {
+		c.alreadySet[f.Name] = true
+	})
+	ents, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range flagNames(fs) {
+		e, ok := ents[name]
+		if !ok || c.alreadySet[name] {
+			continue
+		}
+		if err := fs.Set(name, e.value); err != nil {
+			return nil, c.invalid(e, err)
+		}
+	}
+	c.ents = ents
+	return c, nil
+}
+
+// Reload reads the file again, and sets the flags named in reloadable to
+// the values it now gives them. A reloadable flag the file no longer sets
+// goes back to its default. It returns the names of the flags it changed,
+// and of the other ones given a new value in the file, which only take it
+// on restart and are left as they are. If the file is invalid, no flag is
+// changed.
+func (c *ConfigFile) Reload(reloadable []string) (changed, restart []string, err error) {
+	ents, err := c.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	canReload := make(map[string]bool)
+	for _, name := range reloadable {
+		canReload[name] = true
+	}
+
+	// the value of every flag changed, to undo the changes if a later
+	// value is invalid
+	undo := make(map[string]string)
+	for _, name := range flagNames(c.fs) {
+		e, ok := ents[name]
+		old, wasSet := c.ents[name]
+		if c.alreadySet[name] || ok == wasSet && e.value == old.value {
+			continue
+		}
+		if !canReload[name] {
+			restart = append(restart, name)
+			continue
+		}
+		f := c.fs.Lookup(name)
+		if !ok {
+			e = configEntry{name: name, value: f.DefValue}
+		}
+		undo[name] = f.Value.String()
+		if err := f.Value.Set(e.value); err != nil {
+			for name, v := range undo {
+				c.fs.Lookup(name).Value.Set(v)
+			}
+			return nil, nil, c.invalid(e, err)
+		}
+		changed = append(changed, name)
+	}
+	// the flags needing a restart are not reported again on the next reload
+	c.ents = ents
+	return changed, restart, nil
+}
+
+// read parses the file and checks that its keys are flags, returning the
+// values it sets them to.
+func (c *ConfigFile) read() (map[string]configEntry, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ents, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.path, err)
+	}
+	m := make(map[string]configEntry)
+	for _, e := range ents {
+		if c.fs.Lookup(e.name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q, valid ones are: %s", c.path, e.line, e.name, strings.Join(flagNames(c.fs), ", "))
+		}
+		m[e.name] = e
+	}
+	return m, nil
+}
+
+// invalid returns the error of setting the flag of e. An entry without a
+// line is a flag going back to its default.
+func (c *ConfigFile) invalid(e configEntry, err error) error {
+	if e.line == 0 {
+		return fmt.Errorf("%s: invalid default %q for flag -%s: %v", c.path, e.value, e.name, err)
+	}
+	return fmt.Errorf("%s:%d: invalid value %q for flag -%s: %v", c.path, e.line, e.value, e.name, err)
+}
+
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// parseConfig parses the subset of YAML a config file is written in: a
+// mapping of keys to scalars, to flow lists like [a, b], or to block lists.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var ents []configEntry
+	seen := make(map[string]bool)
+	// list is the entry whose block list is being read, if any
+	var list *configEntry
+	var items []string
+	endList := func() {
+		if list != nil {
+			list.value = strings.Join(items, ",")
+			ents = append(ents, *list)
+			list, items = nil, nil
+		}
+	}
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := stripComment(sc.Text())
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if list == nil {
+				return nil, fmt.Errorf("line %d: list item outside of a list", n)
+			}
+			v, err := unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			items = append(items, v)
+			continue
+		}
+		endList()
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: want \"key: value\"", n)
+		}
+		k, raw := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if seen[k] {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n, k)
+		}
+		seen[k] = true
+		e := configEntry{name: k, line: n}
+		switch {
+		case raw == "":
+			list = &e
+			continue
+		case strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]"):
+			var vs []string
+			for _, s := range strings.Split(raw[1:len(raw)-1], ",") {
+				v, err := unquote(strings.TrimSpace(s))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+				if v != "" {
+					vs = append(vs, v)
+				}
+			}
+			e.value = strings.Join(vs, ",")
+		default:
+			v, err := unquote(raw)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			e.value = v
+		}
+		ents = append(ents, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	endList()
+	return ents, nil
+}
+
+// stripComment removes the comment at the end of line, if any. A comment
+// starts with a '#' that is outside of quotes and at the start of the line
+// or after a space.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated string %s", s)
+	}
+	return s, nil
+}
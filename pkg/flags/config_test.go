@@ -0,0 +1,165 @@
+package flags
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	f, err := ioutil.TempFile("", "etcd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestSetFlagsFromConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+# the command line wins
+name: from-file
+data-dir: "/var/lib/etcd"
+listen-client-urls:
+  - http://10.0.1.10:2379
+  - http://127.0.0.1:2379
+`)
+	defer os.Remove(path)
+
+	fs := flag.NewFlagSet("testing", flag.ExitOnError)
+	name := fs.String("name", "default", "")
+	dir := fs.String("data-dir", "", "")
+	lcurls := NewURLsValue("http://localhost:2379")
+	fs.Var(lcurls, "listen-client-urls", "")
+	fs.Parse([]string{"-name=from-flag"})
+
+	if err := SetFlagsFromConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *name != "from-flag" {
+		t.Errorf("name = %q, want %q", *name, "from-flag")
+	}
+	if *dir != "/var/lib/etcd" {
+		t.Errorf("data-dir = %q, want %q", *dir, "/var/lib/etcd")
+	}
+	if g, w := lcurls.String(), "http://10.0.1.10:2379,http://127.0.0.1:2379"; g != w {
+		t.Errorf("listen-client-urls = %q, want %q", g, w)
+	}
+}
+
+func TestSetFlagsFromConfigFileUnknownKey(t *testing.T) {
+	path := writeConfig(t, "name: foo\ndatadir: /var/lib/etcd\n")
+	defer os.Remove(path)
+
+	fs := flag.NewFlagSet("testing", flag.ExitOnError)
+	fs.String("name", "", "")
+	fs.String("data-dir", "", "")
+	fs.Parse([]string{})
+
+	err := SetFlagsFromConfigFile(fs, path)
+	if err == nil {
+		t.Fatal("err = nil, want unknown flag error")
+	}
+	for _, w := range []string{":2:", `"datadir"`, "data-dir, name"} {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("err = %q, want it to contain %q", err, w)
+		}
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	path := writeConfig(t, "log-level: DEBUG\ncors: http://a.example\ndata-dir: /var/lib/etcd\nname: from-file\n")
+	defer os.Remove(path)
+
+	fs := flag.NewFlagSet("testing", flag.ExitOnError)
+	level := fs.String("log-level", "INFO", "")
+	cors := fs.String("cors", "", "")
+	dir := fs.String("data-dir", "", "")
+	name := fs.String("name", "default", "")
+	interval := fs.Duration("interval", time.Second, "")
+	fs.Parse([]string{"-name=from-flag"})
+
+	c, err := LoadConfigFile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadable := []string{"log-level", "cors", "interval", "name"}
+
+	// log-level goes back to its default, data-dir needs a restart, and
+	// name is kept as set on the command line
+	if err := ioutil.WriteFile(path, []byte("cors: http://b.example\ninterval: 5s\ndata-dir: /var/lib/other\nname: other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, restart, err := c.Reload(reloadable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := []string{"cors", "interval", "log-level"}; !reflect.DeepEqual(changed, w) {
+		t.Errorf("changed = %v, want %v", changed, w)
+	}
+	if w := []string{"data-dir"}; !reflect.DeepEqual(restart, w) {
+		t.Errorf("restart = %v, want %v", restart, w)
+	}
+	if *level != "INFO" || *cors != "http://b.example" || *interval != 5*time.Second {
+		t.Errorf("log-level, cors, interval = %s, %s, %v, want INFO, http://b.example, 5s", *level, *cors, *interval)
+	}
+	if *dir != "/var/lib/etcd" || *name != "from-flag" {
+		t.Errorf("data-dir, name = %s, %s, want /var/lib/etcd, from-flag", *dir, *name)
+	}
+
+	// nothing is reported again for an unchanged file
+	changed, restart, err = c.Reload(reloadable)
+	if err != nil || changed != nil || restart != nil {
+		t.Errorf("reload unchanged = %v, %v, %v, want nothing", changed, restart, err)
+	}
+
+	// an invalid value changes no flag
+	if err := ioutil.WriteFile(path, []byte("cors: http://c.example\ninterval: soon\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Reload(reloadable); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("err = %v, want invalid value at line 2", err)
+	}
+	if *cors != "http://b.example" || *interval != 5*time.Second {
+		t.Errorf("cors, interval = %s, %v, want them unchanged", *cors, *interval)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		in   string
+		w    []configEntry
+		werr bool
+	}{
+		{"", nil, false},
+		{"a: 1\nb: two words # comment\n", []configEntry{{"a", "1", 1}, {"b", "two words", 2}}, false},
+		{"---\na: \"x # y\"\n", []configEntry{{"a", "x # y", 2}}, false},
+		{"a: 'it''s'\n", []configEntry{{"a", "it's", 1}}, false},
+		{"a: [x, \"y\"]\n", []configEntry{{"a", "x,y", 1}}, false},
+		{"a:\n  - x\n  - y\nb: z\n", []configEntry{{"a", "x,y", 1}, {"b", "z", 4}}, false},
+		{"a:\n", []configEntry{{"a", "", 1}}, false},
+		{"a: http://x#y\n", []configEntry{{"a", "http://x#y", 1}}, false},
+
+		{"a: 1\na: 2\n", nil, true},
+		{"- x\n", nil, true},
+		{"a: 1\n  b: 2\n", nil, true},
+		{"a\n", nil, true},
+		{"a: \"x\n", nil, true},
+	}
+	for i, tt := range tests {
+		g, err := parseConfig(strings.NewReader(tt.in))
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if !tt.werr && !reflect.DeepEqual(g, tt.w) {
+			t.Errorf("#%d: entries = %+v, want %+v", i, g, tt.w)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// DirMode implements the flag.Value interface. The argument is validated
+// as the octal permission bits of a directory the owner can make and
+// remove files in, like "0750".
+type DirMode os.FileMode
+
+func (m *DirMode) Set(arg string) error {
+	v, err := strconv.ParseUint(arg, 8, 32)
+	if err != nil {
+		return errors.New("bad octal mode")
+	}
+	mode := os.FileMode(v)
+	if mode&^os.ModePerm != 0 {
+		return errors.New("mode has bits other than the permission bits")
+	}
+	if mode&0700 != 0700 {
+		return errors.New("mode must grant the owner read, write and search permissions")
+	}
+	*m = DirMode(mode)
+	return nil
+}
+
+func (m *DirMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
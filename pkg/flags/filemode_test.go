@@ -0,0 +1,45 @@
+package flags
+
+import (
+	"testing"
+)
+
+func TestDirModeSet(t *testing.T) {
+	tests := []struct {
+		val  string
+		mode DirMode
+		pass bool
+	}{
+		{"0700", 0700, true},
+		{"750", 0750, true},
+		{"0777", 0777, true},
+
+		// unrecognized values
+		{"", 0, false},
+		{"0800", 0, false},
+		{"rwx", 0, false},
+		// not permission bits only
+		{"4700", 0, false},
+		// the owner cannot make files
+		{"0500", 0, false},
+		{"0070", 0, false},
+	}
+
+	for i, tt := range tests {
+		m := new(DirMode)
+		err := m.Set(tt.val)
+		if tt.pass != (err == nil) {
+			t.Errorf("#%d: want pass=%t, but got err=%v", i, tt.pass, err)
+		}
+		if *m != tt.mode {
+			t.Errorf("#%d: mode = %v, want %v", i, m, &tt.mode)
+		}
+	}
+}
+
+func TestDirModeString(t *testing.T) {
+	m := DirMode(0750)
+	if g := m.String(); g != "0750" {
+		t.Errorf("string = %s, want 0750", g)
+	}
+}
@@ -1,7 +1,6 @@
 package flags
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -9,7 +8,8 @@ import (
 )
 
 // IPAddressPort implements the flag.Value interface. The argument
-// is validated as "ip:port".
+// is validated as "ip:port", where an IPv6 ip is bracketed as in
+// "[::1]:4001".
 type IPAddressPort struct {
 	IP   string
 	Port int
@@ -18,26 +18,27 @@ type IPAddressPort struct {
 func (a *IPAddressPort) Set(arg string) error {
 	arg = strings.TrimSpace(arg)
 
-	parts := strings.SplitN(arg, ":", 2)
-	if len(parts) != 2 {
-		return errors.New("bad format in address specification")
+	host, portStr, err := net.SplitHostPort(arg)
+	if err != nil {
+		return fmt.Errorf("bad format in address specification %q: %v", arg, err)
 	}
 
-	if net.ParseIP(parts[0]) == nil {
-		return errors.New("bad IP in address specification")
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("bad IP %q in address specification", host)
 	}
 
-	port, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return errors.New("bad port in address specification")
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("bad port %q in address specification", portStr)
 	}
 
-	a.IP = parts[0]
+	a.IP = host
 	a.Port = port
 
 	return nil
 }
 
+// String returns the address as "ip:port", bracketing an IPv6 ip.
 func (a *IPAddressPort) String() string {
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return net.JoinHostPort(a.IP, strconv.Itoa(a.Port))
 }
@@ -8,6 +8,8 @@ func TestIPAddressPortSet(t *testing.T) {
 	pass := []string{
 		"1.2.3.4:8080",
 		"10.1.1.1:80",
+		"[::1]:4001",
+		"[2001:db8::1]:7001",
 	}
 
 	fail := []string{
@@ -18,6 +20,17 @@ func TestIPAddressPortSet(t *testing.T) {
 		// bad port specification
 		"127.0.0.1:foo",
 		"127.0.0.1:",
+		"127.0.0.1:65536",
+		"127.0.0.1:-1",
+		// hostnames are not IPs
+		"localhost:4001",
+		// IPv6 must be bracketed
+		"::1:4001",
+		"2001:db8::1:7001",
+		"[::1]",
+		"[::1:4001",
+		"[::1]:",
+		"[foo]:4001",
 		// unix sockets not supported
 		"unix://",
 		"unix://tmp/etcd.sock",
@@ -44,14 +57,22 @@ func TestIPAddressPortSet(t *testing.T) {
 }
 
 func TestIPAddressPortString(t *testing.T) {
-	f := &IPAddressPort{}
-	if err := f.Set("127.0.0.1:4001"); err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"127.0.0.1:4001", "127.0.0.1:4001"},
+		{" 10.1.1.1:80 ", "10.1.1.1:80"},
+		{"[::1]:4001", "[::1]:4001"},
+		{"[2001:db8::1]:7001", "[2001:db8::1]:7001"},
 	}
-
-	want := "127.0.0.1:4001"
-	got := f.String()
-	if want != got {
-		t.Fatalf("IPAddressPort.String() value should be %q, got %q", want, got)
+	for i, tt := range tests {
+		f := &IPAddressPort{}
+		if err := f.Set(tt.in); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if got := f.String(); got != tt.want {
+			t.Errorf("#%d: IPAddressPort.String() value should be %q, got %q", i, tt.want, got)
+		}
 	}
 }
@@ -11,8 +11,7 @@ type URLsValue types.URLs
 // Set parses a command line set of URLs formatted like:
 // http://127.0.0.1:7001,http://10.1.1.2:80
 func (us *URLsValue) Set(s string) error {
-	strs := strings.Split(s, ",")
-	nus, err := types.NewURLs(strs)
+	nus, err := types.ParseURLs(s)
 	if err != nil {
 		return err
 	}
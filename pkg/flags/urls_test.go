@@ -22,6 +22,13 @@ func TestValidateURLsValueBad(t *testing.T) {
 		"file://foo/bar",
 		"http://hello/asdf",
 		"http://10.1.1.1",
+		"http://10.1.1.1:",
+		"http://10.1.1.1:65536",
+		// IPv6 must be bracketed
+		"http://::1:4001",
+		"http://2001:db8::1:7001",
+		"http://[::1]",
+		"http://[::1:4001",
 	}
 	for i, in := range tests {
 		u := URLsValue{}
@@ -37,11 +44,17 @@ func TestValidateURLsValueGood(t *testing.T) {
 		"http://10.1.1.1:80",
 		"http://localhost:80",
 		"http://:80",
+		"http://[::1]:4001",
+		"https://[2001:db8::1]:7001",
 	}
 	for i, in := range tests {
 		u := URLsValue{}
 		if err := u.Set(in); err != nil {
 			t.Errorf("#%d: err=%v, want nil for in=%q", i, err, in)
 		}
+		// the bracketed form is kept when the URL is advertised
+		if s := u.String(); s != in {
+			t.Errorf("#%d: string = %q, want %q", i, s, in)
+		}
 	}
 }
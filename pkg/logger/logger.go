@@ -0,0 +1,137 @@
+// Package logger provides leveled logging on top of the standard log
+// package, so that the verbosity of a running member can be chosen.
+//
+// Packages log through the package-level functions, which write to the
+// default logger:
+//
+//	logger.Debugf("raft: recv message from %#x: %+v", m.From, m)
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a message. A Level implements flag.Value.
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > FatalLevel {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name, in any case.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("logger: unknown level %q", s)
+}
+
+func (l *Level) Set(s string) error {
+	v, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// Logger writes the messages at or above its level to an underlying
+// log.Logger, prefixed with their level.
+type Logger struct {
+	level int32
+	l     *log.Logger
+}
+
+// New creates a Logger writing to w the messages at or above level.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{level: int32(level), l: log.New(w, "", log.LstdFlags)}
+}
+
+func (lg *Logger) Level() Level { return Level(atomic.LoadInt32(&lg.level)) }
+
+func (lg *Logger) SetLevel(level Level) { atomic.StoreInt32(&lg.level, int32(level)) }
+
+// Enabled reports whether messages at level are written, which lets
+// callers skip building expensive messages.
+func (lg *Logger) Enabled(level Level) bool { return level >= lg.Level() }
+
+func (lg *Logger) logf(level Level, format string, v ...interface{}) {
+	if !lg.Enabled(level) {
+		return
+	}
+	lg.l.Output(3, level.String()+" "+fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Debugf(format string, v ...interface{}) { lg.logf(DebugLevel, format, v...) }
+func (lg *Logger) Infof(format string, v ...interface{})  { lg.logf(InfoLevel, format, v...) }
+func (lg *Logger) Warnf(format string, v ...interface{})  { lg.logf(WarnLevel, format, v...) }
+func (lg *Logger) Errorf(format string, v ...interface{}) { lg.logf(ErrorLevel, format, v...) }
+
+// Fatalf writes the message whatever the level, and exits.
+func (lg *Logger) Fatalf(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	lg.l.Output(2, FatalLevel.String()+" "+s)
+	os.Exit(1)
+}
+
+// Panicf writes the message whatever the level, and panics with it.
+func (lg *Logger) Panicf(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	lg.l.Output(2, FatalLevel.String()+" "+s)
+	panic(s)
+}
+
+var std = New(os.Stderr, InfoLevel)
+
+// SetLevel sets the level of the default logger.
+func SetLevel(level Level) { std.SetLevel(level) }
+
+// SetOutput sets the destination of the default logger.
+func SetOutput(w io.Writer) { std.l.SetOutput(w) }
+
+func Enabled(level Level) bool { return std.Enabled(level) }
+
+func Debugf(format string, v ...interface{}) { std.logf(DebugLevel, format, v...) }
+func Infof(format string, v ...interface{})  { std.logf(InfoLevel, format, v...) }
+func Warnf(format string, v ...interface{})  { std.logf(WarnLevel, format, v...) }
+func Errorf(format string, v ...interface{}) { std.logf(ErrorLevel, format, v...) }
+
+// Fatal and Fatalf write the message to the default logger whatever its
+// level, and exit.
+func Fatal(v ...interface{}) {
+	std.l.Output(2, FatalLevel.String()+" "+fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func Fatalf(format string, v ...interface{}) {
+	std.l.Output(2, FatalLevel.String()+" "+fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// Panicf writes the message to the default logger whatever its level, and
+// panics with it.
+func Panicf(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	std.l.Output(2, FatalLevel.String()+" "+s)
+	panic(s)
+}
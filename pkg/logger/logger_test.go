@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLevelSuppresses(t *testing.T) {
+	b := &bytes.Buffer{}
+	lg := New(b, WarnLevel)
+	lg.Debugf("debug %d", 1)
+	lg.Infof("info %d", 2)
+	lg.Warnf("warn %d", 3)
+	lg.Errorf("error %d", 4)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	wsuffixes := []string{"WARN warn 3", "ERROR error 4"}
+	if len(lines) != len(wsuffixes) {
+		t.Fatalf("output = %q, want %d lines", b.String(), len(wsuffixes))
+	}
+	for i, w := range wsuffixes {
+		if !strings.HasSuffix(lines[i], w) {
+			t.Errorf("#%d: line = %q, want suffix %q", i, lines[i], w)
+		}
+	}
+
+	b.Reset()
+	lg.SetLevel(DebugLevel)
+	lg.Debugf("debug")
+	if !strings.HasSuffix(b.String(), "DEBUG debug\n") {
+		t.Errorf("output = %q, want the debug message", b.String())
+	}
+}
+
+func TestLevelSet(t *testing.T) {
+	tests := []struct {
+		s    string
+		w    Level
+		werr bool
+	}{
+		{"debug", DebugLevel, false},
+		{"INFO", InfoLevel, false},
+		{"Warn", WarnLevel, false},
+		{"error", ErrorLevel, false},
+		{"fatal", FatalLevel, false},
+		{"verbose", InfoLevel, true},
+		{"", InfoLevel, true},
+	}
+	for i, tt := range tests {
+		l := InfoLevel
+		err := l.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if l != tt.w {
+			t.Errorf("#%d: level = %v, want %v", i, l, tt.w)
+		}
+	}
+}
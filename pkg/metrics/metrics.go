@@ -0,0 +1,191 @@
+// Package metrics provides counters, gauges and histograms that are cheap to
+// update from hot paths, and exposes them in the Prometheus text format.
+//
+// Collectors are usually created as package variables of the package they
+// instrument, which registers them once to the default registry:
+//
+//	var syncDurations = metrics.NewHistogram("etcd_wal_fsync_duration_seconds",
+//		"The latency distributions of fsync called by wal.", metrics.DefaultBuckets)
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of a histogram
+// observing latencies in seconds, from 1ms to about 8s.
+var DefaultBuckets = []float64{.001, .002, .004, .008, .016, .032, .064, .128, .256, .512, 1.024, 2.048, 4.096, 8.192}
+
+var defaultRegistry = &registry{collectors: make(map[string]registered)}
+
+// collector is a metric that writes itself in the text format.
+type collector interface {
+	write(w io.Writer, name string) error
+}
+
+type registered struct {
+	help string
+	c    collector
+}
+
+type registry struct {
+	mu         sync.Mutex
+	collectors map[string]registered
+}
+
+// register adds c to r. It panics if a collector with the same name
+// already exists, since the metrics could not be told apart.
+func (r *registry) register(name, help string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[name]; ok {
+		panic("metrics: duplicate collector " + name)
+	}
+	r.collectors[name] = registered{help: help, c: c}
+}
+
+// writeTo writes all the collectors of r to w, sorted by name.
+func (r *registry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.mu.Lock()
+		rc := r.collectors[name]
+		r.mu.Unlock()
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, rc.help); err != nil {
+			return err
+		}
+		if err := rc.c.write(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTo writes all the registered collectors to w in the Prometheus text
+// exposition format.
+func WriteTo(w io.Writer) error {
+	return defaultRegistry.writeTo(w)
+}
+
+// Handler returns an http.Handler that serves all the registered collectors
+// in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v int64
+}
+
+// NewCounter creates a Counter and registers it with the given name.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	defaultRegistry.register(name, help, c)
+	return c
+}
+
+func (c *Counter) Inc() { atomic.AddInt64(&c.v, 1) }
+
+// Add adds n to c. n MUST NOT be negative.
+func (c *Counter) Add(n int64) { atomic.AddInt64(&c.v, n) }
+
+func (c *Counter) Get() int64 { return atomic.LoadInt64(&c.v) }
+
+func (c *Counter) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, c.Get())
+	return err
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// NewGauge creates a Gauge and registers it with the given name.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	defaultRegistry.register(name, help, g)
+	return g
+}
+
+func (g *Gauge) Set(n int64) { atomic.StoreInt64(&g.v, n) }
+func (g *Gauge) Add(n int64) { atomic.AddInt64(&g.v, n) }
+func (g *Gauge) Get() int64  { return atomic.LoadInt64(&g.v) }
+
+func (g *Gauge) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", name, name, g.Get())
+	return err
+}
+
+// Histogram counts observed values in buckets.
+type Histogram struct {
+	bounds []float64
+	// counts[i] is the number of values observed in (bounds[i-1], bounds[i]],
+	// and the last one the number of values above all the bounds.
+	counts []uint64
+	count  uint64
+	// sum holds the bits of the float64 sum of the observed values
+	sum uint64
+}
+
+// NewHistogram creates a Histogram with the given bucket upper bounds, which
+// MUST be sorted in increasing order, and registers it with the given name.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		bounds: buckets,
+		counts: make([]uint64, len(buckets)+1),
+	}
+	defaultRegistry.register(name, help, h)
+	return h
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		new := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, new) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += atomic.LoadUint64(&h.counts[i])
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, cum); err != nil {
+			return err
+		}
+	}
+	cum += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	sum := math.Float64frombits(atomic.LoadUint64(&h.sum))
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+		name, cum, name, strconv.FormatFloat(sum, 'g', -1, 64), name, atomic.LoadUint64(&h.count))
+	return err
+}
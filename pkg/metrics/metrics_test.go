@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := &registry{collectors: make(map[string]registered)}
+	c, g, h := &Counter{}, &Gauge{}, &Histogram{bounds: []float64{0.5, 1}, counts: make([]uint64, 3)}
+	r.register("test_gauge", "A gauge.", g)
+	r.register("test_counter", "A counter.", c)
+	r.register("test_histogram", "A histogram.", h)
+
+	c.Inc()
+	c.Add(2)
+	g.Set(5)
+	g.Add(-2)
+	for _, v := range []float64{0.25, 0.5, 0.75, 2} {
+		h.Observe(v)
+	}
+
+	b := &bytes.Buffer{}
+	if err := r.writeTo(b); err != nil {
+		t.Fatal(err)
+	}
+	w := `# HELP test_counter A counter.
+# TYPE test_counter counter
+test_counter 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 3
+# HELP test_histogram A histogram.
+# TYPE test_histogram histogram
+test_histogram_bucket{le="0.5"} 2
+test_histogram_bucket{le="1"} 3
+test_histogram_bucket{le="+Inf"} 4
+test_histogram_sum 3.5
+test_histogram_count 4
+`
+	if g := b.String(); g != w {
+		t.Errorf("output = %s, want %s", g, w)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	r := &registry{collectors: make(map[string]registered)}
+	r.register("test", "", &Counter{})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("register duplicate did not panic")
+		}
+	}()
+	r.register("test", "", &Gauge{})
+}
+
+func TestHandler(t *testing.T) {
+	c := NewCounter("test_handler_total", "A counter served by the handler.")
+	c.Inc()
+
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Handler().ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !bytes.Contains(rw.Body.Bytes(), []byte("\ntest_handler_total 1\n")) {
+		t.Errorf("body = %s, want test_handler_total 1", rw.Body.String())
+	}
+}
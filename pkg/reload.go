@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+// A HandlerSwapper serves the requests with a handler that can be swapped
+// for another while serving, as when the configuration is reloaded. The
+// requests already being served finish with the handler they started with,
+// and no connection is dropped.
+type HandlerSwapper struct {
+	v atomic.Value
+}
+
+// handlerBox lets handlers of different types be stored in an atomic.Value.
+type handlerBox struct {
+	h http.Handler
+}
+
+func NewHandlerSwapper(h http.Handler) *HandlerSwapper {
+	s := &HandlerSwapper{}
+	s.Swap(h)
+	return s
+}
+
+// Swap makes h serve the following requests.
+func (s *HandlerSwapper) Swap(h http.Handler) {
+	s.v.Store(handlerBox{h})
+}
+
+func (s *HandlerSwapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.v.Load().(handlerBox).h.ServeHTTP(w, r)
+}
+
+// ReloadOnSignal calls reload each time the process receives one of sigs,
+// one call at a time, until the returned function is called.
+func ReloadOnSignal(reload func(), sigs ...os.Signal) (stop func()) {
+	sigc := make(chan os.Signal, 1)
+	donec := make(chan struct{})
+	signal.Notify(sigc, sigs...)
+	go func() {
+		for {
+			select {
+			case <-sigc:
+				reload()
+			case <-donec:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigc)
+		close(donec)
+	}
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/flags"
+)
+
+func TestReloadCORSOnSIGHUP(t *testing.T) {
+	f, err := ioutil.TempFile("", "etcd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte("cors: http://a.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("testing", flag.ExitOnError)
+	cors := &CORSInfo{}
+	fs.Var(cors, "cors", "")
+	cf, err := flags.LoadConfigFile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCORSHandler := func() http.Handler {
+		info := *cors
+		return &CORSHandler{
+			Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+			Info:    &info,
+		}
+	}
+	h := NewHandlerSwapper(newCORSHandler())
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	reloaded := make(chan error, 1)
+	stop := ReloadOnSignal(func() {
+		_, _, err := cf.Reload([]string{"cors"})
+		if err == nil {
+			h.Swap(newCORSHandler())
+		}
+		reloaded <- err
+	}, syscall.SIGHUP)
+	defer stop()
+
+	allowed := func(origin string) bool {
+		req, _ := http.NewRequest("GET", s.URL+"/v2/keys/foo", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin") == origin
+	}
+	if !allowed("http://a.example") || allowed("http://b.example") {
+		t.Fatalf("want only http://a.example allowed before reload")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("cors: http://b.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("config is not reloaded on SIGHUP")
+	}
+	if allowed("http://a.example") || !allowed("http://b.example") {
+		t.Errorf("want only http://b.example allowed after reload")
+	}
+}
@@ -0,0 +1,35 @@
+// Package timeutil schedules periodic work.
+package timeutil
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jitter returns d made longer or shorter by a random fraction of it, at
+// most f. A f of 0 or less returns d as is.
+func Jitter(d time.Duration, f float64) time.Duration {
+	if f <= 0 {
+		return d
+	}
+	return d + time.Duration((2*rand.Float64()-1)*f*float64(d))
+}
+
+// JitterTick is like time.Tick, except that each interval between two
+// ticks is d changed by Jitter, so that the work done on each tick by
+// several processes started together does not stay synchronized. Like
+// time.Tick, the ticks are dropped while the receiver is not ready, and
+// the ticker is never stopped.
+func JitterTick(d time.Duration, f float64) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	go func() {
+		for {
+			t := <-time.After(Jitter(d, f))
+			select {
+			case c <- t:
+			default:
+			}
+		}
+	}()
+	return c
+}
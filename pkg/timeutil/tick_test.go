@@ -0,0 +1,48 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	d := 500 * time.Millisecond
+	tests := []struct {
+		f float64
+
+		wmin, wmax time.Duration
+	}{
+		{0, d, d},
+		{-1, d, d},
+		{0.1, 450 * time.Millisecond, 550 * time.Millisecond},
+		{0.5, 250 * time.Millisecond, 750 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for j := 0; j < 1000; j++ {
+			g := Jitter(d, tt.f)
+			if g < tt.wmin || g > tt.wmax {
+				t.Fatalf("#%d: interval = %v, want within [%v, %v]", i, g, tt.wmin, tt.wmax)
+			}
+			seen[g] = true
+		}
+		if vary := len(seen) > 1; vary != (tt.f > 0) {
+			t.Errorf("#%d: intervals vary = %v, want %v", i, vary, tt.f > 0)
+		}
+	}
+}
+
+func TestJitterTick(t *testing.T) {
+	d := 10 * time.Millisecond
+	c := JitterTick(d, 0.5)
+	last := <-c
+	for i := 0; i < 5; i++ {
+		next := <-c
+		// the ticks are taken at once, so the interval is only late by
+		// the scheduling of the ticking goroutine
+		if g := next.Sub(last); g < d/2 {
+			t.Errorf("#%d: interval = %v, want at least %v", i, g, d/2)
+		}
+		last = next
+	}
+}
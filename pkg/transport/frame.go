@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maxFrameSize bounds the length read from the header of a frame, so that a
+// corrupted header does not make ReadFrame allocate gigabytes.
+const maxFrameSize = 512 << 20
+
+var ErrFrameTooLarge = errors.New("transport: frame too large")
+
+// WriteFrame writes b to w as a frame: its length as a little-endian
+// uint64, followed by b. Writing frames through a bufio.Writer saves a
+// write on w for each of them.
+func WriteFrame(w io.Writer, b []byte) error {
+	var h [8]byte
+	binary.LittleEndian.PutUint64(h[:], uint64(len(b)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFrame reads the next frame written by WriteFrame from r, and returns
+// its content. It returns io.EOF if r ends between two frames, and
+// io.ErrUnexpectedEOF if it ends within one.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint64(h[:])
+	if n > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
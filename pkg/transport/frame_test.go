@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	frames := [][]byte{[]byte("foo"), {}, []byte("barbaz")}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, w := range frames {
+		f, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if !reflect.DeepEqual(f, w) {
+			t.Errorf("#%d: frame = %q, want %q", i, f, w)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	for _, n := range []int{4, 8, len(b) - 1} {
+		if _, err := ReadFrame(bytes.NewReader(b[:n])); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d bytes: err = %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	h := make([]byte, 8)
+	binary.LittleEndian.PutUint64(h, maxFrameSize+1)
+	if _, err := ReadFrame(bytes.NewReader(h)); err != ErrFrameTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitListener returns a Listener accepting at most n simultaneous
+// connections from l. The connections past the limit are closed as soon
+// as they are accepted, rather than left waiting in the backlog, so that
+// a storm of connections neither exhausts the file descriptors nor hangs
+// the clients. A limit of 0 leaves l unlimited.
+func LimitListener(l net.Listener, n int) net.Listener {
+	if n == 0 {
+		return l
+	}
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			c.Close()
+		}
+	}
+}
+
+// limitConn gives its slot back to its listener when it is closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	ln, err := NewListener("127.0.0.1:0", TLSInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(ln, 2)
+	defer l.Close()
+	acceptc := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			acceptc <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// closed tells whether the listener hung up c
+	closed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	var accepted []net.Conn
+	for i := 0; i < 2; i++ {
+		c := dial()
+		defer c.Close()
+		accepted = append(accepted, <-acceptc)
+	}
+	c := dial()
+	defer c.Close()
+	if !closed(c) {
+		t.Errorf("connection past the limit was not closed")
+	}
+
+	// closing an accepted connection frees its slot
+	accepted[0].Close()
+	c = dial()
+	defer c.Close()
+	select {
+	case sc := <-acceptc:
+		defer sc.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("connection not accepted after a slot was freed")
+	}
+	if closed(c) {
+		t.Errorf("connection within the limit was closed")
+	}
+	accepted[1].Close()
+}
+
+func TestLimitListenerUnlimited(t *testing.T) {
+	ln, err := NewListener("127.0.0.1:0", TLSInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if l := LimitListener(ln, 0); l != ln {
+		t.Errorf("listener = %v, want %v", l, ln)
+	}
+}
@@ -12,39 +12,65 @@ import (
 )
 
 func NewListener(addr string, info TLSInfo) (net.Listener, error) {
+	return NewLimitListener(addr, info, 0)
+}
+
+// NewLimitListener is like NewListener, but accepts at most maxConns
+// simultaneous connections, as LimitListener does, unless it is 0. The TCP
+// connections are limited before TLS, so that the server still gets the
+// TLS connections, and serves their certificates and HTTP/2.
+func NewLimitListener(addr string, info TLSInfo, maxConns int) (net.Listener, error) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	l = LimitListener(l, maxConns)
 
 	if !info.Empty() {
-		cfg, err := info.ServerConfig()
+		cfg, err := info.ServerConfigReloading()
 		if err != nil {
 			return nil, err
 		}
 
 		l = tls.NewListener(l, cfg)
+	} else if info.ClientCertAuth {
+		l.Close()
+		return nil, fmt.Errorf("ClientCertAuth requires CertFile and KeyFile to serve TLS")
 	}
 
 	return l, nil
 }
 
 func NewTransport(info TLSInfo) (*http.Transport, error) {
+	// timeouts taken from http.DefaultTransport
+	return NewTimeoutTransport(info, 30*time.Second)
+}
+
+// NewTimeoutTransport is like NewTransport, but gives up connecting after
+// dialTimeout, which also bounds the TLS handshake if it is shorter than
+// the default one.
+func NewTimeoutTransport(info TLSInfo, dialTimeout time.Duration) (*http.Transport, error) {
+	hsTimeout := 10 * time.Second
+	if dialTimeout < hsTimeout {
+		hsTimeout = dialTimeout
+	}
 	t := &http.Transport{
-		// timeouts taken from http.DefaultTransport
 		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   dialTimeout,
 			KeepAlive: 30 * time.Second,
 		}).Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
+		TLSHandshakeTimeout: hsTimeout,
 	}
 
 	if !info.Empty() {
-		tlsCfg, err := info.ClientConfig()
+		tlsCfg, err := info.ClientConfigReloading()
 		if err != nil {
 			return nil, err
 		}
 		t.TLSClientConfig = tlsCfg
+		// a transport with its own dialer and TLS config only speaks
+		// HTTP/2 if forced to
+		t.ForceAttemptHTTP2 = info.HTTP2
 	}
 
 	return t, nil
@@ -55,6 +81,23 @@ type TLSInfo struct {
 	KeyFile  string
 	CAFile   string
 
+	// ClientCertAuth makes the server refuse the clients without a
+	// certificate signed by CAFile, and refuse to start without a CAFile
+	// rather than serve any client. A CAFile alone requires the client
+	// certificates too.
+	ClientCertAuth bool
+
+	// MinVersion is the oldest TLS version accepted, TLS 1.2 if 0.
+	MinVersion uint16
+	// CipherSuites are the cipher suites accepted up to TLS 1.2, or the
+	// ones of Go if empty. Those of TLS 1.3 cannot be chosen.
+	CipherSuites []uint16
+
+	// HTTP2 offers HTTP/2 in the TLS handshakes, so that the requests to
+	// a server supporting it are multiplexed over one connection. Without
+	// TLS, HTTP/1.1 is always used.
+	HTTP2 bool
+
 	// parseFunc exists to simplify testing. Typically, parseFunc
 	// should be left nil. In that case, tls.X509KeyPair will be used.
 	parseFunc func([]byte, []byte) (tls.Certificate, error)
@@ -91,11 +134,22 @@ func (info TLSInfo) baseConfig() (*tls.Config, error) {
 
 	var cfg tls.Config
 	cfg.Certificates = []tls.Certificate{tlsCert}
+	cfg.MinVersion = info.MinVersion
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.CipherSuites = info.CipherSuites
+	if info.HTTP2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
 	return &cfg, nil
 }
 
 // ServerConfig generates a tls.Config object for use by an HTTP server
 func (info TLSInfo) ServerConfig() (*tls.Config, error) {
+	if info.ClientCertAuth && info.CAFile == "" {
+		return nil, fmt.Errorf("ClientCertAuth requires a CAFile to verify the client certificates")
+	}
 	cfg, err := info.baseConfig()
 	if err != nil {
 		return nil, err
@@ -4,8 +4,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func createTempFile(b []byte) (string, error) {
@@ -74,6 +77,25 @@ func TestNewTransportTLSInfo(t *testing.T) {
 	}
 }
 
+func TestNewTimeoutTransport(t *testing.T) {
+	tests := []struct {
+		dialTimeout time.Duration
+		wtimeout    time.Duration
+	}{
+		{100 * time.Millisecond, 100 * time.Millisecond},
+		{time.Minute, 10 * time.Second},
+	}
+	for i, tt := range tests {
+		trans, err := NewTimeoutTransport(TLSInfo{}, tt.dialTimeout)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if trans.TLSHandshakeTimeout != tt.wtimeout {
+			t.Errorf("#%d: handshake timeout = %v, want %v", i, trans.TLSHandshakeTimeout, tt.wtimeout)
+		}
+	}
+}
+
 func TestTLSInfoEmpty(t *testing.T) {
 	tests := []struct {
 		info TLSInfo
@@ -190,3 +212,186 @@ func TestTLSInfoConfigFuncs(t *testing.T) {
 		}
 	}
 }
+
+func TestNewListenerHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	writeSelfSignedCert(t, "etcd", certFile, keyFile, time.Now())
+
+	tests := []struct {
+		http2  bool
+		wproto string
+	}{
+		{true, "HTTP/2.0"},
+		{false, "HTTP/1.1"},
+	}
+	for i, tt := range tests {
+		info := TLSInfo{CertFile: certFile, KeyFile: keyFile, HTTP2: tt.http2}
+		l, err := NewListener("127.0.0.1:0", info)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		go NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}), Timeouts{}).Serve(l)
+
+		tr, err := NewTransport(info)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		tr.TLSClientConfig.InsecureSkipVerify = true
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if resp.Proto != tt.wproto || string(b) != tt.wproto {
+			t.Errorf("#%d: proto = %s, served %s, want %s", i, resp.Proto, b, tt.wproto)
+		}
+		tr.CloseIdleConnections()
+		l.Close()
+	}
+}
+
+// TestNewLimitListenerTLS tests that a limited TLS listener still serves
+// the TLS connections, whose certificates and HTTP/2 the server sees.
+func TestNewLimitListenerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	writeSelfSignedCert(t, "etcd", certFile, keyFile, time.Now())
+
+	info := TLSInfo{CertFile: certFile, KeyFile: keyFile, HTTP2: true}
+	l, err := NewLimitListener("127.0.0.1:0", info, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "no TLS", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(r.Proto))
+	}), Timeouts{}).Serve(l)
+
+	tr, err := NewTransport(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.CloseIdleConnections()
+	tr.TLSClientConfig.InsecureSkipVerify = true
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != "HTTP/2.0" {
+		t.Errorf("served %d %q, want %d %q", resp.StatusCode, b, http.StatusOK, "HTTP/2.0")
+	}
+}
+
+func TestNewListenerClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	writeSelfSignedCert(t, "etcd", certFile, keyFile, time.Now())
+	// the self-signed certificate of the client is its own CA
+	clientCert, clientKey := path.Join(dir, "client.pem"), path.Join(dir, "client-key.pem")
+	writeSelfSignedCert(t, "alice", clientCert, clientKey, time.Now())
+	otherCert, otherKey := path.Join(dir, "other.pem"), path.Join(dir, "other-key.pem")
+	writeSelfSignedCert(t, "mallory", otherCert, otherKey, time.Now())
+
+	l, err := NewListener("127.0.0.1:0", TLSInfo{CertFile: certFile, KeyFile: keyFile, CAFile: clientCert, ClientCertAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}), Timeouts{}).Serve(l)
+
+	tests := []struct {
+		cert, key string
+
+		wcn string
+	}{
+		{clientCert, clientKey, "alice"},
+		// no client certificate
+		{"", "", ""},
+		// a certificate not signed by the CA
+		{otherCert, otherKey, ""},
+	}
+	for i, tt := range tests {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		if tt.cert != "" {
+			c, err := tls.LoadX509KeyPair(tt.cert, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.TLSClientConfig.Certificates = []tls.Certificate{c}
+		}
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + l.Addr().String())
+		if tt.wcn == "" {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("#%d: err = nil, want the handshake refused", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if string(b) != tt.wcn {
+			t.Errorf("#%d: common name = %q, want %q", i, b, tt.wcn)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestNewListenerClientCertAuthMissingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	writeSelfSignedCert(t, "etcd", certFile, keyFile, time.Now())
+
+	tests := []TLSInfo{
+		// no CA to verify the client certificates
+		{CertFile: certFile, KeyFile: keyFile, ClientCertAuth: true},
+		// no TLS at all
+		{CAFile: certFile, ClientCertAuth: true},
+	}
+	for i, info := range tests {
+		l, err := NewListener("127.0.0.1:0", info)
+		if err == nil {
+			l.Close()
+			t.Errorf("#%d: err = nil, want non-nil", i)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads a certificate from its cert and key files, and loads it
+// again whenever one of the files has changed on disk since.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	parseFunc func([]byte, []byte) (tls.Certificate, error)
+
+	mu sync.Mutex
+	// cert is the last loaded certificate. It is replaced, never modified,
+	// so handshakes that already got it keep using it.
+	cert     *tls.Certificate
+	certStat fileStat
+	keyStat  fileStat
+}
+
+// fileStat is what tells whether a file has changed since it was loaded.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStat, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func newCertReloader(info TLSInfo) (*certReloader, error) {
+	r := &certReloader{
+		certFile:  info.CertFile,
+		keyFile:   info.KeyFile,
+		parseFunc: info.parseFunc,
+	}
+	if r.parseFunc == nil {
+		r.parseFunc = tls.X509KeyPair
+	}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// get returns the certificate, loading it again if its files have changed.
+// If they cannot be loaded, the certificate loaded before is kept, so that a
+// rotation caught half-way through does not fail the handshakes.
+func (r *certReloader) get() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cs, err := statFile(r.certFile)
+	if err != nil {
+		return r.cached(err)
+	}
+	ks, err := statFile(r.keyFile)
+	if err != nil {
+		return r.cached(err)
+	}
+	if r.cert != nil && cs == r.certStat && ks == r.keyStat {
+		return r.cert, nil
+	}
+
+	cert, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return r.cached(err)
+	}
+	key, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return r.cached(err)
+	}
+	tlsCert, err := r.parseFunc(cert, key)
+	if err != nil {
+		return r.cached(err)
+	}
+	r.cert, r.certStat, r.keyStat = &tlsCert, cs, ks
+	return r.cert, nil
+}
+
+func (r *certReloader) cached(err error) (*tls.Certificate, error) {
+	if r.cert != nil {
+		return r.cert, nil
+	}
+	return nil, err
+}
+
+// ServerConfigReloading generates a tls.Config object for use by an HTTP
+// server, like ServerConfig, except that the certificate is loaded again
+// from CertFile and KeyFile for new handshakes whenever they change.
+func (info TLSInfo) ServerConfigReloading() (*tls.Config, error) {
+	cfg, err := info.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newCertReloader(info)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = nil
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.get()
+	}
+	return cfg, nil
+}
+
+// ClientConfigReloading generates a tls.Config object for use by an HTTP
+// client, like ClientConfig, except that the certificate is loaded again
+// from CertFile and KeyFile for new handshakes whenever they change.
+func (info TLSInfo) ClientConfigReloading() (*tls.Config, error) {
+	cfg, err := info.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newCertReloader(info)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = nil
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return r.get()
+	}
+	return cfg, nil
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a new self-signed certificate with the given
+// common name to certFile and keyFile, dated at mtime.
+func writeSelfSignedCert(t *testing.T, cn, certFile, keyFile string, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewListenerReloadsCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := TLSInfo{CertFile: path.Join(dir, "cert.pem"), KeyFile: path.Join(dir, "key.pem")}
+	now := time.Now()
+	writeSelfSignedCert(t, "old", info.CertFile, info.KeyFile, now.Add(-time.Minute))
+
+	l, err := NewListener("127.0.0.1:0", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+
+	peerCN := func() string {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if g := peerCN(); g != "old" {
+		t.Errorf("CN = %q, want %q", g, "old")
+	}
+	writeSelfSignedCert(t, "new", info.CertFile, info.KeyFile, now)
+	if g := peerCN(); g != "new" {
+		t.Errorf("CN = %q, want %q", g, "new")
+	}
+	// a broken rotation keeps the certificate loaded before
+	if err := ioutil.WriteFile(info.CertFile, []byte("XXX"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if g := peerCN(); g != "new" {
+		t.Errorf("CN = %q, want %q", g, "new")
+	}
+}
+
+func TestCertReloaderCaches(t *testing.T) {
+	tmp, err := createTempFile([]byte("XXX"))
+	if err != nil {
+		t.Fatalf("Unable to prepare tmpfile: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	parsed := 0
+	info := TLSInfo{CertFile: tmp, KeyFile: tmp}
+	info.parseFunc = func([]byte, []byte) (tls.Certificate, error) {
+		parsed++
+		return tls.Certificate{}, nil
+	}
+	r, err := newCertReloader(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, _ := r.get()
+	c2, _ := r.get()
+	if parsed != 1 {
+		t.Errorf("parsed = %d, want 1", parsed)
+	}
+	if c1 != c2 {
+		t.Errorf("certificate = %p, want %p", c2, c1)
+	}
+
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if c3, _ := r.get(); c3 == c1 {
+		t.Errorf("certificate was not loaded again")
+	}
+	if parsed != 2 {
+		t.Errorf("parsed = %d, want 2", parsed)
+	}
+}
+
+func TestNewCertReloaderError(t *testing.T) {
+	tmp, err := createTempFile([]byte("XXX"))
+	if err != nil {
+		t.Fatalf("Unable to prepare tmpfile: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	info := TLSInfo{CertFile: tmp, KeyFile: tmp}
+	info.parseFunc = fakeCertificateParserFunc(tls.Certificate{}, errors.New("fake"))
+	if _, err := info.ServerConfigReloading(); err == nil {
+		t.Errorf("expected non-nil error from ServerConfigReloading()")
+	}
+	if _, err := info.ClientConfigReloading(); err == nil {
+		t.Errorf("expected non-nil error from ClientConfigReloading()")
+	}
+}
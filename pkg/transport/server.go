@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultReadHeaderTimeout is how long a connection may take to send the
+// headers of a request before it is closed.
+const DefaultReadHeaderTimeout = 5 * time.Second
+
+// Timeouts bound how long a connection may stall an HTTP server. A zero
+// timeout means no timeout.
+type Timeouts struct {
+	// ReadHeader is the time allowed to read the headers of a request.
+	ReadHeader time.Duration
+	// Read is the time allowed to read a whole request, body included.
+	Read time.Duration
+	// Write is the time allowed to write a response. Long-polling
+	// requests, like watches, are cut off after it.
+	Write time.Duration
+	// Idle is the time a keep-alive connection may wait for the next
+	// request.
+	Idle time.Duration
+}
+
+// NewServer returns an http.Server serving h, which closes the connections
+// stalling for longer than the given timeouts.
+func NewServer(h http.Handler, t Timeouts) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: t.ReadHeader,
+		ReadTimeout:       t.Read,
+		WriteTimeout:      t.Write,
+		IdleTimeout:       t.Idle,
+	}
+}
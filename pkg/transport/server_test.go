@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewServerReadHeaderTimeout(t *testing.T) {
+	l, err := NewListener("127.0.0.1:0", TLSInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(http.NotFoundHandler(), Timeouts{ReadHeader: 100 * time.Millisecond})
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// send nothing, and wait for the server to hang up
+	start := time.Now()
+	c.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read error = %v, want %v", err, io.EOF)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("connection closed after %v, want at least %v", d, 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version named s, like "TLS1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns the cipher suites of the comma separated list
+// of names s, like "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", as Go names
+// them. An empty s is no cipher suite at all, which leaves Go choose them.
+// The cipher suites Go deems insecure, such as those using RC4 or 3DES, are
+// refused.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+	insecure := make(map[string]bool)
+	for _, c := range tls.InsecureCipherSuites() {
+		insecure[c.Name] = true
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if insecure[name] {
+			return nil, fmt.Errorf("insecure cipher suite %q", name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
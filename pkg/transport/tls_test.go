@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		w    uint16
+		werr bool
+	}{
+		{"TLS1.2", tls.VersionTLS12, false},
+		{"TLS1.3", tls.VersionTLS13, false},
+		{"1.2", 0, true},
+		{"SSL3.0", 0, true},
+		{"", 0, true},
+	}
+	for i, tt := range tests {
+		v, err := ParseTLSVersion(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if v != tt.w {
+			t.Errorf("#%d: version = %x, want %x", i, v, tt.w)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		s    string
+		w    []uint16
+		werr bool
+	}{
+		{"", nil, false},
+		{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, false},
+		{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			false,
+		},
+		{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_FAKE_CIPHER", nil, true},
+		{"aes128", nil, true},
+		// the insecure ones are refused
+		{"TLS_ECDHE_RSA_WITH_RC4_128_SHA", nil, true},
+		{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_3DES_EDE_CBC_SHA", nil, true},
+	}
+	for i, tt := range tests {
+		ids, err := ParseCipherSuites(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if !reflect.DeepEqual(ids, tt.w) {
+			t.Errorf("#%d: cipher suites = %v, want %v", i, ids, tt.w)
+		}
+	}
+}
+
+func TestNewListenerTLSVersionAndCiphers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-test-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	writeSelfSignedCert(t, "etcd", certFile, keyFile, time.Now())
+
+	tests := []struct {
+		info   TLSInfo
+		client *tls.Config
+
+		wok bool
+	}{
+		{
+			TLSInfo{CertFile: certFile, KeyFile: keyFile},
+			&tls.Config{MaxVersion: tls.VersionTLS12},
+			true,
+		},
+		// the versions older than TLS 1.2 are refused by default
+		{
+			TLSInfo{CertFile: certFile, KeyFile: keyFile},
+			&tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11},
+			false,
+		},
+		{
+			TLSInfo{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS13},
+			&tls.Config{MaxVersion: tls.VersionTLS12},
+			false,
+		},
+		{
+			TLSInfo{CertFile: certFile, KeyFile: keyFile, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+			true,
+		},
+		{
+			TLSInfo{CertFile: certFile, KeyFile: keyFile, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+			false,
+		},
+	}
+	for i, tt := range tests {
+		l, err := NewListener("127.0.0.1:0", tt.info)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		go NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), Timeouts{}).Serve(l)
+
+		tt.client.InsecureSkipVerify = true
+		tr := &http.Transport{TLSClientConfig: tt.client}
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.wok {
+			t.Errorf("#%d: err = %v, want success %v", i, err, tt.wok)
+		}
+		tr.CloseIdleConnections()
+		l.Close()
+	}
+}
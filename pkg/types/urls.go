@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -27,6 +28,9 @@ func (us URLs) StringSlice() []string {
 	return out
 }
 
+// NewURLs parses strs into canonical URLs, sorted: the scheme, http or
+// https, and the host are lowercased, and a trailing slash is dropped. Each
+// URL must have a scheme and a port, and no other path.
 func NewURLs(strs []string) (URLs, error) {
 	all := make([]url.URL, len(strs))
 	if len(all) == 0 {
@@ -34,6 +38,9 @@ func NewURLs(strs []string) (URLs, error) {
 	}
 	for i, in := range strs {
 		in = strings.TrimSpace(in)
+		if !strings.Contains(in, "://") {
+			return nil, fmt.Errorf("URL must have a scheme, as in http://%s", in)
+		}
 		u, err := url.Parse(in)
 		if err != nil {
 			return nil, err
@@ -41,16 +48,32 @@ func NewURLs(strs []string) (URLs, error) {
 		if u.Scheme != "http" && u.Scheme != "https" {
 			return nil, fmt.Errorf("URL scheme must be http or https: %s", in)
 		}
-		if _, _, err := net.SplitHostPort(u.Host); err != nil {
-			return nil, fmt.Errorf(`URL address does not have the form "host:port": %s`, in)
+		_, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf(`URL address does not have the form "host:port" or "[ipv6]:port": %s`, in)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("URL port must be a number up to 65535: %s", in)
 		}
-		if u.Path != "" {
+		if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
 			return nil, fmt.Errorf("URL must not contain a path: %s", in)
 		}
-		all[i] = *u
+		all[i] = url.URL{Scheme: u.Scheme, Host: strings.ToLower(u.Host)}
 	}
 	us := URLs(all)
 	us.Sort()
 
 	return us, nil
 }
+
+// ParseURLs parses the comma-separated list of URLs s as NewURLs does,
+// ignoring the empty elements.
+func ParseURLs(s string) (URLs, error) {
+	var strs []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			strs = append(strs, v)
+		}
+	}
+	return NewURLs(strs)
+}
@@ -0,0 +1,81 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewURLs(t *testing.T) {
+	tests := []struct {
+		strs []string
+		want []string
+	}{
+		{
+			[]string{"http://10.0.0.1:2379"},
+			[]string{"http://10.0.0.1:2379"},
+		},
+		// canonical scheme and host, without a trailing slash
+		{
+			[]string{" HTTP://Example.COM:2379/ ", "https://[2001:DB8::1]:2380"},
+			[]string{"http://example.com:2379", "https://[2001:db8::1]:2380"},
+		},
+		// sorted
+		{
+			[]string{"http://10.0.0.2:2379", "http://10.0.0.1:2379"},
+			[]string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"},
+		},
+	}
+	for i, tt := range tests {
+		us, err := NewURLs(tt.strs)
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+			continue
+		}
+		if g := us.StringSlice(); !reflect.DeepEqual(g, tt.want) {
+			t.Errorf("#%d: urls = %v, want %v", i, g, tt.want)
+		}
+	}
+}
+
+func TestNewURLsBad(t *testing.T) {
+	tests := [][]string{
+		{},
+		{""},
+		// missing scheme
+		{"10.0.0.1:2379"},
+		{"localhost:2379"},
+		{"//10.0.0.1:2379"},
+		{"ftp://10.0.0.1:2379"},
+		// missing or bad port
+		{"http://10.0.0.1"},
+		{"http://10.0.0.1:foo"},
+		// path, query or fragment
+		{"http://10.0.0.1:2379/v2"},
+		{"http://10.0.0.1:2379?a=b"},
+		{"http://10.0.0.1:2379#a"},
+		// one bad URL spoils the list
+		{"http://10.0.0.1:2379", "10.0.0.2:2379"},
+	}
+	for i, tt := range tests {
+		if _, err := NewURLs(tt); err == nil {
+			t.Errorf("#%d: NewURLs(%q) succeeded, want error", i, tt)
+		}
+	}
+}
+
+func TestParseURLs(t *testing.T) {
+	us, err := ParseURLs("http://10.0.0.2:2379/, ,HTTP://10.0.0.1:2379,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"}
+	if g := us.StringSlice(); !reflect.DeepEqual(g, want) {
+		t.Errorf("urls = %v, want %v", g, want)
+	}
+
+	for i, tt := range []string{"", " , ", "10.0.0.1:2379"} {
+		if _, err := ParseURLs(tt); err == nil {
+			t.Errorf("#%d: ParseURLs(%q) succeeded, want error", i, tt)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Balance tells how the proxy spreads the requests over the available
+// endpoints. Whatever the Balance, a request failing on an endpoint is sent
+// again to the next ones if it can be. A Balance implements flag.Value.
+type Balance int
+
+const (
+	// BalanceFirst sends every request to the first available endpoint.
+	BalanceFirst Balance = iota
+	// BalanceRoundRobin sends each request to the endpoint after the one
+	// the previous request was sent to.
+	BalanceRoundRobin
+	// BalanceLeastConnections sends each request to the endpoint with the
+	// fewest requests in flight, watches included.
+	BalanceLeastConnections
+)
+
+var balanceNames = []string{"first", "round-robin", "least-connections"}
+
+func (b Balance) String() string {
+	if b < BalanceFirst || b > BalanceLeastConnections {
+		return fmt.Sprintf("Balance(%d)", int(b))
+	}
+	return balanceNames[b]
+}
+
+func (b *Balance) Set(s string) error {
+	for i, name := range balanceNames {
+		if s == name {
+			*b = Balance(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("proxy: unknown balance %q", s)
+}
+
+// order reorders eps, the available endpoints, in the order a request
+// should try them. next is the number of the request.
+func (b Balance) order(eps []*endpoint, next uint64) {
+	switch b {
+	case BalanceRoundRobin:
+		if len(eps) == 0 {
+			return
+		}
+		n := int(next % uint64(len(eps)))
+		rotated := append(append([]*endpoint{}, eps[n:]...), eps[:n]...)
+		copy(eps, rotated)
+	case BalanceLeastConnections:
+		// the counts are read once, as they change while sorting
+		s := byInflight{eps: eps, n: make([]int64, len(eps))}
+		for i, ep := range eps {
+			s.n[i] = atomic.LoadInt64(&ep.inflight)
+		}
+		sort.Stable(s)
+	}
+}
+
+type byInflight struct {
+	eps []*endpoint
+	n   []int64
+}
+
+func (s byInflight) Len() int { return len(s.eps) }
+func (s byInflight) Swap(i, j int) {
+	s.eps[i], s.eps[j] = s.eps[j], s.eps[i]
+	s.n[i], s.n[j] = s.n[j], s.n[i]
+}
+func (s byInflight) Less(i, j int) bool { return s.n[i] < s.n[j] }
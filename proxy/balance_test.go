@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBalanceSet(t *testing.T) {
+	tests := []struct {
+		s    string
+		wb   Balance
+		werr bool
+	}{
+		{"first", BalanceFirst, false},
+		{"round-robin", BalanceRoundRobin, false},
+		{"least-connections", BalanceLeastConnections, false},
+		{"", BalanceFirst, true},
+		{"random", BalanceFirst, true},
+	}
+	for i, tt := range tests {
+		var b Balance
+		err := b.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if b != tt.wb {
+			t.Errorf("#%d: balance = %v, want %v", i, b, tt.wb)
+		}
+		if !tt.werr && b.String() != tt.s {
+			t.Errorf("#%d: string = %s, want %s", i, b.String(), tt.s)
+		}
+	}
+}
+
+func testDirector(b Balance, inflight ...int64) *director {
+	d := &director{balance: b}
+	for i, n := range inflight {
+		ep := newEndpoint(url.URL{Scheme: "http", Host: string('a' + byte(i))})
+		ep.inflight = n
+		d.ep = append(d.ep, ep)
+	}
+	return d
+}
+
+func hosts(eps []*endpoint) string {
+	var s string
+	for _, ep := range eps {
+		s += ep.URL.Host
+	}
+	return s
+}
+
+func TestDirectorDirect(t *testing.T) {
+	tests := []struct {
+		b        Balance
+		inflight []int64
+		dead     int
+
+		// the hosts of the endpoints directed to by successive requests
+		w []string
+	}{
+		{BalanceFirst, []int64{0, 0, 0}, -1, []string{"abc", "abc"}},
+		{BalanceRoundRobin, []int64{0, 0, 0}, -1, []string{"abc", "bca", "cab", "abc"}},
+		{BalanceRoundRobin, []int64{0, 0, 0}, 1, []string{"ac", "ca", "ac"}},
+		{BalanceLeastConnections, []int64{0, 0, 0}, -1, []string{"abc", "abc"}},
+		{BalanceLeastConnections, []int64{5, 0, 1}, -1, []string{"bca"}},
+		{BalanceLeastConnections, []int64{5, 0, 1}, 1, []string{"ca"}},
+	}
+	for i, tt := range tests {
+		d := testDirector(tt.b, tt.inflight...)
+		if tt.dead >= 0 {
+			d.ep[tt.dead].Available = false
+		}
+		var g []string
+		for range tt.w {
+			g = append(g, hosts(d.direct()))
+		}
+		if !reflect.DeepEqual(g, tt.w) {
+			t.Errorf("#%d: directed to %v, want %v", i, g, tt.w)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	var mu sync.Mutex
+	got := make([]int, 3)
+	var addrs []string
+	for i := range got {
+		i := i
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			got[i]++
+			mu.Unlock()
+		}))
+		defer s.Close()
+		addrs = append(addrs, s.Listener.Addr().String())
+	}
+	h, err := NewHandler(&http.Transport{}, addrs, 0, BalanceRoundRobin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/v2/keys/foo", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if w := []int{2, 2, 2}; !reflect.DeepEqual(got, w) {
+		t.Errorf("requests per endpoint = %v, want %v", got, w)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	saturated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer saturated.Close()
+	var idle int
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		idle++
+	}))
+	defer other.Close()
+
+	addrs := []string{saturated.Listener.Addr().String(), other.Listener.Addr().String()}
+	h, err := NewHandler(&http.Transport{}, addrs, 0, BalanceLeastConnections, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		// a watch, say, which stays in flight
+		req, _ := http.NewRequest("GET", "http://example.com/v2/keys/foo?wait=true", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-received
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/v2/keys/foo", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	close(release)
+	<-done
+	if idle != 3 {
+		t.Errorf("requests to the idle endpoint = %d, want 3", idle)
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// path under which the members serve the keys
+	keysPrefix = "/v2/keys"
+
+	// the responses are only cached while the cache holds fewer entries,
+	// and only if their body is no larger than maxCacheBody bytes
+	maxCacheEntries = 1024
+	maxCacheBody    = 64 * 1024
+)
+
+type cacheEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	index  uint64
+	expire time.Time
+}
+
+// cacheHandler serves the GET requests on keys from the responses it
+// cached for them, for ttl at most.
+type cacheHandler struct {
+	next http.Handler
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// gen is bumped at each write, so that the responses to the reads that
+	// went to the cluster before the write completed are not cached
+	gen uint64
+}
+
+// NewCacheHandler wraps hdlr so that the responses to the GET requests on
+// keys are cached for ttl, and the same requests are answered from the
+// cache meanwhile. Watches, quorum reads and the requests with credentials
+// always reach hdlr, and the writes drop the cached responses of the keys
+// they may have changed.
+//
+// A client may send the X-Etcd-Index it last saw in its request, in which
+// case it is never answered with a response cached at an older index.
+func NewCacheHandler(hdlr http.Handler, ttl time.Duration) http.Handler {
+	return &cacheHandler{
+		next:    hdlr,
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isRead(req) {
+		h.next.ServeHTTP(w, req)
+		h.invalidate(req.URL.Path)
+		return
+	}
+	if !cacheable(req) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	key := req.URL.RequestURI()
+	var minIndex uint64
+	if s := req.Header.Get("X-Etcd-Index"); s != "" {
+		minIndex, _ = strconv.ParseUint(s, 10, 64)
+	}
+	h.mu.Lock()
+	e, ok := h.entries[key]
+	if ok && time.Now().After(e.expire) {
+		delete(h.entries, key)
+		ok = false
+	}
+	gen := h.gen
+	h.mu.Unlock()
+	if ok && e.index >= minIndex {
+		copyHeader(w.Header(), e.header)
+		w.WriteHeader(e.status)
+		w.Write(e.body)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+	h.next.ServeHTTP(rw, req)
+	if rw.status != http.StatusOK || rw.overflow {
+		return
+	}
+	index, err := strconv.ParseUint(w.Header().Get("X-Etcd-Index"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if gen != h.gen {
+		return
+	}
+	if old, ok := h.entries[key]; ok && old.index > index {
+		return
+	}
+	if len(h.entries) >= maxCacheEntries {
+		h.expire()
+		if len(h.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	header := make(http.Header)
+	copyHeader(header, w.Header())
+	h.entries[key] = &cacheEntry{
+		status: rw.status,
+		header: header,
+		body:   rw.body.Bytes(),
+		index:  index,
+		expire: time.Now().Add(h.ttl),
+	}
+}
+
+// invalidate drops the cached responses that a write on p may have made
+// stale: those of the key p, of its parent directories and of the keys
+// under it. A write on any other path drops them all.
+func (h *cacheHandler) invalidate(p string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.gen++
+	if !isKeyPath(p) {
+		h.entries = make(map[string]*cacheEntry)
+		return
+	}
+	p = path.Clean(p)
+	for key := range h.entries {
+		kp := key
+		if i := strings.IndexByte(kp, '?'); i >= 0 {
+			kp = kp[:i]
+		}
+		kp = path.Clean(kp)
+		if kp == p || strings.HasPrefix(p, kp+"/") || strings.HasPrefix(kp, p+"/") {
+			delete(h.entries, key)
+		}
+	}
+}
+
+// expire drops the expired entries. It must be called with mu held.
+func (h *cacheHandler) expire() {
+	now := time.Now()
+	for key, e := range h.entries {
+		if now.After(e.expire) {
+			delete(h.entries, key)
+		}
+	}
+}
+
+// cacheable reports whether the response to req may be cached: req is a
+// GET on a key that neither waits for a change nor goes through raft. The
+// requests carrying credentials are not cached, since their response may
+// hold keys that the other clients are not permitted to read.
+func cacheable(req *http.Request) bool {
+	if req.Method != "GET" || !isKeyPath(req.URL.Path) {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		return false
+	}
+	q := req.URL.Query()
+	for _, name := range []string{"wait", "stream", "quorum"} {
+		if v, _ := strconv.ParseBool(q.Get(name)); v {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeyPath(p string) bool {
+	return p == keysPrefix || strings.HasPrefix(p, keysPrefix+"/")
+}
+
+// recordingWriter records the status and the body written through it, the
+// body up to maxCacheBody bytes.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxCacheBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeKeys answers the GETs with the number of requests it got so far as
+// etcd index, and counts the reads.
+type fakeKeys struct {
+	index int
+	reads int
+}
+
+func (f *fakeKeys) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.index++
+	if req.Method == "GET" {
+		f.reads++
+	}
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(f.index))
+	fmt.Fprintf(w, "%s %d", req.URL.Path, f.index)
+}
+
+func serveCache(h http.Handler, method, url string, header http.Header) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://example.com"+url, nil)
+	if header != nil {
+		req.Header = header
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCacheHandlerHit(t *testing.T) {
+	f := &fakeKeys{}
+	h := NewCacheHandler(f, time.Minute)
+
+	first := serveCache(h, "GET", "/v2/keys/foo", nil)
+	second := serveCache(h, "GET", "/v2/keys/foo", nil)
+	if f.reads != 1 {
+		t.Errorf("reads = %d, want 1", f.reads)
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("cached response = %d %q, want %d %q", second.Code, second.Body.String(), first.Code, first.Body.String())
+	}
+	if g := second.Header().Get("X-Etcd-Index"); g != "1" {
+		t.Errorf("X-Etcd-Index = %q, want %q", g, "1")
+	}
+
+	// the requests not cached always reach the cluster
+	for i, url := range []string{
+		"/v2/keys/foo?wait=true",
+		"/v2/keys/foo?quorum=true",
+		"/v2/stats/self",
+	} {
+		reads := f.reads
+		serveCache(h, "GET", url, nil)
+		serveCache(h, "GET", url, nil)
+		if f.reads != reads+2 {
+			t.Errorf("#%d: reads = %d, want %d", i, f.reads, reads+2)
+		}
+	}
+}
+
+// TestCacheHandlerAuthorization tests that the response to a request with
+// credentials is neither cached nor answered from the cache, so that it is
+// never replayed to another client.
+func TestCacheHandlerAuthorization(t *testing.T) {
+	f := &fakeKeys{}
+	h := NewCacheHandler(f, time.Minute)
+
+	auth := http.Header{"Authorization": {"Basic Ym9iOmI="}}
+	serveCache(h, "GET", "/v2/keys/foo", auth)
+	serveCache(h, "GET", "/v2/keys/foo", nil)
+	if f.reads != 2 {
+		t.Errorf("reads = %d, want 2", f.reads)
+	}
+	// the response cached for the client without credentials is not served
+	// to the ones with credentials either
+	serveCache(h, "GET", "/v2/keys/foo", auth)
+	if f.reads != 3 {
+		t.Errorf("reads = %d, want 3", f.reads)
+	}
+}
+
+func TestCacheHandlerIndex(t *testing.T) {
+	f := &fakeKeys{}
+	h := NewCacheHandler(f, time.Minute)
+
+	serveCache(h, "GET", "/v2/keys/foo", nil)
+	serveCache(h, "GET", "/v2/keys/foo", http.Header{"X-Etcd-Index": {"1"}})
+	if f.reads != 1 {
+		t.Errorf("reads = %d, want 1", f.reads)
+	}
+	// a client having seen a later index is not answered from the cache
+	rr := serveCache(h, "GET", "/v2/keys/foo", http.Header{"X-Etcd-Index": {"2"}})
+	if f.reads != 2 {
+		t.Errorf("reads = %d, want 2", f.reads)
+	}
+	if g := rr.Header().Get("X-Etcd-Index"); g != "2" {
+		t.Errorf("X-Etcd-Index = %q, want %q", g, "2")
+	}
+}
+
+func TestCacheHandlerExpire(t *testing.T) {
+	f := &fakeKeys{}
+	h := NewCacheHandler(f, time.Millisecond)
+
+	serveCache(h, "GET", "/v2/keys/foo", nil)
+	time.Sleep(5 * time.Millisecond)
+	serveCache(h, "GET", "/v2/keys/foo", nil)
+	if f.reads != 2 {
+		t.Errorf("reads = %d, want 2", f.reads)
+	}
+}
+
+func TestCacheHandlerInvalidate(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+
+		// the cached keys read again
+		wread []string
+	}{
+		{"PUT", "/v2/keys/foo/bar", []string{"/v2/keys", "/v2/keys/foo", "/v2/keys/foo/bar"}},
+		{"DELETE", "/v2/keys/foo", []string{"/v2/keys", "/v2/keys/foo", "/v2/keys/foo/bar"}},
+		{"POST", "/v2/keys/baz", []string{"/v2/keys", "/v2/keys/baz"}},
+		{"PUT", "/v2/keys/qux", []string{"/v2/keys"}},
+		// a write anywhere else may change any key
+		{"POST", "/v2/txn", []string{"/v2/keys", "/v2/keys/foo", "/v2/keys/foo/bar", "/v2/keys/baz"}},
+	}
+	keys := []string{"/v2/keys", "/v2/keys/foo", "/v2/keys/foo/bar", "/v2/keys/baz"}
+	for i, tt := range tests {
+		f := &fakeKeys{}
+		h := NewCacheHandler(f, time.Minute)
+		for _, k := range keys {
+			serveCache(h, "GET", k, nil)
+		}
+		serveCache(h, tt.method, tt.url, nil)
+
+		for _, k := range keys {
+			reads := f.reads
+			serveCache(h, "GET", k, nil)
+			read := f.reads != reads
+			want := false
+			for _, w := range tt.wread {
+				if w == k {
+					want = true
+				}
+			}
+			if read != want {
+				t.Errorf("#%d: %s read again = %v, want %v", i, k, read, want)
+			}
+		}
+	}
+}
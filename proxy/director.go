@@ -4,39 +4,68 @@ import (
 	"errors"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/coreos/etcd/pkg/types"
 )
 
 const (
 	// amount of time an endpoint will be held in a failed
 	// state before being reconsidered for proxied requests
 	endpointFailureWait = 5 * time.Second
+	// the wait doubles with each consecutive failure of an
+	// endpoint, up to this amount of time
+	maxEndpointFailureWait = time.Minute
 )
 
-func newDirector(scheme string, addrs []string) (*director, error) {
+func newDirector(scheme string, addrs []string, b Balance) (*director, error) {
 	if len(addrs) == 0 {
 		return nil, errors.New("one or more upstream addresses required")
 	}
 
 	endpoints := make([]*endpoint, len(addrs))
 	for i, addr := range addrs {
-		u := url.URL{Scheme: scheme, Host: addr}
+		u := url.URL{Scheme: scheme, Host: strings.ToLower(addr)}
+		// addrs may also be full URLs, such as the ones of the members
+		if strings.Contains(addr, "://") {
+			us, err := types.NewURLs([]string{addr})
+			if err != nil {
+				return nil, err
+			}
+			u = us[0]
+		}
 		endpoints[i] = newEndpoint(u)
 	}
 
-	d := director{ep: endpoints}
+	d := director{ep: endpoints, balance: b}
 	return &d, nil
 }
 
 type director struct {
+	// mu protects ep, which is replaced when the list of members of the
+	// cluster is refreshed
+	mu sync.Mutex
 	ep []*endpoint
+
+	balance Balance
+	// number of the requests directed so far
+	requests uint64
 }
 
 func (d *director) endpoints() []*endpoint {
+	d.mu.Lock()
+	eps := d.ep
+	d.mu.Unlock()
+
 	filtered := make([]*endpoint, 0)
-	for _, ep := range d.ep {
-		if ep.Available {
+	for _, ep := range eps {
+		ep.Lock()
+		available := ep.Available
+		ep.Unlock()
+		if available {
 			filtered = append(filtered, ep)
 		}
 	}
@@ -44,6 +73,35 @@ func (d *director) endpoints() []*endpoint {
 	return filtered
 }
 
+// direct returns the available endpoints in the order the next request
+// should try them, according to the Balance of d.
+func (d *director) direct() []*endpoint {
+	eps := d.endpoints()
+	d.balance.order(eps, atomic.AddUint64(&d.requests, 1)-1)
+	return eps
+}
+
+// update replaces the endpoints of d with the given URLs. The endpoints whose
+// URL is still in the list are kept, along with their availability.
+func (d *director) update(urls []url.URL) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old := make(map[string]*endpoint)
+	for _, ep := range d.ep {
+		old[ep.URL.String()] = ep
+	}
+	eps := make([]*endpoint, len(urls))
+	for i, u := range urls {
+		if ep, ok := old[u.String()]; ok {
+			eps[i] = ep
+		} else {
+			eps[i] = newEndpoint(u)
+		}
+	}
+	d.ep = eps
+}
+
 func newEndpoint(u url.URL) *endpoint {
 	ep := endpoint{
 		URL:       u,
@@ -57,9 +115,15 @@ func newEndpoint(u url.URL) *endpoint {
 type endpoint struct {
 	sync.Mutex
 
+	// number of the requests in flight to the endpoint, accessed
+	// atomically
+	inflight int64
+
 	URL       url.URL
 	Available bool
 
+	// number of consecutive failures of the endpoint
+	failures int
 	failFunc func(ep *endpoint)
 }
 
@@ -71,6 +135,7 @@ func (ep *endpoint) Failed() {
 	}
 
 	ep.Available = false
+	ep.failures++
 	ep.Unlock()
 
 	log.Printf("proxy: marked endpoint %s unavailable", ep.URL.String())
@@ -83,10 +148,30 @@ func (ep *endpoint) Failed() {
 	ep.failFunc(ep)
 }
 
+// Succeeded resets the count of consecutive failures of the endpoint.
+func (ep *endpoint) Succeeded() {
+	ep.Lock()
+	ep.failures = 0
+	ep.Unlock()
+}
+
+// timedUnavailabilityFunc makes an endpoint available again after wait,
+// doubled for each consecutive failure of the endpoint but the first.
 func timedUnavailabilityFunc(wait time.Duration) func(*endpoint) {
 	return func(ep *endpoint) {
-		time.AfterFunc(wait, func() {
+		ep.Lock()
+		d := wait
+		for i := 1; i < ep.failures && d < maxEndpointFailureWait; i++ {
+			d *= 2
+		}
+		ep.Unlock()
+		if d > maxEndpointFailureWait {
+			d = maxEndpointFailureWait
+		}
+		time.AfterFunc(d, func() {
+			ep.Lock()
 			ep.Available = true
+			ep.Unlock()
 			log.Printf("proxy: marked endpoint %s available", ep.URL.String())
 		})
 	}
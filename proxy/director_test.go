@@ -23,6 +23,18 @@ func TestNewDirectorScheme(t *testing.T) {
 			want:   []string{"https://192.0.2.8:4002", "https://example.com:8080"},
 		},
 
+		// accept full URLs
+		{
+			scheme: "http",
+			addrs:  []string{"https://192.0.2.8:4002"},
+			want:   []string{"https://192.0.2.8:4002"},
+		},
+		// full URLs are canonical
+		{
+			scheme: "http",
+			addrs:  []string{"HTTPS://Example.COM:4002/"},
+			want:   []string{"https://example.com:4002"},
+		},
 		// accept addrs without a port
 		{
 			scheme: "http",
@@ -39,7 +51,7 @@ func TestNewDirectorScheme(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		got, err := newDirector(tt.scheme, tt.addrs)
+		got, err := newDirector(tt.scheme, tt.addrs, BalanceFirst)
 		if err != nil {
 			t.Errorf("#%d: newDirectory returned unexpected error: %v", i, err)
 		}
@@ -53,6 +65,19 @@ func TestNewDirectorScheme(t *testing.T) {
 	}
 }
 
+func TestNewDirectorBadURL(t *testing.T) {
+	tests := []string{
+		"http://192.0.2.8:4002/v2/keys",
+		"ftp://192.0.2.8:4002",
+		"http://192.0.2.8",
+	}
+	for i, tt := range tests {
+		if _, err := newDirector("http", []string{tt}, BalanceFirst); err == nil {
+			t.Errorf("#%d: newDirector(%q) succeeded, want error", i, tt)
+		}
+	}
+}
+
 func TestDirectorEndpointsFiltering(t *testing.T) {
 	d := director{
 		ep: []*endpoint{
@@ -79,3 +104,27 @@ func TestDirectorEndpointsFiltering(t *testing.T) {
 		t.Fatalf("directed to incorrect endpoint: want = %#v, got = %#v", want, got)
 	}
 }
+
+func TestDirectorUpdate(t *testing.T) {
+	d, err := newDirector("http", []string{"192.0.2.1:4001", "192.0.2.2:4001"}, BalanceFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := d.ep[1]
+	kept.Available = false
+
+	d.update([]url.URL{
+		{Scheme: "http", Host: "192.0.2.2:4001"},
+		{Scheme: "http", Host: "192.0.2.3:4001"},
+	})
+	if len(d.ep) != 2 {
+		t.Fatalf("len(endpoints) = %d, want 2", len(d.ep))
+	}
+	if d.ep[0] != kept {
+		t.Errorf("endpoint of a remaining member was not kept")
+	}
+	eps := d.endpoints()
+	if len(eps) != 1 || eps[0].URL.Host != "192.0.2.3:4001" {
+		t.Errorf("available endpoints = %v, want the new member only", eps)
+	}
+}
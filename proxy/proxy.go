@@ -1,32 +1,160 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
 )
 
-func NewHandler(t *http.Transport, addrs []string) (http.Handler, error) {
+// path where the members serve the client URLs of the cluster
+const machinesPath = "/v2/machines"
+
+// A Refresher refreshes the members of the cluster at an interval that may
+// change while it serves. The handlers created by NewHandler are
+// Refreshers.
+type Refresher interface {
+	// SetRefreshInterval changes the interval at which the members are
+	// refreshed. Zero stops refreshing them.
+	SetRefreshInterval(d time.Duration)
+}
+
+// NewHandler creates a proxy that directs requests to the given addresses.
+// If refreshInterval is not zero, the proxy asks its endpoints for the
+// members of the cluster at that interval, and directs requests to them.
+// The requests are spread over the endpoints according to b.
+//
+// The proxy adds the client IP to the X-Forwarded-For header of the
+// requests, after the addresses already there only if trustForwardedFor,
+// as when the clients reach it through other proxies. It sends an
+// X-Request-Id with each request, the client's or a new one, and responds
+// with it.
+func NewHandler(t *http.Transport, addrs []string, refreshInterval time.Duration, b Balance, trustForwardedFor bool) (http.Handler, error) {
 	scheme := "http"
 	if t.TLSClientConfig != nil {
 		scheme = "https"
 	}
 
-	d, err := newDirector(scheme, addrs)
+	d, err := newDirector(scheme, addrs, b)
 	if err != nil {
 		return nil, err
 	}
 
 	rp := reverseProxy{
-		director:  d,
-		transport: t,
+		director:          d,
+		transport:         t,
+		trustForwardedFor: trustForwardedFor,
+		refreshInterval:   int64(refreshInterval),
+		intervalc:         make(chan struct{}, 1),
 	}
+	go rp.refreshLoop()
 
 	return &rp, nil
 }
 
+func (p *reverseProxy) SetRefreshInterval(d time.Duration) {
+	atomic.StoreInt64(&p.refreshInterval, int64(d))
+	select {
+	case p.intervalc <- struct{}{}:
+	default:
+	}
+}
+
+// refreshLoop refreshes the members at the current interval, counted
+// again from when it changes.
+func (p *reverseProxy) refreshLoop() {
+	for {
+		var t *time.Timer
+		var tc <-chan time.Time
+		if d := time.Duration(atomic.LoadInt64(&p.refreshInterval)); d > 0 {
+			t = time.NewTimer(d)
+			tc = t.C
+		}
+		select {
+		case <-tc:
+			if err := p.refresh(); err != nil {
+				log.Printf("proxy: %v", err)
+			}
+		case <-p.intervalc:
+			if t != nil {
+				t.Stop()
+			}
+		}
+	}
+}
+
+// refresh asks the available endpoints in turn for the client URLs of the
+// members of the cluster, and directs the following requests to them.
+func (p *reverseProxy) refresh() error {
+	for _, ep := range p.director.endpoints() {
+		urls, err := p.fetchMachines(ep.URL)
+		if err != nil {
+			log.Printf("proxy: failed to fetch members from %s: %v", ep.URL.String(), err)
+			continue
+		}
+		p.director.update(urls)
+		return nil
+	}
+	return errors.New("unable to fetch members from any endpoint")
+}
+
+func (p *reverseProxy) fetchMachines(u url.URL) ([]url.URL, error) {
+	u.Path = machinesPath
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty list is an error too, so that the current endpoints are kept
+	// rather than having none at all
+	urls, err := types.ParseURLs(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid member list: %v", err)
+	}
+	return urls, nil
+}
+
+// isRead reports whether req only reads from the cluster. Reads are the
+// GET and HEAD requests on any path, which include the watches, long
+// polling with GET and ?wait=true. Every other method may write.
+func isRead(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD":
+		return true
+	default:
+		return false
+	}
+}
+
 func readonlyHandlerFunc(next http.Handler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "GET" {
-			w.WriteHeader(http.StatusNotImplemented)
+		if !isRead(req) {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			b, _ := json.Marshal(map[string]string{
+				"message": fmt.Sprintf("proxy is read-only: %s requests are not allowed", req.Method),
+			})
+			w.Write(b)
 			return
 		}
 
@@ -34,6 +162,8 @@ func readonlyHandlerFunc(next http.Handler) func(http.ResponseWriter, *http.Requ
 	}
 }
 
+// NewReadonlyHandler wraps hdlr so that only the requests reading from the
+// cluster reach it. The others are refused with 403 Forbidden.
 func NewReadonlyHandler(hdlr http.Handler) http.Handler {
 	readonly := readonlyHandlerFunc(hdlr)
 	return http.HandlerFunc(readonly)
@@ -1,39 +1,166 @@
 package proxy
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestReadonlyHandler(t *testing.T) {
-	fixture := func(w http.ResponseWriter, req *http.Request) {
+	var forwarded []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = append(forwarded, req.Method+" "+req.URL.RequestURI())
 		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	h, err := NewHandler(&http.Transport{}, []string{backend.Listener.Addr().String()}, 0, BalanceFirst, true)
+	if err != nil {
+		t.Fatal(err)
 	}
-	hdlrFunc := readonlyHandlerFunc(http.HandlerFunc(fixture))
+	h = NewReadonlyHandler(h)
 
 	tests := []struct {
 		method string
+		url    string
 		want   int
 	}{
-		// GET is only passing method
-		{"GET", http.StatusOK},
+		// reads, including watches, are forwarded
+		{"GET", "/v2/keys/foo", http.StatusOK},
+		{"GET", "/v2/keys/foo?wait=true", http.StatusOK},
+		{"HEAD", "/v2/keys/foo", http.StatusOK},
 
-		// everything but GET is StatusNotImplemented
-		{"POST", http.StatusNotImplemented},
-		{"PUT", http.StatusNotImplemented},
-		{"PATCH", http.StatusNotImplemented},
-		{"DELETE", http.StatusNotImplemented},
-		{"FOO", http.StatusNotImplemented},
+		// everything else is refused
+		{"POST", "/v2/keys/foo", http.StatusForbidden},
+		{"PUT", "/v2/keys/foo", http.StatusForbidden},
+		{"PATCH", "/v2/keys/foo", http.StatusForbidden},
+		{"DELETE", "/v2/keys/foo", http.StatusForbidden},
+		{"DELETE", "/v2/admin/members/1", http.StatusForbidden},
+		{"FOO", "/v2/keys/foo", http.StatusForbidden},
 	}
 
 	for i, tt := range tests {
-		req, _ := http.NewRequest(tt.method, "http://example.com", nil)
+		forwarded = nil
+		req, _ := http.NewRequest(tt.method, "http://example.com"+tt.url, nil)
 		rr := httptest.NewRecorder()
-		hdlrFunc(rr, req)
+		h.ServeHTTP(rr, req)
 
 		if tt.want != rr.Code {
 			t.Errorf("#%d: incorrect HTTP status code: method=%s want=%d got=%d", i, tt.method, tt.want, rr.Code)
 		}
+		if tt.want != http.StatusForbidden {
+			if w := []string{tt.method + " " + tt.url}; !reflect.DeepEqual(forwarded, w) {
+				t.Errorf("#%d: forwarded = %v, want %v", i, forwarded, w)
+			}
+			continue
+		}
+		if len(forwarded) != 0 {
+			t.Errorf("#%d: forwarded = %v, want nothing", i, forwarded)
+		}
+		var body struct{ Message string }
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || !strings.Contains(body.Message, "read-only") {
+			t.Errorf("#%d: body = %q, want a JSON read-only message", i, rr.Body.String())
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	added := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer added.Close()
+	var machines string
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == machinesPath {
+			w.Write([]byte(machines))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer first.Close()
+
+	h, err := NewHandler(&http.Transport{}, []string{first.Listener.Addr().String()}, 0, BalanceFirst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := h.(*reverseProxy)
+	get := func() int {
+		req, _ := http.NewRequest("GET", "http://example.com/v2/keys/foo", nil)
+		rr := httptest.NewRecorder()
+		rp.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if g := get(); g != http.StatusOK {
+		t.Fatalf("code = %d, want %d", g, http.StatusOK)
+	}
+
+	// a bad member list leaves the endpoints untouched
+	machines = ""
+	if err := rp.refresh(); err == nil {
+		t.Errorf("refresh with empty member list succeeded")
+	}
+	if g := get(); g != http.StatusOK {
+		t.Errorf("code = %d, want %d", g, http.StatusOK)
+	}
+
+	// the first member is removed and another one is added
+	machines = added.URL
+	if err := rp.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if g := get(); g != http.StatusCreated {
+		t.Errorf("code = %d, want %d", g, http.StatusCreated)
+	}
+	eps := rp.director.endpoints()
+	if len(eps) != 1 || eps[0].URL.String() != added.URL {
+		t.Errorf("endpoints = %v, want %s", eps, added.URL)
+	}
+}
+
+func TestSetRefreshInterval(t *testing.T) {
+	fetched := make(chan struct{}, 10)
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == machinesPath {
+			w.Write([]byte(backend.URL))
+			select {
+			case fetched <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	defer backend.Close()
+
+	h, err := NewHandler(&http.Transport{}, []string{backend.Listener.Addr().String()}, 0, BalanceFirst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fetched:
+		t.Fatalf("members refreshed with a zero interval")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rp := h.(Refresher)
+	rp.SetRefreshInterval(time.Millisecond)
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("members not refreshed after setting the interval")
+	}
+
+	rp.SetRefreshInterval(0)
+	// a refresh may be in flight as it is stopped
+	time.Sleep(20 * time.Millisecond)
+	for len(fetched) > 0 {
+		<-fetched
+	}
+	select {
+	case <-fetched:
+		t.Errorf("members refreshed after the interval is set back to zero")
+	case <-time.After(50 * time.Millisecond):
 	}
 }
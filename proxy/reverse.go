@@ -1,12 +1,18 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -23,6 +29,15 @@ var singleHopHeaders = []string{
 	"Upgrade",
 }
 
+// maxReplayBytes is the most of a request body buffered to send it again to
+// the next endpoint. A request with a larger body is streamed to a single
+// endpoint, and not retried.
+const maxReplayBytes = 1024 * 1024
+
+// requestIDHeader carries the ID of a request through the proxy to the
+// member serving it, so that their logs can be matched.
+const requestIDHeader = "X-Request-Id"
+
 func removeSingleHopHeaders(hdrs *http.Header) {
 	for _, h := range singleHopHeaders {
 		hdrs.Del(h)
@@ -32,6 +47,15 @@ func removeSingleHopHeaders(hdrs *http.Header) {
 type reverseProxy struct {
 	director  *director
 	transport http.RoundTripper
+
+	// trustForwardedFor keeps the X-Forwarded-For addresses sent by the
+	// client, rather than replacing them with its own
+	trustForwardedFor bool
+
+	// refreshInterval, in nanoseconds, is read atomically as it may change
+	// while serving; intervalc wakes refreshLoop up when it does
+	refreshInterval int64
+	intervalc       chan struct{}
 }
 
 func (p *reverseProxy) ServeHTTP(rw http.ResponseWriter, clientreq *http.Request) {
@@ -44,33 +68,78 @@ func (p *reverseProxy) ServeHTTP(rw http.ResponseWriter, clientreq *http.Request
 
 	normalizeRequest(proxyreq)
 	removeSingleHopHeaders(&proxyreq.Header)
-	maybeSetForwardedFor(proxyreq)
+	maybeSetForwardedFor(proxyreq, p.trustForwardedFor)
+	id := setRequestID(proxyreq)
+	rw.Header().Set(requestIDHeader, id)
 
-	endpoints := p.director.endpoints()
+	endpoints := p.director.direct()
 	if len(endpoints) == 0 {
-		log.Printf("proxy: zero endpoints currently available")
+		log.Printf("proxy: zero endpoints currently available for request %s", id)
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
+	// only idempotent requests are sent again to the next endpoint, as
+	// the failed endpoint may have applied the request already. Their
+	// body is buffered so that it can be sent again, unless it is larger
+	// than maxReplayBytes.
+	retry := isIdempotent(proxyreq.Method)
+	var body []byte
+	if retry && proxyreq.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(proxyreq.Body, maxReplayBytes+1)); err != nil {
+			log.Printf("proxy: failed to read body of request %s: %v", id, err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxReplayBytes {
+			proxyreq.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), proxyreq.Body), proxyreq.Body}
+			body = nil
+			retry = false
+		}
+	}
+
 	var res *http.Response
 	var err error
 
-	for _, ep := range endpoints {
+	for i, ep := range endpoints {
+		if body != nil {
+			proxyreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
 		redirectRequest(proxyreq, ep.URL)
 
+		atomic.AddInt64(&ep.inflight, 1)
 		res, err = p.transport.RoundTrip(proxyreq)
 		if err != nil {
-			log.Printf("proxy: failed to direct request to %s: %v", ep.URL.String(), err)
+			atomic.AddInt64(&ep.inflight, -1)
+			log.Printf("proxy: failed to direct request %s to %s: %v", id, ep.URL.String(), err)
 			ep.Failed()
+			if !retry {
+				break
+			}
+			continue
+		}
+		ep.Succeeded()
+
+		if res.StatusCode >= 500 && retry && i < len(endpoints)-1 {
+			log.Printf("proxy: %s responded %d to request %s, retrying on the next endpoint", ep.URL.String(), res.StatusCode, id)
+			res.Body.Close()
+			atomic.AddInt64(&ep.inflight, -1)
+			res = nil
 			continue
 		}
 
+		// the request is in flight until its response is copied, which
+		// lasts as long as a watch
+		defer atomic.AddInt64(&ep.inflight, -1)
 		break
 	}
 
 	if res == nil {
-		log.Printf("proxy: unable to get response from %d endpoint(s)", len(endpoints))
+		log.Printf("proxy: unable to get response to request %s from %d endpoint(s)", id, len(endpoints))
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
@@ -79,11 +148,62 @@ func (p *reverseProxy) ServeHTTP(rw http.ResponseWriter, clientreq *http.Request
 
 	removeSingleHopHeaders(&res.Header)
 	copyHeader(rw.Header(), res.Header)
+	rw.Header().Set(requestIDHeader, id)
 
 	rw.WriteHeader(res.StatusCode)
+	if isWatch(clientreq) {
+		copyFlushing(rw, res.Body)
+		return
+	}
 	io.Copy(rw, res.Body)
 }
 
+// isWatch reports whether req waits for changes, so that its response may
+// be sent a bit at a time, as long as the watch lasts.
+func isWatch(req *http.Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	wait, _ := strconv.ParseBool(req.URL.Query().Get("wait"))
+	return wait
+}
+
+// copyFlushing copies src to w, flushing w at once and after each read, so
+// that the client gets each event of a watch as soon as it is sent rather
+// than when the buffer of w is full.
+func copyFlushing(w http.ResponseWriter, src io.Reader) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		io.Copy(w, src)
+		return
+	}
+	f.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			f.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isIdempotent reports whether sending a request of the given method more
+// than once has the same effect as sending it once. A POST creates a new
+// in-order key each time it is applied.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -104,7 +224,13 @@ func normalizeRequest(req *http.Request) {
 	req.Close = false
 }
 
-func maybeSetForwardedFor(req *http.Request) {
+// maybeSetForwardedFor adds the client IP of req to its X-Forwarded-For
+// header. Unless trust, the addresses the client sent, which it may have
+// made up, are dropped.
+func maybeSetForwardedFor(req *http.Request, trust bool) {
+	if !trust {
+		req.Header.Del("X-Forwarded-For")
+	}
 	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		return
@@ -118,3 +244,16 @@ func maybeSetForwardedFor(req *http.Request) {
 	}
 	req.Header.Set("X-Forwarded-For", clientIP)
 }
+
+// setRequestID gives req a new random X-Request-Id unless it has one, and
+// returns it.
+func setRequestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	req.Header.Set(requestIDHeader, id)
+	return id
+}
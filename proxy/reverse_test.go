@@ -1,14 +1,18 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type staticRoundTripper struct {
@@ -62,7 +66,7 @@ func TestReverseProxyServe(t *testing.T) {
 
 	for i, tt := range tests {
 		rp := reverseProxy{
-			director:  &director{tt.eps},
+			director:  &director{ep: tt.eps},
 			transport: tt.rt,
 		}
 
@@ -115,21 +119,27 @@ func TestMaybeSetForwardedFor(t *testing.T) {
 	tests := []struct {
 		raddr  string
 		fwdFor string
+		trust  bool
 		want   string
 	}{
-		{"192.0.2.3:8002", "", "192.0.2.3"},
-		{"192.0.2.3:8002", "192.0.2.2", "192.0.2.2, 192.0.2.3"},
-		{"192.0.2.3:8002", "192.0.2.1, 192.0.2.2", "192.0.2.1, 192.0.2.2, 192.0.2.3"},
-		{"example.com:8002", "", "example.com"},
+		{"192.0.2.3:8002", "", true, "192.0.2.3"},
+		{"192.0.2.3:8002", "192.0.2.2", true, "192.0.2.2, 192.0.2.3"},
+		{"192.0.2.3:8002", "192.0.2.1, 192.0.2.2", true, "192.0.2.1, 192.0.2.2, 192.0.2.3"},
+		{"example.com:8002", "", true, "example.com"},
+
+		// the addresses sent by an untrusted client are dropped
+		{"192.0.2.3:8002", "", false, "192.0.2.3"},
+		{"192.0.2.3:8002", "192.0.2.2", false, "192.0.2.3"},
 
 		// While these cases look valid, golang net/http will not let it happen
 		// The RemoteAddr field will always be a valid host:port
-		{":8002", "", ""},
-		{"192.0.2.3", "", ""},
+		{":8002", "", true, ""},
+		{"192.0.2.3", "", true, ""},
 
 		// blatantly invalid host w/o a port
-		{"12", "", ""},
-		{"12", "192.0.2.3", "192.0.2.3"},
+		{"12", "", true, ""},
+		{"12", "192.0.2.3", true, "192.0.2.3"},
+		{"12", "192.0.2.3", false, ""},
 	}
 
 	for i, tt := range tests {
@@ -142,7 +152,7 @@ func TestMaybeSetForwardedFor(t *testing.T) {
 			req.Header.Set("X-Forwarded-For", tt.fwdFor)
 		}
 
-		maybeSetForwardedFor(req)
+		maybeSetForwardedFor(req, tt.trust)
 		got := req.Header.Get("X-Forwarded-For")
 		if tt.want != got {
 			t.Errorf("#%d: incorrect header: want = %q, got = %q", i, tt.want, got)
@@ -157,10 +167,10 @@ func TestRemoveSingleHopHeaders(t *testing.T) {
 		"Keep-Alive":          []string{"foo"},
 		"Proxy-Authenticate":  []string{"Basic realm=example.com"},
 		"Proxy-Authorization": []string{"foo"},
-		"Te":                []string{"deflate,gzip"},
-		"Trailers":          []string{"ETag"},
-		"Transfer-Encoding": []string{"chunked"},
-		"Upgrade":           []string{"WebSocket"},
+		"Te":                  []string{"deflate,gzip"},
+		"Trailers":            []string{"ETag"},
+		"Transfer-Encoding":   []string{"chunked"},
+		"Upgrade":             []string{"WebSocket"},
 
 		// headers that should persist
 		"Accept": []string{"application/json"},
@@ -225,3 +235,241 @@ func TestCopyHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestReverseProxyFailover(t *testing.T) {
+	var bodies []string
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer live.Close()
+	// a closed server refuses connections
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	tests := []struct {
+		method string
+		addrs  []string
+
+		wcode   int
+		wbodies []string
+	}{
+		{"GET", []string{dead.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusCreated, []string{""}},
+		{"PUT", []string{dead.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusCreated, []string{"value=bar"}},
+		{"PUT", []string{broken.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusCreated, []string{"value=bar"}},
+		// the last response is returned if all endpoints fail
+		{"PUT", []string{live.Listener.Addr().String(), broken.Listener.Addr().String()}, http.StatusCreated, []string{"value=bar"}},
+		{"PUT", []string{dead.Listener.Addr().String(), broken.Listener.Addr().String()}, http.StatusInternalServerError, nil},
+		// POST is not idempotent, so it is not retried
+		{"POST", []string{dead.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusBadGateway, nil},
+		{"POST", []string{broken.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusInternalServerError, nil},
+	}
+	for i, tt := range tests {
+		bodies = nil
+		h, err := NewHandler(&http.Transport{}, tt.addrs, 0, BalanceFirst, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body *bytes.Reader
+		if tt.method != "GET" {
+			body = bytes.NewReader([]byte("value=bar"))
+		} else {
+			body = bytes.NewReader(nil)
+		}
+		req, _ := http.NewRequest(tt.method, "http://192.0.2.2:4001/v2/keys/foo", body)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rr.Code, tt.wcode)
+		}
+		if !reflect.DeepEqual(bodies, tt.wbodies) {
+			t.Errorf("#%d: bodies = %q, want %q", i, bodies, tt.wbodies)
+		}
+	}
+}
+
+// TestReverseProxyForwardHeaders tests that the backend gets the client
+// address in X-Forwarded-For, and the X-Request-Id of the client or a new
+// one, which is sent back to the client.
+func TestReverseProxyForwardHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		trust  bool
+		fwdFor string
+		id     string
+
+		wfwdFor string
+	}{
+		{true, "", "", "192.0.2.3"},
+		{true, "192.0.2.2", "foo", "192.0.2.2, 192.0.2.3"},
+		{false, "192.0.2.2", "foo", "192.0.2.3"},
+	}
+	for i, tt := range tests {
+		got = nil
+		h, err := NewHandler(&http.Transport{}, []string{backend.Listener.Addr().String()}, 0, BalanceFirst, tt.trust)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "http://192.0.2.2:4001/v2/keys/foo", nil)
+		req.RemoteAddr = "192.0.2.3:8002"
+		if tt.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.fwdFor)
+		}
+		if tt.id != "" {
+			req.Header.Set("X-Request-Id", tt.id)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("#%d: code = %d, want %d", i, rr.Code, http.StatusOK)
+		}
+		if g := got.Get("X-Forwarded-For"); g != tt.wfwdFor {
+			t.Errorf("#%d: X-Forwarded-For = %q, want %q", i, g, tt.wfwdFor)
+		}
+		id := got.Get("X-Request-Id")
+		if tt.id != "" && id != tt.id {
+			t.Errorf("#%d: X-Request-Id = %q, want %q", i, id, tt.id)
+		}
+		if id == "" {
+			t.Errorf("#%d: X-Request-Id is not set", i)
+		}
+		if g := rr.Header().Get("X-Request-Id"); g != id {
+			t.Errorf("#%d: response X-Request-Id = %q, want %q", i, g, id)
+		}
+	}
+}
+
+// TestReverseProxyLargeBody tests that a body larger than maxReplayBytes
+// is streamed whole to the first endpoint, and not sent again.
+func TestReverseProxyLargeBody(t *testing.T) {
+	var sizes []int
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		sizes = append(sizes, len(b))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	tests := []struct {
+		addrs []string
+
+		wcode  int
+		wsizes []int
+	}{
+		{[]string{live.Listener.Addr().String()}, http.StatusCreated, []int{maxReplayBytes + 1}},
+		{[]string{dead.Listener.Addr().String(), live.Listener.Addr().String()}, http.StatusBadGateway, nil},
+	}
+	for i, tt := range tests {
+		sizes = nil
+		h, err := NewHandler(&http.Transport{}, tt.addrs, 0, BalanceFirst, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("PUT", "http://192.0.2.2:4001/v2/keys/foo", bytes.NewReader(make([]byte, maxReplayBytes+1)))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rr.Code, tt.wcode)
+		}
+		if !reflect.DeepEqual(sizes, tt.wsizes) {
+			t.Errorf("#%d: sizes = %v, want %v", i, sizes, tt.wsizes)
+		}
+	}
+}
+
+// TestReverseProxyStreamWatch tests that the events of a streaming watch
+// reach the client through the proxy as they are sent, and not when the
+// response ends.
+func TestReverseProxyStreamWatch(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "event1\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "event2\n")
+	}))
+	defer backend.Close()
+	h, err := NewHandler(&http.Transport{}, []string{backend.Listener.Addr().String()}, 0, BalanceFirst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	// the backend is released before the servers are closed, even when
+	// the test fails
+	var once sync.Once
+	release := func() { once.Do(func() { close(next) }) }
+	defer release()
+
+	linec := make(chan string, 2)
+	go func() {
+		defer close(linec)
+		// without flushing, even the headers wait for the response to end
+		resp, err := http.Get(s.URL + "/v2/keys/foo?wait=true&stream=true")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		br := bufio.NewReader(resp.Body)
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			linec <- l
+		}
+	}()
+
+	select {
+	case l := <-linec:
+		if l != "event1\n" {
+			t.Fatalf("line = %q, want %q", l, "event1\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("first event is not delivered before the response ends")
+	}
+	release()
+	select {
+	case l := <-linec:
+		if l != "event2\n" {
+			t.Errorf("line = %q, want %q", l, "event2\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second event is not delivered")
+	}
+}
+
+func TestEndpointFailures(t *testing.T) {
+	var failures []int
+	ep := &endpoint{Available: true}
+	ep.failFunc = func(ep *endpoint) {
+		failures = append(failures, ep.failures)
+		ep.Available = true
+	}
+	ep.Failed()
+	ep.Failed()
+	ep.Succeeded()
+	ep.Failed()
+	w := []int{1, 2, 1}
+	if !reflect.DeepEqual(failures, w) {
+		t.Errorf("failures = %v, want %v", failures, w)
+	}
+}
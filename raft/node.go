@@ -2,8 +2,9 @@ package raft
 
 import (
 	"errors"
-	"log"
+	"sync/atomic"
 
+	"github.com/coreos/etcd/pkg/logger"
 	pb "github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/third_party/code.google.com/p/go.net/context"
 )
@@ -11,6 +12,10 @@ import (
 var (
 	emptyState = pb.HardState{}
 	ErrStopped = errors.New("raft: stopped")
+	// ErrProposalDropped is returned by Propose when it gives up while the
+	// node knows no leader to send the proposal to, so that it can be told
+	// apart from a proposal timing out in the cluster.
+	ErrProposalDropped = errors.New("raft: proposal dropped, no leader")
 )
 
 // SoftState provides state that is useful for logging and debugging.
@@ -19,10 +24,15 @@ type SoftState struct {
 	Lead       int64
 	RaftState  StateType
 	ShouldStop bool
+	// LeaseValid is true while the node is a leader holding a lease, see
+	// LeaderLease. Its ReadIndex requests are then served without a round
+	// trip to the cluster.
+	LeaseValid bool
 }
 
 func (a *SoftState) equal(b *SoftState) bool {
-	return a.Lead == b.Lead && a.RaftState == b.RaftState && a.ShouldStop == b.ShouldStop
+	return a.Lead == b.Lead && a.RaftState == b.RaftState && a.ShouldStop == b.ShouldStop &&
+		a.LeaseValid == b.LeaseValid
 }
 
 // Ready encapsulates the entries and messages that are ready to read,
@@ -54,6 +64,18 @@ type Ready struct {
 	// Messages specifies outbound messages to be sent AFTER Entries are
 	// committed to stable storage.
 	Messages []pb.Message
+
+	// ReadStates specifies the results of the ReadIndex requests that have
+	// been confirmed by a quorum of the cluster.
+	ReadStates []ReadState
+}
+
+// ReadState is the result of a ReadIndex request. Once the state machine
+// has applied all the entries up to Index, reads started before the request
+// was issued are guaranteed to be served with up-to-date data.
+type ReadState struct {
+	Index      int64
+	RequestCtx []byte
 }
 
 func isHardStateEqual(a, b pb.HardState) bool {
@@ -70,7 +92,8 @@ func IsEmptySnap(sp pb.Snapshot) bool {
 
 func (rd Ready) containsUpdates() bool {
 	return rd.SoftState != nil || !IsEmptyHardState(rd.HardState) || !IsEmptySnap(rd.Snapshot) ||
-		len(rd.Entries) > 0 || len(rd.CommittedEntries) > 0 || len(rd.Messages) > 0
+		len(rd.Entries) > 0 || len(rd.CommittedEntries) > 0 || len(rd.Messages) > 0 ||
+		len(rd.ReadStates) > 0
 }
 
 type Node interface {
@@ -79,31 +102,104 @@ type Node interface {
 	Tick()
 	// Campaign causes the Node to transition to candidate state and start campaigning to become leader.
 	Campaign(ctx context.Context) error
-	// Propose proposes that data be appended to the log.
+	// Propose proposes that data be appended to the log. It blocks while
+	// the node knows no leader, and returns ErrProposalDropped if the
+	// deadline of ctx passes before one is elected.
 	Propose(ctx context.Context, data []byte) error
 	// ProposeConfChange proposes config change.
 	// At most one ConfChange can be in the process of going through consensus.
 	// Application needs to call ApplyConfChange when applying EntryConfChange type entry.
 	ProposeConfChange(ctx context.Context, cc pb.ConfChange) error
+	// ReadIndex requests the index up to which the state machine must have
+	// applied entries to serve a linearizable read. The leader confirms
+	// with a quorum of the cluster that it is still the leader before
+	// handing out its commit index, which will show up in Ready.ReadStates
+	// along with rctx. The request may be dropped silently, e.g. while
+	// there is no leader, so callers should time out and retry.
+	ReadIndex(ctx context.Context, rctx []byte) error
 	// Step advances the state machine using the given message. ctx.Err() will be returned, if any.
 	Step(ctx context.Context, msg pb.Message) error
 	// Ready returns a channel that returns the current point-in-time state
 	Ready() <-chan Ready
 	// ApplyConfChange applies config change to the local node.
-	// TODO: reject existing node when add node
-	// TODO: reject non-existant node when remove node
+	// An application rejecting a committed change calls it with the
+	// NodeID of the change set to None, which applies nothing but lets
+	// raft accept the next config change.
 	ApplyConfChange(cc pb.ConfChange)
 	// Stop performs any necessary termination of the Node
 	Stop()
-	// Compact
-	Compact(d []byte)
+	// Snapshot records d, the state of the application once it applied
+	// the entries up to the last one handed out in Ready, as the snapshot
+	// sent to the followers missing entries that were compacted. The new
+	// snapshot shows up in Ready, to be saved to stable storage.
+	Snapshot(d []byte)
+	// Compact discards the log entries up to index, but never past the
+	// index of the snapshot: a follower missing them would be sent a
+	// snapshot that does not catch it up. The entries kept after the
+	// compacted index catch up the followers behind it by little.
+	Compact(index int64)
+	// Status returns the current state of the Node, for debugging.
+	Status() Status
+}
+
+// Status is the state of a Node, for debugging. It carries no entry.
+type Status struct {
+	ID int64
+	pb.HardState
+	SoftState
+	// Applied is the index of the last committed entry handed out in
+	// Ready to be applied.
+	Applied int64
+	// Progress is the replication progress of each member of the cluster,
+	// which only a leader knows. It is nil on the others.
+	Progress map[int64]Progress
+}
+
+// Progress is the replication progress of a member, as known by the leader.
+type Progress struct {
+	// Match is the index of the last entry known to be in the log of
+	// the member, and Next the index of the next entry to send to it.
+	Match, Next int64
+}
+
+// Option configures an optional behaviour of a Node.
+type Option func(r *raft)
+
+// PreVote makes the Node run a pre-election before campaigning: it moves to
+// the next term only if a quorum of the cluster would vote for it. A node
+// that was partitioned away thus rejoins without disrupting the leader.
+func PreVote() Option {
+	return func(r *raft) { r.preVote = true }
+}
+
+// LeaderLease makes the leader serve ReadIndex requests locally, without a
+// round trip to the cluster, while it holds a lease: a quorum has
+// acknowledged one of its heartbeats within the election timeout. Followers
+// refuse to vote while they hear from their leader, so no other leader can
+// be elected before the lease expires. The lease assumes that the clocks of
+// the members tick at about the same rate; the election timeout bounds how
+// much they may drift. All the members of a cluster MUST use the option for
+// the lease to be safe.
+func LeaderLease() Option {
+	return func(r *raft) { r.leaderLease = true }
+}
+
+// Join makes a Node started without data join an existing cluster, rather
+// than bootstrap a new one with its peers: it does not campaign before it
+// hears from the leader, which then sends it the log. A node joining a
+// cluster that already has a leader thus never elects a leader of its own.
+func Join() Option {
+	return func(r *raft) { r.joining = true }
 }
 
 // StartNode returns a new Node given a unique raft id, a list of raft peers, and
 // the election and heartbeat timeouts in units of ticks.
-func StartNode(id int64, peers []int64, election, heartbeat int) Node {
+func StartNode(id int64, peers []int64, election, heartbeat int, opts ...Option) Node {
 	n := newNode()
 	r := newRaft(id, peers, election, heartbeat)
+	for _, opt := range opts {
+		opt(r)
+	}
 	go n.run(r)
 	return &n
 }
@@ -111,9 +207,12 @@ func StartNode(id int64, peers []int64, election, heartbeat int) Node {
 // RestartNode is identical to StartNode but takes an initial State and a slice
 // of entries. Generally this is used when restarting from a stable storage
 // log.
-func RestartNode(id int64, peers []int64, election, heartbeat int, snapshot *pb.Snapshot, st pb.HardState, ents []pb.Entry) Node {
+func RestartNode(id int64, peers []int64, election, heartbeat int, snapshot *pb.Snapshot, st pb.HardState, ents []pb.Entry, opts ...Option) Node {
 	n := newNode()
 	r := newRaft(id, peers, election, heartbeat)
+	for _, opt := range opts {
+		opt(r)
+	}
 	if snapshot != nil {
 		r.restore(*snapshot)
 	}
@@ -125,9 +224,15 @@ func RestartNode(id int64, peers []int64, election, heartbeat int, snapshot *pb.
 
 // node is the canonical implementation of the Node interface
 type node struct {
+	// lead is the leader known by run, read atomically by the proposals
+	// blocked while there is none. It comes first to be 64-bit aligned.
+	lead int64
+
 	propc    chan pb.Message
 	recvc    chan pb.Message
-	compactc chan []byte
+	snapc    chan []byte
+	compactc chan int64
+	statusc  chan chan Status
 	confc    chan pb.ConfChange
 	readyc   chan Ready
 	tickc    chan struct{}
@@ -138,7 +243,9 @@ func newNode() node {
 	return node{
 		propc:    make(chan pb.Message),
 		recvc:    make(chan pb.Message),
-		compactc: make(chan []byte),
+		snapc:    make(chan []byte),
+		compactc: make(chan int64),
+		statusc:  make(chan chan Status),
 		confc:    make(chan pb.ConfChange),
 		readyc:   make(chan Ready),
 		tickc:    make(chan struct{}),
@@ -168,8 +275,9 @@ func (n *node) run(r *raft) {
 		}
 
 		if rd.SoftState != nil && lead != rd.SoftState.Lead {
-			log.Printf("raft: leader changed from %#x to %#x", lead, rd.SoftState.Lead)
+			logger.Infof("raft: leader changed from %#x to %#x", lead, rd.SoftState.Lead)
 			lead = rd.SoftState.Lead
+			atomic.StoreInt64(&n.lead, lead)
 			if r.hasLeader() {
 				propc = n.propc
 			} else {
@@ -186,9 +294,17 @@ func (n *node) run(r *raft) {
 			r.Step(m)
 		case m := <-n.recvc:
 			r.Step(m) // raft never returns an error
-		case d := <-n.compactc:
-			r.compact(d)
+		case d := <-n.snapc:
+			r.snapshot(d)
+		case i := <-n.compactc:
+			r.compact(i)
+		case c := <-n.statusc:
+			c <- r.status()
 		case cc := <-n.confc:
+			if cc.NodeID == None {
+				r.resetPendingConf()
+				break
+			}
 			switch cc.Type {
 			case pb.ConfChangeAddNode:
 				r.addNode(cc.NodeID)
@@ -216,6 +332,7 @@ func (n *node) run(r *raft) {
 			r.raftLog.resetNextEnts()
 			r.raftLog.resetUnstable()
 			r.msgs = nil
+			r.readStates = nil
 		case <-n.done:
 			return
 		}
@@ -236,7 +353,26 @@ func (n *node) Campaign(ctx context.Context) error {
 }
 
 func (n *node) Propose(ctx context.Context, data []byte) error {
-	return n.step(ctx, pb.Message{Type: msgProp, Entries: []pb.Entry{{Data: data}}})
+	err := n.step(ctx, pb.Message{Type: msgProp, Entries: []pb.Entry{{Data: data}}})
+	// a proposal canceled by the caller is not dropped
+	if err == context.DeadlineExceeded && atomic.LoadInt64(&n.lead) == None {
+		return ErrProposalDropped
+	}
+	return err
+}
+
+// ReadIndex goes through propc like a proposal, so it blocks until the node
+// knows the leader, and the message is stamped with the id of the node.
+func (n *node) ReadIndex(ctx context.Context, rctx []byte) error {
+	m := pb.Message{Type: msgReadIndex, Entries: []pb.Entry{{Data: rctx}}}
+	select {
+	case n.propc <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
 }
 
 func (n *node) Step(ctx context.Context, m pb.Message) error {
@@ -285,10 +421,27 @@ func (n *node) ApplyConfChange(cc pb.ConfChange) {
 	}
 }
 
-func (n *node) Compact(d []byte) {
+func (n *node) Snapshot(d []byte) {
+	select {
+	case n.snapc <- d:
+	case <-n.done:
+	}
+}
+
+func (n *node) Compact(index int64) {
+	select {
+	case n.compactc <- index:
+	case <-n.done:
+	}
+}
+
+func (n *node) Status() Status {
+	c := make(chan Status)
 	select {
-	case n.compactc <- d:
+	case n.statusc <- c:
+		return <-c
 	case <-n.done:
+		return Status{}
 	}
 }
 
@@ -297,6 +450,7 @@ func newReady(r *raft, prevSoftSt *SoftState, prevHardSt pb.HardState, prevSnapi
 		Entries:          r.raftLog.unstableEnts(),
 		CommittedEntries: r.raftLog.nextEnts(),
 		Messages:         r.msgs,
+		ReadStates:       r.readStates,
 	}
 	if softSt := r.softState(); !softSt.equal(prevSoftSt) {
 		rd.SoftState = softSt
@@ -124,6 +124,35 @@ func TestBlockProposal(t *testing.T) {
 	}
 }
 
+func TestProposeDroppedWithoutLeader(t *testing.T) {
+	n := newNode()
+	r := newRaft(1, []int64{1}, 10, 1)
+	go n.run(r)
+	defer n.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := n.Propose(ctx, []byte("somedata")); err != ErrProposalDropped {
+		t.Errorf("err = %v, want %v", err, ErrProposalDropped)
+	}
+
+	// a proposal canceled by the caller is not dropped
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := n.Propose(ctx, []byte("somedata")); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// once there is a leader, a proposal only times out
+	n.Campaign(context.TODO())
+	pkg.ForceGosched()
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := n.Propose(ctx, []byte("somedata")); err != nil && err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want nil or %v", err, context.DeadlineExceeded)
+	}
+}
+
 func TestReadyContainUpdates(t *testing.T) {
 	tests := []struct {
 		rd       Ready
@@ -181,6 +210,36 @@ func TestNode(t *testing.T) {
 	}
 }
 
+func TestNodeStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := StartNode(1, []int64{1, 2}, 10, 1)
+	w := Status{ID: 1, SoftState: SoftState{RaftState: StateFollower}}
+	if g := n.Status(); !reflect.DeepEqual(g, w) {
+		t.Errorf("follower status = %+v, want %+v", g, w)
+	}
+	n.Stop()
+	if g := n.Status(); !reflect.DeepEqual(g, Status{}) {
+		t.Errorf("stopped status = %+v, want %+v", g, Status{})
+	}
+
+	n = StartNode(1, []int64{1}, 10, 1)
+	defer n.Stop()
+	n.Campaign(ctx)
+	<-n.Ready()
+	w = Status{
+		ID:        1,
+		HardState: raftpb.HardState{Term: 1, Commit: 1},
+		SoftState: SoftState{Lead: 1, RaftState: StateLeader},
+		Applied:   1,
+		Progress:  map[int64]Progress{1: {Match: 1, Next: 2}},
+	}
+	if g := n.Status(); !reflect.DeepEqual(g, w) {
+		t.Errorf("leader status = %+v, want %+v", g, w)
+	}
+}
+
 func TestNodeRestart(t *testing.T) {
 	entries := []raftpb.Entry{
 		{},
@@ -207,13 +266,17 @@ func TestNodeRestart(t *testing.T) {
 	}
 }
 
-// TestCompacts ensures Node.Compact creates a correct raft snapshot and compacts
-// the raft log (call raft.compact)
+// TestCompact ensures Node.Snapshot creates a correct raft snapshot, and
+// Node.Compact compacts the raft log (call raft.compact).
 func TestCompact(t *testing.T) {
 	ctx := context.Background()
 	n := newNode()
 	r := newRaft(1, []int64{1}, 0, 0)
-	go n.run(r)
+	stopped := make(chan struct{})
+	go func() {
+		n.run(r)
+		close(stopped)
+	}()
 
 	n.Campaign(ctx)
 	n.Propose(ctx, []byte("foo"))
@@ -232,7 +295,7 @@ func TestCompact(t *testing.T) {
 		t.Fatalf("unexpected proposal failure: unable to commit entry")
 	}
 
-	n.Compact(w.Data)
+	n.Snapshot(w.Data)
 	pkg.ForceGosched()
 	select {
 	case rd := <-n.Ready():
@@ -250,7 +313,14 @@ func TestCompact(t *testing.T) {
 		t.Fatalf("unexpected more ready")
 	default:
 	}
+	if r.raftLog.offset != 0 {
+		t.Errorf("log.offset = %d, want 0", r.raftLog.offset)
+	}
+	n.Compact(w.Index)
+	pkg.ForceGosched()
 	n.Stop()
+	// r is only read once run returned, not to race with it
+	<-stopped
 
 	if r.raftLog.offset != w.Index {
 		t.Errorf("log.offset = %d, want %d", r.raftLog.offset, w.Index)
@@ -22,6 +22,12 @@ const (
 	msgVoteResp
 	msgSnap
 	msgDenied
+	msgReadIndex
+	msgReadIndexResp
+	msgHeartbeat
+	msgHeartbeatResp
+	msgPreVote
+	msgPreVoteResp
 )
 
 var mtmap = [...]string{
@@ -34,6 +40,13 @@ var mtmap = [...]string{
 	msgVoteResp: "msgVoteResp",
 	msgSnap:     "msgSnap",
 	msgDenied:   "msgDenied",
+
+	msgReadIndex:     "msgReadIndex",
+	msgReadIndexResp: "msgReadIndexResp",
+	msgHeartbeat:     "msgHeartbeat",
+	msgHeartbeatResp: "msgHeartbeatResp",
+	msgPreVote:       "msgPreVote",
+	msgPreVoteResp:   "msgPreVoteResp",
 }
 
 func (mt messageType) String() string {
@@ -46,6 +59,7 @@ const (
 	StateFollower StateType = iota
 	StateCandidate
 	StateLeader
+	StatePreCandidate
 )
 
 type StateType int64
@@ -54,6 +68,8 @@ var stmap = [...]string{
 	StateFollower:  "StateFollower",
 	StateCandidate: "StateCandidate",
 	StateLeader:    "StateLeader",
+
+	StatePreCandidate: "StatePreCandidate",
 }
 
 func (st StateType) String() string {
@@ -79,6 +95,20 @@ func (pr *progress) String() string {
 	return fmt.Sprintf("n=%d m=%d", pr.next, pr.match)
 }
 
+// readIndexStatus is a read-only request waiting for a quorum of the cluster
+// to confirm that the leader that received it is still the leader.
+type readIndexStatus struct {
+	req   pb.Message // the msgReadIndex request
+	index int64      // the commit index when the request was received
+	seq   int64      // the sequence of the heartbeat sent for the request
+	acks  map[int64]bool
+}
+
+// sentBeat is a heartbeat tagged with a sequence, sent by the leader at tick.
+type sentBeat struct {
+	seq, tick int64
+}
+
 // int64Slice implements sort interface
 type int64Slice []int64
 
@@ -111,6 +141,36 @@ type raft struct {
 	// TODO: need GC and recovery from snapshot
 	removed map[int64]bool
 
+	// read-only requests waiting for their heartbeat to be acknowledged
+	// by a quorum, in the order they were received
+	pendingReads []*readIndexStatus
+	readSeq      int64
+	// read-only requests whose index is ready to be served
+	readStates []ReadState
+
+	// joining keeps a node started to join an existing cluster from
+	// campaigning until it hears from the leader, which sends it the log.
+	joining bool
+
+	// preVote makes the node ask whether it would win an election before
+	// campaigning, so that a node that cannot win does not disrupt the
+	// cluster by increasing its term.
+	preVote bool
+
+	// leaderLease makes the leader hand out read indexes without a round
+	// trip while a quorum has acknowledged one of its heartbeats within
+	// the election timeout, and the followers refuse to vote while they
+	// hear from their leader, so that no other leader can be elected
+	// meanwhile.
+	leaderLease bool
+	// now counts the ticks of the leader
+	now int64
+	// heartbeats tagged with a sequence sent within the election timeout
+	beats []sentBeat
+	// the tick at which the leader sent the last heartbeat acknowledged
+	// by each peer
+	leases map[int64]int64
+
 	elapsed          int // number of ticks since the last msg
 	heartbeatTimeout int
 	electionTimeout  int
@@ -143,7 +203,23 @@ func (r *raft) hasLeader() bool { return r.lead != None }
 func (r *raft) shouldStop() bool { return r.removed[r.id] }
 
 func (r *raft) softState() *SoftState {
-	return &SoftState{Lead: r.lead, RaftState: r.state, ShouldStop: r.shouldStop()}
+	return &SoftState{Lead: r.lead, RaftState: r.state, ShouldStop: r.shouldStop(), LeaseValid: r.inLease()}
+}
+
+func (r *raft) status() Status {
+	s := Status{
+		ID:        r.id,
+		HardState: r.HardState,
+		SoftState: *r.softState(),
+		Applied:   r.raftLog.applied,
+	}
+	if r.state == StateLeader {
+		s.Progress = make(map[int64]Progress, len(r.prs))
+		for id, pr := range r.prs {
+			s.Progress[id] = Progress{Match: pr.match, Next: pr.next}
+		}
+	}
+	return s
 }
 
 func (r *raft) String() string {
@@ -151,7 +227,7 @@ func (r *raft) String() string {
 	switch r.state {
 	case StateFollower:
 		s += fmt.Sprintf(" vote=%v lead=%v", r.Vote, r.lead)
-	case StateCandidate:
+	case StateCandidate, StatePreCandidate:
 		s += fmt.Sprintf(` votes="%v"`, r.votes)
 	case StateLeader:
 		s += fmt.Sprintf(` prs="%v"`, r.prs)
@@ -172,9 +248,12 @@ func (r *raft) poll(id int64, v bool) (granted int) {
 }
 
 // send persists state to stable storage and then sends to its mailbox.
+// The message is sent with the current term, unless it already has one.
 func (r *raft) send(m pb.Message) {
 	m.From = r.id
-	m.Term = r.Term
+	if m.Term == 0 {
+		m.Term = r.Term
+	}
 	r.msgs = append(r.msgs, m)
 }
 
@@ -225,6 +304,111 @@ func (r *raft) bcastHeartbeat() {
 	}
 }
 
+// readIndex handles the read-only request m on the leader. It records the
+// current commit index for m, and sends a heartbeat tagged with a new
+// sequence to all the peers. The index is handed out once a quorum has
+// acknowledged the heartbeat.
+func (r *raft) readIndex(m pb.Message) {
+	// The leader does not know the latest commit index until it has
+	// committed an entry of its own term. Drop the request; the caller
+	// will time out and retry.
+	if r.raftLog.term(r.raftLog.committed) != r.Term {
+		return
+	}
+	// no other leader can have been elected within the lease, so the
+	// commit index is the latest one.
+	if r.inLease() {
+		r.releaseRead(&readIndexStatus{req: m, index: r.raftLog.committed})
+		return
+	}
+	r.pendingReads = append(r.pendingReads, &readIndexStatus{
+		req:   m,
+		index: r.raftLog.committed,
+		seq:   r.bcastSeqHeartbeat(),
+		acks:  map[int64]bool{r.id: true},
+	})
+	r.releaseReads()
+}
+
+// bcastSeqHeartbeat sends msgHeartbeat tagged with a new sequence to all the
+// peers, and returns the sequence.
+func (r *raft) bcastSeqHeartbeat() int64 {
+	r.readSeq++
+	if r.leaderLease {
+		r.beats = append(r.beats, sentBeat{seq: r.readSeq, tick: r.now})
+	}
+	for i := range r.prs {
+		if i == r.id {
+			continue
+		}
+		r.send(pb.Message{To: i, Type: msgHeartbeat, Index: r.readSeq})
+	}
+	return r.readSeq
+}
+
+// ackLease records that the peer from has acknowledged the heartbeat with
+// sequence seq. The lease the peer grants runs from the time the heartbeat
+// was sent, since the peer cannot have received it earlier.
+func (r *raft) ackLease(from, seq int64) {
+	for i := len(r.beats) - 1; i >= 0; i-- {
+		if b := r.beats[i]; b.seq == seq {
+			if t, ok := r.leases[from]; !ok || b.tick > t {
+				r.leases[from] = b.tick
+			}
+			return
+		}
+	}
+}
+
+// inLease reports whether r is a leader holding a lease: a quorum, counting
+// itself, has acknowledged a heartbeat sent within the election timeout.
+func (r *raft) inLease() bool {
+	if !r.leaderLease || r.state != StateLeader {
+		return false
+	}
+	n := 0
+	for id := range r.prs {
+		if t, ok := r.leases[id]; id == r.id || ok && r.now-t < int64(r.electionTimeout) {
+			n++
+		}
+	}
+	return n >= r.q()
+}
+
+// ackReads records that the peer from has acknowledged all the heartbeats
+// up to seq, and releases the read-only requests that are now confirmed.
+func (r *raft) ackReads(from, seq int64) {
+	for _, rs := range r.pendingReads {
+		if rs.seq <= seq {
+			rs.acks[from] = true
+		}
+	}
+	r.releaseReads()
+}
+
+// releaseReads hands out the index of the pending read-only requests that
+// have been acknowledged by a quorum, either to the local node or to the
+// follower that forwarded the request.
+func (r *raft) releaseReads() {
+	for len(r.pendingReads) > 0 {
+		rs := r.pendingReads[0]
+		if len(rs.acks) < r.q() {
+			return
+		}
+		r.pendingReads = r.pendingReads[1:]
+		r.releaseRead(rs)
+	}
+}
+
+// releaseRead hands out the index of the read-only request rs.
+func (r *raft) releaseRead(rs *readIndexStatus) {
+	if rs.req.From == r.id {
+		r.readStates = append(r.readStates, ReadState{Index: rs.index, RequestCtx: rs.req.Entries[0].Data})
+	} else {
+		r.send(pb.Message{To: rs.req.From, Type: msgReadIndexResp, Index: rs.index, Entries: rs.req.Entries})
+	}
+}
+
 func (r *raft) maybeCommit() bool {
 	// TODO(bmizerany): optimize.. Currently naive
 	mis := make(int64Slice, 0, len(r.prs))
@@ -238,9 +422,13 @@ func (r *raft) maybeCommit() bool {
 }
 
 func (r *raft) reset(term int64) {
+	// a pre-candidate falling back in the same term keeps the vote it
+	// may have given in that term before its pre-election
+	if r.state != StatePreCandidate || r.Term != term {
+		r.Vote = None
+	}
 	r.Term = term
 	r.lead = None
-	r.Vote = None
 	r.elapsed = 0
 	r.votes = make(map[int64]bool)
 	for i := range r.prs {
@@ -250,6 +438,9 @@ func (r *raft) reset(term int64) {
 		}
 	}
 	r.pendingConf = false
+	r.pendingReads = nil
+	r.beats = nil
+	r.leases = make(map[int64]int64)
 }
 
 func (r *raft) q() int {
@@ -266,7 +457,7 @@ func (r *raft) appendEntry(e pb.Entry) {
 
 // tickElection is ran by followers and candidates after r.electionTimeout.
 func (r *raft) tickElection() {
-	if !r.promotable() {
+	if !r.promotable() || r.joining {
 		r.elapsed = 0
 		return
 	}
@@ -280,6 +471,13 @@ func (r *raft) tickElection() {
 
 // tickHeartbeat is ran by leaders to send a msgBeat after r.heartbeatTimeout.
 func (r *raft) tickHeartbeat() {
+	r.now++
+	if r.leaderLease {
+		// older heartbeats cannot extend the lease anymore
+		for len(r.beats) > 0 && r.now-r.beats[0].tick >= int64(r.electionTimeout) {
+			r.beats = r.beats[1:]
+		}
+	}
 	r.elapsed++
 	if r.elapsed > r.heartbeatTimeout {
 		r.elapsed = 0
@@ -307,6 +505,21 @@ func (r *raft) becomeCandidate() {
 	r.state = StateCandidate
 }
 
+// becomePreCandidate starts a pre-election. Unlike becomeCandidate, it
+// changes neither the term nor the vote of the node.
+func (r *raft) becomePreCandidate() {
+	// TODO(xiangli) remove the panic when the raft implementation is stable
+	if r.state == StateLeader {
+		panic("invalid transition [leader -> pre-candidate]")
+	}
+	r.step = stepCandidate
+	r.votes = make(map[int64]bool)
+	r.elapsed = 0
+	r.tick = r.tickElection
+	r.lead = None
+	r.state = StatePreCandidate
+}
+
 func (r *raft) becomeLeader() {
 	// TODO(xiangli) remove the panic when the raft implementation is stable
 	if r.state == StateFollower {
@@ -336,6 +549,37 @@ func (r *raft) ReadMessages() []pb.Message {
 	return msgs
 }
 
+// preCampaign asks the peers whether they would vote for the node in the
+// next term, without moving to it. The node campaigns for real once a quorum
+// has said it would.
+func (r *raft) preCampaign() {
+	r.becomePreCandidate()
+	if r.q() == r.poll(r.id, true) {
+		r.campaign()
+		return
+	}
+	for i := range r.prs {
+		if i == r.id {
+			continue
+		}
+		lasti := r.raftLog.lastIndex()
+		r.send(pb.Message{To: i, Type: msgPreVote, Term: r.Term + 1, Index: lasti, LogTerm: r.raftLog.term(lasti)})
+	}
+}
+
+// handlePreVote answers the pre-vote request m. The vote is granted if m is
+// for a later term, its log is at least as up-to-date as the node's, and
+// the node has not heard from a leader within the election timeout. The
+// node's own state is left untouched either way.
+func (r *raft) handlePreVote(m pb.Message) {
+	inLease := r.lead != None && r.elapsed < r.electionTimeout
+	if m.Term > r.Term && !inLease && r.raftLog.isUpToDate(m.Index, m.LogTerm) {
+		r.send(pb.Message{To: m.From, Type: msgPreVoteResp, Term: m.Term})
+	} else {
+		r.send(pb.Message{To: m.From, Type: msgPreVoteResp, Denied: true})
+	}
+}
+
 func (r *raft) campaign() {
 	r.becomeCandidate()
 	if r.q() == r.poll(r.id, true) {
@@ -367,16 +611,29 @@ func (r *raft) Step(m pb.Message) error {
 		return nil
 	}
 
+	// a node hearing from its leader does not help elect another one
+	// before the lease of the leader has expired, nor moves to its term.
+	if r.leaderLease && m.Type == msgVote && r.lead != None && r.elapsed < r.electionTimeout {
+		return nil
+	}
+
 	if m.Type == msgHup {
-		r.campaign()
+		if r.preVote {
+			r.preCampaign()
+		} else {
+			r.campaign()
+		}
 	}
 
 	switch {
 	case m.Term == 0:
 		// local message
+	case m.Term > r.Term && (m.Type == msgPreVote || m.Type == msgPreVoteResp && !m.Denied):
+		// a pre-vote request, or its grant, is for the next term of the
+		// candidate; the receiver does not move to it.
 	case m.Term > r.Term:
 		lead := m.From
-		if m.Type == msgVote {
+		if m.Type == msgVote || m.Type == msgPreVoteResp {
 			lead = None
 		}
 		r.becomeFollower(m.Term, lead)
@@ -384,11 +641,23 @@ func (r *raft) Step(m pb.Message) error {
 		// ignore
 		return nil
 	}
+	if m.Type == msgPreVote {
+		r.handlePreVote(m)
+		return nil
+	}
 	r.step(r, m)
 	return nil
 }
 
 func (r *raft) handleAppendEntries(m pb.Message) {
+	// the entries up to the compacted index were committed, so they match
+	// the log of the leader; answer with the committed index rather than
+	// denying the entry it cannot check, which would make the leader
+	// fall back to sending a snapshot.
+	if m.Index < r.raftLog.offset {
+		r.send(pb.Message{To: m.From, Type: msgAppResp, Index: r.raftLog.committed})
+		return
+	}
 	if r.raftLog.maybeAppend(m.Index, m.LogTerm, m.Commit, m.Entries...) {
 		r.send(pb.Message{To: m.From, Type: msgAppResp, Index: r.raftLog.lastIndex()})
 	} else {
@@ -404,11 +673,21 @@ func (r *raft) handleSnapshot(m pb.Message) {
 	}
 }
 
+func (r *raft) handleHeartbeat(m pb.Message) {
+	r.send(pb.Message{To: m.From, Type: msgHeartbeatResp, Index: m.Index})
+}
+
 func (r *raft) addNode(id int64) {
 	r.setProgress(id, 0, r.raftLog.lastIndex()+1)
 	r.pendingConf = false
 }
 
+// resetPendingConf lets the next config change be proposed, when the
+// pending one is rejected by the application.
+func (r *raft) resetPendingConf() {
+	r.pendingConf = false
+}
+
 func (r *raft) removeNode(id int64) {
 	r.delProgress(id)
 	r.pendingConf = false
@@ -421,6 +700,9 @@ func stepLeader(r *raft, m pb.Message) {
 	switch m.Type {
 	case msgBeat:
 		r.bcastHeartbeat()
+		if r.leaderLease {
+			r.bcastSeqHeartbeat()
+		}
 	case msgProp:
 		if len(m.Entries) != 1 {
 			panic("unexpected length(entries) of a msgProp")
@@ -442,10 +724,19 @@ func stepLeader(r *raft, m pb.Message) {
 			r.prs[m.From].update(m.Index)
 			if r.maybeCommit() {
 				r.bcastAppend()
+			} else if r.prs[m.From].next <= r.raftLog.lastIndex() {
+				// the peer lags behind, e.g. it just installed a
+				// snapshot older than the log
+				r.sendAppend(m.From)
 			}
 		}
 	case msgVote:
 		r.send(pb.Message{To: m.From, Type: msgVoteResp, Denied: true})
+	case msgReadIndex:
+		r.readIndex(m)
+	case msgHeartbeatResp:
+		r.ackLease(m.From, m.Index)
+		r.ackReads(m.From, m.Index)
 	}
 }
 
@@ -459,9 +750,15 @@ func stepCandidate(r *raft, m pb.Message) {
 	case msgSnap:
 		r.becomeFollower(m.Term, m.From)
 		r.handleSnapshot(m)
+	case msgHeartbeat:
+		r.becomeFollower(r.Term, m.From)
+		r.handleHeartbeat(m)
 	case msgVote:
 		r.send(pb.Message{To: m.From, Type: msgVoteResp, Denied: true})
 	case msgVoteResp:
+		if r.state != StateCandidate {
+			return
+		}
 		gr := r.poll(m.From, !m.Denied)
 		switch r.q() {
 		case gr:
@@ -470,6 +767,17 @@ func stepCandidate(r *raft, m pb.Message) {
 		case len(r.votes) - gr:
 			r.becomeFollower(r.Term, None)
 		}
+	case msgPreVoteResp:
+		if r.state != StatePreCandidate {
+			return
+		}
+		gr := r.poll(m.From, !m.Denied)
+		switch r.q() {
+		case gr:
+			r.campaign()
+		case len(r.votes) - gr:
+			r.becomeFollower(r.Term, None)
+		}
 	}
 }
 
@@ -484,10 +792,30 @@ func stepFollower(r *raft, m pb.Message) {
 	case msgApp:
 		r.elapsed = 0
 		r.lead = m.From
+		r.joining = false
 		r.handleAppendEntries(m)
 	case msgSnap:
 		r.elapsed = 0
+		r.joining = false
 		r.handleSnapshot(m)
+	case msgHeartbeat:
+		r.elapsed = 0
+		r.lead = m.From
+		r.joining = false
+		r.handleHeartbeat(m)
+	case msgReadIndex:
+		// drop the request if there is no leader; the caller will time
+		// out and retry.
+		if r.lead == None {
+			return
+		}
+		m.To = r.lead
+		r.send(m)
+	case msgReadIndexResp:
+		if len(m.Entries) != 1 {
+			panic("unexpected length(entries) of a msgReadIndexResp")
+		}
+		r.readStates = append(r.readStates, ReadState{Index: m.Index, RequestCtx: m.Entries[0].Data})
 	case msgVote:
 		if (r.Vote == None || r.Vote == m.From) && r.raftLog.isUpToDate(m.Index, m.LogTerm) {
 			r.elapsed = 0
@@ -499,9 +827,20 @@ func stepFollower(r *raft, m pb.Message) {
 	}
 }
 
-func (r *raft) compact(d []byte) {
+func (r *raft) snapshot(d []byte) {
 	r.raftLog.snap(d, r.raftLog.applied, r.raftLog.term(r.raftLog.applied), r.nodes())
-	r.raftLog.compact(r.raftLog.applied)
+}
+
+// compact compacts the log up to index, or up to the index of the snapshot
+// if it is smaller.
+func (r *raft) compact(index int64) {
+	if index > r.raftLog.snapshot.Index {
+		index = r.raftLog.snapshot.Index
+	}
+	if index <= r.raftLog.offset {
+		return
+	}
+	r.raftLog.compact(index)
 }
 
 // restore recovers the statemachine from a snapshot. It restores the log and the
@@ -451,6 +451,73 @@ func TestCommit(t *testing.T) {
 
 // ensure that the Step function ignores the message from old term and does not pass it to the
 // acutal stepX function.
+func TestReadIndex(t *testing.T) {
+	ctx := []byte("ctx")
+	tests := []struct {
+		id      int64
+		isolate bool
+
+		wrs []ReadState
+	}{
+		{1, false, []ReadState{{Index: 2, RequestCtx: ctx}}},
+		{2, false, []ReadState{{Index: 2, RequestCtx: ctx}}},
+		// the leader cannot confirm its leadership
+		{1, true, nil},
+	}
+	for i, tt := range tests {
+		nt := newNetwork(nil, nil, nil)
+		nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+		nt.send(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{Data: []byte("somedata")}}})
+		if tt.isolate {
+			nt.isolate(1)
+		}
+
+		nt.send(pb.Message{From: tt.id, To: tt.id, Type: msgReadIndex, Entries: []pb.Entry{{Data: ctx}}})
+		sm := nt.peers[tt.id].(*raft)
+		if !reflect.DeepEqual(sm.readStates, tt.wrs) {
+			t.Errorf("#%d: readStates = %+v, want %+v", i, sm.readStates, tt.wrs)
+		}
+	}
+}
+
+// TestReadIndexStaleFollower ensures that the index handed out to a follower
+// lagging behind the leader is the commit index of the leader.
+func TestReadIndexStaleFollower(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+	// the follower 3 misses the entry
+	nt.drop(1, 3, 1.0)
+	nt.send(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{Data: []byte("somedata")}}})
+	nt.recover()
+
+	sm := nt.peers[3].(*raft)
+	if sm.raftLog.committed != 1 {
+		t.Fatalf("committed = %d, want 1", sm.raftLog.committed)
+	}
+	nt.send(pb.Message{From: 3, To: 3, Type: msgReadIndex, Entries: []pb.Entry{{Data: []byte("ctx")}}})
+	wrs := []ReadState{{Index: 2, RequestCtx: []byte("ctx")}}
+	if !reflect.DeepEqual(sm.readStates, wrs) {
+		t.Errorf("readStates = %+v, want %+v", sm.readStates, wrs)
+	}
+}
+
+// TestReadIndexWithoutCommitInTerm ensures that a leader drops read-only
+// requests until it has committed an entry of its own term.
+func TestReadIndexWithoutCommitInTerm(t *testing.T) {
+	sm := newRaft(1, []int64{1, 2, 3}, 10, 1)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.ReadMessages()
+
+	sm.Step(pb.Message{From: 1, Type: msgReadIndex, Entries: []pb.Entry{{Data: []byte("ctx")}}})
+	if msgs := sm.ReadMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+	if len(sm.pendingReads) != 0 {
+		t.Errorf("len(pendingReads) = %d, want 0", len(sm.pendingReads))
+	}
+}
+
 func TestStepIgnoreOldTermMsg(t *testing.T) {
 	called := false
 	fakeStep := func(r *raft, m pb.Message) {
@@ -578,6 +645,228 @@ func TestRecvMsgVote(t *testing.T) {
 	}
 }
 
+func TestRecvMsgPreVote(t *testing.T) {
+	tests := []struct {
+		lead    int64
+		elapsed int
+		i, term int64
+		mterm   int64
+		wdenied bool
+	}{
+		{None, 0, 2, 2, 2, false},
+		// the log of the candidate is behind
+		{None, 0, 1, 2, 2, true},
+		{None, 0, 2, 1, 2, true},
+		// the pre-vote is not for a later term
+		{None, 0, 2, 2, 1, true},
+		// the node still hears from its leader
+		{3, 0, 2, 2, 2, true},
+		{3, 9, 2, 2, 2, true},
+		{3, 10, 2, 2, 2, false},
+	}
+
+	for i, tt := range tests {
+		sm := newRaft(1, []int64{1, 2, 3}, 10, 1)
+		sm.HardState = pb.HardState{Term: 1, Vote: 3}
+		sm.lead = tt.lead
+		sm.elapsed = tt.elapsed
+		sm.raftLog = &raftLog{ents: []pb.Entry{{}, {Term: 1}, {Term: 2}}}
+
+		sm.Step(pb.Message{Type: msgPreVote, From: 2, Term: tt.mterm, Index: tt.i, LogTerm: tt.term})
+
+		msgs := sm.ReadMessages()
+		if g := len(msgs); g != 1 {
+			t.Fatalf("#%d: len(msgs) = %d, want 1", i, g)
+		}
+		if g := msgs[0].Denied; g != tt.wdenied {
+			t.Errorf("#%d: m.Denied = %v, want %v", i, g, tt.wdenied)
+		}
+		// a pre-vote never changes the state of the voter
+		if sm.Term != 1 || sm.Vote != 3 || sm.lead != tt.lead {
+			t.Errorf("#%d: term, vote, lead = %d, %d, %d, want 1, 3, %d", i, sm.Term, sm.Vote, sm.lead, tt.lead)
+		}
+	}
+}
+
+func TestPreVoteElection(t *testing.T) {
+	nt := newNetwork(newPreVoteRaft(), newPreVoteRaft(), newPreVoteRaft())
+	nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+
+	sm := nt.peers[1].(*raft)
+	if sm.state != StateLeader {
+		t.Errorf("state = %s, want %s", sm.state, StateLeader)
+	}
+	if sm.Term != 1 {
+		t.Errorf("term = %d, want 1", sm.Term)
+	}
+}
+
+// TestFlappingFollower checks that a follower that keeps timing out while
+// partitioned away disrupts the leader once it rejoins, unless it runs
+// pre-elections.
+func TestFlappingFollower(t *testing.T) {
+	tests := []struct {
+		preVote bool
+		wstate  StateType
+		wterm   int64
+	}{
+		{false, StateFollower, 6},
+		{true, StateLeader, 1},
+	}
+
+	for i, tt := range tests {
+		peers := make([]Interface, 3)
+		for j := range peers {
+			sm := newRaft(1, []int64{1}, 10, 1)
+			sm.preVote = tt.preVote
+			peers[j] = sm
+		}
+		nt := newNetwork(peers...)
+		nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+
+		lead := nt.peers[1].(*raft)
+		flapper := nt.peers[3].(*raft)
+		nt.isolate(3)
+		// time out four elections while partitioned away
+		for j := 0; j < 4*11; j++ {
+			flapper.tick()
+		}
+		msgs := nt.filter(flapper.ReadMessages())
+		if len(msgs) != 0 {
+			t.Fatalf("#%d: %d messages got through the partition", i, len(msgs))
+		}
+
+		nt.recover()
+		// the next campaign of the flapper reaches the cluster
+		for j := 0; j < 11; j++ {
+			flapper.tick()
+		}
+		nt.send(flapper.ReadMessages()...)
+		if lead.state != tt.wstate {
+			t.Errorf("#%d: state = %s, want %s", i, lead.state, tt.wstate)
+		}
+		if lead.Term != tt.wterm {
+			t.Errorf("#%d: term = %d, want %d", i, lead.Term, tt.wterm)
+		}
+	}
+}
+
+func TestLeaderLease(t *testing.T) {
+	peers := make([]Interface, 3)
+	for i := range peers {
+		sm := newRaft(1, []int64{1}, 10, 1)
+		sm.leaderLease = true
+		peers[i] = sm
+	}
+	nt := newNetwork(peers...)
+	nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+	lead := nt.peers[1].(*raft)
+	if lead.inLease() {
+		t.Fatalf("inLease = true before any heartbeat, want false")
+	}
+
+	// beat ticks the leader until it sends heartbeats, and delivers them
+	beat := func() {
+		for i := 0; i <= lead.heartbeatTimeout; i++ {
+			lead.tick()
+		}
+		nt.send(nt.filter(lead.ReadMessages())...)
+	}
+	read := func() []ReadState {
+		lead.Step(pb.Message{From: 1, To: 1, Type: msgReadIndex, Entries: []pb.Entry{{Data: []byte("ctx")}}})
+		rs := lead.readStates
+		lead.readStates = nil
+		return rs
+	}
+
+	beat()
+	if !lead.inLease() {
+		t.Fatalf("inLease = false, want true")
+	}
+	if !lead.softState().LeaseValid {
+		t.Errorf("LeaseValid = false, want true")
+	}
+	if rs := read(); len(rs) != 1 || rs[0].Index != lead.raftLog.committed {
+		t.Errorf("readStates = %+v, want one at index %d", rs, lead.raftLog.committed)
+	}
+	if msgs := lead.ReadMessages(); len(msgs) != 0 {
+		t.Errorf("read sent %d messages within the lease, want 0", len(msgs))
+	}
+
+	// the leader loses its quorum, and its lease with it
+	nt.isolate(1)
+	for i := 0; i < lead.electionTimeout; i++ {
+		beat()
+	}
+	if lead.inLease() {
+		t.Fatalf("inLease = true after losing the quorum, want false")
+	}
+	if rs := read(); len(rs) != 0 {
+		t.Errorf("readStates = %+v, want none", rs)
+	}
+	if msgs := lead.ReadMessages(); len(msgs) == 0 {
+		t.Errorf("read sent no heartbeats out of the lease")
+	}
+
+	// a quorum acknowledging the heartbeats again renews the lease
+	nt.recover()
+	beat()
+	if !lead.inLease() {
+		t.Errorf("inLease = false after recovering, want true")
+	}
+}
+
+func TestLeaseRefusesVotes(t *testing.T) {
+	sm := newRaft(2, []int64{1, 2, 3}, 10, 1)
+	sm.leaderLease = true
+	sm.becomeFollower(1, 1)
+	vote := pb.Message{From: 3, To: 2, Type: msgVote, Term: 2, Index: 0, LogTerm: 0}
+
+	sm.Step(vote)
+	if msgs := sm.ReadMessages(); len(msgs) != 0 {
+		t.Errorf("answered %d votes within the lease, want 0", len(msgs))
+	}
+	if sm.Term != 1 || sm.lead != 1 {
+		t.Errorf("term, lead = %d, %d, want 1, 1", sm.Term, sm.lead)
+	}
+
+	sm.elapsed = sm.electionTimeout
+	sm.Step(vote)
+	msgs := sm.ReadMessages()
+	if len(msgs) != 1 || msgs[0].Type != msgVoteResp || msgs[0].Denied {
+		t.Errorf("msgs = %+v, want a granted vote once the lease expired", msgs)
+	}
+}
+
+// TestElectionTimeoutTolerance checks that a follower campaigns only once
+// it has not heard from the leader for longer than its election timeout.
+func TestElectionTimeoutTolerance(t *testing.T) {
+	tests := []struct {
+		election  int
+		gap       int
+		wcampaign bool
+	}{
+		{10, 20, true},
+		{50, 20, false},
+		{50, 50, false},
+		{50, 51, true},
+	}
+
+	for i, tt := range tests {
+		sm := newRaft(2, []int64{1, 2, 3}, tt.election, 1)
+		sm.becomeFollower(1, 1)
+		for j := 0; j < 3; j++ {
+			sm.Step(pb.Message{From: 1, To: 2, Type: msgApp, Term: 1})
+			for k := 0; k < tt.gap; k++ {
+				sm.tick()
+			}
+		}
+		if g := sm.state == StateCandidate; g != tt.wcampaign {
+			t.Errorf("#%d: campaigned = %v, want %v", i, g, tt.wcampaign)
+		}
+	}
+}
+
 func TestStateTransition(t *testing.T) {
 	tests := []struct {
 		from   StateType
@@ -894,7 +1183,8 @@ func TestSlowNodeRestore(t *testing.T) {
 	}
 	lead := nt.peers[1].(*raft)
 	nextEnts(lead)
-	lead.compact(nil)
+	lead.snapshot(nil)
+	lead.compact(lead.raftLog.applied)
 
 	nt.recover()
 	// trigger a snapshot
@@ -911,6 +1201,147 @@ func TestSlowNodeRestore(t *testing.T) {
 	}
 }
 
+// TestSlowNodeCatchUp tests that a follower lagging by fewer entries than
+// the leader kept after its snapshot is caught up with these entries, and
+// is never sent the snapshot.
+func TestSlowNodeCatchUp(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: msgHup})
+	for j := 0; j < 30; j++ {
+		nt.send(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{}}})
+	}
+
+	nt.isolate(3)
+	for j := 0; j < 10; j++ {
+		nt.send(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{}}})
+	}
+	lead := nt.peers[1].(*raft)
+	nextEnts(lead)
+	lead.snapshot(nil)
+	// keep 20 entries to catch up the followers, more than 3 lags by
+	lead.compact(lead.raftLog.applied - 20)
+	if lead.raftLog.offset != lead.raftLog.applied-20 {
+		t.Fatalf("lead.offset = %d, want %d", lead.raftLog.offset, lead.raftLog.applied-20)
+	}
+
+	nt.recover()
+	nt.ignore(msgSnap)
+	nt.send(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{}}})
+	follower := nt.peers[3].(*raft)
+	if follower.raftLog.snapshot.Index != 0 {
+		t.Errorf("follower.snap.Index = %d, want 0", follower.raftLog.snapshot.Index)
+	}
+	if follower.raftLog.committed != lead.raftLog.committed {
+		t.Errorf("follower.committed = %d, want %d", follower.raftLog.committed, lead.raftLog.committed)
+	}
+	if g, w := follower.raftLog.lastIndex(), lead.raftLog.lastIndex(); g != w {
+		t.Errorf("follower.lastIndex = %d, want %d", g, w)
+	}
+}
+
+// TestJoin tests that a node started to form a new cluster campaigns once
+// the election timeout is over, while a node started to join an existing
+// one waits to hear from the leader, however long it takes.
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		join   bool
+		wstate StateType
+	}{
+		{false, StateCandidate},
+		{true, StateFollower},
+	}
+	for i, tt := range tests {
+		r := newRaft(1, []int64{1, 2, 3}, 10, 1)
+		if tt.join {
+			Join()(r)
+		}
+		for j := 0; j < 100; j++ {
+			r.tick()
+		}
+		if r.state != tt.wstate {
+			t.Errorf("#%d: state = %s, want %s", i, r.state, tt.wstate)
+		}
+	}
+
+	// the joining node takes part in the elections once it heard from the
+	// leader
+	r := newRaft(1, []int64{1, 2, 3}, 10, 1)
+	Join()(r)
+	r.Step(pb.Message{From: 2, To: 1, Term: 1, Type: msgHeartbeat})
+	if r.lead != 2 {
+		t.Errorf("lead = %d, want 2", r.lead)
+	}
+	for j := 0; j < 100; j++ {
+		r.tick()
+	}
+	if r.state != StateCandidate {
+		t.Errorf("state after hearing from the leader = %s, want %s", r.state, StateCandidate)
+	}
+}
+
+// TestCompactAtSnapshot tests that the log is compacted up to the given
+// index, but not past the snapshot.
+func TestCompactAtSnapshot(t *testing.T) {
+	tests := []struct {
+		index   int64
+		woffset int64
+	}{
+		{3, 3},
+		{6, 6},
+		{8, 6},
+		{0, 0},
+	}
+	for i, tt := range tests {
+		r := newRaft(1, []int64{1}, 10, 1)
+		r.becomeCandidate()
+		r.becomeLeader()
+		for j := 0; j < 9; j++ {
+			r.Step(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{}}})
+		}
+		r.raftLog.committed = 6
+		r.raftLog.applied = 6
+		r.snapshot([]byte("snap"))
+		r.compact(tt.index)
+		if r.raftLog.offset != tt.woffset {
+			t.Errorf("#%d: offset = %d, want %d", i, r.raftLog.offset, tt.woffset)
+		}
+	}
+}
+
+// TestSendAfterCompact tests that a follower whose next entry was kept by
+// the compaction is sent entries, and one whose next entry was compacted
+// is sent the snapshot.
+func TestSendAfterCompact(t *testing.T) {
+	r := newRaft(1, []int64{1, 2, 3}, 10, 1)
+	r.becomeCandidate()
+	r.becomeLeader()
+	for j := 0; j < 10; j++ {
+		r.Step(pb.Message{From: 1, To: 1, Type: msgProp, Entries: []pb.Entry{{}}})
+	}
+	last := r.raftLog.lastIndex()
+	r.raftLog.committed = last
+	r.raftLog.applied = last
+	r.snapshot([]byte("snap"))
+	// keep 5 entries to catch up the followers
+	r.compact(last - 5)
+	r.ReadMessages()
+
+	r.prs[2].next = last - 3
+	r.prs[3].next = last - 7
+	r.sendAppend(2)
+	r.sendAppend(3)
+	msgs := r.ReadMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	if msgs[0].Type != msgApp || len(msgs[0].Entries) != 4 {
+		t.Errorf("to 2: msg = %+v, want msgApp with 4 entries", msgs[0])
+	}
+	if msgs[1].Type != msgSnap || msgs[1].Snapshot.Index != last {
+		t.Errorf("to 3: msg = %+v, want msgSnap at %d", msgs[1], last)
+	}
+}
+
 // TestStepConfig tests that when raft step msgProp in EntryConfChange type,
 // it appends the entry to log and sets pendingConf to be true.
 func TestStepConfig(t *testing.T) {
@@ -1021,6 +1452,23 @@ func TestRemoveNode(t *testing.T) {
 	}
 }
 
+// TestResetPendingConf tests that a rejected config change lets the next
+// one be proposed, and changes no node.
+func TestResetPendingConf(t *testing.T) {
+	r := newRaft(1, []int64{1, 2}, 0, 0)
+	r.pendingConf = true
+	r.resetPendingConf()
+	if r.pendingConf != false {
+		t.Errorf("pendingConf = %v, want false", r.pendingConf)
+	}
+	w := []int64{1, 2}
+	nodes := r.nodes()
+	sort.Sort(int64Slice(nodes))
+	if !reflect.DeepEqual(nodes, w) {
+		t.Errorf("nodes = %v, want %v", nodes, w)
+	}
+}
+
 // TestRecvMsgDenied tests that state machine sets the removed list when
 // handling msgDenied, and does not pass it to the actual stepX function.
 func TestRecvMsgDenied(t *testing.T) {
@@ -1096,6 +1544,12 @@ func TestPromotable(t *testing.T) {
 	}
 }
 
+func newPreVoteRaft() *raft {
+	sm := newRaft(1, []int64{1}, 0, 0)
+	sm.preVote = true
+	return sm
+}
+
 func ents(terms ...int64) *raft {
 	ents := []pb.Entry{{}}
 	for _, term := range terms {
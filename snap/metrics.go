@@ -0,0 +1,6 @@
+package snap
+
+import "github.com/coreos/etcd/pkg/metrics"
+
+var saveDurations = metrics.NewHistogram("etcd_snap_save_duration_seconds",
+	"The latency distributions of saving a snapshot to disk.", metrics.DefaultBuckets)
@@ -0,0 +1,293 @@
+package snap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// the wire types of the protobuf fields of the snapshot files
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errBadField = errors.New("snap: unexpected field")
+
+// LoadReader is like Load, except that the snapshot it returns has no data.
+// The data is rather streamed from the snapshot file by the returned
+// reader, which the caller must close, so that a large snapshot is never
+// held in memory as a whole. The snapshot file is read through once to
+// check its crc before LoadReader returns.
+func (s *Snapshotter) LoadReader() (*raftpb.Snapshot, io.ReadCloser, error) {
+	names, err := s.Names()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		snap *raftpb.Snapshot
+		rc   io.ReadCloser
+	)
+	for _, name := range names {
+		if snap, rc, err = openSnap(s.dir, name); err == nil {
+			break
+		}
+		log.Printf("snap: skipped broken snapshot %v, trying an older one", name)
+	}
+	return snap, rc, err
+}
+
+// OpenData opens the data of snapshot, saved by SaveSnap, to be streamed
+// from its file like LoadReader does. The caller must close the reader.
+func (s *Snapshotter) OpenData(snapshot raftpb.Snapshot) (io.ReadCloser, error) {
+	_, rc, err := openSnap(s.dir, FileName(snapshot))
+	return rc, err
+}
+
+// snapReader reads the data of a snapshot from its file.
+type snapReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *snapReader) Close() error { return r.f.Close() }
+
+func openSnap(dir, name string) (snap *raftpb.Snapshot, rc io.ReadCloser, err error) {
+	fpath := path.Join(dir, name)
+	f, err := os.Open(fpath)
+	if err != nil {
+		log.Printf("Snapshotter cannot read file %v: %v", name, err)
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			renameBroken(fpath)
+		}
+	}()
+
+	off, n, compressed, err := readSnapFile(f)
+	if err != nil {
+		log.Printf("Corrupted snapshot file %v: %v", name, err)
+		return nil, nil, err
+	}
+	// the raft snapshot is read through once for the fields after its
+	// data, and is then read again up to the end of its data
+	r, err := snapData(f, off, n, compressed)
+	if err != nil {
+		log.Printf("Corrupted snapshot file %v: %v", name, err)
+		return nil, nil, err
+	}
+	snap, doff, dn, err := readRaftSnap(r)
+	if err != nil {
+		log.Printf("Corrupted snapshot file %v: %v", name, err)
+		return nil, nil, err
+	}
+	if r, err = snapData(f, off, n, compressed); err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, doff); err != nil {
+		return nil, nil, err
+	}
+	return snap, &snapReader{Reader: io.LimitReader(r, dn), f: f}, nil
+}
+
+// readSnapFile reads through the snappb.Snapshot of f, checking its crc,
+// and returns where its data lies in f and whether it is compressed.
+func readSnapFile(f *os.File) (off, n int64, compressed bool, err error) {
+	// the crc of compressed data also covers the compressed flag, which
+	// may only come after the data
+	h, hc := crc32.New(crcTable), crc32.New(crcTable)
+	hc.Write([]byte{1})
+
+	pr := &protoReader{r: bufio.NewReader(f)}
+	var crc uint32
+	for {
+		num, wire, err := pr.field()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		switch {
+		case num == 1 && wire == wireVarint:
+			v, err := pr.varint()
+			if err != nil {
+				return 0, 0, false, err
+			}
+			crc = uint32(v)
+		case num == 2 && wire == wireBytes:
+			if n, err = pr.length(); err != nil {
+				return 0, 0, false, err
+			}
+			off = pr.off
+			if err = pr.copyN(io.MultiWriter(h, hc), n); err != nil {
+				return 0, 0, false, err
+			}
+		case num == 3 && wire == wireVarint:
+			v, err := pr.varint()
+			if err != nil {
+				return 0, 0, false, err
+			}
+			compressed = v != 0
+		default:
+			if err := pr.skip(wire); err != nil {
+				return 0, 0, false, err
+			}
+		}
+	}
+	sum := h
+	if compressed {
+		sum = hc
+	}
+	if sum.Sum32() != crc {
+		return 0, 0, false, ErrCRCMismatch
+	}
+	return off, n, compressed, nil
+}
+
+// snapData returns a reader of the raft snapshot lying at off in f, which
+// is n bytes long as written.
+func snapData(f *os.File, off, n int64, compressed bool) (io.Reader, error) {
+	var r io.Reader = io.NewSectionReader(f, off, n)
+	if compressed {
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
+// readRaftSnap reads through the raftpb.Snapshot of r, and returns it
+// without its data, along with where its data lies in r.
+func readRaftSnap(r io.Reader) (snap *raftpb.Snapshot, off, n int64, err error) {
+	pr := &protoReader{r: bufio.NewReader(r)}
+	snap = &raftpb.Snapshot{}
+	for {
+		num, wire, err := pr.field()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if num == 1 && wire == wireBytes {
+			if n, err = pr.length(); err != nil {
+				return nil, 0, 0, err
+			}
+			off = pr.off
+			if err = pr.copyN(ioutil.Discard, n); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+		if num < 2 || num > 4 || wire != wireVarint {
+			if err := pr.skip(wire); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+		v, err := pr.varint()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		switch num {
+		case 2:
+			snap.Nodes = append(snap.Nodes, int64(v))
+		case 3:
+			snap.Index = int64(v)
+		case 4:
+			snap.Term = int64(v)
+		}
+	}
+	return snap, off, n, nil
+}
+
+// protoReader reads the fields of a protobuf message one at a time,
+// keeping track of its offset in the message.
+type protoReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+// field reads the key of the next field. It returns io.EOF at the end of
+// the message.
+func (pr *protoReader) field() (num int, wire int, err error) {
+	if _, err := pr.r.Peek(1); err != nil {
+		return 0, 0, err
+	}
+	key, err := pr.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (pr *protoReader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := pr.r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		pr.off++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("snap: varint overflows at offset %d", pr.off)
+}
+
+// length reads the length of a field of wireBytes.
+func (pr *protoReader) length() (int64, error) {
+	v, err := pr.varint()
+	if err != nil {
+		return 0, err
+	}
+	if int64(v) < 0 {
+		return 0, fmt.Errorf("snap: invalid length at offset %d", pr.off)
+	}
+	return int64(v), nil
+}
+
+func (pr *protoReader) copyN(w io.Writer, n int64) error {
+	c, err := io.CopyN(w, pr.r, n)
+	pr.off += c
+	return unexpectedEOF(err)
+}
+
+// skip reads through the value of a field of the given wire type.
+func (pr *protoReader) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := pr.varint()
+		return err
+	case wireBytes:
+		n, err := pr.length()
+		if err != nil {
+			return err
+		}
+		return pr.copyN(ioutil.Discard, n)
+	case 1:
+		return pr.copyN(ioutil.Discard, 8)
+	case 5:
+		return pr.copyN(ioutil.Discard, 4)
+	}
+	return errBadField
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -30,6 +30,7 @@ var _ = math.Inf
 type Snapshot struct {
 	Crc              uint32 `protobuf:"varint,1,req,name=crc" json:"crc"`
 	Data             []byte `protobuf:"bytes,2,opt,name=data" json:"data,omitempty"`
+	Compressed       bool   `protobuf:"varint,3,opt,name=compressed" json:"compressed"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -95,6 +96,23 @@ func (m *Snapshot) Unmarshal(data []byte) error {
 			}
 			m.Data = append(m.Data, data[index:postIndex]...)
 			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Compressed = bool(v != 0)
 		default:
 			var sizeOfWire int
 			for {
@@ -126,6 +144,7 @@ func (m *Snapshot) Size() (n int) {
 		l = len(m.Data)
 		n += 1 + l + sovSnap(uint64(l))
 	}
+	n += 2
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -169,6 +188,14 @@ func (m *Snapshot) MarshalTo(data []byte) (n int, err error) {
 		i = encodeVarintSnap(data, i, uint64(len(m.Data)))
 		i += copy(data[i:], m.Data)
 	}
+	data[i] = 0x18
+	i++
+	if m.Compressed {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1,6 +1,8 @@
 package snap
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -10,6 +12,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
@@ -28,6 +31,9 @@ var (
 
 type Snapshotter struct {
 	dir string
+	// Compress makes SaveSnap compress the snapshots with gzip. Load
+	// reads both compressed and uncompressed snapshots.
+	Compress bool
 }
 
 func New(dir string) *Snapshotter {
@@ -36,6 +42,11 @@ func New(dir string) *Snapshotter {
 	}
 }
 
+// FileName returns the name of the file SaveSnap saves snapshot to.
+func FileName(snapshot raftpb.Snapshot) string {
+	return fmt.Sprintf("%016x-%016x%s", snapshot.Term, snapshot.Index, snapSuffix)
+}
+
 func (s *Snapshotter) SaveSnap(snapshot raftpb.Snapshot) {
 	if raft.IsEmptySnap(snapshot) {
 		return
@@ -44,75 +55,84 @@ func (s *Snapshotter) SaveSnap(snapshot raftpb.Snapshot) {
 }
 
 func (s *Snapshotter) save(snapshot *raftpb.Snapshot) error {
-	fname := fmt.Sprintf("%016x-%016x%s", snapshot.Term, snapshot.Index, snapSuffix)
+	start := time.Now()
+
+	fname := FileName(*snapshot)
 	b, err := snapshot.Marshal()
 	if err != nil {
 		panic(err)
 	}
 
-	crc := crc32.Update(0, crcTable, b)
-	snap := snappb.Snapshot{Crc: crc, Data: b}
+	if s.Compress {
+		if b, err = compress(b); err != nil {
+			return err
+		}
+	}
+	snap := snappb.Snapshot{Crc: snapCrc(b, s.Compress), Data: b, Compressed: s.Compress}
 	d, err := snap.Marshal()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path.Join(s.dir, fname), d, 0666)
+	if err = writeFileAtomic(path.Join(s.dir, fname), d); err != nil {
+		return err
+	}
+	saveDurations.Observe(time.Since(start).Seconds())
+	return nil
 }
 
-func (s *Snapshotter) Load() (*raftpb.Snapshot, error) {
-	names, err := s.snapNames()
-	if err != nil {
-		return nil, err
-	}
-	var snap *raftpb.Snapshot
-	for _, name := range names {
-		if snap, err = loadSnap(s.dir, name); err == nil {
-			break
-		}
+// snapCrc returns the crc of the data of a snapshot file as written. The
+// crc of a compressed snapshot also covers the compressed flag, so that a
+// file truncated before the flag does not pass for an uncompressed one.
+func snapCrc(data []byte, compressed bool) uint32 {
+	crc := uint32(0)
+	if compressed {
+		crc = crc32.Update(crc, crcTable, []byte{1})
 	}
-	return snap, err
+	return crc32.Update(crc, crcTable, data)
 }
 
-func loadSnap(dir, name string) (*raftpb.Snapshot, error) {
-	var err error
-	var b []byte
-
-	fpath := path.Join(dir, name)
-	defer func() {
-		if err != nil {
-			renameBroken(fpath)
-		}
-	}()
-
-	b, err = ioutil.ReadFile(fpath)
+// writeFileAtomic writes b to a temporary file, syncs it, and renames it to
+// fpath, so that a crash never leaves a partial snapshot under its name.
+func writeFileAtomic(fpath string, b []byte) error {
+	tmp := fpath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		log.Printf("Snapshotter cannot read file %v: %v", name, err)
-		return nil, err
+		return err
 	}
-
-	var serializedSnap snappb.Snapshot
-	if err = serializedSnap.Unmarshal(b); err != nil {
-		log.Printf("Corrupted snapshot file %v: %v", name, err)
-		return nil, err
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
 	}
-	crc := crc32.Update(0, crcTable, serializedSnap.Data)
-	if crc != serializedSnap.Crc {
-		log.Printf("Corrupted snapshot file %v: crc mismatch", name)
-		err = ErrCRCMismatch
-		return nil, err
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	if err == nil {
+		err = os.Rename(tmp, fpath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
 
-	var snap raftpb.Snapshot
-	if err = snap.Unmarshal(serializedSnap.Data); err != nil {
-		log.Printf("Corrupted snapshot file %v: %v", name, err)
+// Load returns the newest snapshot that passes its crc check. Snapshots
+// failing it are renamed with a .broken suffix, and skipped for the older ones.
+// The data of the snapshot is read in memory; see LoadReader to stream it.
+func (s *Snapshotter) Load() (*raftpb.Snapshot, error) {
+	snap, rc, err := s.LoadReader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if snap.Data, err = ioutil.ReadAll(rc); err != nil {
 		return nil, err
 	}
-	return &snap, nil
+	return snap, nil
 }
 
-// snapNames returns the filename of the snapshots in logical time order (from newest to oldest).
+// Names returns the filename of the snapshots in logical time order (from newest to oldest).
 // If there is no avaliable snapshots, an ErrNoSnapshot will be returned.
-func (s *Snapshotter) snapNames() ([]string, error) {
+func (s *Snapshotter) Names() ([]string, error) {
 	dir, err := os.Open(s.dir)
 	if err != nil {
 		return nil, err
@@ -130,6 +150,49 @@ func (s *Snapshotter) snapNames() ([]string, error) {
 	return snaps, nil
 }
 
+// Purge removes all but the newest max snapshot files, and returns the index
+// of the oldest snapshot it retains. Purge never removes a snapshot when max
+// is 0. If there is no avaliable snapshots, an ErrNoSnapshot will be returned.
+func (s *Snapshotter) Purge(max int) (int64, error) {
+	names, err := s.Names()
+	if err != nil {
+		return 0, err
+	}
+	if max > 0 && len(names) > max {
+		for _, name := range names[max:] {
+			fpath := path.Join(s.dir, name)
+			if err := os.Remove(fpath); err != nil {
+				return 0, err
+			}
+			log.Printf("snap: purged snapshot file %s", fpath)
+		}
+		names = names[:max]
+	}
+	_, index, err := parseSnapName(names[len(names)-1])
+	return index, err
+}
+
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseSnapName(name string) (term, index int64, err error) {
+	var num int
+	num, err = fmt.Sscanf(name, "%016x-%016x"+snapSuffix, &term, &index)
+	if num != 2 && err == nil {
+		err = fmt.Errorf("bad snapshot name: %s", name)
+	}
+	return
+}
+
 func checkSuffix(names []string) []string {
 	snaps := []string{}
 	for i := range names {
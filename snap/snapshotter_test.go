@@ -1,6 +1,7 @@
 package snap
 
 import (
+	"bytes"
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
@@ -41,6 +42,117 @@ func TestSaveAndLoad(t *testing.T) {
 	}
 }
 
+func TestSaveAndLoadCompression(t *testing.T) {
+	large := &raftpb.Snapshot{
+		Data:  bytes.Repeat([]byte("some snapshot"), 1<<16),
+		Nodes: []int64{1, 2, 3},
+		Index: 1,
+		Term:  1,
+	}
+	var sizes []int64
+	for _, compress := range []bool{false, true} {
+		dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ss := New(dir)
+		ss.Compress = compress
+		if err = ss.save(large); err != nil {
+			t.Fatal(err)
+		}
+
+		// the snapshot loads whatever the setting of the loading side
+		for _, lcompress := range []bool{false, true} {
+			ls := New(dir)
+			ls.Compress = lcompress
+			g, err := ls.Load()
+			if err != nil {
+				t.Fatalf("compress %v/%v: err = %v, want nil", compress, lcompress, err)
+			}
+			if !reflect.DeepEqual(g, large) {
+				t.Errorf("compress %v/%v: snap differs from the saved one", compress, lcompress)
+			}
+		}
+
+		fi, err := os.Stat(path.Join(dir, fmt.Sprintf("%016x-%016x%s", 1, 1, snapSuffix)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, fi.Size())
+	}
+	if sizes[1] >= sizes[0]/10 {
+		t.Errorf("compressed size = %d, want much less than %d", sizes[1], sizes[0])
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	large := &raftpb.Snapshot{
+		Data:  bytes.Repeat([]byte("some snapshot"), 1<<16),
+		Nodes: []int64{1, 2, 1 << 40},
+		Index: 300,
+		Term:  2,
+	}
+	for _, compress := range []bool{false, true} {
+		dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ss := New(dir)
+		ss.Compress = compress
+		if err = ss.save(large); err != nil {
+			t.Fatal(err)
+		}
+
+		g, rc, err := ss.LoadReader()
+		if err != nil {
+			t.Fatalf("compress %v: err = %v, want nil", compress, err)
+		}
+		w := *large
+		w.Data = nil
+		if !reflect.DeepEqual(g, &w) {
+			t.Errorf("compress %v: snap = %#v, want %#v", compress, g, &w)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("compress %v: read err = %v, want nil", compress, err)
+		}
+		if !bytes.Equal(data, large.Data) {
+			t.Errorf("compress %v: streamed data differs from the saved one", compress)
+		}
+	}
+}
+
+func TestOpenData(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ss := New(dir)
+	if err = ss.save(testSnap); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := ss.OpenData(raftpb.Snapshot{Index: testSnap.Index, Term: testSnap.Term})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("read err = %v, want nil", err)
+	}
+	if !bytes.Equal(data, testSnap.Data) {
+		t.Errorf("data = %q, want %q", data, testSnap.Data)
+	}
+	if _, err := ss.OpenData(raftpb.Snapshot{Index: 2, Term: 1}); err == nil {
+		t.Errorf("err = nil, want an error for a snapshot never saved")
+	}
+}
+
 func TestBadCRC(t *testing.T) {
 	dir := path.Join(os.TempDir(), "snapshot")
 	err := os.Mkdir(dir, 0700)
@@ -98,6 +210,60 @@ func TestFailback(t *testing.T) {
 	}
 }
 
+func TestLoadTruncatedNewest(t *testing.T) {
+	older := *testSnap
+	newer := *testSnap
+	newer.Index = 2
+	newer.Data = []byte("newer snapshot")
+	fname := fmt.Sprintf("%016x-%016x%s", newer.Term, newer.Index, snapSuffix)
+
+	tests := []struct {
+		compress bool
+		cut      int
+	}{
+		{false, 1},
+		{false, 10},
+		{true, 1},
+		// drops the compressed flag only
+		{true, 2},
+		{true, 10},
+	}
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ss := New(dir)
+		ss.Compress = tt.compress
+		if err = ss.save(&older); err != nil {
+			t.Fatal(err)
+		}
+		if err = ss.save(&newer); err != nil {
+			t.Fatal(err)
+		}
+		fpath := path.Join(dir, fname)
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Truncate(fpath, fi.Size()-int64(tt.cut)); err != nil {
+			t.Fatal(err)
+		}
+
+		g, err := ss.Load()
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(g, &older) {
+			t.Errorf("#%d: snap = %#v, want %#v", i, g, &older)
+		}
+		if _, err := os.Stat(fpath + ".broken"); err != nil {
+			t.Errorf("#%d: broken snapshot was not renamed: %v", i, err)
+		}
+	}
+}
+
 func TestSnapNames(t *testing.T) {
 	dir := path.Join(os.TempDir(), "snapshot")
 	err := os.Mkdir(dir, 0700)
@@ -113,7 +279,7 @@ func TestSnapNames(t *testing.T) {
 		}
 	}
 	ss := New(dir)
-	names, err := ss.snapNames()
+	names, err := ss.Names()
 	if err != nil {
 		t.Errorf("err = %v, want nil", err)
 	}
@@ -168,3 +334,64 @@ func TestNoSnapshot(t *testing.T) {
 		t.Errorf("err = %v, want %v", err, ErrNoSnapshot)
 	}
 }
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		max      int
+		windexes []int64
+		windex   int64
+	}{
+		{0, []int64{3, 2, 1}, 1},
+		{2, []int64{3, 2}, 2},
+		{3, []int64{3, 2, 1}, 1},
+		{5, []int64{3, 2, 1}, 1},
+	}
+	for i, tt := range tests {
+		dir := path.Join(os.TempDir(), "snapshot")
+		err := os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := New(dir)
+		for j := int64(1); j <= 3; j++ {
+			snap := *testSnap
+			snap.Index = j
+			if err = ss.save(&snap); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		index, err := ss.Purge(tt.max)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if index != tt.windex {
+			t.Errorf("#%d: index = %d, want %d", i, index, tt.windex)
+		}
+		names, err := ss.Names()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wnames []string
+		for _, index := range tt.windexes {
+			wnames = append(wnames, fmt.Sprintf("%016x-%016x.snap", 1, index))
+		}
+		if !reflect.DeepEqual(names, wnames) {
+			t.Errorf("#%d: names = %v, want %v", i, names, wnames)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPurgeNoSnapshot(t *testing.T) {
+	dir := path.Join(os.TempDir(), "snapshot")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ss := New(dir)
+	if _, err = ss.Purge(1); err != ErrNoSnapshot {
+		t.Errorf("err = %v, want %v", err, ErrNoSnapshot)
+	}
+}
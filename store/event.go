@@ -8,14 +8,17 @@ const (
 	Delete           = "delete"
 	CompareAndSwap   = "compareAndSwap"
 	CompareAndDelete = "compareAndDelete"
+	DeleteRange      = "deleteRange"
 	Expire           = "expire"
 )
 
 type Event struct {
-	Action    string      `json:"action"`
-	Node      *NodeExtern `json:"node,omitempty"`
-	PrevNode  *NodeExtern `json:"prevNode,omitempty"`
-	EtcdIndex uint64      `json:"-"`
+	Action   string      `json:"action"`
+	Node     *NodeExtern `json:"node,omitempty"`
+	PrevNode *NodeExtern `json:"prevNode,omitempty"`
+	// Deleted is the number of nodes deleted by a DeleteRange.
+	Deleted   int    `json:"deleted,omitempty"`
+	EtcdIndex uint64 `json:"-"`
 }
 
 func newEvent(action string, key string, modifiedIndex, createdIndex uint64) *Event {
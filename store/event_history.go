@@ -88,6 +88,31 @@ func (eh *EventHistory) scan(key string, recursive bool, index uint64) (*Event,
 	}
 }
 
+// resize sets the capacity of eh, keeping the latest events that fit in it.
+func (eh *EventHistory) resize(capacity int) {
+	eh.rwl.Lock()
+	defer eh.rwl.Unlock()
+
+	old := eh.Queue
+	if old.Capacity == capacity {
+		return
+	}
+	eh.Queue = eventQueue{
+		Capacity: capacity,
+		Events:   make([]*Event, capacity),
+	}
+	skip := 0
+	if old.Size > capacity {
+		skip = old.Size - capacity
+	}
+	for i := skip; i < old.Size; i++ {
+		eh.Queue.insert(old.Events[(old.Front+i)%old.Capacity])
+	}
+	if eh.Queue.Size > 0 {
+		eh.StartIndex = eh.Queue.Events[eh.Queue.Front].Index()
+	}
+}
+
 // clone will be protected by a stop-world lock
 // do not need to obtain internal lock
 func (eh *EventHistory) clone() *EventHistory {
@@ -0,0 +1,24 @@
+/*
+Copyright 2014 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "github.com/coreos/etcd/pkg/metrics"
+
+var (
+	keysGauge            = metrics.NewGauge("etcd_store_keys", "The number of keys in the store.")
+	quotaExceededCounter = metrics.NewCounter("etcd_store_quota_exceeded_total", "The number of mutations refused because the store is over its quota.")
+)
@@ -113,6 +113,9 @@ func (n *node) Write(value string, index uint64) *etcdErr.Error {
 		return etcdErr.NewError(etcdErr.EcodeNotFile, "", n.store.CurrentIndex)
 	}
 
+	if n.Parent != nil {
+		n.store.bytes += int64(len(value) - len(n.Value))
+	}
 	n.Value = value
 	n.ModifiedIndex = index
 
@@ -138,8 +141,9 @@ func (n *node) ExpirationAndTTL() (*time.Time, int64) {
 	return nil, 0
 }
 
-// List function return a slice of nodes under the receiver node.
-// If the receiver node is not a directory, a "Not A Directory" error will be returned.
+// List function return a slice of nodes under the receiver node, sorted by
+// key. If the receiver node is not a directory, a "Not A Directory" error will
+// be returned.
 func (n *node) List() ([]*node, *etcdErr.Error) {
 	if !n.IsDir() {
 		return nil, etcdErr.NewError(etcdErr.EcodeNotDir, "", n.store.CurrentIndex)
@@ -152,10 +156,18 @@ func (n *node) List() ([]*node, *etcdErr.Error) {
 		nodes[i] = node
 		i++
 	}
+	sort.Sort(byPath(nodes))
 
 	return nodes, nil
 }
 
+// byPath sorts nodes by key.
+type byPath []*node
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // GetChild function returns the child node under the directory node.
 // On success, it returns the file node
 func (n *node) GetChild(name string) (*node, *etcdErr.Error) {
@@ -190,6 +202,11 @@ func (n *node) Add(child *node) *etcdErr.Error {
 	}
 
 	n.Children[name] = child
+	n.store.bytes += child.size()
+	if !child.IsDir() {
+		n.store.keys++
+		keysGauge.Add(1)
+	}
 
 	return nil
 }
@@ -216,6 +233,9 @@ func (n *node) Remove(dir, recursive bool, callback func(path string)) *etcdErr.
 		// find its parent and remove the node from the map
 		if n.Parent != nil && n.Parent.Children[name] == n {
 			delete(n.Parent.Children, name)
+			n.store.keys--
+			n.store.bytes -= n.size()
+			keysGauge.Add(-1)
 		}
 
 		if callback != nil {
@@ -237,6 +257,7 @@ func (n *node) Remove(dir, recursive bool, callback func(path string)) *etcdErr.
 	_, name := path.Split(n.Path)
 	if n.Parent != nil && n.Parent.Children[name] == n {
 		delete(n.Parent.Children, name)
+		n.store.bytes -= n.size()
 
 		if callback != nil {
 			callback(n.Path)
@@ -251,7 +272,9 @@ func (n *node) Remove(dir, recursive bool, callback func(path string)) *etcdErr.
 	return nil
 }
 
-func (n *node) Repr(recurisive, sorted bool) *NodeExtern {
+// Repr returns the external representation of n. Unless hidden is true,
+// the hidden nodes are not listed in it.
+func (n *node) Repr(recurisive, hidden bool) *NodeExtern {
 	if n.IsDir() {
 		node := &NodeExtern{
 			Key:           n.Path,
@@ -274,20 +297,17 @@ func (n *node) Repr(recurisive, sorted bool) *NodeExtern {
 
 		for _, child := range children {
 
-			if child.IsHidden() { // get will not list hidden node
+			if child.IsHidden() && !hidden { // get will not list hidden node
 				continue
 			}
 
-			node.Nodes[i] = child.Repr(recurisive, sorted)
+			node.Nodes[i] = child.Repr(recurisive, hidden)
 
 			i++
 		}
 
 		// eliminate hidden nodes
 		node.Nodes = node.Nodes[:i]
-		if sorted {
-			sort.Sort(node.Nodes)
-		}
 
 		return node
 	}
@@ -365,6 +385,32 @@ func (n *node) Clone() *node {
 	return clone
 }
 
+// size is the number of bytes n counts for in the quota of the store.
+func (n *node) size() int64 {
+	return int64(len(n.Path) + len(n.Value))
+}
+
+// countBytes returns the size of the nodes under n, n included.
+func (n *node) countBytes() int64 {
+	b := n.size()
+	for _, child := range n.Children {
+		b += child.countBytes()
+	}
+	return b
+}
+
+// countKeys returns the number of key-value nodes under n, n included.
+func (n *node) countKeys() int64 {
+	if !n.IsDir() {
+		return 1
+	}
+	var c int64
+	for _, child := range n.Children {
+		c += child.countKeys()
+	}
+	return c
+}
+
 // recoverAndclean function help to do recovery.
 // Two things need to be done: 1. recovery structure; 2. delete expired nodes
 
@@ -1,7 +1,6 @@
 package store
 
 import (
-	"sort"
 	"time"
 )
 
@@ -20,7 +19,7 @@ type NodeExtern struct {
 	CreatedIndex  uint64      `json:"createdIndex,omitempty"`
 }
 
-func (eNode *NodeExtern) loadInternalNode(n *node, recursive, sorted bool) {
+func (eNode *NodeExtern) loadInternalNode(n *node, recursive, hidden bool) {
 	if n.IsDir() { // node is a directory
 		eNode.Dir = true
 
@@ -32,21 +31,17 @@ func (eNode *NodeExtern) loadInternalNode(n *node, recursive, sorted bool) {
 		i := 0
 
 		for _, child := range children {
-			if child.IsHidden() { // get will not return hidden nodes
+			if child.IsHidden() && !hidden { // get will not return hidden nodes
 				continue
 			}
 
-			eNode.Nodes[i] = child.Repr(recursive, sorted)
+			eNode.Nodes[i] = child.Repr(recursive, hidden)
 			i++
 		}
 
 		// eliminate hidden nodes
 		eNode.Nodes = eNode.Nodes[:i]
 
-		if sorted {
-			sort.Sort(eNode.Nodes)
-		}
-
 	} else { // node is a file
 		value, _ := n.Read()
 		eNode.Value = &value
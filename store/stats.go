@@ -79,11 +79,50 @@ func newStats() *Stats {
 	return s
 }
 
+// clone returns a copy of the stats, the counters of which are read
+// atomically, as they are incremented while it is made.
 func (s *Stats) clone() *Stats {
-	return &Stats{s.GetSuccess, s.GetFail, s.SetSuccess, s.SetFail,
-		s.DeleteSuccess, s.DeleteFail, s.UpdateSuccess, s.UpdateFail, s.CreateSuccess,
-		s.CreateFail, s.CompareAndSwapSuccess, s.CompareAndSwapFail,
-		s.CompareAndDeleteSuccess, s.CompareAndDeleteFail, s.Watchers, s.ExpireCount}
+	return &Stats{
+		GetSuccess:              atomic.LoadUint64(&s.GetSuccess),
+		GetFail:                 atomic.LoadUint64(&s.GetFail),
+		SetSuccess:              atomic.LoadUint64(&s.SetSuccess),
+		SetFail:                 atomic.LoadUint64(&s.SetFail),
+		DeleteSuccess:           atomic.LoadUint64(&s.DeleteSuccess),
+		DeleteFail:              atomic.LoadUint64(&s.DeleteFail),
+		UpdateSuccess:           atomic.LoadUint64(&s.UpdateSuccess),
+		UpdateFail:              atomic.LoadUint64(&s.UpdateFail),
+		CreateSuccess:           atomic.LoadUint64(&s.CreateSuccess),
+		CreateFail:              atomic.LoadUint64(&s.CreateFail),
+		CompareAndSwapSuccess:   atomic.LoadUint64(&s.CompareAndSwapSuccess),
+		CompareAndSwapFail:      atomic.LoadUint64(&s.CompareAndSwapFail),
+		CompareAndDeleteSuccess: atomic.LoadUint64(&s.CompareAndDeleteSuccess),
+		CompareAndDeleteFail:    atomic.LoadUint64(&s.CompareAndDeleteFail),
+		ExpireCount:             atomic.LoadUint64(&s.ExpireCount),
+		Watchers:                atomic.LoadUint64(&s.Watchers),
+	}
+}
+
+// reset sets the counters back to zero, and returns a copy of the stats
+// before. Watchers, which is not a counter, is kept.
+func (s *Stats) reset() *Stats {
+	return &Stats{
+		GetSuccess:              atomic.SwapUint64(&s.GetSuccess, 0),
+		GetFail:                 atomic.SwapUint64(&s.GetFail, 0),
+		SetSuccess:              atomic.SwapUint64(&s.SetSuccess, 0),
+		SetFail:                 atomic.SwapUint64(&s.SetFail, 0),
+		DeleteSuccess:           atomic.SwapUint64(&s.DeleteSuccess, 0),
+		DeleteFail:              atomic.SwapUint64(&s.DeleteFail, 0),
+		UpdateSuccess:           atomic.SwapUint64(&s.UpdateSuccess, 0),
+		UpdateFail:              atomic.SwapUint64(&s.UpdateFail, 0),
+		CreateSuccess:           atomic.SwapUint64(&s.CreateSuccess, 0),
+		CreateFail:              atomic.SwapUint64(&s.CreateFail, 0),
+		CompareAndSwapSuccess:   atomic.SwapUint64(&s.CompareAndSwapSuccess, 0),
+		CompareAndSwapFail:      atomic.SwapUint64(&s.CompareAndSwapFail, 0),
+		CompareAndDeleteSuccess: atomic.SwapUint64(&s.CompareAndDeleteSuccess, 0),
+		CompareAndDeleteFail:    atomic.SwapUint64(&s.CompareAndDeleteFail, 0),
+		ExpireCount:             atomic.SwapUint64(&s.ExpireCount, 0),
+		Watchers:                atomic.LoadUint64(&s.Watchers),
+	}
 }
 
 // Status() return the statistics info of etcd storage its recent start
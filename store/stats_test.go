@@ -1,6 +1,7 @@
 package store
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -99,3 +100,43 @@ func TestStoreStatsExpireCount(t *testing.T) {
 	time.Sleep(600 * time.Millisecond)
 	assert.Equal(t, uint64(1), s.Stats.ExpireCount, "")
 }
+
+// Ensure that a successful CompareAndDelete is recorded in the stats.
+func TestStoreStatsCompareAndDeleteSuccess(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	s.CompareAndDelete("/foo", "bar", 0)
+	assert.Equal(t, uint64(1), s.Stats.CompareAndDeleteSuccess, "")
+}
+
+// Ensure that a failed CompareAndDelete is recorded in the stats.
+func TestStoreStatsCompareAndDeleteFail(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	s.CompareAndDelete("/foo", "baz", 0)
+	assert.Equal(t, uint64(1), s.Stats.CompareAndDeleteFail, "")
+}
+
+// Ensure that resetting the stats returns the counts so far and sets them
+// back to zero, but keeps the number of watchers.
+func TestStoreStatsReset(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	s.Get("/foo", false, false)
+	s.Watch("/foo", false, false, 0)
+
+	var before, after Stats
+	assert.Nil(t, json.Unmarshal(s.ResetStats(), &before), "")
+	assert.Equal(t, Stats{CreateSuccess: 1, GetSuccess: 1, Watchers: 1}, before, "")
+	assert.Nil(t, json.Unmarshal(s.JsonStats(), &after), "")
+	assert.Equal(t, Stats{Watchers: 1}, after, "")
+
+	s.Get("/foo", false, false)
+	assert.Equal(t, uint64(1), s.Stats.GetSuccess, "")
+}
+
+// Ensure that a clone of the stats holds every count in its own field.
+func TestStatsClone(t *testing.T) {
+	s := &Stats{ExpireCount: 1, Watchers: 2}
+	assert.Equal(t, *s, *s.clone(), "")
+}
@@ -17,15 +17,21 @@ limitations under the License.
 package store
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/pkg/logger"
 )
 
 // The default version to set when the store is first initialized.
@@ -42,23 +48,32 @@ type Store interface {
 	Index() uint64
 
 	Get(nodePath string, recursive, sorted bool) (*Event, error)
+	GetHidden(nodePath string, recursive, sorted bool) (*Event, error)
 	Set(nodePath string, dir bool, value string, expireTime time.Time) (*Event, error)
 	Update(nodePath string, newValue string, expireTime time.Time) (*Event, error)
+	Refresh(nodePath string, expireTime time.Time) (*Event, error)
 	Create(nodePath string, dir bool, value string, unique bool,
 		expireTime time.Time) (*Event, error)
 	CompareAndSwap(nodePath string, prevValue string, prevIndex uint64,
 		value string, expireTime time.Time) (*Event, error)
 	Delete(nodePath string, dir, recursive bool) (*Event, error)
 	CompareAndDelete(nodePath string, prevValue string, prevIndex uint64) (*Event, error)
+	DeleteRange(prefix string) (*Event, error)
+	Txn(t Txn) (*TxnResponse, error)
 
 	Watch(prefix string, recursive, stream bool, sinceIndex uint64) (Watcher, error)
 
 	Save() ([]byte, error)
+	SaveTo(w io.Writer) error
 	Recovery(state []byte) error
+	RecoveryFrom(r io.Reader) error
 
 	TotalTransactions() uint64
 	JsonStats() []byte
+	ResetStats() []byte
 	DeleteExpiredKeys(cutoff time.Time)
+
+	Clone() Store
 }
 
 type store struct {
@@ -69,18 +84,79 @@ type store struct {
 	CurrentVersion int
 	ttlKeyHeap     *ttlKeyHeap  // need to recovery manually
 	worldLock      sync.RWMutex // stop the world lock
+	keys           int64        // number of key-value nodes
+	bytes          int64        // size of the nodes, see node.size
+	quota          Quota
+	overQuota      bool // whether the last checked mutation was refused
+	historySize    int  // capacity of the event history, kept on recovery
+	maxKeyBytes    int
+	maxKeyDepth    int
+}
+
+// DefaultEventHistorySize is the number of events a store keeps by default
+// for the watchers resuming from an index.
+const DefaultEventHistorySize = 1000
+
+// Quota limits the content of a store. A zero field means no limit.
+type Quota struct {
+	// Keys is the maximum number of key-value nodes.
+	Keys int64
+	// Bytes is the maximum total size of the keys and values.
+	Bytes int64
+}
+
+// Config configures a store. A zero field takes its default.
+type Config struct {
+	Quota Quota
+	// EventHistorySize is the number of the latest events kept for the
+	// watchers resuming from an index. A watcher resuming from an older
+	// index gets EcodeEventIndexCleared. It defaults to
+	// DefaultEventHistorySize.
+	EventHistorySize int
+	// MaxKeyBytes and MaxKeyDepth, if not 0, are the longest key in bytes,
+	// and the most nested one in path components, that can be created;
+	// the others are refused with EcodeKeyTooLong and EcodeKeyTooDeep.
+	// Like the quota, they are checked as the entries are applied, so
+	// the members must be configured with the same limits. The keys under
+	// internalPrefix, which etcd writes itself, are not limited.
+	MaxKeyBytes int
+	MaxKeyDepth int
 }
 
+// internalPrefix holds the keys etcd writes itself, such as its members
+// and users.
+const internalPrefix = "/_etcd/"
+
 func New() Store {
 	return newStore()
 }
 
+// NewWithQuota creates a store that refuses, with EcodeQuotaExceeded, the
+// mutations that would grow it past q. Mutations that shrink it, like
+// deletes, are always allowed.
+func NewWithQuota(q Quota) Store {
+	return NewWithConfig(Config{Quota: q})
+}
+
+// NewWithConfig creates a store configured by c.
+func NewWithConfig(c Config) Store {
+	s := newStore()
+	s.quota = c.Quota
+	s.maxKeyBytes, s.maxKeyDepth = c.MaxKeyBytes, c.MaxKeyDepth
+	if c.EventHistorySize > 0 {
+		s.historySize = c.EventHistorySize
+		s.WatcherHub = newWatchHub(c.EventHistorySize)
+	}
+	return s
+}
+
 func newStore() *store {
 	s := new(store)
 	s.CurrentVersion = defaultVersion
 	s.Root = newDir(s, "/", s.CurrentIndex, nil, "", Permanent)
 	s.Stats = newStats()
-	s.WatcherHub = newWatchHub(1000)
+	s.historySize = DefaultEventHistorySize
+	s.WatcherHub = newWatchHub(s.historySize)
 	s.ttlKeyHeap = newTtlKeyHeap()
 	return s
 }
@@ -99,8 +175,20 @@ func (s *store) Index() uint64 {
 
 // Get returns a get event.
 // If recursive is true, it will return all the content under the node path.
-// If sorted is true, it will sort the content by keys.
+// The content is always sorted by keys, so that the same tree is always
+// listed the same; sorted is only kept for the callers asking for it.
+// Hidden nodes, whose names start with '_', are not listed; they can only
+// be got by their own path.
 func (s *store) Get(nodePath string, recursive, sorted bool) (*Event, error) {
+	return s.get(nodePath, recursive, false)
+}
+
+// GetHidden is like Get, except that the hidden nodes are listed too.
+func (s *store) GetHidden(nodePath string, recursive, sorted bool) (*Event, error) {
+	return s.get(nodePath, recursive, true)
+}
+
+func (s *store) get(nodePath string, recursive, hidden bool) (*Event, error) {
 	s.worldLock.RLock()
 	defer s.worldLock.RUnlock()
 
@@ -115,7 +203,7 @@ func (s *store) Get(nodePath string, recursive, sorted bool) (*Event, error) {
 
 	e := newEvent(Get, nodePath, n.ModifiedIndex, n.CreatedIndex)
 	e.EtcdIndex = s.CurrentIndex
-	e.Node.loadInternalNode(n, recursive, sorted)
+	e.Node.loadInternalNode(n, recursive, hidden)
 
 	s.Stats.Inc(GetSuccess)
 
@@ -143,10 +231,14 @@ func (s *store) Create(nodePath string, dir bool, value string, unique bool, exp
 
 // Set creates or replace the node at nodePath.
 func (s *store) Set(nodePath string, dir bool, value string, expireTime time.Time) (*Event, error) {
-	var err error
-
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
+	return s.set(nodePath, dir, value, expireTime)
+}
+
+// set is Set, for callers that hold the world lock.
+func (s *store) set(nodePath string, dir bool, value string, expireTime time.Time) (*Event, error) {
+	var err error
 
 	defer func() {
 		if err == nil {
@@ -194,6 +286,12 @@ func getCompareFailCause(n *node, which int, prevValue string, prevIndex uint64)
 	}
 }
 
+// CompareAndSwap sets the value of the node at nodePath if its value and its
+// modified index match prevValue and prevIndex, where given. Otherwise, the
+// EcodeTestFailed error tells the value or the index the node has, and the
+// current index, as they are under the same lock as the comparison: when
+// called as the entries are applied, they are the ones written by the
+// request applied before.
 func (s *store) CompareAndSwap(nodePath string, prevValue string, prevIndex uint64,
 	value string, expireTime time.Time) (*Event, error) {
 
@@ -226,6 +324,11 @@ func (s *store) CompareAndSwap(nodePath string, prevValue string, prevIndex uint
 		return nil, etcdErr.NewError(etcdErr.EcodeTestFailed, cause, s.CurrentIndex)
 	}
 
+	if err := s.checkQuota(0, int64(len(value)-len(n.Value))); err != nil {
+		s.Stats.Inc(CompareAndSwapFail)
+		return nil, err
+	}
+
 	// update etcd index
 	s.CurrentIndex++
 
@@ -254,7 +357,11 @@ func (s *store) CompareAndSwap(nodePath string, prevValue string, prevIndex uint
 func (s *store) Delete(nodePath string, dir, recursive bool) (*Event, error) {
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
+	return s.delete(nodePath, dir, recursive)
+}
 
+// delete is Delete, for callers that hold the world lock.
+func (s *store) delete(nodePath string, dir, recursive bool) (*Event, error) {
 	nodePath = path.Clean(path.Join("/", nodePath))
 	// we do not allow the user to change "/"
 	if nodePath == "/" {
@@ -305,6 +412,57 @@ func (s *store) Delete(nodePath string, dir, recursive bool) (*Event, error) {
 	return e, nil
 }
 
+// DeleteRange deletes every node under the directory at prefix, keeping
+// the directory itself, as a single change: the nodes are deleted at the
+// same index, and the watchers of the directory are notified of one
+// DeleteRange event, telling the number of nodes deleted. The root cannot
+// be emptied, as it holds the internal keys of the cluster.
+func (s *store) DeleteRange(prefix string) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	prefix = path.Clean(path.Join("/", prefix))
+	if prefix == "/" {
+		s.Stats.Inc(DeleteFail)
+		return nil, etcdErr.NewError(etcdErr.EcodeRootROnly, "/", s.CurrentIndex)
+	}
+	n, err := s.internalGet(prefix)
+	if err != nil {
+		s.Stats.Inc(DeleteFail)
+		return nil, err
+	}
+	if !n.IsDir() {
+		s.Stats.Inc(DeleteFail)
+		return nil, etcdErr.NewError(etcdErr.EcodeNotDir, prefix, s.CurrentIndex)
+	}
+
+	nextIndex := s.CurrentIndex + 1
+	e := newEvent(DeleteRange, prefix, nextIndex, n.CreatedIndex)
+	e.EtcdIndex = nextIndex
+	e.PrevNode = n.Repr(false, false)
+	e.Node.Dir = true
+
+	// the watchers are notified once the event is complete
+	var deleted []string
+	callback := func(path string) {
+		deleted = append(deleted, path)
+	}
+	for _, child := range n.Children {
+		// a recursive removal cannot fail
+		child.Remove(true, true, callback)
+	}
+	e.Deleted = len(deleted)
+	for _, p := range deleted {
+		// notify the watchers with deleted set true
+		s.WatcherHub.notifyWatchers(e, p, true)
+	}
+
+	s.CurrentIndex++
+	s.WatcherHub.notify(e)
+	s.Stats.Inc(DeleteSuccess)
+	return e, nil
+}
+
 func (s *store) CompareAndDelete(nodePath string, prevValue string, prevIndex uint64) (*Event, error) {
 	nodePath = path.Clean(path.Join("/", nodePath))
 
@@ -424,6 +582,11 @@ func (s *store) Update(nodePath string, newValue string, expireTime time.Time) (
 		return nil, etcdErr.NewError(etcdErr.EcodeNotFile, nodePath, currIndex)
 	}
 
+	if err := s.checkQuota(0, int64(len(newValue)-len(n.Value))); err != nil {
+		s.Stats.Inc(UpdateFail)
+		return nil, err
+	}
+
 	n.Write(newValue, nextIndex)
 
 	if n.IsDir() {
@@ -448,6 +611,36 @@ func (s *store) Update(nodePath string, newValue string, expireTime time.Time) (
 	return e, nil
 }
 
+// Refresh updates the expiration time of the node at nodePath, leaving its
+// value and indexes untouched. Watchers are not notified, since the node
+// itself does not change.
+func (s *store) Refresh(nodePath string, expireTime time.Time) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+	if nodePath == "/" {
+		return nil, etcdErr.NewError(etcdErr.EcodeRootROnly, "/", s.CurrentIndex)
+	}
+
+	n, err := s.internalGet(nodePath)
+	if err != nil {
+		s.Stats.Inc(UpdateFail)
+		return nil, err
+	}
+
+	e := newEvent(Update, nodePath, n.ModifiedIndex, n.CreatedIndex)
+	e.EtcdIndex = s.CurrentIndex
+	e.PrevNode = n.Repr(false, false)
+
+	n.UpdateTTL(expireTime)
+	e.Node.loadInternalNode(n, false, false)
+
+	s.Stats.Inc(UpdateSuccess)
+
+	return e, nil
+}
+
 func (s *store) internalCreate(nodePath string, dir bool, value string, unique, replace bool,
 	expireTime time.Time, action string) (*Event, error) {
 
@@ -463,6 +656,9 @@ func (s *store) internalCreate(nodePath string, dir bool, value string, unique,
 	if nodePath == "/" {
 		return nil, etcdErr.NewError(etcdErr.EcodeRootROnly, "/", currIndex)
 	}
+	if err := s.checkKey(nodePath); err != nil {
+		return nil, err
+	}
 
 	// Assume expire times that are way in the past are not valid.
 	// This can occur when the time is serialized to JSON and read back in.
@@ -470,11 +666,39 @@ func (s *store) internalCreate(nodePath string, dir bool, value string, unique,
 		expireTime = Permanent
 	}
 
-	dirName, nodeName := path.Split(nodePath)
+	dirName, _ := path.Split(nodePath)
+
+	// the directories missing on the way to the node are created with it,
+	// and count against the quota along with it
+	dbytes, err := s.missingDirsBytes(dirName)
+	if err != nil {
+		s.Stats.Inc(SetFail)
+		err.Index = currIndex
+		return nil, err
+	}
+	dkeys, dbytes := int64(0), dbytes+int64(len(nodePath)+len(value))
+	if !dir {
+		dkeys = 1
+	}
+
+	n, _ := s.internalGet(nodePath)
+
+	// force will try to replace a existing file
+	if n != nil {
+		if !replace {
+			return nil, etcdErr.NewError(etcdErr.EcodeNodeExist, nodePath, currIndex)
+		}
+		if n.IsDir() {
+			return nil, etcdErr.NewError(etcdErr.EcodeNotFile, nodePath, currIndex)
+		}
+		dkeys, dbytes = dkeys-1, dbytes-n.size()
+	}
+	if err := s.checkQuota(dkeys, dbytes); err != nil {
+		return nil, err
+	}
 
 	// walk through the nodePath, create dirs and get the last directory node
 	d, err := s.walk(dirName, s.checkDir)
-
 	if err != nil {
 		s.Stats.Inc(SetFail)
 		err.Index = currIndex
@@ -484,20 +708,9 @@ func (s *store) internalCreate(nodePath string, dir bool, value string, unique,
 	e := newEvent(action, nodePath, nextIndex, nextIndex)
 	eNode := e.Node
 
-	n, _ := d.GetChild(nodeName)
-
-	// force will try to replace a existing file
 	if n != nil {
-		if replace {
-			if n.IsDir() {
-				return nil, etcdErr.NewError(etcdErr.EcodeNotFile, nodePath, currIndex)
-			}
-			e.PrevNode = n.Repr(false, false)
-
-			n.Remove(false, false, nil)
-		} else {
-			return nil, etcdErr.NewError(etcdErr.EcodeNodeExist, nodePath, currIndex)
-		}
+		e.PrevNode = n.Repr(false, false)
+		n.Remove(false, false, nil)
 	}
 
 	if !dir { // create file
@@ -604,10 +817,69 @@ func (s *store) checkDir(parent *node, dirName string) (*node, *etcdErr.Error) {
 	n := newDir(s, path.Join(parent.Path, dirName), s.CurrentIndex+1, parent, parent.ACL, Permanent)
 
 	parent.Children[dirName] = n
+	s.bytes += n.size()
 
 	return n, nil
 }
 
+// missingDirsBytes returns the size of the directories on the clean dirPath
+// that do not exist, which creating a node under it creates, or an error if
+// one of the nodes on it is a file.
+func (s *store) missingDirsBytes(dirPath string) (int64, *etcdErr.Error) {
+	var b int64
+	curr, p := s.Root, "/"
+	for _, name := range strings.Split(dirPath, "/") {
+		if name == "" {
+			continue
+		}
+		p = path.Join(p, name)
+		if curr != nil {
+			child, ok := curr.Children[name]
+			if ok && !child.IsDir() {
+				return 0, etcdErr.NewError(etcdErr.EcodeNotDir, child.Path, s.CurrentIndex)
+			}
+			if curr = child; ok {
+				continue
+			}
+		}
+		b += int64(len(p))
+	}
+	return b, nil
+}
+
+// checkKey returns an error if the clean nodePath is longer or more nested
+// than allowed. The length is in bytes, whatever the characters.
+func (s *store) checkKey(nodePath string) *etcdErr.Error {
+	if strings.HasPrefix(nodePath, internalPrefix) {
+		return nil
+	}
+	if s.maxKeyBytes > 0 && len(nodePath) > s.maxKeyBytes {
+		return etcdErr.NewError(etcdErr.EcodeKeyTooLong, fmt.Sprintf("%d bytes, more than %d", len(nodePath), s.maxKeyBytes), s.CurrentIndex)
+	}
+	if depth := strings.Count(nodePath, "/"); s.maxKeyDepth > 0 && depth > s.maxKeyDepth {
+		return etcdErr.NewError(etcdErr.EcodeKeyTooDeep, fmt.Sprintf("%d levels, more than %d", depth, s.maxKeyDepth), s.CurrentIndex)
+	}
+	return nil
+}
+
+// checkQuota returns an error if adding dkeys keys and dbytes bytes to the
+// store would take it past its quota. Since it runs as the entries are
+// applied, all the members configured with the same quota agree on it.
+func (s *store) checkQuota(dkeys, dbytes int64) *etcdErr.Error {
+	over := (s.quota.Keys > 0 && dkeys > 0 && s.keys+dkeys > s.quota.Keys) ||
+		(s.quota.Bytes > 0 && dbytes > 0 && s.bytes+dbytes > s.quota.Bytes)
+	if !over {
+		s.overQuota = false
+		return nil
+	}
+	quotaExceededCounter.Inc()
+	if !s.overQuota {
+		logger.Warnf("store: quota exceeded (%d keys, %d bytes; quota %d keys, %d bytes)", s.keys, s.bytes, s.quota.Keys, s.quota.Bytes)
+		s.overQuota = true
+	}
+	return etcdErr.NewError(etcdErr.EcodeQuotaExceeded, "", s.CurrentIndex)
+}
+
 // Save saves the static state of the store system.
 // It will not be able to save the state of watchers.
 // It will not save the parent field of the node. Or there will
@@ -633,28 +905,266 @@ func (s *store) Save() ([]byte, error) {
 	return b, nil
 }
 
-// Recovery recovers the store system from a static state
+// SaveTo writes the static state of the store system to w, as Save
+// returns it. The nodes are encoded one at a time, so that the state is
+// never held in memory as a whole. The store is locked meanwhile; save a
+// Clone of it not to keep the writes waiting on a slow w.
+func (s *store) SaveTo(w io.Writer) error {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	e.raw(`{"Root":`)
+	s.Root.encode(e)
+	e.raw(`,"WatcherHub":`)
+	e.value(s.WatcherHub)
+	e.raw(`,"CurrentIndex":`)
+	e.value(s.CurrentIndex)
+	e.raw(`,"Stats":`)
+	e.value(s.Stats)
+	e.raw(`,"CurrentVersion":`)
+	e.value(s.CurrentVersion)
+	e.raw("}")
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// Clone returns a store holding a copy of the static state of the store
+// system, which the later changes to the store do not change. The
+// watchers are not copied.
+func (s *store) Clone() Store {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+	return s.clone()
+}
+
+// clone is Clone without locking s, which the caller must do.
+func (s *store) clone() *store {
+	c := newStore()
+	c.CurrentIndex = s.CurrentIndex
+	c.Root = s.Root.Clone()
+	c.Root.store = c
+	c.Root.recoverAndclean()
+	c.WatcherHub = s.WatcherHub.clone()
+	c.Stats = s.Stats.clone()
+	c.CurrentVersion = s.CurrentVersion
+	c.keys = s.keys
+	c.bytes = s.bytes
+	c.quota = s.quota
+	c.maxKeyBytes, c.maxKeyDepth = s.maxKeyBytes, s.maxKeyDepth
+	c.historySize = s.historySize
+	return c
+}
+
+// Recovery recovers the store system from a static state, as returned by
+// Save. See RecoveryFrom.
+func (s *store) Recovery(state []byte) error {
+	return s.RecoveryFrom(bytes.NewReader(state))
+}
+
+// RecoveryFrom recovers the store system from a static state read from r.
+// The nodes are decoded one at a time, so that the state is never held in
+// memory alongside the store rebuilt from it.
 // It needs to recover the parent field of the nodes.
 // It needs to delete the expired nodes since the saved time and also
 // needs to create monitoring go routines.
-func (s *store) Recovery(state []byte) error {
+func (s *store) RecoveryFrom(r io.Reader) error {
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
-	err := json.Unmarshal(state, s)
 
-	if err != nil {
+	if err := s.decode(json.NewDecoder(r)); err != nil {
 		return err
 	}
+	// the state holds the history with the capacity it was saved with
+	s.WatcherHub.EventHistory.resize(s.historySize)
 
 	s.ttlKeyHeap = newTtlKeyHeap()
 
 	s.Root.recoverAndclean()
+
+	keys := s.Root.countKeys()
+	keysGauge.Add(keys - s.keys)
+	s.keys = keys
+	s.bytes = s.Root.countBytes() - s.Root.size()
 	return nil
 }
 
+// decode decodes the JSON object written by Save into s, like
+// json.Unmarshal would, except that the nodes under Root are decoded one
+// at a time rather than all at once.
+func (s *store) decode(dec *json.Decoder) error {
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "Root":
+			root := &node{store: s}
+			if err := root.decode(dec); err != nil {
+				return err
+			}
+			s.Root = root
+			return nil
+		case "WatcherHub":
+			return dec.Decode(&s.WatcherHub)
+		case "CurrentIndex":
+			return dec.Decode(&s.CurrentIndex)
+		case "Stats":
+			return dec.Decode(&s.Stats)
+		case "CurrentVersion":
+			return dec.Decode(&s.CurrentVersion)
+		}
+		var v json.RawMessage
+		return dec.Decode(&v)
+	})
+}
+
+// decode decodes the JSON object of a node into n, and its children one
+// at a time.
+func (n *node) decode(dec *json.Decoder) error {
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "Path":
+			return dec.Decode(&n.Path)
+		case "CreatedIndex":
+			return dec.Decode(&n.CreatedIndex)
+		case "ModifiedIndex":
+			return dec.Decode(&n.ModifiedIndex)
+		case "ExpireTime":
+			return dec.Decode(&n.ExpireTime)
+		case "ACL":
+			return dec.Decode(&n.ACL)
+		case "Value":
+			return dec.Decode(&n.Value)
+		case "Children":
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				n.Children = nil
+				return nil
+			}
+			if t != json.Delim('{') {
+				return fmt.Errorf("store: unexpected %v in the children of %s", t, n.Path)
+			}
+			n.Children = make(map[string]*node)
+			for dec.More() {
+				t, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := &node{store: n.store}
+				if err := child.decode(dec); err != nil {
+					return err
+				}
+				n.Children[t.(string)] = child
+			}
+			_, err = dec.Token()
+			return err
+		}
+		var v json.RawMessage
+		return dec.Decode(&v)
+	})
+}
+
+// encode writes the JSON object of n to e, as json.Marshal would, and its
+// children one at a time.
+func (n *node) encode(e *encoder) {
+	e.raw(`{"Path":`)
+	e.value(n.Path)
+	e.raw(`,"CreatedIndex":`)
+	e.value(n.CreatedIndex)
+	e.raw(`,"ModifiedIndex":`)
+	e.value(n.ModifiedIndex)
+	e.raw(`,"ExpireTime":`)
+	e.value(n.ExpireTime)
+	e.raw(`,"ACL":`)
+	e.value(n.ACL)
+	e.raw(`,"Value":`)
+	e.value(n.Value)
+	e.raw(`,"Children":`)
+	if n.Children == nil {
+		e.raw("null}")
+		return
+	}
+	names := make([]string, 0, len(n.Children))
+	for name := range n.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.raw("{")
+	for i, name := range names {
+		if i > 0 {
+			e.raw(",")
+		}
+		e.value(name)
+		e.raw(":")
+		n.Children[name].encode(e)
+	}
+	e.raw("}}")
+}
+
+// encoder writes JSON to w, and keeps the first error, after which it
+// writes nothing more.
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) raw(s string) {
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *encoder) value(v interface{}) {
+	if e.err != nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+// decodeObject reads a JSON object from dec, calling decodeValue to decode
+// the value of each of its keys.
+func decodeObject(dec *json.Decoder, decodeValue func(key string) error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("store: unexpected %v, want an object", t)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := decodeValue(t.(string)); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
 func (s *store) JsonStats() []byte {
-	s.Stats.Watchers = uint64(s.WatcherHub.count)
-	return s.Stats.toJson()
+	st := s.Stats.clone()
+	st.Watchers = uint64(atomic.LoadInt64(&s.WatcherHub.count))
+	return st.toJson()
+}
+
+// ResetStats returns the stats as JsonStats does, and sets the counters
+// back to zero at once, so that the next stats count the operations since.
+func (s *store) ResetStats() []byte {
+	st := s.Stats.reset()
+	st.Watchers = uint64(atomic.LoadInt64(&s.WatcherHub.count))
+	return st.toJson()
 }
 
 func (s *store) TotalTransactions() uint64 {
@@ -17,7 +17,12 @@ limitations under the License.
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	etcdErr "github.com/coreos/etcd/error"
@@ -37,6 +42,34 @@ func TestStoreGetValue(t *testing.T) {
 	assert.Equal(t, *e.Node.Value, "bar", "")
 }
 
+// Ensure that the hidden nodes, like the ones under /_etcd, are left out of
+// recursive listings unless asked for, and can always be got by their path.
+func TestStoreGetHidden(t *testing.T) {
+	s := newStore()
+	s.Create("/_etcd/lock", false, "owner", false, Permanent)
+	s.Create("/foo/_lock", false, "owner", false, Permanent)
+	s.Create("/foo/bar", false, "X", false, Permanent)
+
+	e, err := s.Get("/", true, true)
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(e.Node.Nodes), 1, "")
+	assert.Equal(t, e.Node.Nodes[0].Key, "/foo", "")
+	assert.Equal(t, len(e.Node.Nodes[0].Nodes), 1, "")
+	assert.Equal(t, e.Node.Nodes[0].Nodes[0].Key, "/foo/bar", "")
+
+	e, err = s.Get("/foo/_lock", false, false)
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "owner", "")
+
+	e, err = s.GetHidden("/", true, true)
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(e.Node.Nodes), 2, "")
+	assert.Equal(t, e.Node.Nodes[0].Key, "/_etcd", "")
+	assert.Equal(t, e.Node.Nodes[0].Nodes[0].Key, "/_etcd/lock", "")
+	assert.Equal(t, len(e.Node.Nodes[1].Nodes), 2, "")
+	assert.Equal(t, e.Node.Nodes[1].Nodes[0].Key, "/foo/_lock", "")
+}
+
 // Ensure that the store can recrusively retrieve a directory listing.
 // Note that hidden files should not be returned.
 func TestStoreGetDirectory(t *testing.T) {
@@ -118,6 +151,46 @@ func TestStoreGetSorted(t *testing.T) {
 	}
 }
 
+// Ensure that the store lists the same tree the same, whether sorted is
+// asked for or not, with directories and keys mixed in key order.
+func TestStoreGetStable(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", true, "", false, Permanent)
+	for _, k := range []string{"d", "b", "e", "a", "c"} {
+		s.Create("/foo/"+k, false, k, false, Permanent)
+		s.Create("/foo/"+k+"dir", true, "", false, Permanent)
+		s.Create("/foo/"+k+"dir/"+k, false, k, false, Permanent)
+	}
+
+	var first []byte
+	for i := 0; i < 20; i++ {
+		for _, sorted := range []bool{true, false} {
+			e, err := s.Get("/foo", true, sorted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(e.Node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = b
+				var keys []string
+				for _, n := range e.Node.Nodes {
+					keys = append(keys, n.Key)
+				}
+				w := []string{"/foo/a", "/foo/adir", "/foo/b", "/foo/bdir", "/foo/c", "/foo/cdir", "/foo/d", "/foo/ddir", "/foo/e", "/foo/edir"}
+				if !reflect.DeepEqual(keys, w) {
+					t.Fatalf("keys = %v, want %v", keys, w)
+				}
+			}
+			if !bytes.Equal(b, first) {
+				t.Fatalf("#%d: listing = %s, want %s", i, b, first)
+			}
+		}
+	}
+}
+
 func TestSet(t *testing.T) {
 	s := newStore()
 
@@ -418,6 +491,75 @@ func TestStoreDeleteDiretoryFailsIfNonRecursiveAndDir(t *testing.T) {
 	assert.Nil(t, e, "")
 }
 
+// Ensure that the store deletes a populated subtree at once, keeping its root.
+func TestStoreDeleteRange(t *testing.T) {
+	s := newStore()
+	s.Create("/foo/a", false, "1", false, Permanent)
+	s.Create("/foo/b/c", false, "2", false, Permanent)
+	s.Create("/foo/b/d", false, "3", false, time.Now().Add(time.Hour))
+	s.Create("/foo/_hidden", false, "4", false, Permanent)
+	s.Create("/foobar", false, "5", false, Permanent)
+	var eidx uint64 = 6
+	wdir, _ := s.Watch("/foo", true, false, 0)
+	wkey, _ := s.Watch("/foo/b/c", false, false, 0)
+
+	e, err := s.DeleteRange("/foo")
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.EtcdIndex, eidx, "")
+	assert.Equal(t, e.Action, "deleteRange", "")
+	assert.Equal(t, e.Node.Key, "/foo", "")
+	assert.Equal(t, e.Node.Dir, true, "")
+	assert.Equal(t, e.PrevNode.Key, "/foo", "")
+	// a, b, b/c, b/d and _hidden
+	assert.Equal(t, e.Deleted, 5, "")
+	assert.Equal(t, s.CurrentIndex, eidx, "")
+
+	// the directory is kept, empty, and the keys next to it are not deleted
+	ge, err := s.Get("/foo", true, false)
+	assert.Nil(t, err, "")
+	assert.Equal(t, ge.Node.Dir, true, "")
+	assert.Equal(t, len(ge.Node.Nodes), 0, "")
+	_, err = s.GetHidden("/foo/_hidden", false, false)
+	assert.NotNil(t, err, "")
+	_, err = s.Get("/foobar", false, false)
+	assert.Nil(t, err, "")
+	assert.Nil(t, s.ttlKeyHeap.top(), "")
+
+	// the watchers of the directory and of the keys get the one event
+	assert.Equal(t, nbselect(wdir.EventChan()), e, "")
+	assert.Equal(t, nbselect(wkey.EventChan()), e, "")
+	we, _ := s.Watch("/foo", true, false, eidx)
+	assert.Equal(t, nbselect(we.EventChan()), e, "")
+
+	// an empty directory is emptied again
+	e, err = s.DeleteRange("/foo")
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Deleted, 0, "")
+}
+
+func TestStoreDeleteRangeFails(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	tests := []struct {
+		prefix string
+		wcode  int
+	}{
+		{"/", etcdErr.EcodeRootROnly},
+		{"/foo", etcdErr.EcodeNotDir},
+		{"/nope", etcdErr.EcodeKeyNotFound},
+	}
+	for i, tt := range tests {
+		e, err := s.DeleteRange(tt.prefix)
+		if e != nil {
+			t.Errorf("#%d: event = %+v, want nil", i, e)
+		}
+		if ee, ok := err.(*etcdErr.Error); !ok || ee.ErrorCode != tt.wcode {
+			t.Errorf("#%d: err = %v, want code %d", i, err, tt.wcode)
+		}
+	}
+	assert.Equal(t, s.CurrentIndex, uint64(1), "")
+}
+
 func TestRootRdOnly(t *testing.T) {
 	s := newStore()
 
@@ -623,6 +765,73 @@ func TestStoreWatchUpdate(t *testing.T) {
 	assert.Equal(t, e.Node.Key, "/foo", "")
 }
 
+// Ensure that a watcher resuming from an index in the event history gets
+// the events it missed, and one resuming from an older index an error.
+func TestStoreWatchHistory(t *testing.T) {
+	s := NewWithConfig(Config{EventHistorySize: 3})
+	for i := 0; i < 5; i++ {
+		s.Set("/foo", false, fmt.Sprint(i), Permanent)
+	}
+
+	// the events 3 to 5 are kept
+	for _, index := range []uint64{3, 4, 5} {
+		w, err := s.Watch("/foo", false, false, index)
+		assert.Nil(t, err, "")
+		e := nbselect(w.EventChan())
+		if assert.NotNil(t, e, "") {
+			assert.Equal(t, e.Index(), index, "")
+			assert.Equal(t, *e.Node.Value, fmt.Sprint(index-1), "")
+		}
+	}
+	for _, index := range []uint64{1, 2} {
+		_, err := s.Watch("/foo", false, false, index)
+		if assert.NotNil(t, err, "") {
+			assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeEventIndexCleared, "")
+		}
+	}
+}
+
+// Ensure that the event history of a recovered store has the size of the
+// store, rather than the one it was saved with.
+func TestStoreRecoveryHistorySize(t *testing.T) {
+	s := NewWithConfig(Config{EventHistorySize: 5})
+	for i := 0; i < 5; i++ {
+		s.Set("/foo", false, fmt.Sprint(i), Permanent)
+	}
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+
+	tests := []struct {
+		size int
+		// the oldest index watched from
+		wstart uint64
+	}{
+		{2, 4},
+		{5, 1},
+		{10, 1},
+	}
+	for i, tt := range tests {
+		s := NewWithConfig(Config{EventHistorySize: tt.size}).(*store)
+		assert.Nil(t, s.Recovery(b), "")
+		if s.WatcherHub.EventHistory.Queue.Capacity != tt.size {
+			t.Errorf("#%d: capacity = %d, want %d", i, s.WatcherHub.EventHistory.Queue.Capacity, tt.size)
+		}
+		if _, err := s.Watch("/foo", false, false, tt.wstart); err != nil {
+			t.Errorf("#%d: watch from %d: err = %v", i, tt.wstart, err)
+		}
+		if _, err := s.Watch("/foo", false, false, tt.wstart-1); tt.wstart > 1 && err == nil {
+			t.Errorf("#%d: watch from %d: err = nil, want cleared", i, tt.wstart-1)
+		}
+		// the history goes on after the events recovered
+		s.Set("/foo", false, "5", Permanent)
+		w, err := s.Watch("/foo", false, false, 6)
+		assert.Nil(t, err, "")
+		if e := nbselect(w.EventChan()); e == nil || e.Index() != 6 {
+			t.Errorf("#%d: event = %v, want index 6", i, e)
+		}
+	}
+}
+
 // Ensure that the store can watch for recursive key updates.
 func TestStoreWatchRecursiveUpdate(t *testing.T) {
 	s := newStore()
@@ -768,6 +977,327 @@ func TestStoreRecover(t *testing.T) {
 	assert.Equal(t, *e.Node.Value, "baz", "")
 }
 
+// Ensure that the store recovered from a streamed state is the store
+// recovered from the same state as a byte slice.
+func TestStoreRecoveryFrom(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", true, "", false, Permanent)
+	s.Create("/foo/x", false, "bar", false, Permanent)
+	s.Create("/foo/y/z", false, "{\"escaped\": \"\\u00e9\"}", false, Permanent)
+	s.Create("/_hidden", false, "h", false, Permanent)
+	s.Create("/ttl", false, "t", false, time.Now().Add(time.Hour))
+	s.Create("/emptydir", true, "", false, Permanent)
+	s.Delete("/foo/x", false, false)
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+
+	s1 := newStore()
+	assert.Nil(t, s1.Recovery(b), "")
+	s2 := newStore()
+	// a reader returning one byte at a time splits every token
+	assert.Nil(t, s2.RecoveryFrom(iotest.OneByteReader(bytes.NewReader(b))), "")
+
+	b1, err := s1.Save()
+	assert.Nil(t, err, "")
+	b2, err := s2.Save()
+	assert.Nil(t, err, "")
+	assert.Equal(t, string(b1), string(b), "")
+	assert.Equal(t, string(b2), string(b1), "")
+	assert.Equal(t, s2.keys, s.keys, "")
+	assert.Equal(t, s2.bytes, s.bytes, "")
+	assert.Equal(t, s2.ttlKeyHeap.Len(), 1, "")
+
+	e, err := s2.Get("/foo/y/z", false, false)
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "{\"escaped\": \"\\u00e9\"}", "")
+
+	s3 := newStore()
+	assert.NotNil(t, s3.RecoveryFrom(bytes.NewReader(b[:len(b)/2])), "")
+}
+
+// Ensure that the state written by SaveTo is the state returned by Save.
+func TestStoreSaveTo(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", true, "", false, Permanent)
+	s.Create("/foo/x", false, "<bar> & \u00e9", false, Permanent)
+	s.Create("/foo/y/z", false, "baz", false, Permanent)
+	s.Create("/ttl", false, "t", false, time.Now().Add(time.Hour))
+	s.Create("/emptydir", true, "", false, Permanent)
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+
+	var buf bytes.Buffer
+	assert.Nil(t, s.SaveTo(&buf), "")
+	assert.Equal(t, buf.String(), string(b), "")
+}
+
+// Ensure that a clone of the store is not changed by the store, and the
+// other way around.
+func TestStoreClone(t *testing.T) {
+	s := newStore()
+	s.Create("/foo/x", false, "bar", false, Permanent)
+	s.Create("/ttl", false, "t", false, time.Now().Add(time.Hour))
+
+	c := s.Clone()
+	s.Set("/foo/x", false, "changed", Permanent)
+	c.Delete("/ttl", false, false)
+
+	e, err := c.Get("/foo/x", false, false)
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "bar", "")
+	assert.Equal(t, e.EtcdIndex, uint64(3), "")
+	e, err = s.Get("/ttl", false, false)
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "t", "")
+}
+
+// Ensure that refreshing a key updates its TTL without notifying watchers.
+func TestStoreRefresh(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, time.Now().Add(time.Minute))
+	w, _ := s.Watch("/foo", false, false, 0)
+
+	e, err := s.Refresh("/foo", time.Now().Add(time.Hour))
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Action, "update", "")
+	assert.Equal(t, *e.Node.Value, "bar", "")
+	assert.Equal(t, e.Node.ModifiedIndex, uint64(1), "")
+	assert.Equal(t, e.EtcdIndex, uint64(1), "")
+	assert.True(t, e.Node.TTL > 3500, "")
+	assert.True(t, e.PrevNode.TTL <= 60, "")
+	select {
+	case e := <-w.EventChan():
+		t.Fatalf("unexpected event %v", e)
+	default:
+	}
+
+	s.DeleteExpiredKeys(time.Now().Add(time.Minute))
+	_, err = s.Get("/foo", false, false)
+	assert.Nil(t, err, "")
+
+	_, err = s.Refresh("/bar", time.Now().Add(time.Hour))
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+}
+
+// Ensure that the keys expire in the order of their expiration time, refreshed
+// or not, after the store recovers from a snapshot.
+func TestStoreExpireOrderAfterRecover(t *testing.T) {
+	s := newStore()
+	now := time.Now()
+	s.Create("/a", false, "a", false, now.Add(1*time.Second))
+	s.Create("/b", false, "b", false, now.Add(2*time.Second))
+	s.Create("/c", false, "c", false, now.Add(3*time.Second))
+	s.Refresh("/a", now.Add(4*time.Second))
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+
+	s2 := newStore()
+	s2.Recovery(b)
+	w, _ := s2.Watch("/", true, true, 0)
+	for _, k := range []string{"/b", "/c", "/a"} {
+		now = now.Add(time.Second)
+		s2.DeleteExpiredKeys(now.Add(time.Second))
+		e := nbselect(w.EventChan())
+		assert.NotNil(t, e, "")
+		assert.Equal(t, e.Action, "expire", "")
+		assert.Equal(t, e.Node.Key, k, "")
+	}
+}
+
+// Ensure that the store counts its keys, including after a recovery.
+func TestStoreKeys(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", true, "", false, Permanent)
+	s.Create("/foo/x", false, "bar", false, Permanent)
+	s.Create("/foo/y", false, "baz", false, Permanent)
+	s.Set("/foo/x", false, "bar2", Permanent)
+	assert.Equal(t, s.keys, int64(2), "")
+	b, _ := s.Save()
+
+	s.Delete("/foo/x", false, false)
+	assert.Equal(t, s.keys, int64(1), "")
+	s.Delete("/foo", true, true)
+	assert.Equal(t, s.keys, int64(0), "")
+
+	s.Recovery(b)
+	assert.Equal(t, s.keys, int64(2), "")
+}
+
+// Ensure that the store counts the size of its nodes, including after a recovery.
+func TestStoreBytes(t *testing.T) {
+	s := newStore()
+	s.Create("/foo/x", false, "bar", false, Permanent)
+	s.Set("/foo/x", false, "bar2", Permanent)
+	s.Update("/foo/x", "b", Permanent)
+	s.Create("/foo/y", false, "baz", false, Permanent)
+	// "/foo", "/foo/x" "b" and "/foo/y" "baz"
+	assert.Equal(t, s.bytes, int64(4+7+6+3), "")
+	b, _ := s.Save()
+
+	s.Delete("/foo/x", false, false)
+	assert.Equal(t, s.bytes, int64(4+6+3), "")
+	s.Delete("/foo", true, true)
+	assert.Equal(t, s.bytes, int64(0), "")
+
+	s.Recovery(b)
+	assert.Equal(t, s.bytes, int64(4+7+6+3), "")
+}
+
+// Ensure that the store refuses the writes past its quota, and accepts them
+// again once keys are deleted.
+func TestStoreQuota(t *testing.T) {
+	tests := []Quota{
+		{Keys: 2},
+		{Bytes: int64(len("/foo") + len("/foo/x") + len("/foo/y") + 6)},
+	}
+	for i, q := range tests {
+		s := NewWithQuota(q)
+		if _, err := s.Create("/foo/x", false, "bar", false, Permanent); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if _, err := s.Create("/foo/y", false, "baz", false, Permanent); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		_, err := s.Create("/foo/z", false, "bat", false, Permanent)
+		if e, ok := err.(*etcdErr.Error); !ok || e.ErrorCode != etcdErr.EcodeQuotaExceeded {
+			t.Errorf("#%d: err = %v, want quota exceeded", i, err)
+		}
+		if _, err := s.Get("/foo/z", false, false); err == nil {
+			t.Errorf("#%d: refused key was created", i)
+		}
+		// replacing a value of the same size does not grow the store
+		if _, err := s.Set("/foo/x", false, "bat", Permanent); err != nil {
+			t.Errorf("#%d: err = %v", i, err)
+		}
+		if _, err := s.Delete("/foo/y", false, false); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if _, err := s.Create("/foo/z", false, "bat", false, Permanent); err != nil {
+			t.Errorf("#%d: err = %v", i, err)
+		}
+	}
+
+	// the directories created on the way count too, and are not created
+	// if the node is refused
+	s := NewWithQuota(Quota{Bytes: int64(len("/a") + len("/a/b") + 3)})
+	_, err := s.Create("/a/b/c", false, "bar", false, Permanent)
+	if e, ok := err.(*etcdErr.Error); !ok || e.ErrorCode != etcdErr.EcodeQuotaExceeded {
+		t.Errorf("err = %v, want quota exceeded", err)
+	}
+	if _, err := s.Get("/a", false, false); err == nil {
+		t.Errorf("directory of a refused key was created")
+	}
+	if _, err := s.Create("/a/b", false, "bar", false, Permanent); err != nil {
+		t.Errorf("err = %v", err)
+	}
+
+	s = NewWithQuota(Quota{Bytes: 10})
+	s.Create("/foo", false, "bar", false, Permanent)
+	_, err = s.Update("/foo", "barbazbat", Permanent)
+	if e, ok := err.(*etcdErr.Error); !ok || e.ErrorCode != etcdErr.EcodeQuotaExceeded {
+		t.Errorf("err = %v, want quota exceeded", err)
+	}
+	_, err = s.CompareAndSwap("/foo", "bar", 0, "barbazbat", Permanent)
+	if e, ok := err.(*etcdErr.Error); !ok || e.ErrorCode != etcdErr.EcodeQuotaExceeded {
+		t.Errorf("err = %v, want quota exceeded", err)
+	}
+	if _, err := s.Update("/foo", "ba", Permanent); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestStoreKeyLimits(t *testing.T) {
+	tests := []struct {
+		c    Config
+		op   func(s Store) (*Event, error)
+		code int
+	}{
+		{
+			Config{MaxKeyBytes: 4},
+			func(s Store) (*Event, error) { return s.Create("/foo", false, "bar", false, Permanent) },
+			0,
+		},
+		{
+			Config{MaxKeyBytes: 4},
+			func(s Store) (*Event, error) { return s.Create("/fooo", false, "bar", false, Permanent) },
+			etcdErr.EcodeKeyTooLong,
+		},
+		{
+			Config{MaxKeyBytes: 4},
+			func(s Store) (*Event, error) { return s.Set("/fooo", true, "", Permanent) },
+			etcdErr.EcodeKeyTooLong,
+		},
+		// the length is in bytes: 3 characters, 5 bytes
+		{
+			Config{MaxKeyBytes: 4},
+			func(s Store) (*Event, error) { return s.Set("/éé", false, "bar", Permanent) },
+			etcdErr.EcodeKeyTooLong,
+		},
+		// the key is cleaned first
+		{
+			Config{MaxKeyBytes: 4},
+			func(s Store) (*Event, error) { return s.Set("//foo/", false, "bar", Permanent) },
+			0,
+		},
+		// the name of an in-order key counts too
+		{
+			Config{MaxKeyBytes: 6},
+			func(s Store) (*Event, error) { return s.Create("/foo", false, "bar", true, Permanent) },
+			0,
+		},
+		{
+			Config{MaxKeyBytes: 6},
+			func(s Store) (*Event, error) { return s.Create("/fooo", false, "bar", true, Permanent) },
+			etcdErr.EcodeKeyTooLong,
+		},
+		{
+			Config{MaxKeyDepth: 2},
+			func(s Store) (*Event, error) { return s.Set("/a/b", false, "bar", Permanent) },
+			0,
+		},
+		{
+			Config{MaxKeyDepth: 2},
+			func(s Store) (*Event, error) { return s.Set("/a/b/c", false, "bar", Permanent) },
+			etcdErr.EcodeKeyTooDeep,
+		},
+		{
+			Config{MaxKeyDepth: 2},
+			func(s Store) (*Event, error) { return s.Create("/a/b", true, "", true, Permanent) },
+			etcdErr.EcodeKeyTooDeep,
+		},
+		// etcd writes its own keys whatever the limits
+		{
+			Config{MaxKeyBytes: 4, MaxKeyDepth: 2},
+			func(s Store) (*Event, error) { return s.Create("/_etcd/machines/1", false, "bar", false, Permanent) },
+			0,
+		},
+	}
+	for i, tt := range tests {
+		// a store and its clone, as on a member recovered from a snapshot,
+		// refuse the same keys
+		s := NewWithConfig(tt.c)
+		for j, st := range []Store{s, s.Clone()} {
+			_, err := tt.op(st)
+			code := 0
+			if e, ok := err.(*etcdErr.Error); ok {
+				code = e.ErrorCode
+			} else if err != nil {
+				t.Fatalf("#%d.%d: err = %v", i, j, err)
+			}
+			if code != tt.code {
+				t.Errorf("#%d.%d: code = %d, want %d", i, j, code, tt.code)
+			}
+			windex := uint64(1)
+			if tt.code != 0 {
+				windex = 0
+			}
+			if g := st.Index(); g != windex {
+				t.Errorf("#%d.%d: index = %d, want %d", i, j, g, windex)
+			}
+		}
+	}
+}
+
 // Ensure that the store can recover from a previously saved state that includes an expiring key.
 func TestStoreRecoverWithExpiration(t *testing.T) {
 	s := newStore()
@@ -962,3 +1492,85 @@ func mockSyncService(f func(now time.Time), c chan bool) {
 		}
 	}
 }
+
+// Ensure that a transaction applies its success operations when all of its
+// comparisons hold, and its failure operations otherwise.
+func TestStoreTxn(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	s.Create("/lock", false, "owner", false, Permanent)
+
+	txn := Txn{
+		Compare: []Compare{
+			{Key: "/foo", Value: stringp("bar"), Index: 1},
+			{Key: "/baz", Exist: boolp(false)},
+		},
+		Success: []Op{
+			{Action: Set, Key: "/foo", Value: "bar2"},
+			{Action: Set, Key: "/baz", Value: "X"},
+			{Action: Delete, Key: "/lock"},
+		},
+		Failure: []Op{
+			{Action: Set, Key: "/failed", Value: "true"},
+		},
+	}
+	resp, err := s.Txn(txn)
+	assert.Nil(t, err, "")
+	assert.Equal(t, resp.Succeeded, true, "")
+	assert.Equal(t, len(resp.Results), 3, "")
+	assert.Equal(t, resp.Results[0].Action, "set", "")
+	assert.Equal(t, *resp.Results[0].PrevNode.Value, "bar", "")
+	assert.Equal(t, resp.Results[2].Action, "delete", "")
+	assert.Equal(t, resp.EtcdIndex, uint64(5), "")
+	e, _ := s.Get("/baz", false, false)
+	assert.Equal(t, *e.Node.Value, "X", "")
+	_, err = s.Get("/lock", false, false)
+	assert.NotNil(t, err, "")
+
+	// the comparisons no longer hold
+	resp, err = s.Txn(txn)
+	assert.Nil(t, err, "")
+	assert.Equal(t, resp.Succeeded, false, "")
+	assert.Equal(t, len(resp.Results), 1, "")
+	e, _ = s.Get("/foo", false, false)
+	assert.Equal(t, *e.Node.Value, "bar2", "")
+	e, _ = s.Get("/failed", false, false)
+	assert.Equal(t, *e.Node.Value, "true", "")
+}
+
+// Ensure that a transaction whose operation fails returns its error and
+// applies none of its operations, even the ones before it, and that an
+// invalid transaction is not applied at all.
+func TestStoreTxnErrors(t *testing.T) {
+	s := newStore()
+	s.Create("/foo", false, "bar", false, Permanent)
+	w, _ := s.Watch("/foo", false, false, 0)
+	_, err := s.Txn(Txn{Success: []Op{
+		{Action: Set, Key: "/foo", Value: "baz"},
+		{Action: Delete, Key: "/nope"},
+	}})
+	serr, ok := err.(*etcdErr.Error)
+	assert.Equal(t, ok, true, "")
+	assert.Equal(t, serr.ErrorCode, etcdErr.EcodeKeyNotFound, "")
+	assert.Equal(t, serr.Index, uint64(1), "")
+	assert.Equal(t, s.Index(), uint64(1), "")
+	e, _ := s.Get("/foo", false, false)
+	assert.Equal(t, *e.Node.Value, "bar", "")
+	select {
+	case e := <-w.EventChan():
+		t.Errorf("watcher got %+v of a transaction not applied", e)
+	default:
+	}
+
+	_, err = s.Txn(Txn{Success: []Op{
+		{Action: Set, Key: "/foo", Value: "baz"},
+		{Action: "get", Key: "/foo"},
+	}})
+	assert.NotNil(t, err, "")
+	e, _ = s.Get("/foo", false, false)
+	assert.Equal(t, *e.Node.Value, "bar", "")
+}
+
+func boolp(b bool) *bool { return &b }
+
+func stringp(s string) *string { return &s }
@@ -0,0 +1,143 @@
+/*
+Copyright 2014 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	etcdErr "github.com/coreos/etcd/error"
+)
+
+// Txn is a transaction: if all of its comparisons hold, its Success
+// operations are applied, and otherwise its Failure operations.
+type Txn struct {
+	Compare []Compare `json:"compare"`
+	Success []Op      `json:"success"`
+	Failure []Op      `json:"failure"`
+}
+
+// Compare is a condition on the node at Key. Every field that is set must
+// hold for the comparison to hold.
+type Compare struct {
+	Key string `json:"key"`
+	// Value, if set, is the value of the node, which must be a file.
+	Value *string `json:"value,omitempty"`
+	// Index, if not 0, is the modified index of the node.
+	Index uint64 `json:"index,omitempty"`
+	// Exist, if set, tells whether the node exists.
+	Exist *bool `json:"exist,omitempty"`
+}
+
+// Op is an operation of a transaction, applied as Set or Delete would be.
+type Op struct {
+	// Action is either Set or Delete.
+	Action     string    `json:"action"`
+	Key        string    `json:"key"`
+	Value      string    `json:"value,omitempty"`
+	Dir        bool      `json:"dir,omitempty"`
+	Recursive  bool      `json:"recursive,omitempty"`
+	ExpireTime time.Time `json:"expireTime,omitempty"`
+}
+
+// TxnResponse tells which branch of a transaction was taken, and the
+// event of each of its operations.
+type TxnResponse struct {
+	Succeeded bool     `json:"succeeded"`
+	Results   []*Event `json:"results"`
+	EtcdIndex uint64   `json:"-"`
+}
+
+// Txn applies t atomically: no other read or write of the store happens
+// between its comparisons and its operations, and the operations of the
+// branch taken are either all applied, in order, or none is. If one of
+// them fails, Txn returns its error, and the store is left unchanged.
+func (s *store) Txn(t Txn) (*TxnResponse, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	for _, ops := range [][]Op{t.Success, t.Failure} {
+		for _, op := range ops {
+			if op.Action != Set && op.Action != Delete {
+				return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, fmt.Sprintf("unknown action %q", op.Action), s.CurrentIndex)
+			}
+		}
+	}
+
+	resp := &TxnResponse{Succeeded: true}
+	for _, c := range t.Compare {
+		if !s.compare(c) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := t.Success
+	if !resp.Succeeded {
+		ops = t.Failure
+	}
+
+	// an operation may fail because of the ones before it, so they are
+	// first applied to a copy of the store, which the watchers do not see
+	if len(ops) > 1 {
+		c := s.clone()
+		for _, op := range ops {
+			if _, err := c.applyOp(op); err != nil {
+				if serr, ok := err.(*etcdErr.Error); ok {
+					serr.Index = s.CurrentIndex
+				}
+				return nil, err
+			}
+		}
+	}
+
+	resp.Results = make([]*Event, len(ops))
+	for i, op := range ops {
+		e, err := s.applyOp(op)
+		if err != nil {
+			return nil, err
+		}
+		resp.Results[i] = e
+	}
+	resp.EtcdIndex = s.CurrentIndex
+	return resp, nil
+}
+
+func (s *store) applyOp(op Op) (*Event, error) {
+	if op.Action == Delete {
+		return s.delete(op.Key, op.Dir, op.Recursive)
+	}
+	return s.set(op.Key, op.Dir, op.Value, op.ExpireTime)
+}
+
+func (s *store) compare(c Compare) bool {
+	n, err := s.internalGet(path.Clean(path.Join("/", c.Key)))
+	exist := err == nil
+	if c.Exist != nil && *c.Exist != exist {
+		return false
+	}
+	if c.Value == nil && c.Index == 0 {
+		return true
+	}
+	if !exist {
+		return false
+	}
+	if c.Value != nil && (n.IsDir() || n.Value != *c.Value) {
+		return false
+	}
+	return c.Index == 0 || n.ModifiedIndex == c.Index
+}
@@ -154,6 +154,7 @@ func (wh *watcherHub) clone() *watcherHub {
 	clonedHistory := wh.EventHistory.clone()
 
 	return &watcherHub{
+		watchers:     make(map[string]*list.List),
 		EventHistory: clonedHistory,
 	}
 }
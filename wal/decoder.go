@@ -15,6 +15,12 @@ type decoder struct {
 	br  *bufio.Reader
 	c   io.Closer
 	crc hash.Hash32
+	// offset of the end of the last record decoded successfully,
+	// counted from the start of the underlying stream
+	off int64
+	// set once the decoder reached the space preallocated after the
+	// last record
+	inPrealloc bool
 }
 
 func newDecoder(rc io.ReadCloser) *decoder {
@@ -31,19 +37,57 @@ func (d *decoder) decode(rec *walpb.Record) error {
 	if err != nil {
 		return err
 	}
+	if l < 0 {
+		return &CRCMismatchError{Offset: d.off}
+	}
+	if l == 0 {
+		// no record is empty: this is the space preallocated after the
+		// last record, which must be zeros to the end
+		d.inPrealloc = true
+		return d.skipZeros()
+	}
 	data := make([]byte, l)
 	if _, err = io.ReadFull(d.br, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return err
 	}
 	if err := rec.Unmarshal(data); err != nil {
-		return err
+		rec.Reset()
+		return &CRCMismatchError{Offset: d.off}
 	}
 	// skip crc checking if the record type is crcType
-	if rec.Type == crcType {
-		return nil
+	if rec.Type != crcType {
+		prev := d.crc.Sum32()
+		d.crc.Write(rec.Data)
+		if rec.Validate(d.crc.Sum32()) != nil {
+			// keep the crc of the last valid record, so the
+			// stream can be continued from there
+			d.crc = crc.New(prev, crcTable)
+			return &CRCMismatchError{Offset: d.off}
+		}
+	}
+	d.off += 8 + l
+	return nil
+}
+
+// skipZeros reads the rest of the stream, and returns io.EOF if it is all
+// zeros, or a CRCMismatchError at the end of the last record if not, as
+// when a record was torn in preallocated space.
+func (d *decoder) skipZeros() error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := d.br.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return &CRCMismatchError{Offset: d.off}
+			}
+		}
+		if err != nil {
+			return err
+		}
 	}
-	d.crc.Write(rec.Data)
-	return rec.Validate(d.crc.Sum32())
 }
 
 func (d *decoder) updateCRC(prevCrc uint32) {
@@ -20,7 +20,7 @@ A WAL is created at a particular directory and is made up of a number of
 discrete WAL files. Inside of each file the raft state and entries are appended
 to it with the Save method:
 
-	w, err := wal.Create("/var/lib/etcd")
+	w, err := wal.Create("/var/lib/etcd", id)
 	...
 	err := w.Save(s, ents)
 
@@ -43,6 +43,11 @@ Cut has been called on this WAL then the sequence will increment from 0x0 to
 Cut issues 0x10 entries with incremental index later then the file will be called:
 0000000000000002-0000000000000031.wal.
 
+Save cuts the WAL by itself once the current file has grown beyond
+SegmentSizeBytes, so a single file never gets much larger than that. Files
+that only hold entries covered by a snapshot are no longer needed to open the
+WAL at the index of the snapshot.
+
 At a later time a WAL can be opened at a particular raft index:
 
 	w, err := wal.OpenAtIndex("/var/lib/etcd", 0)
@@ -60,5 +65,9 @@ the end of the WAL are read first:
 This will give you the raft node id, the last raft.State and the slice of
 raft.Entry items in the log.
 
+If ReadAll fails with a *CRCMismatchError, the WAL can be truncated before the
+corrupted record with Repair, which backs up the files it changes with a
+".broken" suffix. The entries after the corrupted record are lost.
+
 */
 package wal
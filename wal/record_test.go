@@ -42,7 +42,7 @@ func TestReadRecord(t *testing.T) {
 		{infoRecord[:len(infoRecord)-len(infoData)-8], &walpb.Record{}, io.ErrUnexpectedEOF},
 		{infoRecord[:len(infoRecord)-len(infoData)], &walpb.Record{}, io.ErrUnexpectedEOF},
 		{infoRecord[:len(infoRecord)-8], &walpb.Record{}, io.ErrUnexpectedEOF},
-		{badInfoRecord, &walpb.Record{}, walpb.ErrCRCMismatch},
+		{badInfoRecord, &walpb.Record{}, &CRCMismatchError{Offset: 0}},
 	}
 
 	rec := &walpb.Record{}
@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/coreos/etcd/pkg/logger"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// brokenSuffix is appended to the name of the WAL files that Repair backs
+// up, so that they are no longer read as part of the WAL.
+const brokenSuffix = ".broken"
+
+// Repair truncates the WAL in dirpath before its first corrupted record,
+// so that it can be opened again, at the cost of the records after it.
+// The file holding the corrupted record is copied to a file with the same
+// name and a ".broken" suffix before it is truncated, and the files after
+// it are renamed so. Repair does nothing if the WAL is not corrupted.
+func Repair(dirpath string) error {
+	names, err := readDir(dirpath)
+	if err != nil {
+		return err
+	}
+	names = checkWalNames(names)
+	if len(names) == 0 {
+		return ErrFileNotFound
+	}
+	sort.Sort(sort.StringSlice(names))
+	if !isValidSeq(names) {
+		return ErrFileNotFound
+	}
+
+	// offset at which each file starts in the stream of all the files
+	starts := make([]int64, len(names))
+	rcs := make([]io.ReadCloser, 0, len(names))
+	var start int64
+	for i, name := range names {
+		f, err := os.Open(path.Join(dirpath, name))
+		if err != nil {
+			MultiReadCloser(rcs...).Close()
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			MultiReadCloser(rcs...).Close()
+			return err
+		}
+		starts[i], start = start, start+fi.Size()
+		rcs = append(rcs, f)
+	}
+	off, err := lastValidOffset(newDecoder(MultiReadCloser(rcs...)))
+	if err == io.EOF {
+		return nil
+	}
+	if off == 0 {
+		return fmt.Errorf("wal: cannot repair %s, its first record is corrupted: %v", dirpath, err)
+	}
+
+	// i is the file holding the corrupted record
+	i := sort.Search(len(names), func(i int) bool { return starts[i] > off }) - 1
+	logger.Warnf("wal: repairing %s, truncating %s at offset %d: %v", dirpath, names[i], off-starts[i], err)
+	fpath := path.Join(dirpath, names[i])
+	if off == starts[i] {
+		if err := os.Rename(fpath, fpath+brokenSuffix); err != nil {
+			return err
+		}
+	} else {
+		if err := copyFile(fpath, fpath+brokenSuffix); err != nil {
+			return err
+		}
+		if err := os.Truncate(fpath, off-starts[i]); err != nil {
+			return err
+		}
+	}
+	for _, name := range names[i+1:] {
+		p := path.Join(dirpath, name)
+		if err := os.Rename(p, p+brokenSuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastValidOffset decodes the records of d up to the first one that cannot
+// be read or whose crc does not match, and returns the offset at which it
+// starts along with the error. It closes d.
+func lastValidOffset(d *decoder) (int64, error) {
+	defer d.close()
+	rec := &walpb.Record{}
+	var err error
+	for err = d.decode(rec); err == nil; err = d.decode(rec) {
+		if rec.Type != crcType {
+			continue
+		}
+		if crc := d.crc.Sum32(); crc != 0 && rec.Validate(crc) != nil {
+			start := d.off - int64(8+rec.Size())
+			return start, &CRCMismatchError{Offset: start}
+		}
+		d.updateCRC(rec.Crc)
+	}
+	return d.off, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestRepair(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	fpath := mustCreateWALWithEntries(t, p, 3)
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offs := recordOffsets(b)
+	// corrupt the last byte of the second entry record
+	b[offs[len(offs)-1]-1] ^= 0xff
+	if err := ioutil.WriteFile(fpath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Repair(p); err != nil {
+		t.Fatal(err)
+	}
+	if bb, err := ioutil.ReadFile(fpath + brokenSuffix); err != nil || !bytes.Equal(bb, b) {
+		t.Errorf("backup = %q, %v, want %q", bb, err, b)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != offs[len(offs)-2] {
+		t.Errorf("size = %d, want %d", fi.Size(), offs[len(offs)-2])
+	}
+
+	w, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Index != 0 {
+		t.Fatalf("ents = %+v, want the first entry", ents)
+	}
+	// the repaired WAL can be appended to, and read again
+	if err := w.SaveEntry(&raftpb.Entry{Index: 1, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, err = OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, ents, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[1].Term != 2 {
+		t.Errorf("ents = %+v, want the first entry and the one saved after repair", ents)
+	}
+}
+
+// TestRepairAfterCut tests that the files after the one holding the
+// corrupted record are set aside.
+func TestRepairAfterCut(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = w.SaveEntry(&raftpb.Entry{Index: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// corrupt the entry of the second file
+	fpath := path.Join(p, walName(1, 1))
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(fpath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Repair(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{walName(2, 2), walName(3, 3)} {
+		if _, err := os.Stat(path.Join(p, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: err = %v, want not exist", name, err)
+		}
+		if _, err := os.Stat(path.Join(p, name+brokenSuffix)); err != nil {
+			t.Errorf("%s: err = %v, want nil", name+brokenSuffix, err)
+		}
+	}
+
+	w, err = OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Index != 0 {
+		t.Errorf("ents = %+v, want the first entry", ents)
+	}
+}
+
+func TestRepairNotCorrupted(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	fpath := mustCreateWALWithEntries(t, p, 3)
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair(p); err != nil {
+		t.Fatal(err)
+	}
+	if bb, _ := ioutil.ReadFile(fpath); !bytes.Equal(bb, b) {
+		t.Errorf("wal was modified")
+	}
+	if _, err := os.Stat(fpath + brokenSuffix); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want no backup", err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2014 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// A SyncMode tells how a WAL makes the records it saves durable. A
+// SyncMode implements flag.Value.
+type SyncMode int
+
+const (
+	// SyncFsync calls fsync after each Save, which flushes the records
+	// and all the metadata of the file to disk.
+	SyncFsync SyncMode = iota
+	// SyncFdatasync calls fdatasync on Linux, which flushes the records
+	// and only the metadata needed to read them back. It is as durable as
+	// SyncFsync for the WAL, and faster. Other systems use fsync.
+	SyncFdatasync
+	// SyncNone never syncs: the records saved are left to the OS to write
+	// in its own time. They survive a crash of etcd, but the last ones are
+	// lost if the machine crashes or loses power, after raft was told they
+	// were stable. A member may then forget the votes it cast and the
+	// entries it acknowledged, and the cluster may lose committed writes or
+	// elect two leaders for a term. It is only meant for benchmarks and
+	// clusters whose data can be thrown away.
+	SyncNone
+)
+
+var syncModeNames = []string{"fsync", "fdatasync", "none"}
+
+func (m SyncMode) String() string {
+	if m < SyncFsync || m > SyncNone {
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+	return syncModeNames[m]
+}
+
+func (m *SyncMode) Set(s string) error {
+	for i, name := range syncModeNames {
+		if s == name {
+			*m = SyncMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("wal: unknown sync mode %q", s)
+}
+
+// sync makes the data written to f durable according to m.
+func (m SyncMode) sync(f *os.File) error {
+	switch m {
+	case SyncFdatasync:
+		return fileutil.Fdatasync(f)
+	case SyncNone:
+		return nil
+	}
+	return f.Sync()
+}
+
+// A CommitMode tells when a WAL syncs the records saved by concurrent
+// calls to Save. A CommitMode implements flag.Value.
+type CommitMode int
+
+const (
+	// CommitGroup syncs together the records of the Saves that arrive
+	// while a sync is in flight: the first Save to find none in flight
+	// syncs everything written so far, and the Saves it covers return
+	// with it. Concurrent Saves then cost one sync per group rather than
+	// one each, and none returns before its own records are synced.
+	CommitGroup CommitMode = iota
+	// CommitWrite syncs the records of each Save on their own, holding
+	// back the other Saves until it is done, as a WAL used by a single
+	// goroutine does anyway.
+	CommitWrite
+)
+
+var commitModeNames = []string{"group", "write"}
+
+func (m CommitMode) String() string {
+	if m < CommitGroup || m > CommitWrite {
+		return fmt.Sprintf("CommitMode(%d)", int(m))
+	}
+	return commitModeNames[m]
+}
+
+func (m *CommitMode) Set(s string) error {
+	for i, name := range commitModeNames {
+		if s == name {
+			*m = CommitMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("wal: unknown commit mode %q", s)
+}
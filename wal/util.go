@@ -2,16 +2,21 @@ package wal
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/logger"
 )
 
+// Exist returns whether dirpath holds a WAL. Only the files named as WAL
+// segments count, not the other entries, such as the lost+found directory
+// of a file system mounted there.
 func Exist(dirpath string) bool {
 	names, err := readDir(dirpath)
 	if err != nil {
 		return false
 	}
-	return len(names) != 0
+	return len(checkWalNames(names)) != 0
 }
 
 // searchIndex returns the last array index of names whose raft index section is
@@ -66,7 +71,7 @@ func checkWalNames(names []string) []string {
 	wnames := make([]string, 0)
 	for _, name := range names {
 		if _, _, err := parseWalName(name); err != nil {
-			log.Printf("parse %s: %v", name, err)
+			logger.Warnf("parse %s: %v", name, err)
 			continue
 		}
 		wnames = append(wnames, name)
@@ -75,6 +80,9 @@ func checkWalNames(names []string) []string {
 }
 
 func parseWalName(str string) (seq, index int64, err error) {
+	if !strings.HasSuffix(str, ".wal") {
+		return 0, 0, fmt.Errorf("bad wal name: %s", str)
+	}
 	var num int
 	num, err = fmt.Sscanf(str, "%016x-%016x.wal", &seq, &index)
 	if num != 2 && err == nil {
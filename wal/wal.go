@@ -24,7 +24,11 @@ import (
 	"os"
 	"path"
 	"sort"
+	"sync"
+	"time"
 
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/logger"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/wal/walpb"
@@ -35,48 +39,89 @@ const (
 	entryType
 	stateType
 	crcType
-
-	// the owner can make/remove files inside the directory
-	privateDirMode = 0700
 )
 
 var (
+	// SegmentSizeBytes is the size above which Save cuts the WAL and
+	// continues appending to a new file. Each file is preallocated to it
+	// when it is created, so that appending to it neither updates the
+	// size of the file on every sync nor fragments it, and is truncated
+	// to the records written when it is cut or closed.
+	SegmentSizeBytes int64 = 64 * 1024 * 1024 // 64MB
+
 	ErrIDMismatch    = errors.New("wal: unmatch id")
 	ErrFileNotFound  = errors.New("wal: file not found")
 	ErrIndexNotFound = errors.New("wal: index not found in file")
-	ErrCRCMismatch   = errors.New("wal: crc mismatch")
 	crcTable         = crc32.MakeTable(crc32.Castagnoli)
 )
 
+// CRCMismatchError is returned when a record read from the WAL is corrupted,
+// that is its crc does not match the crc chained over the previous records or
+// it cannot be decoded at all.
+type CRCMismatchError struct {
+	// Offset is the position of the corrupted record, counted in bytes
+	// from the start of the first file read.
+	Offset int64
+}
+
+func (e *CRCMismatchError) Error() string {
+	return fmt.Sprintf("wal: crc mismatch at offset %d", e.Offset)
+}
+
 // WAL is a logical repersentation of the stable storage.
 // WAL is either in read mode or append mode but not both.
 // A newly created WAL is in append mode, and ready for appending records.
 // A just opened WAL is in read mode, and ready for reading records.
 // The WAL will be ready for appending after reading out all the previous records.
+// Save may be called by several goroutines at once; the other methods must
+// not be called concurrently with it.
 type WAL struct {
 	dir string // the living directory of the underlay files
+	id  int64  // id of the node the WAL belongs to, 0 if not saved
 
 	ri      int64    // index of entry to start reading
 	decoder *decoder // decoder to decode records
 
 	f       *os.File // underlay file opened for appending, sync
+	fstart  int64    // offset at which f starts in the stream read by decoder
 	seq     int64    // sequence of the wal file currently used for writes
 	enti    int64    // index of the last entry saved to the wal
 	encoder *encoder // encoder to encode records
+	sync    SyncMode // how f is synced
+	// syncf syncs f according to sync; tests replace it to hold a sync
+	syncf func(f *os.File) error
+
+	// the commit of the Saves; see Save
+	mu      sync.Mutex
+	cond    *sync.Cond // broadcast whenever a sync ends
+	commit  CommitMode
+	syncing bool  // a Save is syncing f, without holding mu
+	written int64 // number of Saves written
+	synced  int64 // number of Saves written before the last sync
 }
 
-// Create creates a WAL ready for appending records.
-func Create(dirpath string) (*WAL, error) {
+// Create creates a WAL ready for appending records, which starts with an
+// info record holding the given node id unless it is 0. Every file cut
+// after the first one starts with the id too, so that ReadAll returns it
+// whatever the index the WAL is opened at. The records are synced with
+// fsync.
+func Create(dirpath string, id int64) (*WAL, error) {
+	return CreateWithSync(dirpath, id, SyncFsync)
+}
+
+// CreateWithSync is like Create, but the records are synced according to
+// mode.
+func CreateWithSync(dirpath string, id int64, mode SyncMode) (*WAL, error) {
 	if Exist(dirpath) {
 		return nil, os.ErrExist
 	}
 
-	if err := os.MkdirAll(dirpath, privateDirMode); err != nil {
+	if err := fileutil.CreateDirAll(dirpath, fileutil.PrivateDirMode); err != nil {
 		return nil, err
 	}
 
 	p := path.Join(dirpath, walName(0, 0))
-	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	f, err := createSegment(p)
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +130,18 @@ func Create(dirpath string) (*WAL, error) {
 		seq:     0,
 		f:       f,
 		encoder: newEncoder(f, 0),
+		sync:    mode,
+		syncf:   mode.sync,
 	}
+	w.cond = sync.NewCond(&w.mu)
 	if err := w.saveCrc(0); err != nil {
 		return nil, err
 	}
+	if id != 0 {
+		if err := w.SaveInfo(&raftpb.Info{ID: id}); err != nil {
+			return nil, err
+		}
+	}
 	return w, nil
 }
 
@@ -97,8 +150,14 @@ func Create(dirpath string) (*WAL, error) {
 // ReadAll will fail.
 // The returned WAL is ready to read and the first record will be the given
 // index. The WAL cannot be appended to before reading out all of its
-// previous records.
+// previous records, which are then synced with fsync.
 func OpenAtIndex(dirpath string, index int64) (*WAL, error) {
+	return OpenAtIndexWithSync(dirpath, index, SyncFsync)
+}
+
+// OpenAtIndexWithSync is like OpenAtIndex, but the records appended are
+// synced according to mode.
+func OpenAtIndexWithSync(dirpath string, index int64, mode SyncMode) (*WAL, error) {
 	names, err := readDir(dirpath)
 	if err != nil {
 		return nil, err
@@ -117,11 +176,18 @@ func OpenAtIndex(dirpath string, index int64) (*WAL, error) {
 
 	// open the wal files for reading
 	rcs := make([]io.ReadCloser, 0)
+	var fstart, size int64
 	for _, name := range names[nameIndex:] {
 		f, err := os.Open(path.Join(dirpath, name))
 		if err != nil {
 			return nil, err
 		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		fstart, size = fstart+size, fi.Size()
 		rcs = append(rcs, f)
 	}
 	rc := MultiReadCloser(rcs...)
@@ -132,8 +198,10 @@ func OpenAtIndex(dirpath string, index int64) (*WAL, error) {
 		rc.Close()
 		return nil, err
 	}
+	// it is written from the end of its records, set by ReadAll, rather
+	// than from the end of the file, which may be preallocated
 	last := path.Join(dirpath, names[len(names)-1])
-	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	f, err := os.OpenFile(last, os.O_WRONLY, 0)
 	if err != nil {
 		rc.Close()
 		return nil, err
@@ -145,14 +213,46 @@ func OpenAtIndex(dirpath string, index int64) (*WAL, error) {
 		ri:      index,
 		decoder: newDecoder(rc),
 
-		f:   f,
-		seq: seq,
+		f:      f,
+		fstart: fstart,
+		seq:    seq,
+		sync:   mode,
+		syncf:  mode.sync,
 	}
+	w.cond = sync.NewCond(&w.mu)
 	return w, nil
 }
 
+// Purge removes the WAL files in dirpath that only hold entries older than
+// the given index. The file holding index, and all files after it, are kept,
+// so the WAL can still be opened at index after purging.
+func Purge(dirpath string, index int64) error {
+	names, err := readDir(dirpath)
+	if err != nil {
+		return err
+	}
+	names = checkWalNames(names)
+	sort.Sort(sort.StringSlice(names))
+
+	nameIndex, ok := searchIndex(names, index)
+	if !ok {
+		return nil
+	}
+	for _, name := range names[:nameIndex] {
+		fpath := path.Join(dirpath, name)
+		if err := os.Remove(fpath); err != nil {
+			return err
+		}
+		logger.Infof("wal: purged file %s", fpath)
+	}
+	return nil
+}
+
 // ReadAll reads out all records of the current WAL.
 // If it cannot read out the expected entry, it will return ErrIndexNotFound.
+// A torn or corrupted record at the very end of the last file is treated as
+// an incomplete write: it is truncated away and reading stops cleanly before
+// it. Corruption anywhere else returns a *CRCMismatchError.
 // After ReadAll, the WAL will be ready for appending new records.
 func (w *WAL) ReadAll() (id int64, state raftpb.HardState, ents []raftpb.Entry, err error) {
 	rec := &walpb.Record{}
@@ -181,7 +281,7 @@ func (w *WAL) ReadAll() (id int64, state raftpb.HardState, ents []raftpb.Entry,
 			// do no need to match 0 crc, since the decoder is a new one at this case.
 			if crc != 0 && rec.Validate(crc) != nil {
 				state.Reset()
-				return 0, state, nil, ErrCRCMismatch
+				return 0, state, nil, &CRCMismatchError{Offset: decoder.off - int64(8+rec.Size())}
 			}
 			decoder.updateCRC(rec.Crc)
 		default:
@@ -190,6 +290,17 @@ func (w *WAL) ReadAll() (id int64, state raftpb.HardState, ents []raftpb.Entry,
 		}
 	}
 	if err != io.EOF {
+		if !w.isTornTail(err) {
+			state.Reset()
+			return 0, state, nil, err
+		}
+		logger.Warnf("wal: truncating torn record at the tail of %s: %v", w.f.Name(), err)
+		if err = w.f.Truncate(decoder.off - w.fstart); err != nil {
+			state.Reset()
+			return 0, state, nil, err
+		}
+	}
+	if _, err = w.f.Seek(decoder.off-w.fstart, io.SeekStart); err != nil {
 		state.Reset()
 		return 0, state, nil, err
 	}
@@ -205,18 +316,40 @@ func (w *WAL) ReadAll() (id int64, state raftpb.HardState, ents []raftpb.Entry,
 	// create encoder (chain crc with the decoder), enable appending
 	w.encoder = newEncoder(w.f, w.decoder.lastCRC())
 	w.decoder = nil
+	w.id = id
 	return id, state, ents, nil
 }
 
+// isTornTail reports whether the decoding error err was caused by the last
+// record of the WAL, which lives in the file opened for appending, and can
+// thus be the result of a write that did not complete.
+func (w *WAL) isTornTail(err error) bool {
+	if w.decoder.off < w.fstart {
+		return false
+	}
+	switch err.(type) {
+	case *CRCMismatchError:
+		// bytes in the space preallocated after the last record were
+		// written there without their record; a record followed only by
+		// that space was written in part, the rest being still zeros
+		return w.decoder.inPrealloc || w.decoder.skipZeros() == io.EOF
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
 // Cut closes current file written and creates a new one ready to append.
 func (w *WAL) Cut() error {
+	// the preallocated space is dropped before the next file exists, so
+	// that only the last file may end with it
+	if err := w.truncateTail(); err != nil {
+		return err
+	}
 	// create a new wal file with name sequence + 1
 	fpath := path.Join(w.dir, walName(w.seq+1, w.enti+1))
-	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	f, err := createSegment(fpath)
 	if err != nil {
 		return err
 	}
-	w.Sync()
 	w.f.Close()
 
 	// update writer and save the previous crc
@@ -224,7 +357,13 @@ func (w *WAL) Cut() error {
 	w.seq++
 	prevCrc := w.encoder.crc.Sum32()
 	w.encoder = newEncoder(w.f, prevCrc)
-	return w.saveCrc(prevCrc)
+	if err := w.saveCrc(prevCrc); err != nil {
+		return err
+	}
+	if w.id != 0 {
+		return w.SaveInfo(&raftpb.Info{ID: w.id})
+	}
+	return nil
 }
 
 func (w *WAL) Sync() error {
@@ -233,23 +372,89 @@ func (w *WAL) Sync() error {
 			return err
 		}
 	}
-	return w.f.Sync()
+	if w.sync == SyncNone {
+		return nil
+	}
+	return w.syncFile(w.f)
+}
+
+// syncFile syncs f, which holds the records written, and records how long
+// it took.
+func (w *WAL) syncFile(f *os.File) error {
+	if w.sync == SyncNone {
+		return nil
+	}
+	start := time.Now()
+	err := w.syncf(f)
+	syncDurations.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// SetCommitMode sets when the records of concurrent Saves are synced, which
+// is CommitGroup by default. It must not be called concurrently with Save.
+func (w *WAL) SetCommitMode(m CommitMode) {
+	w.commit = m
 }
 
-func (w *WAL) Close() {
+// Close flushes any buffered records to disk and closes the file
+// currently used for appending, truncated to the records written.
+func (w *WAL) Close() error {
 	if w.f != nil {
-		w.Sync()
-		w.f.Close()
+		if w.encoder != nil {
+			if err := w.truncateTail(); err != nil {
+				return err
+			}
+		} else if err := w.Sync(); err != nil {
+			return err
+		}
+		return w.f.Close()
+	}
+	return nil
+}
+
+// truncateTail syncs the records written to the file used for appending,
+// and truncates the space preallocated after them.
+func (w *WAL) truncateTail() error {
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	off, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := w.f.Truncate(off); err != nil {
+		return err
 	}
+	return w.sync.sync(w.f)
 }
 
+// createSegment creates the WAL file p, preallocated to SegmentSizeBytes.
+func createSegment(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := fileutil.Preallocate(f, SegmentSizeBytes); err != nil {
+		f.Close()
+		os.Remove(p)
+		return nil, err
+	}
+	return f, nil
+}
+
+// SaveInfo saves the id of the node the WAL belongs to. It is repeated at
+// the start of the files cut afterwards.
 func (w *WAL) SaveInfo(i *raftpb.Info) error {
 	b, err := i.Marshal()
 	if err != nil {
 		panic(err)
 	}
 	rec := &walpb.Record{Type: infoType, Data: b}
-	return w.encoder.encode(rec)
+	if err := w.encoder.encode(rec); err != nil {
+		return err
+	}
+	w.id = i.ID
+	return nil
 }
 
 func (w *WAL) SaveEntry(e *raftpb.Entry) error {
@@ -277,13 +482,78 @@ func (w *WAL) SaveState(s *raftpb.HardState) error {
 	return w.encoder.encode(rec)
 }
 
+// Save appends st and ents to the WAL, and syncs them to disk before
+// returning, unless its SyncMode is SyncNone. The entries of a single call
+// share one sync, so callers that gather the entries proposed meanwhile
+// into the next call, as the raft Ready loop does, commit them in groups.
+// With CommitGroup, concurrent calls share one sync too.
 func (w *WAL) Save(st raftpb.HardState, ents []raftpb.Entry) {
-	// TODO(xiangli): no more reference operator
-	w.SaveState(&st)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the entries are written before the state committing them, so that a
+	// torn tail never leaves a commit index past the last entry
 	for i := range ents {
 		w.SaveEntry(&ents[i])
 	}
-	w.Sync()
+	// TODO(xiangli): no more reference operator
+	w.SaveState(&st)
+	if w.commit == CommitWrite {
+		if err := w.Sync(); err != nil {
+			logger.Errorf("wal: failed to sync %s: %v", w.f.Name(), err)
+		}
+		if err := w.cutIfFull(); err != nil {
+			logger.Errorf("wal: failed to cut %s: %v", w.f.Name(), err)
+		}
+		return
+	}
+	w.written++
+	w.waitSynced(w.written)
+}
+
+// waitSynced returns once the records of the n-th Save are synced. The
+// first Save to find no sync in flight flushes and syncs all the records
+// written, releasing mu meanwhile, so that the Saves arriving during the
+// sync are written and then synced together by the next one. w.mu MUST be
+// held.
+func (w *WAL) waitSynced(n int64) {
+	for w.synced < n {
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+		last := w.written
+		err := w.encoder.flush()
+		if err == nil {
+			w.syncing = true
+			f := w.f
+			w.mu.Unlock()
+			err = w.syncFile(f)
+			w.mu.Lock()
+			w.syncing = false
+		}
+		if err != nil {
+			logger.Errorf("wal: failed to sync %s: %v", w.f.Name(), err)
+		}
+		w.synced = last
+		// f is only cut once no sync of it is in flight
+		if err := w.cutIfFull(); err != nil {
+			logger.Errorf("wal: failed to cut %s: %v", w.f.Name(), err)
+		}
+		w.cond.Broadcast()
+	}
+}
+
+// cutIfFull cuts the WAL if the file currently used for appending has
+// grown to SegmentSizeBytes or more. The encoder MUST have been flushed.
+func (w *WAL) cutIfFull() error {
+	off, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if off < SegmentSizeBytes {
+		return nil
+	}
+	return w.Cut()
 }
 
 func (w *WAL) saveCrc(prevCrc uint32) error {
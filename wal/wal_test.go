@@ -18,11 +18,15 @@ package wal
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/coreos/etcd/raft/raftpb"
 )
@@ -39,7 +43,7 @@ func TestNew(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(p)
+	w, err := Create(p, 0)
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -57,11 +61,35 @@ func TestNewForInitedDir(t *testing.T) {
 	defer os.RemoveAll(p)
 
 	os.Create(path.Join(p, walName(0, 0)))
-	if _, err = Create(p); err == nil || err != os.ErrExist {
+	if _, err = Create(p, 0); err == nil || err != os.ErrExist {
 		t.Errorf("err = %v, want %v", err, os.ErrExist)
 	}
 }
 
+func TestNewForDirWithOtherEntries(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	// as the root of a file system mounted for the WAL holds
+	if err := os.Mkdir(path.Join(p, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if Exist(p) {
+		t.Errorf("exist = true, want false for a directory holding no segment")
+	}
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	w.Close()
+	if !Exist(p) {
+		t.Errorf("exist = false, want true once the WAL is created")
+	}
+}
+
 func TestOpenAtIndex(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
 	if err != nil {
@@ -123,7 +151,7 @@ func TestCut(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(p)
+	w, err := Create(p, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +189,7 @@ func TestRecover(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(p)
+	w, err := Create(p, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -256,6 +284,7 @@ func TestScanWalName(t *testing.T) {
 		{"0000000000000000-0000000000000000.wal", 0, 0, true},
 		{"0000000000000000.wal", 0, 0, false},
 		{"0000000000000000-0000000000000000.snap", 0, 0, false},
+		{"0000000000000000-0000000000000000.wal.broken", 0, 0, false},
 	}
 	for i, tt := range tests {
 		s, index, err := parseWalName(tt.str)
@@ -278,7 +307,7 @@ func TestRecoverAfterCut(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(p)
+	w, err := Create(p, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -339,6 +368,70 @@ func TestRecoverAfterCut(t *testing.T) {
 	}
 }
 
+func TestCreateID(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	wid := int64(0xBAD0)
+	w, err := Create(p, wid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = w.SaveEntry(&raftpb.Entry{Index: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// the id is found whatever the file the WAL is opened at
+	for i := 0; i < 5; i++ {
+		w, err := OpenAtIndex(p, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _, _, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if id != wid {
+			t.Errorf("#%d: id = %x, want %x", i, id, wid)
+		}
+		w.Close()
+	}
+
+	// a reopened WAL keeps saving its id in the files it cuts
+	if w, err = OpenAtIndex(p, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveEntry(&raftpb.Entry{Index: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveEntry(&raftpb.Entry{Index: 6}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if w, err = OpenAtIndex(p, 6); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if id, _, _, err := w.ReadAll(); err != nil || id != wid {
+		t.Errorf("id = %x, err = %v, want %x, nil", id, err, wid)
+	}
+}
+
 func TestOpenAtUncommittedIndex(t *testing.T) {
 	p, err := ioutil.TempDir(os.TempDir(), "waltest")
 	if err != nil {
@@ -346,7 +439,7 @@ func TestOpenAtUncommittedIndex(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(p)
+	w, err := Create(p, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -379,3 +472,740 @@ func TestSaveEmpty(t *testing.T) {
 		t.Errorf("buf.Bytes = %d, want 0", len(buf.Bytes()))
 	}
 }
+
+func TestSaveCutsFullSegment(t *testing.T) {
+	defer func(size int64) { SegmentSizeBytes = size }(SegmentSizeBytes)
+	SegmentSizeBytes = 1024
+
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &raftpb.Info{ID: int64(0xBAD1)}
+	if err = w.SaveInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	for i := 0; i < 50; i++ {
+		st := raftpb.HardState{Term: 1, Commit: int64(i)}
+		w.Save(st, []raftpb.Entry{{Index: int64(i), Term: 1, Data: data}})
+	}
+	w.Close()
+
+	names, err := readDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 2 {
+		t.Fatalf("len(names) = %d, want > 1", len(names))
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		seq, _, err := parseWalName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != int64(i) {
+			t.Errorf("seq = %d, want %d", seq, i)
+		}
+		fi, err := os.Stat(path.Join(p, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(names)-1 && fi.Size() > SegmentSizeBytes+200 {
+			t.Errorf("size of %s = %d, want about %d", name, fi.Size(), SegmentSizeBytes)
+		}
+	}
+
+	// open at the first entry of the last segment, and at the beginning
+	_, lastIndex, err := parseWalName(names[len(names)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []int64{lastIndex, 0} {
+		w, err = OpenAtIndex(p, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, state, ents, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("index %d: err = %v, want nil", index, err)
+		}
+		if g := int64(len(ents)); g != 50-index {
+			t.Errorf("index %d: len(ents) = %d, want %d", index, g, 50-index)
+		}
+		if len(ents) > 0 && ents[0].Index != index {
+			t.Errorf("index %d: ents[0].Index = %d, want %d", index, ents[0].Index, index)
+		}
+		if state.Commit != 49 {
+			t.Errorf("index %d: commit = %d, want 49", index, state.Commit)
+		}
+		w.Close()
+	}
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		index  int64
+		wnames []string
+	}{
+		{0, []string{walName(0, 0), walName(1, 1), walName(2, 5)}},
+		{1, []string{walName(1, 1), walName(2, 5)}},
+		{4, []string{walName(1, 1), walName(2, 5)}},
+		{5, []string{walName(2, 5)}},
+		{10, []string{walName(2, 5)}},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+		for _, name := range []string{walName(0, 0), walName(1, 1), walName(2, 5), "notawal"} {
+			if err := ioutil.WriteFile(path.Join(p, name), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := Purge(p, tt.index); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		names, err := readDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = checkWalNames(names)
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.wnames) {
+			t.Errorf("#%d: names = %v, want %v", i, names, tt.wnames)
+		}
+	}
+}
+
+// TestReadAllCorruptedTail tests that a corrupted or torn record at the very
+// end of the WAL is truncated away, and the WAL can be appended to and
+// read back afterwards.
+func TestReadAllCorruptedTail(t *testing.T) {
+	tests := []func(b []byte, lastOff int64) []byte{
+		// bad byte in the data of the last record
+		func(b []byte, lastOff int64) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		},
+		// last record is partially written
+		func(b []byte, lastOff int64) []byte {
+			return b[:len(b)-3]
+		},
+		// only a part of the length of the last record is written
+		func(b []byte, lastOff int64) []byte {
+			return b[:lastOff+4]
+		},
+	}
+	for i, corrupt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+
+		fpath := mustCreateWALWithEntries(t, p, 3)
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offs := recordOffsets(b)
+		if err := ioutil.WriteFile(fpath, corrupt(b, offs[len(offs)-1]), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := OpenAtIndex(p, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, ents, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(ents) != 2 {
+			t.Fatalf("#%d: len(ents) = %d, want 2", i, len(ents))
+		}
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != offs[len(offs)-1] {
+			t.Errorf("#%d: size = %d, want %d", i, fi.Size(), offs[len(offs)-1])
+		}
+		if err := w.SaveEntry(&raftpb.Entry{Index: 2, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		w, err = OpenAtIndex(p, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ents, err = w.ReadAll(); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(ents) != 3 {
+			t.Errorf("#%d: len(ents) = %d, want 3", i, len(ents))
+		}
+		w.Close()
+	}
+}
+
+// TestReadAllTornInPreallocated tests that a record of which only a part
+// reached the disk, the rest being still the zeros preallocated, is
+// truncated as a torn write.
+func TestReadAllTornInPreallocated(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 0, Term: 1, Data: []byte("a")}}
+	w.Save(raftpb.HardState{}, ents)
+	off, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("somedata")}})
+	end, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.f.WriteAt(make([]byte, end-off-20), off+20); err != nil {
+		t.Fatal(err)
+	}
+	w.f.Close()
+
+	r, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, gents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) {
+		t.Errorf("ents = %+v, want %+v", gents, ents)
+	}
+	fi, err := os.Stat(path.Join(p, walName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != off {
+		t.Errorf("size = %d, want %d", fi.Size(), off)
+	}
+}
+
+// TestReadAllCorruptedMiddle tests that a corrupted record followed by other
+// records fails with the offset of the corrupted record.
+func TestReadAllCorruptedMiddle(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	fpath := mustCreateWALWithEntries(t, p, 3)
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offs := recordOffsets(b)
+	// corrupt the last byte of the second entry record
+	b[offs[len(offs)-1]-1] ^= 0xff
+	if err := ioutil.WriteFile(fpath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	werr := &CRCMismatchError{Offset: offs[len(offs)-2]}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+}
+
+func TestSaveIsReadableBeforeClose(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.SaveInfo(&raftpb.Info{ID: int64(0xBAD1)}); err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 0, Term: 1, Data: []byte("a")}, {Index: 1, Term: 1, Data: []byte("b")}}
+	w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents)
+
+	r, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, state, gents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) {
+		t.Errorf("ents = %+v, want %+v", gents, ents)
+	}
+	if state.Commit != 1 {
+		t.Errorf("commit = %d, want 1", state.Commit)
+	}
+}
+
+// TestPreallocatedSegment tests that a file preallocated past its records,
+// as left by a crash, reads back only the records written, is appended to
+// after them, and is truncated to them once closed.
+func TestPreallocatedSegment(t *testing.T) {
+	defer func(size int64) { SegmentSizeBytes = size }(SegmentSizeBytes)
+	SegmentSizeBytes = 4096
+
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	fpath := path.Join(p, walName(0, 0))
+	size := func() int64 {
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	w, err := Create(p, 0xBAD1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 0, Term: 1, Data: []byte("a")}, {Index: 1, Term: 1, Data: []byte("b")}}
+	w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents)
+	if g := size(); g != SegmentSizeBytes {
+		t.Fatalf("size = %d, want %d", g, SegmentSizeBytes)
+	}
+	// crash: the file is left preallocated
+
+	r, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, gents, err := r.ReadAll(); err != nil || !reflect.DeepEqual(gents, ents) {
+		t.Fatalf("ents = %+v, %v, want %+v", gents, err, ents)
+	}
+	ents = append(ents, raftpb.Entry{Index: 2, Term: 1, Data: []byte("c")})
+	r.Save(raftpb.HardState{Term: 1, Commit: 2}, ents[2:])
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if g := size(); g >= SegmentSizeBytes {
+		t.Errorf("size after close = %d, want less than %d", g, SegmentSizeBytes)
+	}
+
+	r, err = OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, state, gents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) {
+		t.Errorf("ents = %+v, want %+v", gents, ents)
+	}
+	if state.Commit != 2 {
+		t.Errorf("commit = %d, want 2", state.Commit)
+	}
+}
+
+// TestPreallocatedTornTail tests that bytes written in the preallocated
+// space after the last record, but not where the next record starts, are
+// truncated as a torn write.
+func TestPreallocatedTornTail(t *testing.T) {
+	defer func(size int64) { SegmentSizeBytes = size }(SegmentSizeBytes)
+	SegmentSizeBytes = 4096
+
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 0, Term: 1, Data: []byte("a")}}
+	w.Save(raftpb.HardState{Term: 1, Commit: 0}, ents)
+	off, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.f.WriteAt([]byte("torn"), off+100); err != nil {
+		t.Fatal(err)
+	}
+	w.f.Close()
+
+	r, err := OpenAtIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, gents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) {
+		t.Errorf("ents = %+v, want %+v", gents, ents)
+	}
+	fi, err := os.Stat(path.Join(p, walName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != off {
+		t.Errorf("size = %d, want %d", fi.Size(), off)
+	}
+}
+
+// TestSyncNoneSaves tests that a WAL that is never synced still writes the
+// same records, which are read back once it is closed.
+func TestSyncNoneSaves(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	var files [][]byte
+	for i, mode := range []SyncMode{SyncFsync, SyncNone} {
+		dir := path.Join(p, mode.String())
+		w, err := CreateWithSync(dir, 0xBAD1, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{{Index: 0, Term: 1, Data: []byte("a")}, {Index: 1, Term: 1, Data: []byte("b")}}
+		w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents)
+		w.Close()
+
+		r, err := OpenAtIndexWithSync(dir, 0, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, state, gents, err := r.ReadAll()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if id != 0xBAD1 {
+			t.Errorf("#%d: id = %x, want %x", i, id, 0xBAD1)
+		}
+		if !reflect.DeepEqual(gents, ents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, gents, ents)
+		}
+		if state.Commit != 1 {
+			t.Errorf("#%d: commit = %d, want 1", i, state.Commit)
+		}
+		r.Close()
+
+		b, err := ioutil.ReadFile(path.Join(dir, walName(0, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b)
+	}
+	if !bytes.Equal(files[0], files[1]) {
+		t.Errorf("file synced with none differs from the one synced with fsync")
+	}
+}
+
+func TestSyncModeSet(t *testing.T) {
+	tests := []struct {
+		s     string
+		wmode SyncMode
+		werr  bool
+	}{
+		{"fsync", SyncFsync, false},
+		{"fdatasync", SyncFdatasync, false},
+		{"none", SyncNone, false},
+		{"", SyncFsync, true},
+		{"always", SyncFsync, true},
+	}
+	for i, tt := range tests {
+		var m SyncMode
+		err := m.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if m != tt.wmode {
+			t.Errorf("#%d: mode = %v, want %v", i, m, tt.wmode)
+		}
+		if !tt.werr && m.String() != tt.s {
+			t.Errorf("#%d: string = %s, want %s", i, m.String(), tt.s)
+		}
+	}
+}
+
+// TestSaveGroupCommit tests that the Saves arriving while a sync is in
+// flight are synced together by the next one, and that none returns before
+// the sync of its records completed.
+func TestSaveGroupCommit(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startc := make(chan struct{})
+	releasec := make(chan struct{})
+	w.syncf = func(f *os.File) error {
+		startc <- struct{}{}
+		<-releasec
+		return f.Sync()
+	}
+	donec := make(chan int64, 4)
+	save := func(i int64) {
+		w.Save(raftpb.HardState{Term: 1, Commit: i}, []raftpb.Entry{{Index: i, Term: 1}})
+		donec <- i
+	}
+	waitSync := func() {
+		select {
+		case <-startc:
+		case <-time.After(time.Second):
+			t.Fatalf("no sync started")
+		}
+	}
+	noneDone := func() {
+		select {
+		case i := <-donec:
+			t.Fatalf("save %d returned before its records were synced", i)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	go save(0)
+	waitSync()
+	for i := int64(1); i <= 3; i++ {
+		go save(i)
+	}
+	// the three are written while the first sync is in flight
+	for written := int64(0); written < 4; {
+		time.Sleep(time.Millisecond)
+		w.mu.Lock()
+		written = w.written
+		w.mu.Unlock()
+	}
+	noneDone()
+	releasec <- struct{}{}
+	if i := <-donec; i != 0 {
+		t.Fatalf("save %d returned, want 0", i)
+	}
+
+	// the three share the next sync
+	waitSync()
+	noneDone()
+	releasec <- struct{}{}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-donec:
+		case <-time.After(time.Second):
+			t.Fatalf("%d saves returned, want 3", i)
+		}
+	}
+	select {
+	case <-startc:
+		t.Errorf("unexpected third sync")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.syncf = (*os.File).Sync
+	w.Close()
+}
+
+// TestSaveCommitWrite tests that with CommitWrite concurrent Saves are
+// synced one by one.
+func TestSaveCommitWrite(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetCommitMode(CommitWrite)
+	var (
+		mu    sync.Mutex
+		syncs int
+	)
+	w.syncf = func(f *os.File) error {
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+		return f.Sync()
+	}
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < 4; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			w.Save(raftpb.HardState{Term: 1, Commit: i}, []raftpb.Entry{{Index: i, Term: 1}})
+		}(i)
+	}
+	wg.Wait()
+	if syncs != 4 {
+		t.Errorf("syncs = %d, want 4", syncs)
+	}
+}
+
+func TestCommitModeSet(t *testing.T) {
+	tests := []struct {
+		s     string
+		wmode CommitMode
+		werr  bool
+	}{
+		{"group", CommitGroup, false},
+		{"write", CommitWrite, false},
+		{"", CommitGroup, true},
+		{"fsync", CommitGroup, true},
+	}
+	for i, tt := range tests {
+		var m CommitMode
+		err := m.Set(tt.s)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if m != tt.wmode {
+			t.Errorf("#%d: mode = %v, want %v", i, m, tt.wmode)
+		}
+		if !tt.werr && m.String() != tt.s {
+			t.Errorf("#%d: string = %s, want %s", i, m.String(), tt.s)
+		}
+	}
+}
+
+func BenchmarkSave1(b *testing.B)   { benchmarkSave(b, 1, SyncFsync) }
+func BenchmarkSave10(b *testing.B)  { benchmarkSave(b, 10, SyncFsync) }
+func BenchmarkSave100(b *testing.B) { benchmarkSave(b, 100, SyncFsync) }
+
+// the sync modes compared on the same load
+func BenchmarkSave1Fdatasync(b *testing.B) { benchmarkSave(b, 1, SyncFdatasync) }
+func BenchmarkSave1NoSync(b *testing.B)    { benchmarkSave(b, 1, SyncNone) }
+
+// benchmarkSave saves b.N entries of 100 bytes, batch entries per Save, to
+// show how sharing an fsync between entries raises the throughput.
+func benchmarkSave(b *testing.B, batch int, mode SyncMode) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := CreateWithSync(p, 0, mode)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	data := make([]byte, 100)
+	ents := make([]raftpb.Entry, batch)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		for j := range ents {
+			ents[j] = raftpb.Entry{Index: int64(i + j), Term: 1, Data: data}
+		}
+		w.Save(raftpb.HardState{Term: 1, Commit: int64(i)}, ents)
+	}
+}
+
+// the commit modes compared on concurrent Saves
+func BenchmarkSaveParallelGroup(b *testing.B) { benchmarkSaveParallel(b, CommitGroup) }
+func BenchmarkSaveParallelWrite(b *testing.B) { benchmarkSaveParallel(b, CommitWrite) }
+
+// benchmarkSaveParallel saves b.N entries of 100 bytes, one per Save, from
+// many goroutines at once, to show how syncing them in groups raises the
+// throughput.
+func benchmarkSaveParallel(b *testing.B, mode CommitMode) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	w.SetCommitMode(mode)
+	data := make([]byte, 100)
+	b.SetBytes(int64(len(data)))
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ents := []raftpb.Entry{{Term: 1, Data: data}}
+		for pb.Next() {
+			w.Save(raftpb.HardState{Term: 1}, ents)
+		}
+	})
+}
+
+// mustCreateWALWithEntries creates a WAL in dir holding n entries, and
+// returns the path of its only file.
+func mustCreateWALWithEntries(t *testing.T, dir string, n int) string {
+	w, err := Create(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		e := &raftpb.Entry{Index: int64(i), Term: 1, Data: []byte("somedata")}
+		if err := w.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return path.Join(dir, walName(0, 0))
+}
+
+// recordOffsets returns the offsets of the records encoded in b.
+func recordOffsets(b []byte) []int64 {
+	var offs []int64
+	for off := int64(0); off < int64(len(b)); {
+		offs = append(offs, off)
+		l, _ := readInt64(bytes.NewReader(b[off:]))
+		off += 8 + l
+	}
+	return offs
+}